@@ -5,9 +5,7 @@
 // Usage with xcaddy:
 //
 //	xcaddy build --with github.com/sitepod/sitepod/caddy
+//
+// It also exports the types needed to write additional storage backend
+// modules (see StorageProvider).
 package caddy
-
-import (
-	// Register the SitePod Caddy module
-	_ "github.com/sitepod/sitepod/internal/caddy"
-)
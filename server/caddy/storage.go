@@ -0,0 +1,42 @@
+package caddy
+
+import (
+	sitepod "github.com/sitepod/sitepod/internal/caddy"
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+// Types for third-party storage modules.
+//
+// A storage backend is a Caddy module registered in the sitepod.storage
+// namespace (for example "sitepod.storage.mybackend") that implements
+// StorageProvider. Compile it in next to SitePod with xcaddy:
+//
+//	xcaddy build \
+//	    --with github.com/sitepod/sitepod/caddy \
+//	    --with example.com/sitepod-storage-mybackend
+//
+// and select it in the Caddyfile:
+//
+//	sitepod {
+//	    storage mybackend {
+//	        ...
+//	    }
+//	}
+type (
+	StorageProvider = sitepod.StorageProvider
+	StorageBackend  = storage.Backend
+	BlobInfo        = storage.BlobInfo
+
+	// Optional interfaces a StorageBackend may implement
+	BatchChecker = storage.BatchChecker
+	Pinger       = storage.Pinger
+	Locker       = storage.Locker
+	Lister       = storage.Lister
+	Quarantiner  = storage.Quarantiner
+	UploadStager = storage.UploadStager
+
+	HashMismatchError    = storage.HashMismatchError
+	BlobNotFoundError    = storage.BlobNotFoundError
+	RefNotFoundError     = storage.RefNotFoundError
+	PreviewNotFoundError = storage.PreviewNotFoundError
+)
@@ -0,0 +1,279 @@
+// Package analytics aggregates privacy-preserving traffic counters per
+// project, environment and day.
+//
+// No IP addresses or user agents are stored. Unique visitors are counted by
+// hashing the client address and user agent with a salt that changes every
+// day, and only a HyperLogLog sketch of those hashes is kept.
+package analytics
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dayLayout formats the UTC day of a rollup
+const dayLayout = "2006-01-02"
+
+// maxPendingKeys bounds the distinct paths or referrers held per rollup
+// between flushes
+const maxPendingKeys = 10000
+
+// Store persists rollups
+type Store interface {
+	// Salt returns the visitor hash salt for day, creating it if needed
+	Salt(day string) ([]byte, error)
+	// Merge adds rollups to the stored counters
+	Merge(rollups []*Rollup, topN int) error
+	// Query returns the stored rollups of a project between two days
+	// (inclusive). An empty env matches every environment.
+	Query(project, env, from, to string) ([]*Rollup, error)
+	// Prune deletes rollups and salts of days before day
+	Prune(day string) error
+}
+
+// Config configures a Collector
+type Config struct {
+	FlushInterval time.Duration
+	RetentionDays int
+	// TopN bounds the stored path, referrer and 404 tables per day
+	TopN int
+}
+
+// Hit is one static request
+type Hit struct {
+	Time      time.Time
+	Project   string
+	Env       string
+	Host      string
+	Path      string
+	Status    int
+	Bytes     int64
+	RemoteIP  string
+	UserAgent string
+	Referer   string
+}
+
+// Collector aggregates hits in memory and flushes them to a Store
+type Collector struct {
+	store  Store
+	config Config
+
+	mu        sync.Mutex
+	pending   map[rollupKey]*Rollup
+	salts     map[string][]byte
+	saltRetry time.Time
+}
+
+type rollupKey struct {
+	project, env, day string
+}
+
+// NewCollector creates a collector writing to store
+func NewCollector(store Store, config Config) *Collector {
+	return &Collector{
+		store:   store,
+		config:  config,
+		pending: make(map[rollupKey]*Rollup),
+		salts:   make(map[string][]byte),
+	}
+}
+
+// Record adds a hit. It is safe to call on a nil Collector.
+func (c *Collector) Record(hit Hit) {
+	if c == nil || hit.Project == "" {
+		return
+	}
+
+	day := hit.Time.UTC().Format(dayLayout)
+	salt := c.salt(day)
+	referrer := referrerHost(hit.Referer, hit.Host)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := rollupKey{hit.Project, hit.Env, day}
+	r, ok := c.pending[key]
+	if !ok {
+		r = NewRollup(hit.Project, hit.Env, day)
+		c.pending[key] = r
+	}
+
+	r.Requests++
+	r.Bytes += hit.Bytes
+	r.Statuses[statusKey(hit.Status)]++
+	if salt != nil {
+		r.Visitors.Add(visitorHash(salt, hit))
+	}
+	switch {
+	case hit.Status < 400:
+		addCount(r.Paths, hit.Path)
+	case hit.Status == 404:
+		addCount(r.NotFound, hit.Path)
+	}
+	if referrer != "" {
+		addCount(r.Referrers, referrer)
+	}
+}
+
+// addCount increments key, ignoring new keys once the table is full
+func addCount(counts map[string]int64, key string) {
+	if _, ok := counts[key]; ok || len(counts) < maxPendingKeys {
+		counts[key]++
+	}
+}
+
+// salt returns the day's salt, loading it from the store on first use.
+// Without a salt, visitors are not counted.
+func (c *Collector) salt(day string) []byte {
+	c.mu.Lock()
+	salt, ok := c.salts[day]
+	retry := c.saltRetry
+	c.mu.Unlock()
+	if ok {
+		return salt
+	}
+	if time.Now().Before(retry) {
+		return nil
+	}
+
+	salt, err := c.store.Salt(day)
+	if err != nil {
+		log.Printf("analytics: loading salt for %s: %v", day, err)
+		c.mu.Lock()
+		c.saltRetry = time.Now().Add(time.Minute)
+		c.mu.Unlock()
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Forget earlier days' salts
+	for d := range c.salts {
+		if d < day {
+			delete(c.salts, d)
+		}
+	}
+	c.salts[day] = salt
+	return salt
+}
+
+// visitorHash identifies a visitor for one day and project
+func visitorHash(salt []byte, hit Hit) uint64 {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(hit.Project))
+	h.Write([]byte{0})
+	h.Write([]byte(hit.RemoteIP))
+	h.Write([]byte{0})
+	h.Write([]byte(hit.UserAgent))
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+// referrerHost returns the host of an external referrer, or ""
+func referrerHost(referer, host string) string {
+	if referer == "" {
+		return ""
+	}
+	u, err := url.Parse(referer)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	if i := strings.IndexByte(host, ':'); i >= 0 {
+		host = host[:i]
+	}
+	if strings.EqualFold(u.Hostname(), host) {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// Flush writes pending counters to the store. On failure they are kept
+// and retried on the next flush.
+func (c *Collector) Flush() error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	if len(c.pending) == 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	batch := make([]*Rollup, 0, len(c.pending))
+	for _, r := range c.pending {
+		batch = append(batch, r)
+	}
+	c.pending = make(map[rollupKey]*Rollup)
+	c.mu.Unlock()
+
+	if err := c.store.Merge(batch, c.config.TopN); err != nil {
+		c.mu.Lock()
+		for _, r := range batch {
+			key := rollupKey{r.Project, r.Env, r.Day}
+			if cur, ok := c.pending[key]; ok {
+				r.Merge(cur, 0)
+			}
+			c.pending[key] = r
+		}
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Run flushes every FlushInterval and prunes expired days until ctx is
+// cancelled, then flushes once more
+func (c *Collector) Run(ctx context.Context) {
+	c.prune()
+
+	flush := time.NewTicker(c.config.FlushInterval)
+	defer flush.Stop()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := c.Flush(); err != nil {
+				log.Printf("analytics: final flush: %v", err)
+			}
+			return
+		case <-flush.C:
+			if err := c.Flush(); err != nil {
+				log.Printf("analytics: flush: %v", err)
+			}
+		case <-prune.C:
+			c.prune()
+		}
+	}
+}
+
+func (c *Collector) prune() {
+	if c.config.RetentionDays <= 0 {
+		return
+	}
+	if err := c.store.Prune(c.OldestDay(time.Now())); err != nil {
+		log.Printf("analytics: prune: %v", err)
+	}
+}
+
+// Query returns the stored rollups of a project between two days (inclusive).
+// Counters not yet flushed are not included.
+func (c *Collector) Query(project, env, from, to string) ([]*Rollup, error) {
+	return c.store.Query(project, env, from, to)
+}
+
+// OldestDay returns the first day still within the retention period
+func (c *Collector) OldestDay(now time.Time) string {
+	days := c.config.RetentionDays
+	if days <= 0 {
+		return ""
+	}
+	return now.UTC().AddDate(0, 0, -(days - 1)).Format(dayLayout)
+}
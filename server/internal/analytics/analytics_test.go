@@ -0,0 +1,175 @@
+package analytics
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// memoryStore is a Store for tests
+type memoryStore struct {
+	salts   map[string][]byte
+	rollups map[rollupKey]*Rollup
+	fail    bool
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{salts: make(map[string][]byte), rollups: make(map[rollupKey]*Rollup)}
+}
+
+func (s *memoryStore) Salt(day string) ([]byte, error) {
+	if _, ok := s.salts[day]; !ok {
+		s.salts[day] = []byte("salt-" + day)
+	}
+	return s.salts[day], nil
+}
+
+func (s *memoryStore) Merge(rollups []*Rollup, topN int) error {
+	if s.fail {
+		return errors.New("unavailable")
+	}
+	for _, r := range rollups {
+		key := rollupKey{r.Project, r.Env, r.Day}
+		stored, ok := s.rollups[key]
+		if !ok {
+			stored = NewRollup(r.Project, r.Env, r.Day)
+			s.rollups[key] = stored
+		}
+		stored.Merge(r, topN)
+	}
+	return nil
+}
+
+func (s *memoryStore) Query(project, env, from, to string) ([]*Rollup, error) {
+	var out []*Rollup
+	for key, r := range s.rollups {
+		if key.project == project && (env == "" || key.env == env) && key.day >= from && key.day <= to {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+func (s *memoryStore) Prune(day string) error {
+	for key := range s.rollups {
+		if key.day < day {
+			delete(s.rollups, key)
+		}
+	}
+	return nil
+}
+
+func TestCollector(t *testing.T) {
+	store := newMemoryStore()
+	c := NewCollector(store, Config{TopN: 2, RetentionDays: 30})
+
+	day1 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+
+	hit := func(at time.Time, ip, path string, status int, referer string) Hit {
+		return Hit{
+			Time: at, Project: "blog", Env: "prod", Host: "blog.example.com:443",
+			Path: path, Status: status, Bytes: 100, RemoteIP: ip, UserAgent: "ua", Referer: referer,
+		}
+	}
+	c.Record(hit(day1, "1.1.1.1", "/", 200, "https://news.example.org/item"))
+	c.Record(hit(day1, "1.1.1.1", "/about", 200, "https://blog.example.com/"))
+	c.Record(hit(day1, "2.2.2.2", "/", 304, ""))
+	c.Record(hit(day1, "2.2.2.2", "/missing", 404, ""))
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed flush keeps the counters for the next one
+	store.fail = true
+	c.Record(hit(day1, "3.3.3.3", "/docs", 200, ""))
+	c.Record(hit(day2, "1.1.1.1", "/", 200, ""))
+	if err := c.Flush(); err == nil {
+		t.Fatal("expected flush error")
+	}
+	store.fail = false
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	rollups, err := c.Query("blog", "", "2024-03-01", "2024-03-03")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := Summarize(rollups, "2024-03-01", "2024-03-03", 10)
+
+	if report.Requests != 6 || report.Bytes != 600 {
+		t.Errorf("requests/bytes = %d/%d, want 6/600", report.Requests, report.Bytes)
+	}
+	if len(report.Days) != 3 {
+		t.Fatalf("days = %d, want 3", len(report.Days))
+	}
+	testCases := []struct {
+		day      string
+		requests int64
+		visitors int64
+	}{
+		{"2024-03-01", 5, 3},
+		{"2024-03-02", 1, 1},
+		{"2024-03-03", 0, 0},
+	}
+	for i, tc := range testCases {
+		t.Run(tc.day, func(t *testing.T) {
+			got := report.Days[i]
+			if got.Day != tc.day || got.Requests != tc.requests || got.Visitors != tc.visitors {
+				t.Errorf("got %+v, want %d requests and %d visitors", got, tc.requests, tc.visitors)
+			}
+		})
+	}
+
+	// Same-site referrers are not counted
+	if len(report.TopReferrers) != 1 || report.TopReferrers[0].Key != "news.example.org" {
+		t.Errorf("referrers = %v, want only news.example.org", report.TopReferrers)
+	}
+	if len(report.NotFound) != 1 || report.NotFound[0].Key != "/missing" {
+		t.Errorf("not found = %v", report.NotFound)
+	}
+	if report.Statuses["304"] != 1 || report.Statuses["404"] != 1 {
+		t.Errorf("statuses = %v", report.Statuses)
+	}
+	// Day 1 stored only the top 2 paths
+	if got := store.rollups[rollupKey{"blog", "prod", "2024-03-01"}].Paths; len(got) != 2 || got["/"] != 2 {
+		t.Errorf("stored paths = %v, want top 2 with / = 2", got)
+	}
+}
+
+func TestSketchEstimate(t *testing.T) {
+	for _, n := range []int{0, 10, 1000, 50000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			s := NewSketch()
+			for i := 0; i < n; i++ {
+				s.Add(visitorHash([]byte("salt"), Hit{Project: "p", RemoteIP: fmt.Sprint(i)}))
+			}
+
+			// Round-trip through the stored form
+			text, err := s.MarshalText()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded Sketch
+			if err := decoded.UnmarshalText(text); err != nil {
+				t.Fatal(err)
+			}
+
+			got := decoded.Estimate()
+			if math.Abs(float64(got-int64(n))) > 0.1*float64(n) {
+				t.Errorf("estimate = %d, want %d ±10%%", got, n)
+			}
+		})
+	}
+}
+
+func TestNilCollector(t *testing.T) {
+	var c *Collector
+	c.Record(Hit{Project: "p"})
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,190 @@
+package analytics
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// PocketBaseStore keeps rollups in the analytics_daily collection and salts
+// in analytics_salts
+type PocketBaseStore struct {
+	app core.App
+}
+
+// NewPocketBaseStore creates a store backed by app
+func NewPocketBaseStore(app core.App) *PocketBaseStore {
+	return &PocketBaseStore{app: app}
+}
+
+// Salt implements Store
+func (s *PocketBaseStore) Salt(day string) ([]byte, error) {
+	record, err := s.app.FindFirstRecordByData("analytics_salts", "day", day)
+	if err == nil {
+		return hex.DecodeString(record.GetString("salt"))
+	}
+
+	collection, err := s.app.FindCachedCollectionByNameOrId("analytics_salts")
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	record = core.NewRecord(collection)
+	record.Set("day", day)
+	record.Set("salt", hex.EncodeToString(salt))
+	if err := s.app.Save(record); err != nil {
+		// Another handler may have created it first
+		if existing, findErr := s.app.FindFirstRecordByData("analytics_salts", "day", day); findErr == nil {
+			return hex.DecodeString(existing.GetString("salt"))
+		}
+		return nil, err
+	}
+	return salt, nil
+}
+
+// Merge implements Store
+func (s *PocketBaseStore) Merge(rollups []*Rollup, topN int) error {
+	collection, err := s.app.FindCachedCollectionByNameOrId("analytics_daily")
+	if err != nil {
+		return err
+	}
+
+	return s.app.RunInTransaction(func(txApp core.App) error {
+		projectIDs := make(map[string]string)
+		for _, r := range rollups {
+			projectID, ok := projectIDs[r.Project]
+			if !ok {
+				project, err := txApp.FindFirstRecordByData("projects", "name", r.Project)
+				if err == nil {
+					projectID = project.Id
+				}
+				projectIDs[r.Project] = projectID
+			}
+			if projectID == "" {
+				continue // project deleted
+			}
+
+			record, err := txApp.FindFirstRecordByFilter("analytics_daily",
+				"project_id = {:project_id} && env = {:env} && day = {:day}",
+				dbx.Params{"project_id": projectID, "env": r.Env, "day": r.Day})
+			if err != nil {
+				record = core.NewRecord(collection)
+				record.Set("project_id", projectID)
+				record.Set("env", r.Env)
+				record.Set("day", r.Day)
+			}
+
+			stored, err := rollupFromRecord(record)
+			if err != nil {
+				return fmt.Errorf("analytics %s/%s/%s: %w", r.Project, r.Env, r.Day, err)
+			}
+			stored.Merge(r, topN)
+			if err := setRollupFields(record, stored); err != nil {
+				return err
+			}
+			if err := txApp.Save(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Query implements Store
+func (s *PocketBaseStore) Query(project, env, from, to string) ([]*Rollup, error) {
+	p, err := s.app.FindFirstRecordByData("projects", "name", project)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := "project_id = {:project_id} && day >= {:from} && day <= {:to}"
+	params := dbx.Params{"project_id": p.Id, "from": from, "to": to}
+	if env != "" {
+		filter += " && env = {:env}"
+		params["env"] = env
+	}
+	records, err := s.app.FindRecordsByFilter("analytics_daily", filter, "day", 0, 0, params)
+	if err != nil {
+		return nil, err
+	}
+
+	rollups := make([]*Rollup, 0, len(records))
+	for _, record := range records {
+		r, err := rollupFromRecord(record)
+		if err != nil {
+			return nil, err
+		}
+		r.Project = project
+		rollups = append(rollups, r)
+	}
+	return rollups, nil
+}
+
+// Prune implements Store
+func (s *PocketBaseStore) Prune(day string) error {
+	for _, table := range []string{"analytics_daily", "analytics_salts"} {
+		_, err := s.app.DB().NewQuery("DELETE FROM " + table + " WHERE day < {:day}").
+			Bind(dbx.Params{"day": day}).
+			Execute()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func rollupFromRecord(record *core.Record) (*Rollup, error) {
+	r := NewRollup("", record.GetString("env"), record.GetString("day"))
+	r.Requests = int64(record.GetInt("requests"))
+	r.Bytes = int64(record.GetFloat("bytes"))
+	if err := r.Visitors.UnmarshalText([]byte(record.GetString("visitors_sketch"))); err != nil {
+		return nil, err
+	}
+	for field, dst := range map[string]*map[string]int64{
+		"paths":     &r.Paths,
+		"referrers": &r.Referrers,
+		"statuses":  &r.Statuses,
+		"not_found": &r.NotFound,
+	} {
+		if raw := record.GetString(field); raw != "" && raw != "null" {
+			if err := json.Unmarshal([]byte(raw), dst); err != nil {
+				return nil, err
+			}
+		}
+		if *dst == nil {
+			*dst = make(map[string]int64)
+		}
+	}
+	return r, nil
+}
+
+func setRollupFields(record *core.Record, r *Rollup) error {
+	sketch, err := r.Visitors.MarshalText()
+	if err != nil {
+		return err
+	}
+	record.Set("requests", r.Requests)
+	record.Set("bytes", r.Bytes)
+	record.Set("visitors", r.Visitors.Estimate())
+	record.Set("visitors_sketch", string(sketch))
+	for field, counts := range map[string]map[string]int64{
+		"paths":     r.Paths,
+		"referrers": r.Referrers,
+		"statuses":  r.Statuses,
+		"not_found": r.NotFound,
+	} {
+		raw, err := json.Marshal(counts)
+		if err != nil {
+			return err
+		}
+		record.Set(field, raw)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package analytics
+
+import "time"
+
+// Report summarizes a project's traffic over a range of days
+type Report struct {
+	From         string           `json:"from"`
+	To           string           `json:"to"`
+	Env          string           `json:"env,omitempty"`
+	Requests     int64            `json:"requests"`
+	Bytes        int64            `json:"bytes"`
+	Visitors     int64            `json:"visitors"`
+	Days         []DayStats       `json:"days"`
+	TopPaths     []Count          `json:"top_paths"`
+	TopReferrers []Count          `json:"top_referrers"`
+	NotFound     []Count          `json:"not_found"`
+	Statuses     map[string]int64 `json:"statuses"`
+}
+
+// DayStats are the totals of one day
+type DayStats struct {
+	Day      string `json:"day"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+	Visitors int64  `json:"visitors"`
+}
+
+// Summarize builds a report from rollups between from and to (inclusive).
+// Days without traffic are included with zero counts.
+func Summarize(rollups []*Rollup, from, to string, topN int) *Report {
+	total := NewRollup("", "", "")
+	byDay := make(map[string]*Rollup)
+	for _, r := range rollups {
+		total.Merge(r, 0)
+		day, ok := byDay[r.Day]
+		if !ok {
+			day = NewRollup("", "", r.Day)
+			byDay[r.Day] = day
+		}
+		day.Merge(r, 0)
+	}
+
+	report := &Report{
+		From:         from,
+		To:           to,
+		Requests:     total.Requests,
+		Bytes:        total.Bytes,
+		Visitors:     total.Visitors.Estimate(),
+		TopPaths:     Top(total.Paths, topN),
+		TopReferrers: Top(total.Referrers, topN),
+		NotFound:     Top(total.NotFound, topN),
+		Statuses:     total.Statuses,
+		Days:         []DayStats{},
+	}
+
+	start, err1 := time.Parse(dayLayout, from)
+	end, err2 := time.Parse(dayLayout, to)
+	if err1 != nil || err2 != nil {
+		return report
+	}
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		stats := DayStats{Day: d.Format(dayLayout)}
+		if r, ok := byDay[stats.Day]; ok {
+			stats.Requests = r.Requests
+			stats.Bytes = r.Bytes
+			stats.Visitors = r.Visitors.Estimate()
+		}
+		report.Days = append(report.Days, stats)
+	}
+	return report
+}
+
+// ParseDay parses a YYYY-MM-DD day
+func ParseDay(s string) (time.Time, error) {
+	return time.Parse(dayLayout, s)
+}
+
+// FormatDay formats t as its UTC day
+func FormatDay(t time.Time) string {
+	return t.UTC().Format(dayLayout)
+}
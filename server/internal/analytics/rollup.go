@@ -0,0 +1,95 @@
+package analytics
+
+import (
+	"sort"
+	"strconv"
+)
+
+// Rollup holds the counters of one project environment for one day (UTC)
+type Rollup struct {
+	Project  string
+	Env      string
+	Day      string // YYYY-MM-DD
+	Requests int64
+	Bytes    int64
+	Visitors *Sketch
+	// Paths counts successful (< 400) requests, NotFound 404 responses
+	Paths     map[string]int64
+	Referrers map[string]int64
+	Statuses  map[string]int64
+	NotFound  map[string]int64
+}
+
+// NewRollup returns an empty rollup
+func NewRollup(project, env, day string) *Rollup {
+	return &Rollup{
+		Project:   project,
+		Env:       env,
+		Day:       day,
+		Visitors:  NewSketch(),
+		Paths:     make(map[string]int64),
+		Referrers: make(map[string]int64),
+		Statuses:  make(map[string]int64),
+		NotFound:  make(map[string]int64),
+	}
+}
+
+// Merge adds other's counters to r. Path, referrer and 404 tables are
+// trimmed to the topN entries, so counts outside the top are approximate.
+func (r *Rollup) Merge(other *Rollup, topN int) {
+	r.Requests += other.Requests
+	r.Bytes += other.Bytes
+	if r.Visitors == nil {
+		r.Visitors = NewSketch()
+	}
+	r.Visitors.Merge(other.Visitors)
+	r.Paths = mergeCounts(r.Paths, other.Paths, topN)
+	r.Referrers = mergeCounts(r.Referrers, other.Referrers, topN)
+	r.NotFound = mergeCounts(r.NotFound, other.NotFound, topN)
+	r.Statuses = mergeCounts(r.Statuses, other.Statuses, 0)
+}
+
+func mergeCounts(dst, src map[string]int64, topN int) map[string]int64 {
+	if dst == nil {
+		dst = make(map[string]int64, len(src))
+	}
+	for k, v := range src {
+		dst[k] += v
+	}
+	if topN > 0 && len(dst) > topN {
+		kept := make(map[string]int64, topN)
+		for _, c := range Top(dst, topN) {
+			kept[c.Key] = c.Count
+		}
+		dst = kept
+	}
+	return dst
+}
+
+// Count is a key and its count
+type Count struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// Top returns the n largest counts, highest first (all if n <= 0)
+func Top(counts map[string]int64, n int) []Count {
+	out := make([]Count, 0, len(counts))
+	for k, v := range counts {
+		out = append(out, Count{Key: k, Count: v})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Key < out[j].Key
+	})
+	if n > 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+func statusKey(status int) string {
+	return strconv.Itoa(status)
+}
@@ -0,0 +1,93 @@
+package analytics
+
+import (
+	"encoding/base64"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// sketchPrecision gives 1024 registers, about 3% standard error
+const sketchPrecision = 10
+
+const sketchRegisters = 1 << sketchPrecision
+
+// Sketch is a HyperLogLog counter of unique visitors. It stores only
+// register maxima, so visitor hashes cannot be recovered from it.
+type Sketch struct {
+	registers [sketchRegisters]uint8
+}
+
+// NewSketch returns an empty sketch
+func NewSketch() *Sketch {
+	return new(Sketch)
+}
+
+// Add records a visitor hash
+func (s *Sketch) Add(hash uint64) {
+	idx := hash >> (64 - sketchPrecision)
+	rest := hash<<sketchPrecision | 1<<(sketchPrecision-1)
+	rank := uint8(bits.LeadingZeros64(rest) + 1)
+	if rank > s.registers[idx] {
+		s.registers[idx] = rank
+	}
+}
+
+// Merge adds the visitors of other to s
+func (s *Sketch) Merge(other *Sketch) {
+	if other == nil {
+		return
+	}
+	for i, r := range other.registers {
+		if r > s.registers[i] {
+			s.registers[i] = r
+		}
+	}
+}
+
+// Estimate returns the approximate number of unique visitors
+func (s *Sketch) Estimate() int64 {
+	const m = float64(sketchRegisters)
+	alpha := 0.7213 / (1 + 1.079/m)
+
+	sum := 0.0
+	zeros := 0
+	for _, r := range s.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small cardinalities
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(estimate))
+}
+
+// MarshalText encodes the registers as base64
+func (s *Sketch) MarshalText() ([]byte, error) {
+	out := make([]byte, base64.StdEncoding.EncodedLen(sketchRegisters))
+	base64.StdEncoding.Encode(out, s.registers[:])
+	return out, nil
+}
+
+// UnmarshalText decodes registers encoded by MarshalText
+func (s *Sketch) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*s = Sketch{}
+		return nil
+	}
+	buf := make([]byte, base64.StdEncoding.DecodedLen(len(text)))
+	n, err := base64.StdEncoding.Decode(buf, text)
+	if err != nil {
+		return err
+	}
+	if n != sketchRegisters {
+		return errors.New("analytics: invalid visitor sketch")
+	}
+	copy(s.registers[:], buf[:n])
+	return nil
+}
@@ -0,0 +1,271 @@
+package caddy
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"go.uber.org/zap"
+)
+
+const (
+	// slowRequest is the duration above which a static request is always logged
+	slowRequest = 10 * time.Millisecond
+
+	accessLogBuffer        = 4096
+	accessLogBatchSize     = 500
+	accessLogFlushInterval = 2 * time.Second
+	accessLogRefresh       = time.Minute
+	accessLogPruneInterval = time.Hour
+)
+
+// accessLogEntry is one static request
+type accessLogEntry struct {
+	RequestID string
+	Project   string
+	Env       string
+	Method    string
+	Host      string
+	Path      string
+	Status    int
+	Bytes     int64
+	Duration  time.Duration
+	ImageID   string
+	CacheHit  bool
+	RemoteIP  string
+	UserAgent string
+	Referer   string
+}
+
+func (e *accessLogEntry) zapFields() []zap.Field {
+	return []zap.Field{
+		zap.String("request_id", e.RequestID),
+		zap.String("project", e.Project),
+		zap.String("env", e.Env),
+		zap.String("method", e.Method),
+		zap.String("host", e.Host),
+		zap.String("path", e.Path),
+		zap.Int("status", e.Status),
+		zap.Int64("bytes", e.Bytes),
+		zap.Duration("duration", e.Duration),
+		zap.String("image_id", e.ImageID),
+		zap.Bool("cache_hit", e.CacheHit),
+		zap.String("remote_ip", e.RemoteIP),
+	}
+}
+
+// logAccess writes a static request to the log and, if its project opted
+// in, to the project's persisted access log.
+//
+// With [log] access enabled, a sample of requests is logged at INFO level;
+// otherwise only errors and slow requests are logged, at DEBUG level. Server
+// errors and slow requests are never sampled out.
+func (h *SitePodHandler) logAccess(e *accessLogEntry, err error) {
+	always := e.Status >= 500 || e.Duration > slowRequest
+	if h.config.Log.Access {
+		if always || rand.Float64() < h.config.Log.AccessSampleRate {
+			h.logger.Info("static", e.zapFields()...)
+		}
+	} else if always || err != nil {
+		h.logger.Debug("static", e.zapFields()...)
+	}
+
+	h.accessLog.record(e)
+}
+
+// remoteIP returns the client address of a request without the port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// accessLogSink persists the access logs of projects that opted in. Entries
+// are buffered and written in batches; when the buffer is full, entries are
+// dropped rather than slowing down requests.
+type accessLogSink struct {
+	app       core.App
+	logger    *zap.Logger
+	retention time.Duration
+	entries   chan *accessLogEntry
+	dropped   atomic.Int64
+
+	mu       sync.RWMutex
+	projects map[string]string // opted-in project name -> record id
+}
+
+func newAccessLogSink(app core.App, logger *zap.Logger, retention time.Duration) *accessLogSink {
+	return &accessLogSink{
+		app:       app,
+		logger:    logger,
+		retention: retention,
+		entries:   make(chan *accessLogEntry, accessLogBuffer),
+		projects:  make(map[string]string),
+	}
+}
+
+// record queues e if its project persists access logs
+func (s *accessLogSink) record(e *accessLogEntry) {
+	if s == nil || e.Project == "" {
+		return
+	}
+	s.mu.RLock()
+	_, ok := s.projects[e.Project]
+	s.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	select {
+	case s.entries <- e:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// setProject updates a project's opt-in immediately, without waiting for
+// the next refresh
+func (s *accessLogSink) setProject(name, id string, enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if enabled {
+		s.projects[name] = id
+	} else {
+		delete(s.projects, name)
+	}
+}
+
+// refresh reloads the set of projects that opted in
+func (s *accessLogSink) refresh() {
+	records, err := s.app.FindAllRecords("projects", dbx.HashExp{"access_log": true})
+	if err != nil {
+		s.logger.Warn("failed to load access log settings", zap.Error(err))
+		return
+	}
+	projects := make(map[string]string, len(records))
+	for _, record := range records {
+		projects[record.GetString("name")] = record.Id
+	}
+	s.mu.Lock()
+	s.projects = projects
+	s.mu.Unlock()
+}
+
+// run writes queued entries until ctx is cancelled, then flushes the rest
+func (s *accessLogSink) run(ctx context.Context) {
+	s.refresh()
+	s.prune()
+
+	flush := time.NewTicker(accessLogFlushInterval)
+	defer flush.Stop()
+	refresh := time.NewTicker(accessLogRefresh)
+	defer refresh.Stop()
+	prune := time.NewTicker(accessLogPruneInterval)
+	defer prune.Stop()
+
+	batch := make([]*accessLogEntry, 0, accessLogBatchSize)
+	write := func() {
+		if len(batch) > 0 {
+			s.write(batch)
+			batch = batch[:0]
+		}
+		if n := s.dropped.Swap(0); n > 0 {
+			s.logger.Warn("access log buffer full; entries dropped", zap.Int64("dropped", n))
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case e := <-s.entries:
+					batch = append(batch, e)
+				default:
+					write()
+					return
+				}
+			}
+		case e := <-s.entries:
+			batch = append(batch, e)
+			if len(batch) >= accessLogBatchSize {
+				write()
+			}
+		case <-flush.C:
+			write()
+		case <-refresh.C:
+			s.refresh()
+		case <-prune.C:
+			s.prune()
+		}
+	}
+}
+
+// write stores a batch of entries in one transaction
+func (s *accessLogSink) write(batch []*accessLogEntry) {
+	collection, err := s.app.FindCachedCollectionByNameOrId("access_logs")
+	if err != nil {
+		s.logger.Warn("failed to write access logs", zap.Error(err))
+		return
+	}
+
+	s.mu.RLock()
+	ids := make([]string, len(batch))
+	for i, e := range batch {
+		ids[i] = s.projects[e.Project]
+	}
+	s.mu.RUnlock()
+
+	err = s.app.RunInTransaction(func(txApp core.App) error {
+		for i, e := range batch {
+			if ids[i] == "" {
+				continue // opted out since the entry was queued
+			}
+			record := core.NewRecord(collection)
+			record.Set("project_id", ids[i])
+			record.Set("env", e.Env)
+			record.Set("request_id", e.RequestID)
+			record.Set("method", e.Method)
+			record.Set("host", e.Host)
+			record.Set("path", e.Path)
+			record.Set("status", e.Status)
+			record.Set("bytes", e.Bytes)
+			record.Set("duration_ms", float64(e.Duration.Microseconds())/1000)
+			record.Set("image_id", e.ImageID)
+			record.Set("cache_hit", e.CacheHit)
+			record.Set("remote_ip", e.RemoteIP)
+			record.Set("user_agent", e.UserAgent)
+			record.Set("referer", e.Referer)
+			if err := txApp.SaveNoValidate(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Warn("failed to write access logs", zap.Int("entries", len(batch)), zap.Error(err))
+	}
+}
+
+// prune deletes entries older than the retention period
+func (s *accessLogSink) prune() {
+	cutoff, err := types.ParseDateTime(time.Now().Add(-s.retention))
+	if err != nil {
+		return
+	}
+	_, err = s.app.DB().NewQuery("DELETE FROM access_logs WHERE created < {:cutoff}").
+		Bind(dbx.Params{"cutoff": cutoff.String()}).
+		Execute()
+	if err != nil {
+		s.logger.Warn("failed to prune access logs", zap.Error(err))
+	}
+}
@@ -1,14 +1,13 @@
 package caddy
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/pocketbase/pocketbase/core"
-	"github.com/sitepod/sitepod/internal/storage"
+	"github.com/sitepod/sitepod/internal/purge"
 	"go.uber.org/zap"
 )
 
@@ -97,6 +96,7 @@ func (h *SitePodHandler) deleteUserCascade(user *core.Record) error {
 	for _, project := range projects {
 		projectID := project.Id
 		projectName := project.GetString("name")
+		purgeBases := h.purgeBases(project, "")
 
 		// Delete domains
 		domains, _ := h.app.FindRecordsByFilter(
@@ -137,6 +137,12 @@ func (h *SitePodHandler) deleteUserCascade(user *core.Record) error {
 		// Delete ref files from storage
 		recordErr(h.storage.DeleteRef(projectName, "beta"))
 		recordErr(h.storage.DeleteRef(projectName, "prod"))
+		h.sendPurge(purge.Request{
+			Project: projectName,
+			Bases:   purgeBases,
+			Keys:    []string{purge.ProjectKey(projectName)},
+			All:     true,
+		})
 
 		// Delete the project record
 		recordErr(h.app.Delete(project))
@@ -180,108 +186,13 @@ func (h *SitePodHandler) cleanupExpiredPreviews(projectName string) int {
 	return deleted
 }
 
-// API: Garbage Collection - removes unreferenced blobs
-func (h *SitePodHandler) apiGarbageCollect(w http.ResponseWriter, r *http.Request) error {
-	if err := h.requireAdminToken(r); err != nil {
-		if errors.Is(err, errAdminTokenMissing) {
-			return h.jsonError(w, http.StatusForbidden, "admin token not configured")
-		}
-		return h.jsonError(w, http.StatusForbidden, "forbidden")
-	}
-
-	h.logger.Info("Starting garbage collection")
-
-	// 1. Collect all referenced blob hashes from refs and previews
-	referencedHashes := make(map[string]bool)
-
-	// Scan all projects' refs
-	projects, _ := h.app.FindRecordsByFilter("projects", "1=1", "", 10000, 0, nil)
-	for _, project := range projects {
-		projectName := project.GetString("name")
-
-		// Check beta ref
-		if refData, err := h.storage.GetRef(projectName, "beta"); err == nil {
-			var ref storage.RefData
-			if json.Unmarshal(refData, &ref) == nil {
-				for _, entry := range ref.Manifest {
-					referencedHashes[entry.Hash] = true
-				}
-			}
-		}
-
-		// Check prod ref
-		if refData, err := h.storage.GetRef(projectName, "prod"); err == nil {
-			var ref storage.RefData
-			if json.Unmarshal(refData, &ref) == nil {
-				for _, entry := range ref.Manifest {
-					referencedHashes[entry.Hash] = true
-				}
-			}
-		}
-	}
-
-	// Also check images in database for recently deployed content
-	images, _ := h.app.FindRecordsByFilter("images", "1=1", "", 10000, 0, nil)
-	for _, image := range images {
-		manifestStr := image.GetString("manifest")
-		var manifest map[string]storage.FileEntry
-		if json.Unmarshal([]byte(manifestStr), &manifest) == nil {
-			for _, entry := range manifest {
-				referencedHashes[entry.Hash] = true
-			}
-		}
-	}
-
-	h.logger.Info("Found referenced blobs", zap.Int("count", len(referencedHashes)))
-
-	// 2. List all blobs in storage
-	allBlobs, err := h.storage.ListBlobs()
-	if err != nil {
-		return h.jsonError(w, http.StatusInternalServerError, "failed to list blobs: "+err.Error())
-	}
-
-	h.logger.Info("Total blobs in storage", zap.Int("count", len(allBlobs)))
-
-	// 3. Find and delete unreferenced blobs
-	var deletedCount int
-	var deletedSize int64
-	var errs []string
-
-	for _, hash := range allBlobs {
-		if !referencedHashes[hash] {
-			// Get blob size before deletion
-			if info, err := h.storage.StatBlob(hash); err == nil {
-				deletedSize += info.Size
-			}
-
-			if err := h.storage.DeleteBlob(hash); err != nil {
-				errs = append(errs, fmt.Sprintf("failed to delete blob %s: %v", hash, err))
-			} else {
-				deletedCount++
-			}
-		}
-	}
-
-	h.logger.Info("Garbage collection completed",
-		zap.Int("deleted_blobs", deletedCount),
-		zap.Int64("freed_bytes", deletedSize))
-
-	return h.jsonResponse(w, http.StatusOK, map[string]any{
-		"referenced_blobs": len(referencedHashes),
-		"total_blobs":      len(allBlobs),
-		"deleted_blobs":    deletedCount,
-		"freed_bytes":      deletedSize,
-		"errors":           errs,
-	})
-}
-
 // API: Invalidate Cache
 func (h *SitePodHandler) apiInvalidateCache(w http.ResponseWriter, r *http.Request) error {
 	project := r.URL.Query().Get("project")
 	env := r.URL.Query().Get("env")
 
 	if project != "" && env != "" {
-		h.cache.Delete(project + ":" + env)
+		h.invalidateRefs(project, env)
 	}
 
 	w.WriteHeader(http.StatusOK)
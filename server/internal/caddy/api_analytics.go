@@ -0,0 +1,75 @@
+package caddy
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/analytics"
+)
+
+// API: Get Analytics
+//
+// GET /api/v1/projects/{name}/analytics?env=&from=&to=
+//
+// from and to are UTC days (YYYY-MM-DD, inclusive) and default to the last
+// 30 days. The range is clipped to the retention period. Counters are
+// written every [analytics] flush_interval, so the current day lags by up
+// to that long.
+func (h *SitePodHandler) apiGetAnalytics(w http.ResponseWriter, r *http.Request, projectName string, user *core.Record) error {
+	if h.analytics == nil {
+		return h.jsonError(w, http.StatusNotFound, "analytics disabled")
+	}
+
+	if _, err := h.requireProjectOwnerByName(projectName, user); err != nil {
+		if errors.Is(err, errForbidden) {
+			return h.jsonError(w, http.StatusForbidden, "forbidden")
+		}
+		return h.jsonError(w, http.StatusNotFound, "project not found")
+	}
+
+	now := time.Now()
+	q := r.URL.Query()
+
+	to := analytics.FormatDay(now)
+	if v := q.Get("to"); v != "" {
+		if _, err := analytics.ParseDay(v); err != nil {
+			return h.jsonError(w, http.StatusBadRequest, "invalid to: use YYYY-MM-DD")
+		}
+		to = v
+	}
+	toDay, _ := analytics.ParseDay(to)
+
+	from := analytics.FormatDay(toDay.AddDate(0, 0, -29))
+	if v := q.Get("from"); v != "" {
+		if _, err := analytics.ParseDay(v); err != nil {
+			return h.jsonError(w, http.StatusBadRequest, "invalid from: use YYYY-MM-DD")
+		}
+		from = v
+	}
+	if oldest := h.analytics.OldestDay(now); oldest != "" && from < oldest {
+		from = oldest
+	}
+	if from > to {
+		return h.jsonError(w, http.StatusBadRequest, "from must not be after to")
+	}
+	if fromDay, _ := analytics.ParseDay(from); toDay.Sub(fromDay) > 366*24*time.Hour {
+		return h.jsonError(w, http.StatusBadRequest, "range must not exceed 366 days")
+	}
+
+	env := q.Get("env")
+	rollups, err := h.analytics.Query(projectName, env, from, to)
+	if err != nil {
+		return h.jsonErrorf(w, http.StatusInternalServerError, "failed to query analytics", err)
+	}
+
+	report := analytics.Summarize(rollups, from, to, h.analyticsConfig.TopN)
+	report.Env = env
+
+	return h.jsonResponse(w, http.StatusOK, map[string]any{
+		"project":        projectName,
+		"retention_days": h.analyticsConfig.RetentionDays,
+		"report":         report,
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/purge"
 	"go.uber.org/zap"
 )
 
@@ -166,6 +167,7 @@ func (h *SitePodHandler) apiDeleteAccount(w http.ResponseWriter, r *http.Request
 		projectName := project.GetString("name")
 
 		h.logger.Info("Deleting project", zap.String("project", projectName))
+		purgeBases := h.purgeBases(project, "")
 
 		// Delete domains
 		domains, _ := h.app.FindRecordsByFilter(
@@ -218,6 +220,12 @@ func (h *SitePodHandler) apiDeleteAccount(w http.ResponseWriter, r *http.Request
 		if err := h.storage.DeleteRef(projectName, "prod"); err != nil {
 			h.logger.Warn("Failed to delete prod ref", zap.String("project", projectName), zap.Error(err))
 		}
+		h.sendPurge(purge.Request{
+			Project: projectName,
+			Bases:   purgeBases,
+			Keys:    []string{purge.ProjectKey(projectName)},
+			All:     true,
+		})
 
 		// Delete the project record
 		if err := h.app.Delete(project); err != nil {
@@ -12,7 +12,11 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/dedup"
+	"github.com/sitepod/sitepod/internal/events"
+	"github.com/sitepod/sitepod/internal/manifest"
 	"github.com/sitepod/sitepod/internal/storage"
+	"github.com/sitepod/sitepod/internal/webhook"
 	"github.com/zeebo/blake3"
 	"go.uber.org/zap"
 )
@@ -95,6 +99,29 @@ func (h *SitePodHandler) apiPlan(w http.ResponseWriter, r *http.Request, user *c
 	}
 	contentHash := hex.EncodeToString(hasher.Sum(nil))
 
+	// The manifest is stored once as an object named by its hash
+	manifestFiles := make(map[string]storage.FileEntry, len(req.Files))
+	for _, f := range req.Files {
+		manifestFiles[f.Path] = storage.FileEntry{
+			Hash:        f.Blake3,
+			Size:        f.Size,
+			ContentType: f.ContentType,
+		}
+	}
+	m := manifest.New(manifestFiles)
+
+	// Lease the blobs and the manifest object before checking which exist,
+	// so the GC cannot delete one this plan reuses before the image
+	// referencing it is committed
+	expiresAt := time.Now().Add(30 * time.Minute)
+	hashes := make([]string, len(req.Files))
+	for i, f := range req.Files {
+		hashes[i] = f.Blake3
+	}
+	if err := h.gc.Lease(append(hashes, m.Hash), expiresAt); err != nil {
+		return h.jsonError(w, http.StatusInternalServerError, err.Error())
+	}
+
 	// Check which blobs are missing
 	type missingBlob struct {
 		Path      string `json:"path"`
@@ -103,21 +130,27 @@ func (h *SitePodHandler) apiPlan(w http.ResponseWriter, r *http.Request, user *c
 		UploadURL string `json:"upload_url"`
 	}
 
+	// Presigned uploads are kept per plan until commit verifies them
+	planID := "plan_" + uuid.New().String()[:8]
+	uploadMode := h.uploadMode()
+
+	// Only blobs the owner holds are looked up, so a plan cannot tell
+	// whether another tenant has stored a file
+	stored, err := h.reusableBlobs(project, hashes)
+	if err != nil {
+		return h.jsonError(w, http.StatusInternalServerError, err.Error())
+	}
+
 	missing := make([]missingBlob, 0)
 	reusable := 0
 
 	for _, f := range req.Files {
-		exists, err := h.storage.HasBlob(f.Blake3)
-		if err != nil {
-			return h.jsonError(w, http.StatusInternalServerError, err.Error())
-		}
-
-		if exists {
+		if stored[f.Blake3] {
 			reusable++
 		} else {
 			var uploadURL string
-			if h.storage.UploadMode() == "presigned" {
-				uploadURL, _ = h.storage.GenerateUploadURL(f.Blake3, f.SHA256, f.Size)
+			if uploadMode == "presigned" {
+				uploadURL, _ = storage.GeneratePlanUploadURL(h.storage, planID, f.Blake3, f.SHA256, f.Size)
 			}
 			missing = append(missing, missingBlob{
 				Path:      f.Path,
@@ -129,18 +162,9 @@ func (h *SitePodHandler) apiPlan(w http.ResponseWriter, r *http.Request, user *c
 	}
 
 	// Create plan record
-	planID := "plan_" + uuid.New().String()[:8]
-
-	manifest := make(map[string]storage.FileEntry)
-	for _, f := range req.Files {
-		manifest[f.Path] = storage.FileEntry{
-			Hash:        f.Blake3,
-			Size:        f.Size,
-			ContentType: f.ContentType,
-		}
+	if err := h.manifests.Put(m); err != nil {
+		return h.jsonError(w, http.StatusInternalServerError, err.Error())
 	}
-
-	manifestJSON, _ := json.Marshal(manifest)
 	missingJSON, _ := json.Marshal(missing)
 
 	plansCollection, _ := h.app.FindCollectionByNameOrId("plans")
@@ -152,11 +176,11 @@ func (h *SitePodHandler) apiPlan(w http.ResponseWriter, r *http.Request, user *c
 	planRecord.Set("plan_id", planID)
 	planRecord.Set("project_id", project.Id)
 	planRecord.Set("content_hash", contentHash)
-	planRecord.Set("manifest", string(manifestJSON))
+	manifest.Set(planRecord, m)
 	planRecord.Set("missing_blobs", string(missingJSON))
-	planRecord.Set("upload_mode", h.storage.UploadMode())
+	planRecord.Set("upload_mode", uploadMode)
 	planRecord.Set("status", "pending")
-	planRecord.Set("expires_at", time.Now().Add(30*time.Minute))
+	planRecord.Set("expires_at", expiresAt)
 
 	if req.Git != nil {
 		planRecord.Set("git_commit", req.Git.Commit)
@@ -169,7 +193,7 @@ func (h *SitePodHandler) apiPlan(w http.ResponseWriter, r *http.Request, user *c
 	}
 
 	// Set upload URLs for direct mode
-	if h.storage.UploadMode() == "direct" {
+	if uploadMode == "direct" {
 		for i := range missing {
 			missing[i].UploadURL = fmt.Sprintf("/api/v1/upload/%s/%s", planID, missing[i].Hash)
 		}
@@ -178,7 +202,7 @@ func (h *SitePodHandler) apiPlan(w http.ResponseWriter, r *http.Request, user *c
 	return h.jsonResponse(w, http.StatusOK, map[string]any{
 		"plan_id":      planID,
 		"content_hash": contentHash,
-		"upload_mode":  h.storage.UploadMode(),
+		"upload_mode":  uploadMode,
 		"missing":      missing,
 		"reusable":     reusable,
 	})
@@ -251,6 +275,11 @@ func (h *SitePodHandler) apiUpload(w http.ResponseWriter, r *http.Request, path
 		return h.jsonError(w, http.StatusInternalServerError, err.Error())
 	}
 
+	// The upload proves the owner holds the blob
+	if err := h.dedup.Add(project.GetString("owner_id"), []string{hash}); err != nil {
+		return h.jsonError(w, http.StatusInternalServerError, err.Error())
+	}
+
 	w.WriteHeader(http.StatusOK)
 	return nil
 }
@@ -288,18 +317,40 @@ func (h *SitePodHandler) apiCommit(w http.ResponseWriter, r *http.Request, user
 	}
 
 	// Verify all blobs exist
-	var manifest map[string]storage.FileEntry
-	if err := json.Unmarshal([]byte(plan.GetString("manifest")), &manifest); err != nil {
+	m, err := h.manifests.Record(plan)
+	if err != nil {
 		return h.jsonError(w, http.StatusInternalServerError, "invalid manifest")
 	}
 
-	for _, entry := range manifest {
-		exists, err := h.storage.HasBlob(entry.Hash)
-		if err != nil {
+	if plan.GetString("upload_mode") == "presigned" {
+		if err := h.commitUploads(plan, project); err != nil {
+			var mismatch *storage.HashMismatchError
+			var sizeMismatch *storage.SizeMismatchError
+			switch {
+			case errors.As(err, &mismatch):
+				return h.jsonError(w, http.StatusBadRequest, "hash mismatch: "+mismatch.Expected)
+			case errors.As(err, &sizeMismatch):
+				return h.jsonError(w, http.StatusBadRequest, "size mismatch: "+sizeMismatch.Hash)
+			case errors.Is(err, storage.ErrUploadChanged):
+				return h.jsonError(w, http.StatusConflict, err.Error())
+			}
 			return h.jsonError(w, http.StatusInternalServerError, err.Error())
 		}
-		if !exists {
-			return h.jsonError(w, http.StatusBadRequest, "missing blob: "+entry.Hash)
+	}
+
+	// Blobs the owner does not hold are missing even if stored, so an
+	// image can only reference content its owner uploaded
+	hashes := make([]string, 0, len(m.Files))
+	for _, entry := range m.Files {
+		hashes = append(hashes, entry.Hash)
+	}
+	stored, err := h.reusableBlobs(project, hashes)
+	if err != nil {
+		return h.jsonError(w, http.StatusInternalServerError, err.Error())
+	}
+	for _, hash := range hashes {
+		if !stored[hash] {
+			return h.jsonError(w, http.StatusBadRequest, "missing blob: "+hash)
 		}
 	}
 
@@ -316,14 +367,14 @@ func (h *SitePodHandler) apiCommit(w http.ResponseWriter, r *http.Request, user
 	imageRecord.Set("image_id", imageID)
 	imageRecord.Set("project_id", plan.GetString("project_id"))
 	imageRecord.Set("content_hash", contentHash)
-	imageRecord.Set("manifest", plan.GetString("manifest"))
-	imageRecord.Set("file_count", len(manifest))
+	manifest.Set(imageRecord, m)
+	imageRecord.Set("file_count", len(m.Files))
 	imageRecord.Set("git_commit", plan.GetString("git_commit"))
 	imageRecord.Set("git_branch", plan.GetString("git_branch"))
 	imageRecord.Set("git_message", plan.GetString("git_message"))
 
 	var totalSize int64
-	for _, entry := range manifest {
+	for _, entry := range m.Files {
 		totalSize += entry.Size
 	}
 	imageRecord.Set("total_size", totalSize)
@@ -343,6 +394,87 @@ func (h *SitePodHandler) apiCommit(w http.ResponseWriter, r *http.Request, user
 	})
 }
 
+// commitUploads verifies the blobs uploaded for a presigned plan, moves
+// them into the blob store and records that the project owner holds them.
+// Blobs that were not uploaded are skipped: they may have been uploaded by
+// another plan of the owner since, which the check that follows settles.
+func (h *SitePodHandler) commitUploads(plan, project *core.Record) error {
+	var missing []struct {
+		Hash string `json:"hash"`
+		Size int64  `json:"size"`
+	}
+	if err := json.Unmarshal([]byte(plan.GetString("missing_blobs")), &missing); err != nil {
+		return fmt.Errorf("invalid plan: %w", err)
+	}
+
+	// Plans only use presigned uploads with a stager, see uploadMode
+	stager, ok := storage.As[storage.UploadStager](h.storage)
+	if !ok {
+		return errors.New("storage backend cannot verify presigned uploads")
+	}
+
+	seen := make(map[string]bool, len(missing))
+	committed := make([]string, 0, len(missing))
+	for _, blob := range missing {
+		if seen[blob.Hash] {
+			continue
+		}
+		seen[blob.Hash] = true
+		err := stager.CommitUpload(plan.GetString("plan_id"), blob.Hash, blob.Size)
+		if storage.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		committed = append(committed, blob.Hash)
+	}
+	return h.dedup.Add(project.GetString("owner_id"), committed)
+}
+
+// uploadMode returns how plans upload missing blobs. Presigned uploads
+// need a backend that stages them until commit verifies them; other
+// backends take uploads through the API, which verifies them as they are
+// stored, so a plan cannot claim a blob it did not upload.
+func (h *SitePodHandler) uploadMode() string {
+	if h.storage.UploadMode() != "presigned" {
+		return h.storage.UploadMode()
+	}
+	if _, ok := storage.As[storage.UploadStager](h.storage); !ok {
+		return "direct"
+	}
+	return "presigned"
+}
+
+// reusableBlobs returns which of hashes are stored and held (see
+// heldBlobs), checking the held ones in a single batch
+func (h *SitePodHandler) reusableBlobs(project *core.Record, hashes []string) (map[string]bool, error) {
+	held, err := h.heldBlobs(project, hashes)
+	if err != nil {
+		return nil, err
+	}
+	check := make([]string, 0, len(held))
+	for hash := range held {
+		check = append(check, hash)
+	}
+	return storage.HasBlobs(h.storage, check)
+}
+
+// heldBlobs returns which of hashes deploys to project may use without
+// uploading them: with the tenant dedup scope those the project owner
+// holds, with the global scope all of them. Whether they are stored is
+// checked separately.
+func (h *SitePodHandler) heldBlobs(project *core.Record, hashes []string) (map[string]bool, error) {
+	if h.config.Storage.DedupScope == dedup.ScopeGlobal {
+		held := make(map[string]bool, len(hashes))
+		for _, hash := range hashes {
+			held[hash] = true
+		}
+		return held, nil
+	}
+	return h.dedup.Owned(project.GetString("owner_id"), hashes)
+}
+
 // API: Release
 func (h *SitePodHandler) apiRelease(w http.ResponseWriter, r *http.Request, user *core.Record) error {
 	var req struct {
@@ -399,33 +531,34 @@ func (h *SitePodHandler) apiRelease(w http.ResponseWriter, r *http.Request, user
 
 	// Get current ref for audit
 	var previousImageID string
-	if refData, err := h.storage.GetRef(projectName, req.Environment); err == nil {
-		var currentRef storage.RefData
-		if json.Unmarshal(refData, &currentRef) == nil {
-			previousImageID = currentRef.ImageID
-		}
+	previousRef, err := h.loadRef(projectName, req.Environment)
+	if err == nil {
+		previousImageID = previousRef.ImageID
 	}
 
 	// Build and write ref
-	var manifest map[string]storage.FileEntry
-	if err := json.Unmarshal([]byte(image.GetString("manifest")), &manifest); err != nil {
+	m, err := h.manifests.Record(image)
+	if err != nil {
 		return h.jsonError(w, http.StatusInternalServerError, "invalid manifest")
 	}
 
 	refData := storage.RefData{
-		ImageID:     image.GetString("image_id"),
-		ContentHash: image.GetString("content_hash"),
-		Manifest:    manifest,
-		UpdatedAt:   time.Now(),
+		ImageID:      image.GetString("image_id"),
+		ContentHash:  image.GetString("content_hash"),
+		ManifestHash: m.Hash,
+		Manifest:     m.Inline(),
+		UpdatedAt:    time.Now(),
 	}
 
 	refJSON, _ := json.Marshal(refData)
+	refData.Manifest = m.Files
 
 	if err := h.storage.PutRef(projectName, req.Environment, refJSON); err != nil {
 		return h.jsonError(w, http.StatusInternalServerError, "failed to write ref: "+err.Error())
 	}
 
-	h.cache.Delete(projectName + ":" + req.Environment)
+	h.invalidateRefs(projectName, req.Environment)
+	h.purgeRef(project, req.Environment, previousRef, &refData)
 
 	// Record deploy event
 	eventsCollection, _ := h.app.FindCollectionByNameOrId("deploy_events")
@@ -443,6 +576,14 @@ func (h *SitePodHandler) apiRelease(w http.ResponseWriter, r *http.Request, user
 
 	url := h.buildURL(projectName, req.Environment)
 
+	h.emitWebhook(project, webhook.Payload{
+		Event:           events.TypeRelease,
+		Environment:     req.Environment,
+		URL:             url,
+		Image:           webhookImage(image),
+		PreviousImageID: previousImageID,
+	})
+
 	return h.jsonResponse(w, http.StatusOK, map[string]string{"url": url})
 }
 
@@ -478,33 +619,34 @@ func (h *SitePodHandler) apiRollback(w http.ResponseWriter, r *http.Request, use
 
 	// Get current ref
 	var previousImageID string
-	if refData, err := h.storage.GetRef(req.Project, req.Environment); err == nil {
-		var currentRef storage.RefData
-		if json.Unmarshal(refData, &currentRef) == nil {
-			previousImageID = currentRef.ImageID
-		}
+	previousRef, err := h.loadRef(req.Project, req.Environment)
+	if err == nil {
+		previousImageID = previousRef.ImageID
 	}
 
 	// Build and write ref
-	var manifest map[string]storage.FileEntry
-	if err := json.Unmarshal([]byte(image.GetString("manifest")), &manifest); err != nil {
+	m, err := h.manifests.Record(image)
+	if err != nil {
 		return h.jsonError(w, http.StatusInternalServerError, "invalid manifest")
 	}
 
 	refData := storage.RefData{
-		ImageID:     image.GetString("image_id"),
-		ContentHash: image.GetString("content_hash"),
-		Manifest:    manifest,
-		UpdatedAt:   time.Now(),
+		ImageID:      image.GetString("image_id"),
+		ContentHash:  image.GetString("content_hash"),
+		ManifestHash: m.Hash,
+		Manifest:     m.Inline(),
+		UpdatedAt:    time.Now(),
 	}
 
 	refJSON, _ := json.Marshal(refData)
+	refData.Manifest = m.Files
 
 	if err := h.storage.PutRef(req.Project, req.Environment, refJSON); err != nil {
 		return h.jsonError(w, http.StatusInternalServerError, "failed to write ref")
 	}
 
-	h.cache.Delete(req.Project + ":" + req.Environment)
+	h.invalidateRefs(req.Project, req.Environment)
+	h.purgeRef(project, req.Environment, previousRef, &refData)
 
 	// Record rollback event
 	eventsCollection, _ := h.app.FindCollectionByNameOrId("deploy_events")
@@ -522,6 +664,14 @@ func (h *SitePodHandler) apiRollback(w http.ResponseWriter, r *http.Request, use
 
 	url := h.buildURL(req.Project, req.Environment)
 
+	h.emitWebhook(project, webhook.Payload{
+		Event:           events.TypeRollback,
+		Environment:     req.Environment,
+		URL:             url,
+		Image:           webhookImage(image),
+		PreviousImageID: previousImageID,
+	})
+
 	return h.jsonResponse(w, http.StatusOK, map[string]any{
 		"url":               url,
 		"previous_image_id": previousImageID,
@@ -575,16 +725,17 @@ func (h *SitePodHandler) apiCreatePreview(w http.ResponseWriter, r *http.Request
 	}
 	expiresAt := time.Now().Add(time.Duration(expiresIn) * time.Second)
 
-	var manifest map[string]storage.FileEntry
-	if err := json.Unmarshal([]byte(image.GetString("manifest")), &manifest); err != nil {
+	m, err := h.manifests.Record(image)
+	if err != nil {
 		return h.jsonError(w, http.StatusInternalServerError, "invalid manifest")
 	}
 
 	previewRef := storage.PreviewRef{
-		ImageID:   image.GetString("image_id"),
-		Manifest:  manifest,
-		ExpiresAt: expiresAt,
-		CreatedAt: time.Now(),
+		ImageID:      image.GetString("image_id"),
+		ManifestHash: m.Hash,
+		Manifest:     m.Inline(),
+		ExpiresAt:    expiresAt,
+		CreatedAt:    time.Now(),
 	}
 
 	previewJSON, _ := json.Marshal(previewRef)
@@ -607,6 +758,13 @@ func (h *SitePodHandler) apiCreatePreview(w http.ResponseWriter, r *http.Request
 
 	url := h.buildPreviewURL(req.Project, slug)
 
+	h.emitWebhook(project, webhook.Payload{
+		Event:   events.TypePreview,
+		URL:     url,
+		Image:   webhookImage(image),
+		Preview: &webhook.Preview{Slug: slug, ExpiresAt: expiresAt},
+	})
+
 	return h.jsonResponse(w, http.StatusOK, map[string]any{
 		"url":        url,
 		"expires_at": expiresAt,
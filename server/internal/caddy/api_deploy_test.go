@@ -0,0 +1,47 @@
+package caddy
+
+import (
+	"testing"
+
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+// presignedBackend is a remote backend that does not stage uploads
+type presignedBackend struct {
+	storage.Backend
+}
+
+func (presignedBackend) UploadMode() string { return "presigned" }
+
+// stagingBackend also stages them
+type stagingBackend struct {
+	presignedBackend
+	storage.UploadStager
+}
+
+func TestUploadMode(t *testing.T) {
+	local, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name    string
+		backend storage.Backend
+		want    string
+	}{
+		{"local", local, "direct"},
+		// Presigned uploads it could not verify would let a plan claim
+		// blobs it never uploaded
+		{"presigned_without_staging", presignedBackend{local}, "direct"},
+		{"presigned_with_staging", stagingBackend{presignedBackend: presignedBackend{local}}, "presigned"},
+		{"wrapped", storage.WithKnownBlobs(presignedBackend{local}, 10, 0), "direct"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &SitePodHandler{storage: tc.backend}
+			if got := h.uploadMode(); got != tc.want {
+				t.Errorf("upload mode = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
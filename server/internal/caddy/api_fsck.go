@@ -0,0 +1,54 @@
+package caddy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/sitepod/sitepod/internal/fsck"
+	"go.uber.org/zap"
+)
+
+// API: Integrity Check
+//
+// POST /api/v1/admin/fsck?verify=&quarantine=&delete_orphans=
+//
+// Checks that images, refs, previews and the routing index only point at
+// blobs and projects that exist, and with verify=true re-hashes every
+// blob. Repairs are only made when asked for. The check runs within the
+// request; for large blob stores prefer the fsck subcommand.
+func (h *SitePodHandler) apiFsck(w http.ResponseWriter, r *http.Request) error {
+	if err := h.requireAdminToken(r); err != nil {
+		return h.adminError(w, err)
+	}
+
+	query := r.URL.Query()
+	var opts fsck.Options
+	opts.Verify, _ = strconv.ParseBool(query.Get("verify"))
+	opts.Quarantine, _ = strconv.ParseBool(query.Get("quarantine"))
+	opts.DeleteOrphans, _ = strconv.ParseBool(query.Get("delete_orphans"))
+	if opts.Quarantine && !opts.Verify {
+		return h.jsonError(w, http.StatusBadRequest, "quarantine requires verify=true")
+	}
+
+	h.logger.Info("Starting integrity check",
+		zap.Bool("verify", opts.Verify),
+		zap.Bool("quarantine", opts.Quarantine),
+		zap.Bool("delete_orphans", opts.DeleteOrphans))
+
+	report, err := h.fsck.Run(r.Context(), opts)
+	if errors.Is(err, fsck.ErrRunning) {
+		return h.jsonError(w, http.StatusConflict, "integrity check already running")
+	}
+	if err != nil {
+		return h.jsonErrorf(w, http.StatusInternalServerError, "integrity check failed", err)
+	}
+
+	h.logger.Info("Integrity check completed",
+		zap.Int("issues", len(report.Issues)),
+		zap.Int("repaired", report.Repaired),
+		zap.Int("errors", len(report.Errors)),
+		zap.Int64("duration_ms", report.DurationMS))
+
+	return h.jsonResponse(w, http.StatusOK, report)
+}
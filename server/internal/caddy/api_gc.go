@@ -0,0 +1,137 @@
+package caddy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sitepod/sitepod/internal/gc"
+	"github.com/sitepod/sitepod/internal/lease"
+	"go.uber.org/zap"
+)
+
+// API: Start GC
+//
+// POST /api/v1/admin/gc (and the older POST /api/v1/gc)
+//
+// Starts a GC cycle in the background and returns its job ID. Poll
+// GET /api/v1/admin/gc/jobs/{job_id} for progress. ?full=true forces a
+// full cycle that rebuilds the blob index.
+func (h *SitePodHandler) apiStartGC(w http.ResponseWriter, r *http.Request) error {
+	if err := h.requireAdminToken(r); err != nil {
+		return h.adminError(w, err)
+	}
+
+	job, err := h.gc.NewJob(gc.TriggerAdmin)
+	if errors.Is(err, gc.ErrRunning) {
+		return h.jsonResponse(w, http.StatusConflict, map[string]any{
+			"error": "garbage collection already running",
+			"job":   h.gc.Progress(),
+		})
+	}
+	if errors.Is(err, lease.ErrHeld) {
+		return h.jsonResponse(w, http.StatusConflict, map[string]any{
+			"error": "garbage collection running on another instance",
+			"lease": h.leaseStatus(gc.LeaseName),
+		})
+	}
+	if err != nil {
+		return h.jsonErrorf(w, http.StatusInternalServerError, "failed to start garbage collection", err)
+	}
+
+	if full, _ := strconv.ParseBool(r.URL.Query().Get("full")); full {
+		job.Mode = gc.ModeFull
+	}
+
+	h.logger.Info("Starting garbage collection", zap.String("job_id", job.ID), zap.String("mode", job.Mode))
+	h.goBackground(func(ctx context.Context) { h.gc.RunJob(ctx, job) })
+
+	return h.jsonResponse(w, http.StatusAccepted, map[string]any{
+		"job_id": job.ID,
+		"mode":   job.Mode,
+		"status": gc.StatusRunning,
+		"url":    "/api/v1/admin/gc/jobs/" + job.ID,
+	})
+}
+
+// API: GC Progress
+//
+// GET /api/v1/gc returns the running or last run of this process
+func (h *SitePodHandler) apiGCProgress(w http.ResponseWriter, r *http.Request) error {
+	if err := h.requireAdminToken(r); err != nil {
+		return h.adminError(w, err)
+	}
+	return h.jsonResponse(w, http.StatusOK, h.gc.Progress())
+}
+
+// API: GC Job
+//
+// GET /api/v1/admin/gc/jobs/{job_id}
+func (h *SitePodHandler) apiGetGCJob(w http.ResponseWriter, r *http.Request, jobID string) error {
+	if err := h.requireAdminToken(r); err != nil {
+		return h.adminError(w, err)
+	}
+	run, err := h.gc.FindRun(jobID)
+	if err != nil {
+		return h.jsonError(w, http.StatusNotFound, "job not found")
+	}
+	return h.jsonResponse(w, http.StatusOK, run)
+}
+
+// API: GC History
+//
+// GET /api/v1/admin/gc/runs?limit=&page=
+func (h *SitePodHandler) apiListGCRuns(w http.ResponseWriter, r *http.Request) error {
+	if err := h.requireAdminToken(r); err != nil {
+		return h.adminError(w, err)
+	}
+
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			limit = min(parsed, 100)
+		}
+	}
+	page := 1
+	if v := r.URL.Query().Get("page"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			page = parsed
+		}
+	}
+
+	runs, total, err := h.gc.Runs(limit, (page-1)*limit)
+	if err != nil {
+		return h.jsonErrorf(w, http.StatusInternalServerError, "failed to list runs", err)
+	}
+	return h.jsonResponse(w, http.StatusOK, map[string]any{"runs": runs, "total": total})
+}
+
+// API: GC Plan
+//
+// GET /api/v1/admin/gc/plan returns what a GC cycle would expire and
+// delete now, without changing anything
+func (h *SitePodHandler) apiGCPlan(w http.ResponseWriter, r *http.Request) error {
+	if err := h.requireAdminToken(r); err != nil {
+		return h.adminError(w, err)
+	}
+	result, err := h.gc.RunDryRun()
+	if err != nil {
+		return h.jsonErrorf(w, http.StatusInternalServerError, "failed to plan garbage collection", err)
+	}
+	return h.jsonResponse(w, http.StatusOK, result)
+}
+
+// adminError responds to a failed requireAdminToken check
+func (h *SitePodHandler) adminError(w http.ResponseWriter, err error) error {
+	if errors.Is(err, errAdminTokenMissing) {
+		return h.jsonError(w, http.StatusForbidden, "admin token not configured")
+	}
+	return h.jsonError(w, http.StatusForbidden, "forbidden")
+}
+
+// gcJobID extracts the job ID from /admin/gc/jobs/{job_id}
+func gcJobID(path string) string {
+	return strings.TrimPrefix(path, "/admin/gc/jobs/")
+}
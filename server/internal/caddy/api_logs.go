@@ -0,0 +1,170 @@
+package caddy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// API: Get Access Logs
+//
+// GET /api/v1/projects/{name}/logs?env=&status=&path=&request_id=&since=&limit=&page=
+//
+// status is a code (404) or a class (5xx); path matches a prefix; since is
+// an RFC 3339 time or a duration such as 1h.
+func (h *SitePodHandler) apiGetAccessLogs(w http.ResponseWriter, r *http.Request, projectName string, user *core.Record) error {
+	project, err := h.requireProjectOwnerByName(projectName, user)
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			return h.jsonError(w, http.StatusForbidden, "forbidden")
+		}
+		return h.jsonError(w, http.StatusNotFound, "project not found")
+	}
+
+	q := r.URL.Query()
+	filter := []string{"project_id = {:project_id}"}
+	params := map[string]any{"project_id": project.Id}
+
+	if env := q.Get("env"); env != "" {
+		filter = append(filter, "env = {:env}")
+		params["env"] = env
+	}
+	if status := q.Get("status"); status != "" {
+		if class, ok := strings.CutSuffix(strings.ToLower(status), "xx"); ok {
+			n, err := strconv.Atoi(class)
+			if err != nil || n < 1 || n > 5 {
+				return h.jsonError(w, http.StatusBadRequest, "invalid status")
+			}
+			filter = append(filter, "status >= {:status_min} && status < {:status_max}")
+			params["status_min"] = n * 100
+			params["status_max"] = (n + 1) * 100
+		} else {
+			n, err := strconv.Atoi(status)
+			if err != nil {
+				return h.jsonError(w, http.StatusBadRequest, "invalid status")
+			}
+			filter = append(filter, "status = {:status}")
+			params["status"] = n
+		}
+	}
+	if path := q.Get("path"); path != "" {
+		filter = append(filter, "path ~ {:path}")
+		params["path"] = strings.ReplaceAll(path, "%", "") + "%"
+	}
+	if id := q.Get("request_id"); id != "" {
+		filter = append(filter, "request_id = {:request_id}")
+		params["request_id"] = id
+	}
+	if v := q.Get("since"); v != "" {
+		since, err := parseSince(v)
+		if err != nil {
+			return h.jsonError(w, http.StatusBadRequest, "invalid since: use an RFC 3339 time or a duration")
+		}
+		dt, err := types.ParseDateTime(since)
+		if err != nil {
+			return h.jsonError(w, http.StatusBadRequest, "invalid since")
+		}
+		filter = append(filter, "created >= {:since}")
+		params["since"] = dt.String()
+	}
+
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			if parsed > 1000 {
+				parsed = 1000
+			}
+			limit = parsed
+		}
+	}
+
+	page := 1
+	if v := q.Get("page"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			page = parsed
+		}
+	}
+
+	records, err := h.app.FindRecordsByFilter(
+		"access_logs", strings.Join(filter, " && "), "-created", limit, (page-1)*limit, params,
+	)
+	if err != nil {
+		return h.jsonErrorf(w, http.StatusInternalServerError, "failed to query access logs", err)
+	}
+
+	items := make([]map[string]any, len(records))
+	for i, rec := range records {
+		items[i] = map[string]any{
+			"time":        rec.GetDateTime("created").Time(),
+			"request_id":  rec.GetString("request_id"),
+			"env":         rec.GetString("env"),
+			"method":      rec.GetString("method"),
+			"host":        rec.GetString("host"),
+			"path":        rec.GetString("path"),
+			"status":      rec.GetInt("status"),
+			"bytes":       rec.GetInt("bytes"),
+			"duration_ms": rec.GetFloat("duration_ms"),
+			"image_id":    rec.GetString("image_id"),
+			"cache_hit":   rec.GetBool("cache_hit"),
+			"remote_ip":   rec.GetString("remote_ip"),
+			"user_agent":  rec.GetString("user_agent"),
+			"referer":     rec.GetString("referer"),
+		}
+	}
+
+	return h.jsonResponse(w, http.StatusOK, map[string]any{
+		"enabled":   project.GetBool("access_log"),
+		"retention": h.config.Log.AccessRetention.String(),
+		"items":     items,
+		"page":      page,
+		"limit":     limit,
+	})
+}
+
+// API: Set Access Log
+//
+// PUT /api/v1/projects/{name}/logs with {"enabled": true} opts the project
+// in to persisted access logs. Disabling it keeps existing entries until
+// they expire.
+func (h *SitePodHandler) apiSetAccessLog(w http.ResponseWriter, r *http.Request, projectName string, user *core.Record) error {
+	project, err := h.requireProjectOwnerByName(projectName, user)
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			return h.jsonError(w, http.StatusForbidden, "forbidden")
+		}
+		return h.jsonError(w, http.StatusNotFound, "project not found")
+	}
+
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+		return h.jsonError(w, http.StatusBadRequest, "enabled required")
+	}
+
+	project.Set("access_log", *req.Enabled)
+	if err := h.app.Save(project); err != nil {
+		return h.jsonErrorf(w, http.StatusInternalServerError, "failed to update project", err)
+	}
+	h.accessLog.setProject(project.GetString("name"), project.Id, *req.Enabled)
+
+	return h.jsonResponse(w, http.StatusOK, map[string]any{
+		"project":   project.GetString("name"),
+		"enabled":   *req.Enabled,
+		"retention": h.config.Log.AccessRetention.String(),
+	})
+}
+
+// parseSince parses an absolute RFC 3339 time or a duration before now
+func parseSince(v string) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
@@ -1,44 +1,20 @@
 package caddy
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
 	"os"
 	"strconv"
-	"time"
+	"strings"
 
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/purge"
 	"github.com/sitepod/sitepod/internal/storage"
 	"go.uber.org/zap"
 )
 
-// API: Health
-func (h *SitePodHandler) apiHealth(w http.ResponseWriter, r *http.Request) error {
-	dbStatus := "ok"
-	if _, err := h.app.FindCollectionByNameOrId("projects"); err != nil {
-		dbStatus = "error"
-	}
-
-	storageStatus := "ok"
-	if _, err := h.storage.ListBlobs(); err != nil {
-		storageStatus = "error"
-	}
-
-	status := "healthy"
-	if dbStatus != "ok" || storageStatus != "ok" {
-		status = "degraded"
-	}
-
-	return h.jsonResponse(w, http.StatusOK, map[string]any{
-		"status":   status,
-		"database": dbStatus,
-		"storage":  storageStatus,
-		"uptime":   time.Since(h.startTime).String(),
-	})
-}
-
 // API: Config (public endpoint for frontend configuration)
 func (h *SitePodHandler) apiConfig(w http.ResponseWriter, r *http.Request) error {
 	isDemo := os.Getenv("IS_DEMO") == "1" || os.Getenv("IS_DEMO") == "true"
@@ -51,17 +27,33 @@ func (h *SitePodHandler) apiConfig(w http.ResponseWriter, r *http.Request) error
 
 // API: Metrics (Prometheus format)
 func (h *SitePodHandler) apiMetrics(w http.ResponseWriter, r *http.Request) error {
-	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
-	// Basic metrics - can be extended
-	fmt.Fprintf(w, "# HELP sitepod_up SitePod is running\n")
-	fmt.Fprintf(w, "# TYPE sitepod_up gauge\n")
-	fmt.Fprintf(w, "sitepod_up 1\n")
-	fmt.Fprintf(w, "# HELP sitepod_uptime_seconds Uptime in seconds\n")
-	fmt.Fprintf(w, "# TYPE sitepod_uptime_seconds counter\n")
-	fmt.Fprintf(w, "sitepod_uptime_seconds %.0f\n", time.Since(h.startTime).Seconds())
+	if !h.config.Metrics.Enabled {
+		return h.jsonError(w, http.StatusNotFound, "endpoint not found")
+	}
+	if !h.metricsAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sitepod metrics"`)
+		return h.jsonError(w, http.StatusUnauthorized, "unauthorized")
+	}
+
+	h.metrics.Handler().ServeHTTP(w, r)
 	return nil
 }
 
+// metricsAuthorized reports whether the request may read metrics. Without a
+// configured metrics token the endpoint is public.
+func (h *SitePodHandler) metricsAuthorized(r *http.Request) bool {
+	token := h.config.Metrics.Token
+	if token == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1 {
+		return true
+	}
+	return h.requireAdminToken(r) == nil
+}
+
 // API: Get Current
 func (h *SitePodHandler) apiGetCurrent(w http.ResponseWriter, r *http.Request, user *core.Record) error {
 	projectName := r.URL.Query().Get("project")
@@ -253,6 +245,7 @@ func (h *SitePodHandler) apiListImages(w http.ResponseWriter, r *http.Request, u
 			"git_branch":   img.GetString("git_branch"),
 			"git_message":  img.GetString("git_message"),
 			"created_at":   img.GetDateTime("created").String(),
+			"pinned":       img.GetBool("pinned"),
 			"deployed_to":  deployedTo,
 		}
 	}
@@ -332,6 +325,7 @@ func (h *SitePodHandler) apiGetProject(w http.ResponseWriter, r *http.Request, p
 		"name":       project.GetString("name"),
 		"subdomain":  project.GetString("subdomain"),
 		"owner_id":   project.GetString("owner_id"),
+		"access_log": project.GetBool("access_log"),
 		"created_at": project.GetDateTime("created").String(),
 		"updated_at": project.GetDateTime("updated").String(),
 	})
@@ -353,6 +347,9 @@ func (h *SitePodHandler) apiDeleteProject(w http.ResponseWriter, r *http.Request
 
 	projectID := project.Id
 
+	// Resolve CDN origins while the project's domains still exist
+	purgeBases := h.purgeBases(project, "")
+
 	// Delete domains
 	domains, _ := h.app.FindRecordsByFilter(
 		"domains", "project_id = {:project_id}", "", 1000, 0,
@@ -422,8 +419,13 @@ func (h *SitePodHandler) apiDeleteProject(w http.ResponseWriter, r *http.Request
 		h.logger.Warn("Failed to delete prod ref", zap.String("project", projectName), zap.Error(err))
 	}
 
-	h.cache.Delete(projectName + ":prod")
-	h.cache.Delete(projectName + ":beta")
+	h.invalidateRefs(projectName, "prod", "beta")
+	h.sendPurge(purge.Request{
+		Project: projectName,
+		Bases:   purgeBases,
+		Keys:    []string{purge.ProjectKey(projectName)},
+		All:     true,
+	})
 
 	if err := h.app.Delete(project); err != nil {
 		return h.jsonError(w, http.StatusInternalServerError, "failed to delete project")
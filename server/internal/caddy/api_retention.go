@@ -0,0 +1,118 @@
+package caddy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// API: Get Retention
+//
+// GET /api/v1/projects/{name}/retention
+//
+// Returns the project's retention policy and, as a dry run, which images
+// the next GC cycle keeps (with the reason) and which it deletes, or would
+// delete if [gc] retention were enabled.
+func (h *SitePodHandler) apiGetRetention(w http.ResponseWriter, r *http.Request, projectName string, user *core.Record) error {
+	project, err := h.requireProjectOwnerByName(projectName, user)
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			return h.jsonError(w, http.StatusForbidden, "forbidden")
+		}
+		return h.jsonError(w, http.StatusNotFound, "project not found")
+	}
+
+	plan, err := h.gc.PlanRetention(project, time.Now())
+	if err != nil {
+		return h.jsonErrorf(w, http.StatusInternalServerError, "failed to plan retention", err)
+	}
+
+	return h.jsonResponse(w, http.StatusOK, map[string]any{
+		"project":   plan.Project,
+		"enabled":   h.config.GC.Retention,
+		"policy":    plan.Policy,
+		"overrides": retentionOverrides(project),
+		"images":    plan.Images,
+		"delete":    plan.Delete,
+	})
+}
+
+// API: Set Retention
+//
+// PUT /api/v1/projects/{name}/retention {"min_versions": 10, "keep_days": 0}
+//
+// Overrides the server defaults for this project; 0 restores the default.
+func (h *SitePodHandler) apiSetRetention(w http.ResponseWriter, r *http.Request, projectName string, user *core.Record) error {
+	project, err := h.requireProjectOwnerByName(projectName, user)
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			return h.jsonError(w, http.StatusForbidden, "forbidden")
+		}
+		return h.jsonError(w, http.StatusNotFound, "project not found")
+	}
+
+	var req struct {
+		MinVersions *int `json:"min_versions"`
+		KeepDays    *int `json:"keep_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return h.jsonError(w, http.StatusBadRequest, "invalid request")
+	}
+	if (req.MinVersions != nil && *req.MinVersions < 0) || (req.KeepDays != nil && *req.KeepDays < 0) {
+		return h.jsonError(w, http.StatusBadRequest, "min_versions and keep_days must not be negative")
+	}
+
+	if req.MinVersions != nil {
+		project.Set("retention_min_versions", *req.MinVersions)
+	}
+	if req.KeepDays != nil {
+		project.Set("retention_keep_days", *req.KeepDays)
+	}
+	if err := h.app.Save(project); err != nil {
+		return h.jsonErrorf(w, http.StatusInternalServerError, "failed to update project", err)
+	}
+
+	return h.jsonResponse(w, http.StatusOK, map[string]any{
+		"project":   project.GetString("name"),
+		"policy":    h.gc.Policy(project),
+		"overrides": retentionOverrides(project),
+	})
+}
+
+// API: Pin Image
+//
+// POST /api/v1/images/{image_id}/pin and DELETE to unpin. Pinned images
+// are never deleted by retention.
+func (h *SitePodHandler) apiPinImage(w http.ResponseWriter, r *http.Request, imageID string, pinned bool, user *core.Record) error {
+	image, err := h.app.FindFirstRecordByData("images", "image_id", imageID)
+	if err != nil {
+		return h.jsonError(w, http.StatusNotFound, "image not found")
+	}
+	if _, err := h.requireProjectOwnerByID(image.GetString("project_id"), user); err != nil {
+		if errors.Is(err, errForbidden) {
+			return h.jsonError(w, http.StatusForbidden, "forbidden")
+		}
+		return h.jsonError(w, http.StatusNotFound, "project not found")
+	}
+
+	image.Set("pinned", pinned)
+	if err := h.app.Save(image); err != nil {
+		return h.jsonErrorf(w, http.StatusInternalServerError, "failed to update image", err)
+	}
+
+	return h.jsonResponse(w, http.StatusOK, map[string]any{
+		"image_id": imageID,
+		"pinned":   pinned,
+	})
+}
+
+// retentionOverrides returns a project's retention overrides (0 = default)
+func retentionOverrides(project *core.Record) map[string]int {
+	return map[string]int{
+		"min_versions": project.GetInt("retention_min_versions"),
+		"keep_days":    project.GetInt("retention_keep_days"),
+	}
+}
@@ -0,0 +1,351 @@
+package caddy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/events"
+	"github.com/sitepod/sitepod/internal/webhook"
+	"go.uber.org/zap"
+)
+
+// webhookEvents are the event types a webhook can subscribe to
+var webhookEvents = []string{
+	events.TypeRelease,
+	events.TypeRollback,
+	events.TypePreview,
+	events.TypeDomainAdded,
+	events.TypeDomainUpdated,
+	events.TypeDomainRemoved,
+}
+
+// emitWebhook queues p for the project's webhooks. Failures are logged and
+// never fail the request that caused the event.
+func (h *SitePodHandler) emitWebhook(project *core.Record, p webhook.Payload) {
+	p.Project = project.GetString("name")
+	if err := h.webhooks.Emit(project.Id, p); err != nil {
+		h.logger.Warn("failed to queue webhooks",
+			zap.String("project", p.Project), zap.String("event", p.Event), zap.Error(err))
+	}
+}
+
+// webhookImage describes an images record in webhook payloads
+func webhookImage(image *core.Record) *webhook.Image {
+	return &webhook.Image{
+		ID:          image.GetString("image_id"),
+		ContentHash: image.GetString("content_hash"),
+		GitCommit:   image.GetString("git_commit"),
+		GitBranch:   image.GetString("git_branch"),
+		GitMessage:  image.GetString("git_message"),
+	}
+}
+
+// validateWebhookEvents checks an event filter; "*" and "domain.*" are
+// accepted as wildcards
+func validateWebhookEvents(filter []string) error {
+	for _, f := range filter {
+		if f == "*" || f == "domain.*" {
+			continue
+		}
+		known := false
+		for _, e := range webhookEvents {
+			known = known || f == e
+		}
+		if !known {
+			return errors.New("unknown event " + strconv.Quote(f))
+		}
+	}
+	return nil
+}
+
+// validateWebhookURL accepts absolute http and https URLs
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	return nil
+}
+
+func webhookJSON(hook *core.Record, project string) map[string]any {
+	var filter []string
+	_ = json.Unmarshal([]byte(hook.GetString("events")), &filter)
+	if filter == nil {
+		filter = []string{}
+	}
+	return map[string]any{
+		"id":         hook.Id,
+		"project":    project,
+		"url":        hook.GetString("url"),
+		"events":     filter,
+		"active":     hook.GetBool("active"),
+		"created_at": hook.GetDateTime("created").Time(),
+	}
+}
+
+// requireWebhookOwner loads a webhook and its project if user owns the project
+func (h *SitePodHandler) requireWebhookOwner(id string, user *core.Record) (*core.Record, *core.Record, error) {
+	hook, err := h.app.FindRecordById("webhooks", id)
+	if err != nil {
+		return nil, nil, err
+	}
+	project, err := h.requireProjectOwnerByID(hook.GetString("project_id"), user)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hook, project, nil
+}
+
+// API: List Webhooks
+//
+// GET /api/v1/webhooks?project=
+func (h *SitePodHandler) apiListWebhooks(w http.ResponseWriter, r *http.Request, user *core.Record) error {
+	projectName := r.URL.Query().Get("project")
+	if projectName == "" {
+		return h.jsonError(w, http.StatusBadRequest, "project required")
+	}
+	project, err := h.requireProjectOwnerByName(projectName, user)
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			return h.jsonError(w, http.StatusForbidden, "forbidden")
+		}
+		return h.jsonError(w, http.StatusNotFound, "project not found")
+	}
+
+	hooks, err := h.app.FindRecordsByFilter(
+		"webhooks", "project_id = {:project_id}", "created", 100, 0,
+		map[string]any{"project_id": project.Id},
+	)
+	if err != nil {
+		return h.jsonErrorf(w, http.StatusInternalServerError, "failed to list webhooks", err)
+	}
+
+	result := make([]map[string]any, len(hooks))
+	for i, hook := range hooks {
+		result[i] = webhookJSON(hook, projectName)
+	}
+	return h.jsonResponse(w, http.StatusOK, result)
+}
+
+// API: Create Webhook
+//
+// POST /api/v1/webhooks with {"project", "url", "events", "secret"}. The
+// secret is generated if omitted and only returned in this response.
+func (h *SitePodHandler) apiCreateWebhook(w http.ResponseWriter, r *http.Request, user *core.Record) error {
+	var req struct {
+		Project string   `json:"project"`
+		URL     string   `json:"url"`
+		Events  []string `json:"events"`
+		Secret  string   `json:"secret"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return h.jsonError(w, http.StatusBadRequest, "invalid request")
+	}
+	if err := validateWebhookURL(req.URL); err != nil {
+		return h.jsonError(w, http.StatusBadRequest, err.Error())
+	}
+	if err := validateWebhookEvents(req.Events); err != nil {
+		return h.jsonError(w, http.StatusBadRequest, err.Error())
+	}
+
+	project, err := h.requireProjectOwnerByName(req.Project, user)
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			return h.jsonError(w, http.StatusForbidden, "forbidden")
+		}
+		return h.jsonError(w, http.StatusNotFound, "project not found")
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		b := make([]byte, 32)
+		_, _ = rand.Read(b)
+		secret = hex.EncodeToString(b)
+	}
+
+	collection, err := h.app.FindCollectionByNameOrId("webhooks")
+	if err != nil {
+		return h.jsonError(w, http.StatusInternalServerError, "webhooks collection not found")
+	}
+	hook := core.NewRecord(collection)
+	hook.Set("project_id", project.Id)
+	hook.Set("url", req.URL)
+	hook.Set("secret", secret)
+	hook.Set("events", req.Events)
+	hook.Set("active", true)
+	if err := h.app.Save(hook); err != nil {
+		return h.jsonErrorf(w, http.StatusInternalServerError, "failed to create webhook", err)
+	}
+
+	result := webhookJSON(hook, project.GetString("name"))
+	result["secret"] = secret
+	return h.jsonResponse(w, http.StatusCreated, result)
+}
+
+// API: Update Webhook
+//
+// PATCH /api/v1/webhooks/{id} with any of {"url", "events", "active"}
+func (h *SitePodHandler) apiUpdateWebhook(w http.ResponseWriter, r *http.Request, id string, user *core.Record) error {
+	var req struct {
+		URL    *string   `json:"url"`
+		Events *[]string `json:"events"`
+		Active *bool     `json:"active"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return h.jsonError(w, http.StatusBadRequest, "invalid request")
+	}
+
+	hook, project, err := h.requireWebhookOwner(id, user)
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			return h.jsonError(w, http.StatusForbidden, "forbidden")
+		}
+		return h.jsonError(w, http.StatusNotFound, "webhook not found")
+	}
+
+	if req.URL != nil {
+		if err := validateWebhookURL(*req.URL); err != nil {
+			return h.jsonError(w, http.StatusBadRequest, err.Error())
+		}
+		hook.Set("url", *req.URL)
+	}
+	if req.Events != nil {
+		if err := validateWebhookEvents(*req.Events); err != nil {
+			return h.jsonError(w, http.StatusBadRequest, err.Error())
+		}
+		hook.Set("events", *req.Events)
+	}
+	if req.Active != nil {
+		hook.Set("active", *req.Active)
+	}
+	if err := h.app.Save(hook); err != nil {
+		return h.jsonErrorf(w, http.StatusInternalServerError, "failed to update webhook", err)
+	}
+
+	return h.jsonResponse(w, http.StatusOK, webhookJSON(hook, project.GetString("name")))
+}
+
+// API: Delete Webhook
+//
+// DELETE /api/v1/webhooks/{id} also deletes its delivery log
+func (h *SitePodHandler) apiDeleteWebhook(w http.ResponseWriter, r *http.Request, id string, user *core.Record) error {
+	hook, _, err := h.requireWebhookOwner(id, user)
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			return h.jsonError(w, http.StatusForbidden, "forbidden")
+		}
+		return h.jsonError(w, http.StatusNotFound, "webhook not found")
+	}
+	if err := h.app.Delete(hook); err != nil {
+		return h.jsonErrorf(w, http.StatusInternalServerError, "failed to delete webhook", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// API: List Webhook Deliveries
+//
+// GET /api/v1/webhooks/{id}/deliveries?status=&limit=&page=
+func (h *SitePodHandler) apiListWebhookDeliveries(w http.ResponseWriter, r *http.Request, id string, user *core.Record) error {
+	if _, _, err := h.requireWebhookOwner(id, user); err != nil {
+		if errors.Is(err, errForbidden) {
+			return h.jsonError(w, http.StatusForbidden, "forbidden")
+		}
+		return h.jsonError(w, http.StatusNotFound, "webhook not found")
+	}
+
+	q := r.URL.Query()
+	filter := "webhook_id = {:webhook_id}"
+	params := map[string]any{"webhook_id": id}
+	if status := q.Get("status"); status != "" {
+		filter += " && status = {:status}"
+		params["status"] = status
+	}
+
+	limit := 50
+	if v, err := strconv.Atoi(q.Get("limit")); err == nil && v > 0 {
+		limit = min(v, 500)
+	}
+	page := 1
+	if v, err := strconv.Atoi(q.Get("page")); err == nil && v > 0 {
+		page = v
+	}
+
+	records, err := h.app.FindRecordsByFilter("webhook_deliveries", filter, "-created", limit, (page-1)*limit, params)
+	if err != nil {
+		return h.jsonErrorf(w, http.StatusInternalServerError, "failed to list deliveries", err)
+	}
+
+	items := make([]map[string]any, len(records))
+	for i, rec := range records {
+		item := map[string]any{
+			"id":              rec.Id,
+			"event":           rec.GetString("event"),
+			"status":          rec.GetString("status"),
+			"attempts":        rec.GetInt("attempts"),
+			"response_status": rec.GetInt("response_status"),
+			"error":           rec.GetString("error"),
+			"duration_ms":     rec.GetInt("duration_ms"),
+			"redelivery_of":   rec.GetString("redelivery_of"),
+			"created_at":      rec.GetDateTime("created").Time(),
+			"updated_at":      rec.GetDateTime("updated").Time(),
+			"payload":         json.RawMessage(rec.GetString("payload")),
+		}
+		if rec.GetString("status") == webhook.StatusPending {
+			item["next_attempt"] = rec.GetDateTime("next_attempt").Time()
+		}
+		items[i] = item
+	}
+
+	return h.jsonResponse(w, http.StatusOK, map[string]any{
+		"items": items,
+		"page":  page,
+		"limit": limit,
+	})
+}
+
+// API: Redeliver Webhook
+//
+// POST /api/v1/webhooks/{id}/deliveries/{delivery_id}/redeliver queues the
+// payload of an earlier delivery again, as a new delivery
+func (h *SitePodHandler) apiRedeliverWebhook(w http.ResponseWriter, r *http.Request, id, deliveryID string, user *core.Record) error {
+	if _, _, err := h.requireWebhookOwner(id, user); err != nil {
+		if errors.Is(err, errForbidden) {
+			return h.jsonError(w, http.StatusForbidden, "forbidden")
+		}
+		return h.jsonError(w, http.StatusNotFound, "webhook not found")
+	}
+
+	delivery, err := h.app.FindRecordById("webhook_deliveries", deliveryID)
+	if err != nil || delivery.GetString("webhook_id") != id {
+		return h.jsonError(w, http.StatusNotFound, "delivery not found")
+	}
+
+	queued, err := h.webhooks.Redeliver(delivery)
+	if err != nil {
+		return h.jsonErrorf(w, http.StatusInternalServerError, "failed to queue delivery", err)
+	}
+
+	return h.jsonResponse(w, http.StatusAccepted, map[string]any{
+		"id":            queued.Id,
+		"status":        queued.GetString("status"),
+		"redelivery_of": deliveryID,
+	})
+}
+
+// parseWebhookPath splits /webhooks/{id}[/deliveries[/{delivery_id}/redeliver]]
+func parseWebhookPath(path string) (id, deliveryID string) {
+	parts := strings.Split(strings.TrimPrefix(path, "/webhooks/"), "/")
+	id = parts[0]
+	if len(parts) == 4 {
+		deliveryID = parts[2]
+	}
+	return id, deliveryID
+}
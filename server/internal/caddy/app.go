@@ -0,0 +1,438 @@
+package caddy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/analytics"
+	"github.com/sitepod/sitepod/internal/config"
+	"github.com/sitepod/sitepod/internal/dedup"
+	"github.com/sitepod/sitepod/internal/events"
+	"github.com/sitepod/sitepod/internal/fsck"
+	"github.com/sitepod/sitepod/internal/gc"
+	"github.com/sitepod/sitepod/internal/invalidate"
+	"github.com/sitepod/sitepod/internal/lease"
+	"github.com/sitepod/sitepod/internal/manifest"
+	"github.com/sitepod/sitepod/internal/metrics"
+	"github.com/sitepod/sitepod/internal/purge"
+	"github.com/sitepod/sitepod/internal/storage"
+	"github.com/sitepod/sitepod/internal/tracing"
+	"github.com/sitepod/sitepod/internal/webhook"
+	"go.uber.org/zap"
+)
+
+// appPool holds the long-lived SitePod state, keyed by data directory.
+//
+// On a config reload Caddy provisions the new handler before cleaning up the
+// old one, so the new handler picks up the existing state instead of
+// bootstrapping a second PocketBase instance on the same data dir. The state
+// is destroyed once the last handler referencing it is cleaned up.
+var appPool = caddy.NewUsagePool()
+
+// appState is the state shared by every handler that uses the same data dir
+type appState struct {
+	app             *pocketbase.PocketBase
+	backend         storage.Backend // handlers use their storage view of it
+	storageType     string
+	storageConfig   string
+	purger          purge.Purger
+	purgeConfig     string
+	gcConfig        gc.Config
+	domain          string
+	cache           *refCache
+	routingCache    *routingCache
+	invalidation    *invalidate.Bus
+	peers           *invalidate.Peers // receives peer invalidations, if configured
+	invalidationCfg string
+	manifests       *manifest.Store
+	gc              *gc.GC
+	fsck            *fsck.Checker
+	dedup           *dedup.Index
+	leases          *lease.Manager
+	metrics         *metrics.Metrics
+	accessLog       *accessLogSink
+	analytics       *analytics.Collector
+	analyticsConfig config.AnalyticsConfig
+	tracer          *tracing.Provider
+	tracingConfig   string
+	events          *events.Broker
+	webhooks        *webhook.Dispatcher
+	startTime       time.Time
+
+	// ctx is cancelled when the state is destroyed; background workers
+	// must use it instead of the (per-config) Caddy context.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// Readiness: long-running workers, the last GC cycle and a cached report
+	workersMu sync.Mutex
+	workers   map[string]bool // name -> running
+	lastGC    atomic.Pointer[gc.Stats]
+	lastGCOK  atomic.Pointer[time.Time]
+	health    healthCache
+}
+
+// appKey returns the pool key for a data directory
+func appKey(dataDir string) string {
+	if abs, err := filepath.Abs(dataDir); err == nil {
+		return abs
+	}
+	return filepath.Clean(dataDir)
+}
+
+// goBackground runs fn in a goroutine tracked by the state.
+// fn must return promptly once ctx is cancelled.
+func (s *appState) goBackground(fn func(ctx context.Context)) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		fn(s.ctx)
+	}()
+}
+
+// goWorker runs a long-running worker with goBackground. Readiness fails
+// if a worker returns before the state is destroyed.
+func (s *appState) goWorker(name string, fn func(ctx context.Context)) {
+	s.workersMu.Lock()
+	if s.workers == nil {
+		s.workers = make(map[string]bool)
+	}
+	s.workers[name] = true
+	s.workersMu.Unlock()
+
+	s.goBackground(func(ctx context.Context) {
+		defer func() {
+			s.workersMu.Lock()
+			s.workers[name] = false
+			s.workersMu.Unlock()
+		}()
+		fn(ctx)
+	})
+}
+
+// recordGC keeps the outcome of a GC cycle for readiness
+func (s *appState) recordGC(stats gc.Stats) {
+	s.lastGC.Store(&stats)
+	if stats.Err == nil {
+		finished := stats.Started.Add(stats.Duration)
+		s.lastGCOK.Store(&finished)
+	}
+}
+
+// Destruct stops background workers and shuts down PocketBase.
+// It implements caddy.Destructor and is called by appPool.
+func (s *appState) Destruct() error {
+	s.cancel()
+	s.wg.Wait()
+
+	var err error
+	if s.app != nil {
+		event := new(core.TerminateEvent)
+		event.App = s.app
+		err = s.app.OnTerminate().Trigger(event, func(e *core.TerminateEvent) error {
+			return e.App.ResetBootstrapState()
+		})
+	}
+
+	// Flush remaining spans
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if shutdownErr := s.tracer.Shutdown(ctx); err == nil {
+		err = shutdownErr
+	}
+	return err
+}
+
+// loadAppState returns the shared state for the handler's data dir,
+// creating and bootstrapping it if this is the first handler to use it.
+func (h *SitePodHandler) loadAppState(ctx caddy.Context) (*appState, error) {
+	key := appKey(h.DataDir)
+
+	// Capture before loadStorage consumes StorageRaw
+	if h.StorageRaw == nil {
+		h.StorageRaw = defaultStorageConfig(h.config.Storage)
+	}
+	storageConfig := string(h.StorageRaw)
+	if h.PurgeRaw == nil {
+		h.PurgeRaw = defaultPurgeConfig(h.config.Purge)
+	}
+	purgeConfig := string(h.PurgeRaw)
+
+	val, loaded, err := appPool.LoadOrNew(key, func() (caddy.Destructor, error) {
+		return h.newAppState(ctx, storageConfig, purgeConfig)
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.appKey = key
+
+	state := val.(*appState)
+	if loaded {
+		h.logger.Info("reusing SitePod state from previous config", zap.String("data_dir", key))
+		if state.storageConfig != storageConfig {
+			h.logger.Warn("storage configuration changed; restart SitePod to apply it",
+				zap.String("data_dir", key))
+		}
+		if state.purgeConfig != purgeConfig {
+			h.logger.Warn("purge configuration changed; restart SitePod to apply it",
+				zap.String("data_dir", key))
+		}
+		if state.gcConfig != newGCConfig(h.config.GC) {
+			h.logger.Warn("gc configuration changed; restart SitePod to apply it",
+				zap.String("data_dir", key))
+		}
+		if state.analyticsConfig != h.config.Analytics {
+			h.logger.Warn("analytics configuration changed; restart SitePod to apply it",
+				zap.String("data_dir", key))
+		}
+		if state.invalidationCfg != invalidationConfigKey(h.config.Cache.Invalidation) {
+			h.logger.Warn("cache invalidation configuration changed; restart SitePod to apply it",
+				zap.String("data_dir", key))
+		}
+		if state.tracingConfig != tracingConfigKey(h.Tracing) {
+			h.logger.Warn("tracing configuration changed; restart SitePod to apply it",
+				zap.String("data_dir", key))
+		}
+	}
+
+	return state, nil
+}
+
+// newAppState opens storage, bootstraps PocketBase and starts background workers
+func (h *SitePodHandler) newAppState(ctx caddy.Context, storageConfig, purgeConfig string) (*appState, error) {
+	backend, storageType, err := h.loadStorage(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading storage module: %w", err)
+	}
+	purger, purgeProvider, err := h.loadPurger(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading purge module: %w", err)
+	}
+	if purger != nil {
+		h.logger.Info("CDN purge enabled", zap.String("provider", purgeProvider))
+	}
+
+	// The journal is polled every second; its reads are left out of
+	// storage metrics and traces
+	transport, peers, err := newInvalidationTransport(h.config.Cache.Invalidation, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	startTime := time.Now()
+	m := metrics.New(h.config.Metrics.MaxProjects, startTime)
+
+	var tracer *tracing.Provider
+	if h.Tracing != nil {
+		tracer, err = tracing.New(context.Background(), *h.Tracing)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Known blobs are answered without reaching the backend, so they are
+	// not counted as storage operations
+	cached := storage.WithKnownBlobs(
+		tracer.InstrumentStorage(m.InstrumentStorage(backend, storageType), storageType),
+		h.config.Cache.KnownBlobs, h.config.Cache.KnownBlobsTTL)
+
+	stateCtx, cancel := context.WithCancel(context.Background())
+	state := &appState{
+		backend:         cached,
+		storageType:     storageType,
+		storageConfig:   storageConfig,
+		purger:          purger,
+		purgeConfig:     purgeConfig,
+		gcConfig:        newGCConfig(h.config.GC),
+		analyticsConfig: h.config.Analytics,
+		domain:          h.Domain,
+		cache:           newRefCache(h.config.Cache),
+		routingCache:    newRoutingCache(h.config.Cache),
+		peers:           peers,
+		invalidationCfg: invalidationConfigKey(h.config.Cache.Invalidation),
+		manifests:       manifest.NewStore(cached, h.config.Cache.ManifestFiles),
+		metrics:         m,
+		tracer:          tracer,
+		tracingConfig:   tracingConfigKey(h.Tracing),
+		events:          events.NewBroker(eventsReplay),
+		startTime:       startTime,
+		ctx:             stateCtx,
+		cancel:          cancel,
+	}
+
+	logger := h.logger
+	state.invalidation = invalidate.NewBus(transport, lease.InstanceID(), state.applyInvalidation)
+	state.cache.onStale = func(key string, err error) {
+		logger.Warn("serving expired ref after storage error", zap.String("ref", key), zap.Error(err))
+	}
+
+	// The bootstrap helpers below are handler methods; point the handler
+	// at the new state while they run.
+	h.useState(state)
+	if err := h.bootstrap(); err != nil {
+		h.useState(nil)
+		_ = state.Destruct()
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// bootstrap initializes PocketBase and starts background workers for a new state
+func (h *SitePodHandler) bootstrap() error {
+	// Initialize PocketBase (headless mode - no HTTP server)
+	h.app = pocketbase.NewWithConfig(pocketbase.Config{
+		DefaultDataDir: h.DataDir,
+		DefaultDev:     envBool("SITEPOD_PB_DEV"),
+	})
+
+	// Bootstrap the app (initialize config and logger)
+	if err := h.app.Bootstrap(); err != nil {
+		return err
+	}
+
+	// Record queries made while serving a request as spans
+	if h.tracer != nil {
+		for _, db := range []dbx.Builder{h.app.ConcurrentDB(), h.app.NonconcurrentDB()} {
+			if db, ok := db.(*dbx.DB); ok {
+				h.tracer.InstrumentDB(db)
+			}
+		}
+	}
+
+	// Disable PocketBase internal request logging (we use Caddy's logging)
+	settings := h.app.Settings()
+	settings.Logs.MaxDays = 0
+
+	// Forward PocketBase logs to Caddy's logger (without enabling PB log storage)
+	if err := h.installPocketBaseLogger(); err != nil {
+		h.logger.Warn("failed to install pocketbase logger", zap.Error(err))
+	}
+
+	// Initialize database schema
+	if err := h.initDatabaseSchema(); err != nil {
+		return err
+	}
+
+	// Create default superuser if none exists
+	if err := h.ensureDefaultAdmin(); err != nil {
+		h.logger.Warn("failed to create default admin", zap.Error(err))
+	}
+
+	// Create system user for internal projects
+	if _, err := h.ensureSystemUser(); err != nil {
+		h.logger.Warn("failed to create system user", zap.Error(err))
+	}
+
+	// Create demo user if IS_DEMO is set
+	if err := h.ensureDemoUser(); err != nil {
+		h.logger.Warn("failed to create demo user", zap.Error(err))
+	}
+
+	// Create console admin user if configured
+	if err := h.ensureConsoleAdmin(); err != nil {
+		h.logger.Warn("failed to create console admin user", zap.Error(err))
+	}
+
+	// Start writing opted-in projects' access logs
+	h.accessLog = newAccessLogSink(h.app, h.logger.Named("access"), h.config.Log.AccessRetention)
+	h.goWorker("access_log", h.accessLog.run)
+
+	// Start aggregating traffic analytics
+	if h.analyticsConfig.Enabled {
+		h.analytics = analytics.NewCollector(analytics.NewPocketBaseStore(h.app), analytics.Config{
+			FlushInterval: h.analyticsConfig.FlushInterval,
+			RetentionDays: h.analyticsConfig.RetentionDays,
+			TopN:          h.analyticsConfig.TopN,
+		})
+		h.goWorker("analytics", h.analytics.Run)
+	}
+
+	// Track which blobs each tenant holds, for tenant-scoped dedup
+	h.dedup = dedup.New(h.app, h.storage)
+	h.dedup.BindHooks()
+
+	// Start GC background worker. Instances sharing the storage backend
+	// take turns through the GC lease if it holds lock objects.
+	h.gc = gc.New(h.app, h.storage, h.gcConfig)
+	if locker, ok := storage.As[storage.Locker](h.storage); ok {
+		h.leases = lease.NewManager(locker, h.invalidation.Origin(), lease.DefaultTTL)
+		h.gc.UseLease(h.leases)
+	} else if h.gc.Enabled() {
+		h.logger.Warn("storage backend has no lock objects; GC does not take turns with other instances, enable it on one instance only",
+			zap.String("backend", h.storageType))
+	}
+	h.gc.BindHooks()
+	h.gc.OnRun(h.metrics.ObserveGC)
+	h.gc.OnRun(h.recordGC)
+	h.gc.OnDelete(func(hash string) {
+		if err := h.dedup.Forget(hash); err != nil {
+			h.logger.Warn("failed to forget owners of deleted blob", zap.String("hash", hash), zap.Error(err))
+		}
+	})
+	if h.gc.Enabled() {
+		h.goWorker("gc", h.gc.Start)
+	}
+
+	// Store the inline manifests of earlier versions as manifest objects
+	h.goBackground(func(ctx context.Context) {
+		n, err := h.gc.ConvertManifests(ctx)
+		if n > 0 {
+			h.logger.Info("converted inline manifests", zap.Int("records", n))
+		}
+		if err != nil {
+			h.logger.Warn("failed to convert inline manifests", zap.Error(err))
+		}
+	})
+
+	// Integrity checks run on demand from the admin API
+	h.fsck = fsck.New(h.app, h.storage, h.rebuildRoutingIndex)
+
+	// Drop refs and routing changed by other instances from the caches
+	if h.invalidation.Enabled() {
+		h.logger.Info("cache invalidation enabled", zap.String("transport", h.config.Cache.Invalidation.Transport))
+		h.goWorker("invalidation", h.invalidation.Run)
+	}
+
+	// Start delivering webhooks
+	h.webhooks = webhook.New(h.app)
+	h.goWorker("webhooks", h.webhooks.Run)
+
+	// Push deploy, domain and GC events to /api/v1/events subscribers
+	// and domain changes to webhooks
+	h.registerEventHooks()
+
+	// Print startup banner
+	h.printStartupBanner()
+
+	// Ensure system sites exist (welcome page, console)
+	h.goBackground(func(context.Context) { h.ensureSystemSites() })
+
+	return nil
+}
+
+// invalidationConfigKey returns a comparable form of the invalidation
+// configuration
+func invalidationConfigKey(cfg config.InvalidationConfig) string {
+	b, _ := json.Marshal(cfg)
+	return string(b)
+}
+
+// tracingConfigKey returns a comparable form of the tracing configuration
+func tracingConfigKey(cfg *tracing.Config) string {
+	if cfg == nil {
+		return ""
+	}
+	b, _ := json.Marshal(cfg)
+	return string(b)
+}
@@ -0,0 +1,37 @@
+package caddy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAppStateDestructStopsBackgroundWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	state := &appState{ctx: ctx, cancel: cancel}
+
+	stopped := make(chan struct{})
+	state.goBackground(func(ctx context.Context) {
+		<-ctx.Done()
+		close(stopped)
+	})
+
+	if err := state.Destruct(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("background worker still running after Destruct")
+	}
+}
+
+func TestAppKey(t *testing.T) {
+	if appKey("./data") != appKey("data/") {
+		t.Error("equivalent data dirs should share a pool key")
+	}
+	if appKey("./data") == appKey("./other") {
+		t.Error("different data dirs should not share a pool key")
+	}
+}
@@ -1,64 +1,193 @@
 package caddy
 
 import (
+	"container/list"
 	"sync"
 	"time"
 
+	"github.com/sitepod/sitepod/internal/config"
 	"github.com/sitepod/sitepod/internal/storage"
+	"golang.org/x/sync/singleflight"
 )
 
-// refCache caches ref data for projects
+// refCache caches ref data for projects, keyed by "project:env", in an
+// LRU of up to maxEntries refs (0 for no limit). A ref is fresh for ttl.
+// An expired ref is kept until evicted and served again if reloading it
+// fails with a storage error. Refs that do not exist are cached for
+// negativeTTL, so requests for unknown projects do not each read storage.
+// Concurrent loads of a key share one read.
 type refCache struct {
-	mu    sync.RWMutex
-	items map[string]*cacheItem
-	ttl   time.Duration
+	mu          sync.Mutex
+	items       map[string]*list.Element
+	lru         *list.List // *cacheItem, most recently used first
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	// gen is bumped by Delete, so loads started before it are not cached
+	gen   uint64
+	loads singleflight.Group
+
+	// onStale is called when an expired ref is served because reloading
+	// it failed
+	onStale func(key string, err error)
 }
 
 type cacheItem struct {
-	data      *storage.RefData
+	key  string
+	data *storage.RefData
+	// err is the not-found error of a ref that does not exist
+	err       error
 	expiresAt time.Time
 }
 
-func newRefCache(ttl time.Duration) *refCache {
-	return &refCache{
-		items: make(map[string]*cacheItem),
-		ttl:   ttl,
+func newRefCache(cfg config.CacheConfig) *refCache {
+	c := &refCache{
+		items: make(map[string]*list.Element),
+		lru:   list.New(),
 	}
+	c.configure(cfg)
+	return c
+}
+
+// configure applies the cache settings, evicting refs beyond a lower limit
+func (c *refCache) configure(cfg config.CacheConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = cfg.ManifestTTL
+	c.negativeTTL = cfg.NegativeTTL
+	c.maxEntries = cfg.MaxEntries
+	c.evict()
 }
 
-func (c *refCache) Get(key string) (*storage.RefData, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// Load returns the ref cached under key, or loads and caches it. It
+// reports whether the ref came from the cache; a cached missing ref is
+// returned as its not-found error.
+func (c *refCache) Load(key string, load func() (*storage.RefData, error)) (*storage.RefData, bool, error) {
+	if item, ok := c.fresh(key); ok {
+		return item.data, true, item.err
+	}
+
+	v, err, _ := c.loads.Do(key, func() (any, error) {
+		gen := c.generation()
+		data, err := load()
+		switch {
+		case err == nil:
+			c.set(key, gen, data, nil)
+		case storage.IsNotFound(err):
+			c.set(key, gen, nil, err)
+		default:
+			stale := c.stale(key)
+			if stale == nil {
+				return nil, err
+			}
+			if c.onStale != nil {
+				c.onStale(key, err)
+			}
+			// Retried once the ref is due again
+			c.set(key, gen, stale, nil)
+			return stale, nil
+		}
+		return data, err
+	})
+	data, _ := v.(*storage.RefData)
+	return data, false, err
+}
 
-	item, ok := c.items[key]
-	if !ok || time.Now().After(item.expiresAt) {
+// fresh returns the unexpired item cached under key
+func (c *refCache) fresh(key string) (*cacheItem, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
 		return nil, false
 	}
-	return item.data, true
+	item := el.Value.(*cacheItem)
+	if time.Now().After(item.expiresAt) {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return item, true
+}
+
+// stale returns the ref cached under key, expired or not
+func (c *refCache) stale(key string) *storage.RefData {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		return el.Value.(*cacheItem).data
+	}
+	return nil
+}
+
+func (c *refCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
 }
 
-func (c *refCache) Set(key string, data *storage.RefData) {
+// set caches a ref, or the not-found error of a missing one, under key
+// unless the cache was invalidated since gen
+func (c *refCache) set(key string, gen uint64, data *storage.RefData, notFound error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.gen != gen {
+		return
+	}
+	item := &cacheItem{key: key, data: data, err: notFound, expiresAt: time.Now().Add(c.ttl)}
+	if notFound != nil {
+		item.expiresAt = time.Now().Add(c.negativeTTL)
+	}
+	if el, ok := c.items[key]; ok {
+		el.Value = item
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.lru.PushFront(item)
+	c.evict()
+}
 
-	c.items[key] = &cacheItem{
-		data:      data,
-		expiresAt: time.Now().Add(c.ttl),
+// evict removes the least recently used refs beyond maxEntries
+func (c *refCache) evict() {
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheItem).key)
 	}
 }
 
 func (c *refCache) Delete(key string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	delete(c.items, key)
+	c.gen++
+	if el, ok := c.items[key]; ok {
+		c.lru.Remove(el)
+		delete(c.items, key)
+	}
 }
 
-// routingCache caches domain routing index
+// Clear removes every ref
+func (c *refCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	clear(c.items)
+	c.lru.Init()
+}
+
+// routingCache caches the domain routing index like refCache caches refs:
+// fresh for ttl, kept after that if reloading fails, and cached as missing
+// for negativeTTL if there is none
 type routingCache struct {
-	mu    sync.RWMutex
-	index *RoutingIndex
-	ttl   time.Duration
-	timer time.Time
+	mu          sync.Mutex
+	index       *RoutingIndex
+	loaded      bool
+	ttl         time.Duration
+	negativeTTL time.Duration
+	timer       time.Time
+	// gen is bumped by Invalidate, so loads started before it are not
+	// cached
+	gen   uint64
+	loads singleflight.Group
 }
 
 // RoutingIndex maps domains to projects with slug prefixes
@@ -76,24 +205,64 @@ type RoutingEntry struct {
 	Env       string `json:"env,omitempty"`
 }
 
-func newRoutingCache(ttl time.Duration) *routingCache {
-	return &routingCache{ttl: ttl}
+func newRoutingCache(cfg config.CacheConfig) *routingCache {
+	c := &routingCache{}
+	c.configure(cfg)
+	return c
 }
 
-func (c *routingCache) Get() (*RoutingIndex, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+func (c *routingCache) configure(cfg config.CacheConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = cfg.ManifestTTL
+	c.negativeTTL = cfg.NegativeTTL
+}
 
-	if c.index == nil || time.Now().After(c.timer) {
-		return nil, false
+// Load returns the cached routing index, or loads and caches it, and
+// reports whether it came from the cache. It returns nil if there is no
+// index or it cannot be loaded.
+func (c *routingCache) Load(load func() (*RoutingIndex, error)) (*RoutingIndex, bool) {
+	c.mu.Lock()
+	if c.loaded && !time.Now().After(c.timer) {
+		index := c.index
+		c.mu.Unlock()
+		return index, true
 	}
-	return c.index, true
+	c.mu.Unlock()
+
+	v, _, _ := c.loads.Do("", func() (any, error) {
+		c.mu.Lock()
+		gen := c.gen
+		c.mu.Unlock()
+		index, err := load()
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.gen != gen {
+			return index, err
+		}
+		switch {
+		case err == nil:
+			c.index, c.timer = index, time.Now().Add(c.ttl)
+		case storage.IsNotFound(err):
+			c.index, c.timer = nil, time.Now().Add(c.negativeTTL)
+		case c.index != nil:
+			// Keep the last index, retried once it is due again
+			c.timer = time.Now().Add(c.ttl)
+		default:
+			return nil, err
+		}
+		c.loaded = true
+		return c.index, nil
+	})
+	index, _ := v.(*RoutingIndex)
+	return index, false
 }
 
-func (c *routingCache) Set(index *RoutingIndex) {
+// Invalidate makes the next Load read the index again
+func (c *routingCache) Invalidate() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-
-	c.index = index
-	c.timer = time.Now().Add(c.ttl)
+	c.gen++
+	c.loaded = false
 }
@@ -0,0 +1,205 @@
+package caddy
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sitepod/sitepod/internal/config"
+	"github.com/sitepod/sitepod/internal/invalidate"
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+func testCacheConfig() config.CacheConfig {
+	return config.CacheConfig{ManifestTTL: time.Hour, MaxEntries: 2, NegativeTTL: time.Hour}
+}
+
+func TestRefCacheEviction(t *testing.T) {
+	c := newRefCache(testCacheConfig())
+	loads := 0
+	load := func(key string) {
+		t.Helper()
+		if _, _, err := c.Load(key, func() (*storage.RefData, error) {
+			loads++
+			return &storage.RefData{ImageID: key}, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	load("a:prod")
+	load("b:prod")
+	load("a:prod") // a is now the most recently used
+	load("c:prod") // evicts b
+	if loads != 3 || len(c.items) != 2 {
+		t.Fatalf("%d loads, %d entries", loads, len(c.items))
+	}
+	load("a:prod")
+	load("b:prod")
+	if loads != 4 {
+		t.Errorf("%d loads, want 4", loads)
+	}
+
+	c.configure(config.CacheConfig{ManifestTTL: time.Hour, MaxEntries: 1})
+	if len(c.items) != 1 {
+		t.Errorf("%d entries after lowering the limit", len(c.items))
+	}
+}
+
+func TestRefCacheMissing(t *testing.T) {
+	c := newRefCache(testCacheConfig())
+	loads := 0
+	load := func() (*storage.RefData, error) {
+		loads++
+		return nil, &storage.RefNotFoundError{Project: "nope", Env: "prod"}
+	}
+
+	for range 3 {
+		if _, _, err := c.Load("nope:prod", load); !storage.IsNotFound(err) {
+			t.Fatalf("err = %v", err)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("missing ref loaded %d times", loads)
+	}
+
+	// A release deletes the negative entry
+	c.Delete("nope:prod")
+	ref, hit, err := c.Load("nope:prod", func() (*storage.RefData, error) {
+		return &storage.RefData{ImageID: "img_1"}, nil
+	})
+	if err != nil || hit || ref.ImageID != "img_1" {
+		t.Errorf("after delete: %v, %v, %v", ref, hit, err)
+	}
+}
+
+func TestRefCacheSingleflight(t *testing.T) {
+	c := newRefCache(testCacheConfig())
+	var loads atomic.Int32
+	release := make(chan struct{})
+	load := func() (*storage.RefData, error) {
+		loads.Add(1)
+		<-release
+		return &storage.RefData{ImageID: "img_1"}, nil
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ref, _, err := c.Load("site:prod", load); err != nil || ref.ImageID != "img_1" {
+				t.Errorf("Load = %v, %v", ref, err)
+			}
+		}()
+	}
+	// Let the callers pile up behind the first load
+	for loads.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if loads.Load() != 1 {
+		t.Errorf("%d loads, want 1", loads.Load())
+	}
+}
+
+func TestRefCacheStale(t *testing.T) {
+	c := newRefCache(config.CacheConfig{MaxEntries: 10})
+	var staleErr error
+	c.onStale = func(key string, err error) { staleErr = err }
+
+	if _, _, err := c.Load("site:prod", func() (*storage.RefData, error) {
+		return &storage.RefData{ImageID: "img_1"}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// With a ttl of 0 the ref has expired; storage fails
+	down := errors.New("storage unavailable")
+	ref, _, err := c.Load("site:prod", func() (*storage.RefData, error) { return nil, down })
+	if err != nil || ref.ImageID != "img_1" {
+		t.Fatalf("stale ref: %v, %v", ref, err)
+	}
+	if staleErr != down {
+		t.Errorf("onStale got %v", staleErr)
+	}
+
+	// Without a cached ref the error is returned
+	if _, _, err := c.Load("other:prod", func() (*storage.RefData, error) { return nil, down }); err != down {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestRefCacheDeleteDuringLoad(t *testing.T) {
+	c := newRefCache(testCacheConfig())
+	c.Load("site:prod", func() (*storage.RefData, error) {
+		// A release lands while the old ref is being read
+		c.Delete("site:prod")
+		return &storage.RefData{ImageID: "img_old"}, nil
+	})
+	ref, hit, _ := c.Load("site:prod", func() (*storage.RefData, error) {
+		return &storage.RefData{ImageID: "img_new"}, nil
+	})
+	if hit || ref.ImageID != "img_new" {
+		t.Errorf("got %s (hit %v), want img_new", ref.ImageID, hit)
+	}
+}
+
+func TestRoutingCache(t *testing.T) {
+	c := newRoutingCache(config.CacheConfig{NegativeTTL: time.Hour})
+	loads := 0
+	missing := func() (*RoutingIndex, error) {
+		loads++
+		return nil, storage.ErrRoutingNotFound
+	}
+	for range 3 {
+		if index, _ := c.Load(missing); index != nil {
+			t.Fatal("expected no index")
+		}
+	}
+	if loads != 1 {
+		t.Errorf("missing index loaded %d times", loads)
+	}
+
+	c.Invalidate()
+	index, hit := c.Load(func() (*RoutingIndex, error) {
+		return &RoutingIndex{Entries: []RoutingEntry{{Domain: "example.com"}}}, nil
+	})
+	if hit || index == nil {
+		t.Fatalf("index = %v, hit %v", index, hit)
+	}
+
+	// The index has expired (ttl 0); the last one is kept on errors
+	index, _ = c.Load(func() (*RoutingIndex, error) { return nil, errors.New("storage unavailable") })
+	if index == nil || index.Entries[0].Domain != "example.com" {
+		t.Errorf("stale index = %v", index)
+	}
+}
+
+func TestApplyInvalidation(t *testing.T) {
+	s := &appState{cache: newRefCache(testCacheConfig()), routingCache: newRoutingCache(testCacheConfig())}
+	ref := func(key string) func() (*storage.RefData, error) {
+		return func() (*storage.RefData, error) { return &storage.RefData{ImageID: key}, nil }
+	}
+	s.cache.Load("a:prod", ref("a:prod"))
+	s.cache.Load("b:prod", ref("b:prod"))
+
+	// A release on another instance
+	s.applyInvalidation(invalidate.Message{Origin: "other", Refs: []string{"a:prod"}})
+	if _, hit, _ := s.cache.Load("a:prod", ref("a:prod")); hit {
+		t.Error("a:prod still cached")
+	}
+	if _, hit, _ := s.cache.Load("b:prod", ref("b:prod")); !hit {
+		t.Error("b:prod dropped")
+	}
+
+	s.applyInvalidation(invalidate.Message{All: true})
+	if len(s.cache.items) != 0 {
+		t.Errorf("%d refs left after dropping all", len(s.cache.items))
+	}
+}
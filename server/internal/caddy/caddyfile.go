@@ -3,12 +3,15 @@ package caddy
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/sitepod/sitepod/internal/tracing"
 )
 
 func init() {
@@ -41,6 +44,37 @@ func (h *SitePodHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					return d.ArgErr()
 				}
 				h.Domain = d.Val()
+			case "config":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.ConfigFile = d.Val()
+			case "storage":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				name := d.Val()
+				unm, err := caddyfile.UnmarshalModule(d, "sitepod.storage."+name)
+				if err != nil {
+					return err
+				}
+				h.StorageRaw = caddyconfig.JSONModuleObject(unm, "backend", name, nil)
+			case "purge":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				name := d.Val()
+				unm, err := caddyfile.UnmarshalModule(d, "sitepod.purge."+name)
+				if err != nil {
+					return err
+				}
+				h.PurgeRaw = caddyconfig.JSONModuleObject(unm, "provider", name, nil)
+			case "tracing":
+				cfg, err := parseTracing(d)
+				if err != nil {
+					return err
+				}
+				h.Tracing = cfg
 			default:
 				return d.Errf("unrecognized subdirective: %s", d.Val())
 			}
@@ -49,6 +83,59 @@ func (h *SitePodHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// parseTracing parses a tracing block:
+//
+//	tracing {
+//		endpoint     <host:port>
+//		insecure
+//		sample_ratio <0..1>
+//		service_name <name>
+//		header       <name> <value>
+//	}
+func parseTracing(d *caddyfile.Dispenser) (*tracing.Config, error) {
+	cfg := new(tracing.Config)
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "endpoint":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			cfg.Endpoint = d.Val()
+		case "insecure":
+			cfg.Insecure = true
+		case "sample_ratio":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			ratio, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return nil, d.Errf("invalid sample_ratio: %v", err)
+			}
+			cfg.SampleRatio = &ratio
+		case "service_name":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			cfg.ServiceName = d.Val()
+		case "header":
+			var name, value string
+			if !d.Args(&name, &value) {
+				return nil, d.ArgErr()
+			}
+			if cfg.Headers == nil {
+				cfg.Headers = make(map[string]string)
+			}
+			cfg.Headers[name] = value
+		default:
+			return nil, d.Errf("unrecognized tracing option: %s", d.Val())
+		}
+	}
+	return cfg, nil
+}
+
 // printStartupBanner prints helpful information after server starts
 func (h *SitePodHandler) printStartupBanner() {
 	scheme := "https"
@@ -57,12 +144,6 @@ func (h *SitePodHandler) printStartupBanner() {
 		scheme = "http"
 	}
 
-	// Determine storage type from environment
-	storageType := os.Getenv("SITEPOD_STORAGE_TYPE")
-	if storageType == "" {
-		storageType = "local"
-	}
-
 	baseURL := fmt.Sprintf("%s://%s", scheme, h.Domain)
 
 	fmt.Println()
@@ -71,7 +152,7 @@ func (h *SitePodHandler) printStartupBanner() {
 	fmt.Println("===============================================================")
 	fmt.Println("  Configuration:                                               ")
 	fmt.Printf("    Domain:    %s\n", h.Domain)
-	fmt.Printf("    Storage:   %s\n", storageType)
+	fmt.Printf("    Storage:   %s\n", h.storageType)
 	fmt.Printf("    Data Dir:  %s\n", h.DataDir)
 	fmt.Println("---------------------------------------------------------------")
 	fmt.Println("  Endpoints:                                                   ")
@@ -133,5 +214,6 @@ var (
 	_ caddyhttp.MiddlewareHandler = (*SitePodHandler)(nil)
 	_ caddy.Provisioner           = (*SitePodHandler)(nil)
 	_ caddy.Validator             = (*SitePodHandler)(nil)
+	_ caddy.CleanerUpper          = (*SitePodHandler)(nil)
 	_ caddyfile.Unmarshaler       = (*SitePodHandler)(nil)
 )
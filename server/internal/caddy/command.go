@@ -0,0 +1,275 @@
+package caddy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/pocketbase/pocketbase"
+	"github.com/sitepod/sitepod/internal/fsck"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "config",
+		Short: "Commands for working with the SitePod configuration",
+		CobraFunc: func(cmd *cobra.Command) {
+			validateCmd := &cobra.Command{
+				Use:   "validate [--config <config.toml>] [--caddyfile <path>]",
+				Short: "Validates the configuration and prints the effective values",
+				Long: `
+Loads config.toml, applies SITEPOD_* environment variables and, if
+--caddyfile is given, the options of every sitepod, sitepod_api and
+sitepod_static handler in it. The effective configuration is printed
+as TOML; unknown keys are reported as warnings.
+
+Without --config, $SITEPOD_CONFIG and then ./config.toml are used.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdConfigValidate),
+			}
+			validateCmd.Flags().StringP("config", "c", "", "SitePod config file (config.toml)")
+			validateCmd.Flags().String("caddyfile", "", "Caddyfile whose handler options to apply")
+			cmd.AddCommand(validateCmd)
+		},
+	})
+
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "fsck",
+		Usage: "[--config <config.toml>] [--caddyfile <path>] [--verify] [--quarantine] [--delete-orphans] [--json]",
+		Short: "Checks the integrity of SitePod storage",
+		Long: `
+Checks that images, refs, previews and the routing index only point at
+blobs and projects that exist. With --verify every blob is re-hashed
+with BLAKE3 and compared with its name.
+
+Nothing is changed unless asked: --quarantine moves corrupt blobs to
+quarantine/ (requires --verify), and --delete-orphans deletes refs and
+previews of deleted projects and rebuilds the routing index if it
+points at deleted projects.
+
+The storage and data directory are taken from the configuration as for
+"config validate". The command can run while the server is up. It exits
+with status 1 if anything was found.
+`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.Flags().StringP("config", "c", "", "SitePod config file (config.toml)")
+			cmd.Flags().String("caddyfile", "", "Caddyfile whose handler options to apply")
+			cmd.Flags().Bool("verify", false, "Re-hash every blob")
+			cmd.Flags().Bool("quarantine", false, "Move corrupt blobs to quarantine/")
+			cmd.Flags().Bool("delete-orphans", false, "Delete refs, previews and routes of deleted projects")
+			cmd.Flags().Bool("json", false, "Print the report as JSON")
+			cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdFsck)
+		},
+	})
+}
+
+func cmdConfigValidate(fl caddycmd.Flags) (int, error) {
+	configFile := fl.String("config")
+	caddyfilePath := fl.String("caddyfile")
+
+	handlers := []*SitePodHandler{{}}
+	if caddyfilePath != "" {
+		var err error
+		handlers, err = handlersFromCaddyfile(caddyfilePath)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		if len(handlers) == 0 {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("%s: no sitepod handler found", caddyfilePath)
+		}
+	}
+
+	for i, h := range handlers {
+		if configFile != "" {
+			h.ConfigFile = configFile
+		}
+		cfg, err := h.loadConfig()
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+
+		if i > 0 {
+			fmt.Println()
+		}
+		if len(handlers) > 1 {
+			fmt.Printf("# handler %d\n", i+1)
+		}
+		source := cfg.Source
+		if source == "" {
+			source = "(none)"
+		}
+		fmt.Printf("# config file: %s\n", source)
+		for _, warning := range cfg.Warnings {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+		}
+		if err := toml.NewEncoder(os.Stdout).Encode(cfg.Redacted()); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdFsck(fl caddycmd.Flags) (int, error) {
+	opts := fsck.Options{
+		Verify:        fl.Bool("verify"),
+		Quarantine:    fl.Bool("quarantine"),
+		DeleteOrphans: fl.Bool("delete-orphans"),
+	}
+	if opts.Quarantine && !opts.Verify {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--quarantine requires --verify")
+	}
+
+	h := new(SitePodHandler)
+	if path := fl.String("caddyfile"); path != "" {
+		handlers, err := handlersFromCaddyfile(path)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		if len(handlers) == 0 {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("%s: no sitepod handler found", path)
+		}
+		h = handlers[0]
+	}
+	if configFile := fl.String("config"); configFile != "" {
+		h.ConfigFile = configFile
+	}
+	cfg, err := h.loadConfig()
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if h.StorageRaw == nil {
+		h.StorageRaw = defaultStorageConfig(cfg.Storage)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	caddyCtx, cancelModules := caddy.NewContext(caddy.Context{Context: ctx})
+	defer cancelModules()
+
+	backend, _, err := h.loadStorage(caddyCtx)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("loading storage module: %w", err)
+	}
+	app := pocketbase.NewWithConfig(pocketbase.Config{DefaultDataDir: cfg.DataDir()})
+	if err := app.Bootstrap(); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer app.ResetBootstrapState()
+
+	// rebuildRoutingIndex is a handler method
+	h.useState(&appState{app: app, backend: backend})
+	report, err := fsck.New(app, backend, h.rebuildRoutingIndex).Run(ctx, opts)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	if fl.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+	} else {
+		printFsckReport(report)
+	}
+
+	if !report.OK() {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("%d issues, %d errors", len(report.Issues), len(report.Errors))
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// printFsckReport prints an integrity check report for a terminal
+func printFsckReport(r *fsck.Report) {
+	fmt.Printf("checked %d blobs (%d verified, %d bytes), %d images, %d refs, %d previews, %d routes in %dms\n",
+		r.Blobs, r.VerifiedBlobs, r.VerifiedBytes, r.Images, r.Refs, r.Previews, r.Routes, r.DurationMS)
+	for _, issue := range r.Issues {
+		line := issue.Kind + " " + issue.Object
+		if issue.Detail != "" {
+			line += ": " + issue.Detail
+		}
+		if len(issue.Missing) > 0 {
+			line += fmt.Sprintf(" (%d missing blobs: %s)", len(issue.Missing), strings.Join(issue.Missing, ", "))
+		}
+		switch {
+		case issue.Repair != "":
+			line += " [" + issue.Repair + "]"
+		case issue.RepairError != "":
+			line += " [repair failed: " + issue.RepairError + "]"
+		}
+		fmt.Println(line)
+	}
+	for _, err := range r.Errors {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+	}
+	if r.OK() {
+		fmt.Println("no issues found")
+	}
+}
+
+// handlersFromCaddyfile adapts a Caddyfile and returns the SitePod handler
+// configurations found in it
+func handlersFromCaddyfile(path string) ([]*SitePodHandler, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	adapter := caddyconfig.GetAdapter("caddyfile")
+	if adapter == nil {
+		return nil, fmt.Errorf("caddyfile adapter not available")
+	}
+	adapted, _, err := adapter.Adapt(body, map[string]any{"filename": path})
+	if err != nil {
+		return nil, fmt.Errorf("adapting %s: %w", path, err)
+	}
+
+	var tree any
+	if err := json.Unmarshal(adapted, &tree); err != nil {
+		return nil, err
+	}
+
+	var handlers []*SitePodHandler
+	var walk func(v any) error
+	walk = func(v any) error {
+		switch v := v.(type) {
+		case map[string]any:
+			switch v["handler"] {
+			case "sitepod", "sitepod_api", "sitepod_static":
+				raw, err := json.Marshal(v)
+				if err != nil {
+					return err
+				}
+				h := new(SitePodHandler)
+				if err := json.Unmarshal(raw, h); err != nil {
+					return err
+				}
+				handlers = append(handlers, h)
+			}
+			for _, child := range v {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		case []any:
+			for _, child := range v {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(tree); err != nil {
+		return nil, err
+	}
+	return handlers, nil
+}
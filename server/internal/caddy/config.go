@@ -0,0 +1,98 @@
+package caddy
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sitepod/sitepod/internal/config"
+	"github.com/sitepod/sitepod/internal/gc"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// loadConfig loads config.toml and the environment, then applies the
+// handler's Caddyfile options on top (see package config for the order).
+func (h *SitePodHandler) loadConfig() (*config.Config, error) {
+	cfg, err := config.Load(h.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.applyConfigOverrides(cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+// applyConfigOverrides applies the options set in the Caddyfile to cfg
+func (h *SitePodHandler) applyConfigOverrides(cfg *config.Config) error {
+	if h.Domain != "" {
+		cfg.Domain.Primary = h.Domain
+	}
+	if h.StoragePath != "" {
+		cfg.Storage.Path = h.StoragePath
+	}
+	if h.DataDir != "" {
+		cfg.Database.DataDir = h.DataDir
+	} else if h.StoragePath != "" {
+		// data_dir has always defaulted to storage_path
+		cfg.Database.DataDir = h.StoragePath
+	}
+	if h.CacheTTL != "" {
+		ttl, err := time.ParseDuration(h.CacheTTL)
+		if err != nil {
+			return fmt.Errorf("cache_ttl: %w", err)
+		}
+		cfg.Cache.ManifestTTL = ttl
+	}
+	if h.StorageRaw != nil {
+		var mod struct {
+			Backend  string `json:"backend"`
+			Path     string `json:"path"`
+			Bucket   string `json:"bucket"`
+			Region   string `json:"region"`
+			Endpoint string `json:"endpoint"`
+		}
+		if err := json.Unmarshal(h.StorageRaw, &mod); err != nil {
+			return fmt.Errorf("storage: %w", err)
+		}
+		// Other storage modules are validated by Caddy
+		switch mod.Backend {
+		case "local":
+			cfg.Storage.Type = "local"
+			if mod.Path != "" {
+				cfg.Storage.Path = mod.Path
+			}
+		case "s3":
+			cfg.Storage.Type = "s3"
+			cfg.Storage.S3 = config.S3Config{Bucket: mod.Bucket, Region: mod.Region, Endpoint: mod.Endpoint}
+		}
+	}
+	return nil
+}
+
+// newGCConfig converts the [gc] section to the GC worker configuration
+func newGCConfig(cfg config.GCConfig) gc.Config {
+	return gc.Config{
+		Enabled:     cfg.Enabled,
+		Interval:    cfg.Interval,
+		GracePeriod: cfg.GracePeriod,
+		Retention:   cfg.Retention,
+		MinVersions: cfg.MinVersions,
+		KeepDays:    cfg.KeepDays,
+
+		ReconcileInterval: cfg.ReconcileInterval,
+	}
+}
+
+// levelLogger drops SitePod log messages below the configured log.level
+func levelLogger(logger *zap.Logger, level string) *zap.Logger {
+	lvl, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return logger
+	}
+	return logger.WithOptions(zap.IncreaseLevel(lvl))
+}
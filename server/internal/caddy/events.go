@@ -0,0 +1,228 @@
+package caddy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/events"
+	"github.com/sitepod/sitepod/internal/gc"
+	"github.com/sitepod/sitepod/internal/webhook"
+	"go.uber.org/zap"
+)
+
+const (
+	// eventsReplay is the number of recent events kept for Last-Event-ID
+	eventsReplay = 1000
+	// eventsHeartbeat keeps idle streams open through proxies
+	eventsHeartbeat = 25 * time.Second
+	// eventsRetry is the reconnect delay suggested to clients, in milliseconds
+	eventsRetry = 3000
+)
+
+// registerEventHooks publishes deploy, preview and domain changes from
+// PocketBase record hooks, and GC cycles from the collector
+func (h *SitePodHandler) registerEventHooks() {
+	h.app.OnRecordAfterCreateSuccess("deploy_events").BindFunc(func(e *core.RecordEvent) error {
+		eventType := events.TypeRelease
+		if e.Record.GetString("action") == "rollback" {
+			eventType = events.TypeRollback
+		}
+		h.publishProjectEvent(e.App, eventType, e.Record.GetString("project_id"), map[string]any{
+			"environment":       e.Record.GetString("environment"),
+			"image_id":          publicImageID(e.App, e.Record.GetString("image_id")),
+			"previous_image_id": e.Record.GetString("previous_image_id"),
+		})
+		return e.Next()
+	})
+
+	h.app.OnRecordAfterCreateSuccess("previews").BindFunc(func(e *core.RecordEvent) error {
+		if project, err := e.App.FindFirstRecordByData("projects", "name", e.Record.GetString("project")); err == nil {
+			h.publishProjectEvent(e.App, events.TypePreview, project.Id, map[string]any{
+				"slug":       e.Record.GetString("slug"),
+				"image_id":   publicImageID(e.App, e.Record.GetString("image_id")),
+				"expires_at": e.Record.GetDateTime("expires_at").Time(),
+			})
+		}
+		return e.Next()
+	})
+
+	domainHook := func(eventType string) func(e *core.RecordEvent) error {
+		return func(e *core.RecordEvent) error {
+			domain := &webhook.Domain{
+				Domain: e.Record.GetString("domain"),
+				Slug:   e.Record.GetString("slug"),
+				Type:   e.Record.GetString("type"),
+				Status: e.Record.GetString("status"),
+			}
+			project := h.publishProjectEvent(e.App, eventType, e.Record.GetString("project_id"), map[string]any{
+				"domain": domain.Domain,
+				"slug":   domain.Slug,
+				"type":   domain.Type,
+				"status": domain.Status,
+			})
+			if project != nil {
+				h.emitWebhook(project, webhook.Payload{Event: eventType, Domain: domain})
+			}
+			return e.Next()
+		}
+	}
+	h.app.OnRecordAfterCreateSuccess("domains").BindFunc(domainHook(events.TypeDomainAdded))
+	h.app.OnRecordAfterUpdateSuccess("domains").BindFunc(domainHook(events.TypeDomainUpdated))
+	h.app.OnRecordAfterDeleteSuccess("domains").BindFunc(domainHook(events.TypeDomainRemoved))
+
+	h.gc.OnRun(func(stats gc.Stats) {
+		data := map[string]any{
+			"job_id":        stats.JobID,
+			"mode":          stats.Mode,
+			"duration_ms":   stats.Duration.Milliseconds(),
+			"blobs_deleted": stats.BlobsDeleted,
+			"bytes_freed":   stats.BytesFreed,
+		}
+		if stats.Err != nil {
+			data["error"] = stats.Err.Error()
+		}
+		h.events.Publish(events.Event{Type: events.TypeGC, Data: data})
+	})
+}
+
+// publishProjectEvent publishes an event about the project with the given
+// record id and returns the project, or nil if it no longer exists
+func (h *SitePodHandler) publishProjectEvent(app core.App, eventType, projectID string, data map[string]any) *core.Record {
+	project, err := app.FindRecordById("projects", projectID)
+	if err != nil {
+		// A domain deleted along with its project; nobody can see it anymore
+		h.logger.Debug("event for unknown project", zap.String("type", eventType), zap.String("project_id", projectID))
+		return nil
+	}
+	h.events.Publish(events.Event{
+		Type:      eventType,
+		Project:   project.GetString("name"),
+		ProjectID: project.Id,
+		OwnerID:   project.GetString("owner_id"),
+		Data:      data,
+	})
+	return project
+}
+
+// publicImageID returns the image_id the API reports for an images record id
+func publicImageID(app core.App, recordID string) string {
+	image, err := app.FindRecordById("images", recordID)
+	if err != nil {
+		return ""
+	}
+	return image.GetString("image_id")
+}
+
+// userCanSeeEvent applies userOwnsProject to an event. Events without a
+// project are only sent to admins.
+func (h *SitePodHandler) userCanSeeEvent(user *core.Record, e events.Event) bool {
+	if user.GetBool("is_admin") {
+		return true
+	}
+	if e.ProjectID == "" {
+		return false
+	}
+	if e.OwnerID == "" {
+		return h.isSystemUser(user)
+	}
+	return e.OwnerID == user.Id
+}
+
+// API: Events
+//
+// GET /api/v1/events?project=&token= streams events as Server-Sent Events.
+// Browsers' EventSource cannot set headers, so the auth token may also be
+// passed as ?token=. Reconnecting clients send Last-Event-ID (or
+// ?last_event_id=) to receive the events they missed; if those are no
+// longer available, a "reset" event tells them to reload their state.
+func (h *SitePodHandler) apiEvents(w http.ResponseWriter, r *http.Request) error {
+	if token := r.URL.Query().Get("token"); token != "" && r.Header.Get("Authorization") == "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	user, err := h.authenticate(r)
+	if err != nil {
+		return h.jsonError(w, http.StatusUnauthorized, "authentication required")
+	}
+
+	filterProject := r.URL.Query().Get("project")
+	if filterProject != "" {
+		if _, err := h.requireProjectOwnerByName(filterProject, user); err != nil {
+			if errors.Is(err, errForbidden) {
+				return h.jsonError(w, http.StatusForbidden, "forbidden")
+			}
+			return h.jsonError(w, http.StatusNotFound, "project not found")
+		}
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+
+	// The stream outlives any server write timeout
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	sub, replay, resumed := h.events.Subscribe(lastID)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventsRetry)
+	if !resumed {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+
+	send := func(e events.Event) error {
+		if !h.userCanSeeEvent(user, e) || (filterProject != "" && e.Project != filterProject) {
+			return nil
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		return err
+	}
+
+	for _, e := range replay {
+		if err := send(e); err != nil {
+			return nil
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return nil
+	}
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-h.ctx.Done():
+			return nil
+		case e, ok := <-sub.Events():
+			if !ok {
+				return nil // fell behind; the client reconnects with Last-Event-ID
+			}
+			if err := send(e); err != nil {
+				return nil
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return nil
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return nil
+		}
+	}
+}
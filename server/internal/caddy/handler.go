@@ -1,19 +1,21 @@
 package caddy
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
-	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/core"
-	"github.com/sitepod/sitepod/internal/gc"
+	"github.com/sitepod/sitepod/internal/analytics"
+	"github.com/sitepod/sitepod/internal/config"
 	"github.com/sitepod/sitepod/internal/storage"
+	"github.com/sitepod/sitepod/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 
 	// Import migrations to register them
@@ -55,15 +57,30 @@ type SitePodHandler struct {
 	Domain      string `json:"domain,omitempty"`
 	CacheTTL    string `json:"cache_ttl,omitempty"`
 
+	// ConfigFile is the config.toml to load. Defaults to $SITEPOD_CONFIG,
+	// then ./config.toml if it exists. Options set here override it.
+	ConfigFile string `json:"config_file,omitempty"`
+
+	// StorageRaw configures the storage backend module (sitepod.storage.*).
+	// When omitted, the backend is selected from [storage] in the config.
+	StorageRaw json.RawMessage `json:"storage,omitempty" caddy:"namespace=sitepod.storage inline_key=backend"`
+
+	// PurgeRaw configures the CDN purge module (sitepod.purge.*).
+	// When omitted, the provider is selected from [purge] in the config.
+	PurgeRaw json.RawMessage `json:"purge,omitempty" caddy:"namespace=sitepod.purge inline_key=provider"`
+
+	// Tracing enables OpenTelemetry spans exported over OTLP/gRPC
+	Tracing *tracing.Config `json:"tracing,omitempty"`
+
 	// Runtime
-	storage      storage.Backend
-	app          *pocketbase.PocketBase
-	cache        *refCache
-	routingCache *routingCache
-	cacheTTL     time.Duration
-	gc           *gc.GC
-	logger       *zap.Logger
-	startTime    time.Time
+	*appState // shared across config reloads, see appPool
+	// storage is the shared backend, or a view of it tied to the request
+	// being served (see withContext)
+	storage storage.Backend
+	appKey  string
+	config  *config.Config
+	quota   QuotaConfig
+	logger  *zap.Logger
 }
 
 // CaddyModule returns the Caddy module information
@@ -76,169 +93,239 @@ func (SitePodHandler) CaddyModule() caddy.ModuleInfo {
 
 // Provision sets up the handler
 func (h *SitePodHandler) Provision(ctx caddy.Context) error {
-	h.logger = ctx.Logger(h)
-	h.startTime = time.Now()
-
-	// Defaults
-	if h.StoragePath == "" {
-		h.StoragePath = "./data"
-	}
-	if h.DataDir == "" {
-		h.DataDir = h.StoragePath
-	}
-	if h.Domain == "" {
-		h.Domain = "localhost"
-	}
-	if h.CacheTTL == "" {
-		h.CacheTTL = "5s"
-	}
+	return h.provision(ctx, ctx.Logger(h))
+}
 
-	// Parse cache TTL
-	ttl, err := time.ParseDuration(h.CacheTTL)
+// provision loads the configuration and attaches the handler to the shared
+// app state. It is shared by the sitepod, sitepod_api and sitepod_static modules.
+func (h *SitePodHandler) provision(ctx caddy.Context, logger *zap.Logger) error {
+	cfg, err := h.loadConfig()
 	if err != nil {
-		ttl = 5 * time.Second
-	}
-	h.cacheTTL = ttl
-
-	// Initialize storage
-	storageType := os.Getenv("SITEPOD_STORAGE_TYPE")
-	if storageType == "" {
-		storageType = "local"
-	}
-
-	switch storageType {
-	case "s3", "oss", "r2":
-		backend, err := storage.NewS3Backend(
-			os.Getenv("SITEPOD_S3_BUCKET"),
-			os.Getenv("SITEPOD_S3_REGION"),
-			os.Getenv("SITEPOD_S3_ENDPOINT"),
-		)
-		if err != nil {
-			return err
-		}
-		h.storage = backend
-	default:
-		backend, err := storage.NewLocalBackend(h.StoragePath)
-		if err != nil {
-			return err
-		}
-		h.storage = backend
-	}
-
-	// Initialize PocketBase (headless mode - no HTTP server)
-	h.app = pocketbase.NewWithConfig(pocketbase.Config{
-		DefaultDataDir: h.DataDir,
-		DefaultDev:     envBool("SITEPOD_PB_DEV"),
-	})
-
-	// Bootstrap the app (initialize config and logger)
-	if err := h.app.Bootstrap(); err != nil {
 		return err
 	}
-
-	// Disable PocketBase internal request logging (we use Caddy's logging)
-	settings := h.app.Settings()
-	settings.Logs.MaxDays = 0
-
-	// Forward PocketBase logs to Caddy's logger (without enabling PB log storage)
-	if err := h.installPocketBaseLogger(); err != nil {
-		h.logger.Warn("failed to install pocketbase logger", zap.Error(err))
+	h.config = cfg
+	h.logger = levelLogger(logger, cfg.Log.Level)
+	for _, warning := range cfg.Warnings {
+		h.logger.Warn("config warning", zap.String("detail", warning))
 	}
 
-	// Initialize database schema
-	if err := h.initDatabaseSchema(); err != nil {
+	h.StoragePath = cfg.Storage.Path
+	h.DataDir = cfg.DataDir()
+	h.Domain = cfg.Domain.Primary
+	h.quota = newQuotaConfig(cfg.Quota)
+
+	// Load (or create) the shared app state
+	state, err := h.loadAppState(ctx)
+	if err != nil {
 		return err
 	}
+	h.useState(state)
+	h.cache.configure(cfg.Cache)
+	h.routingCache.configure(cfg.Cache)
 
-	// Create default superuser if none exists
-	if err := h.ensureDefaultAdmin(); err != nil {
-		h.logger.Warn("failed to create default admin", zap.Error(err))
-	}
+	return nil
+}
 
-	// Create system user for internal projects
-	if _, err := h.ensureSystemUser(); err != nil {
-		h.logger.Warn("failed to create system user", zap.Error(err))
+// useState points the handler at the shared state
+func (h *SitePodHandler) useState(state *appState) {
+	h.appState = state
+	h.storage = nil
+	if state != nil {
+		h.storage = state.backend
 	}
+}
 
-	// Create demo user if IS_DEMO is set
-	if err := h.ensureDemoUser(); err != nil {
-		h.logger.Warn("failed to create demo user", zap.Error(err))
+// withContext returns a copy of the handler whose storage calls belong to
+// ctx, so they are traced as children of the request span. Without
+// tracing it returns h.
+func (h *SitePodHandler) withContext(ctx context.Context) *SitePodHandler {
+	if h.tracer == nil {
+		return h
 	}
+	rh := *h
+	rh.storage = storage.WithContext(h.backend, ctx)
+	return &rh
+}
 
-	// Create console admin user if configured
-	if err := h.ensureConsoleAdmin(); err != nil {
-		h.logger.Warn("failed to create console admin user", zap.Error(err))
+// Cleanup releases the handler's reference to the shared app state.
+// The state (PocketBase, GC, background workers) is shut down when the
+// last handler using it is cleaned up.
+func (h *SitePodHandler) Cleanup() error {
+	if h.appKey == "" {
+		return nil
 	}
-
-	// Initialize caches
-	h.cache = newRefCache(h.cacheTTL)
-	h.routingCache = newRoutingCache(h.cacheTTL)
-
-	// Start GC background worker
-	h.gc = gc.New(h.app, h.storage, gc.DefaultConfig())
-	go h.gc.Start(ctx.Context)
-
-	// Print startup banner
-	h.printStartupBanner()
-
-	// Ensure system sites exist (welcome page, console)
-	go h.ensureSystemSites()
-
-	return nil
+	_, err := appPool.Delete(h.appKey)
+	return err
 }
 
 // Validate validates the handler configuration
 func (h *SitePodHandler) Validate() error {
+	if h.Tracing != nil {
+		return h.Tracing.Validate()
+	}
 	return nil
 }
 
 // ServeHTTP handles all HTTP requests
 func (h *SitePodHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	start := time.Now()
-	path := r.URL.Path
-
 	// API routes
-	if strings.HasPrefix(path, "/api/v1/") {
-		h.logger.Info("[SITEPOD] API request", zap.String("method", r.Method), zap.String("path", path))
-		return h.handleAPI(w, r)
+	if isAPIPath(r.URL.Path) {
+		return h.serveAPI(w, r)
 	}
 
 	// PocketBase admin UI routes - in embedded mode, these are typically not exposed
 	// The PocketBase admin UI can be accessed separately if needed
-	if strings.HasPrefix(path, "/_/") || strings.HasPrefix(path, "/api/") {
+	if isPocketBasePath(r.URL.Path) {
 		// Return 404 for PocketBase internal routes in embedded mode
 		// Our API is served via /api/v1/ prefix
 		return caddyhttp.Error(http.StatusNotFound, nil)
 	}
 
-	// Static file serving with logging
-	err := h.handleStatic(w, r)
-	duration := time.Since(start)
+	return h.serveStaticLogged(w, r)
+}
 
-	// Log static requests
-	// - Always log errors and slow requests (>10ms) at DEBUG level
-	// - Log all requests at INFO level if SITEPOD_ACCESS_LOG=1
-	accessLog := os.Getenv("SITEPOD_ACCESS_LOG") == "1"
-	status := 200
-	if err != nil {
-		status = 404
+// isAPIPath reports whether path belongs to the SitePod API
+func isAPIPath(path string) bool {
+	return strings.HasPrefix(path, "/api/v1/")
+}
+
+// isPocketBasePath reports whether path belongs to PocketBase's own routes,
+// which are not exposed in embedded mode
+func isPocketBasePath(path string) bool {
+	return strings.HasPrefix(path, "/_/") || strings.HasPrefix(path, "/api/")
+}
+
+// serveAPI handles a request under /api/v1/
+func (h *SitePodHandler) serveAPI(w http.ResponseWriter, r *http.Request) error {
+	reqID := requestID(w, r)
+	h.logger.Info("[SITEPOD] API request",
+		zap.String("method", r.Method),
+		zap.String("path", r.URL.Path),
+		zap.String("request_id", reqID),
+	)
+
+	r, span := h.tracer.StartRequest(r, r.Method+" /api/v1"+apiRoute(r.URL.Path),
+		attribute.String("sitepod.request_id", reqID))
+	h = h.withContext(r.Context())
+
+	start := time.Now()
+	rec := newResponseRecorder(w)
+	err := h.handleAPI(rec, r)
+	status := rec.statusFor(err)
+
+	if op := deployOperation(r); op != "" {
+		h.metrics.ObserveDeploy(op, err == nil && status < 400, time.Since(start))
 	}
+	h.tracer.EndRequest(span, status, err)
+	return err
+}
 
-	if accessLog {
-		h.logger.Info("static",
-			zap.String("host", r.Host),
-			zap.String("path", path),
-			zap.Int("status", status),
-			zap.Duration("duration", duration),
-		)
-	} else if duration > 10*time.Millisecond || err != nil {
-		h.logger.Debug("static",
-			zap.String("host", r.Host),
-			zap.String("path", path),
-			zap.Int("status", status),
-			zap.Duration("duration", duration),
-		)
+// apiRoute returns the route template of an API path for span names,
+// e.g. /projects/{name} for /api/v1/projects/blog
+func apiRoute(path string) string {
+	path = strings.TrimPrefix(path, "/api/v1")
+	switch {
+	case strings.HasPrefix(path, "/projects/") && strings.HasSuffix(path, "/logs"):
+		return "/projects/{name}/logs"
+	case strings.HasPrefix(path, "/projects/") && strings.HasSuffix(path, "/analytics"):
+		return "/projects/{name}/analytics"
+	case strings.HasPrefix(path, "/projects/"):
+		return "/projects/{name}"
+	case strings.HasPrefix(path, "/webhooks/") && strings.HasSuffix(path, "/redeliver"):
+		return "/webhooks/{id}/deliveries/{delivery_id}/redeliver"
+	case strings.HasPrefix(path, "/webhooks/") && strings.HasSuffix(path, "/deliveries"):
+		return "/webhooks/{id}/deliveries"
+	case strings.HasPrefix(path, "/webhooks/"):
+		return "/webhooks/{id}"
+	case strings.HasPrefix(path, "/upload/"):
+		return "/upload/{plan_id}/{hash}"
+	case path == "/domains/check" || path == "/domains/rename":
+		return path
+	case strings.HasPrefix(path, "/domains/") && strings.HasSuffix(path, "/verify"):
+		return "/domains/{domain}/verify"
+	case strings.HasPrefix(path, "/domains/"):
+		return "/domains/{domain}"
+	}
+	return path
+}
+
+// deployOperation returns the deploy operation name of an API request for
+// metrics, or "" if it is not part of the deploy flow
+func deployOperation(r *http.Request) string {
+	if r.Method != http.MethodPost {
+		return ""
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1")
+	switch {
+	case path == "/plan":
+		return "plan"
+	case strings.HasPrefix(path, "/upload/"):
+		return "upload"
+	case path == "/commit":
+		return "commit"
+	case path == "/release":
+		return "release"
+	case path == "/rollback":
+		return "rollback"
+	case path == "/preview":
+		return "preview"
+	}
+	return ""
+}
+
+// serveStaticLogged serves a deployed site, logs the request and records metrics
+func (h *SitePodHandler) serveStaticLogged(w http.ResponseWriter, r *http.Request) error {
+	start := time.Now()
+	path := r.URL.Path
+	reqID := requestID(w, r)
+
+	rec := newResponseRecorder(w)
+	r, info := withRequestInfo(r)
+	r, span := h.tracer.StartRequest(r, "sitepod.static", attribute.String("sitepod.request_id", reqID))
+
+	err := h.withContext(r.Context()).handleStatic(rec, r)
+	duration := time.Since(start)
+	status := rec.statusFor(err)
+
+	// Unknown subdomains would otherwise use up the project labels
+	metricsProject := ""
+	if info.projectFound {
+		metricsProject = info.project
 	}
+	h.metrics.ObserveRequest(metricsProject, info.env, status, rec.bytes, duration)
+	h.tracer.EndRequest(span, status, err,
+		attribute.String("sitepod.project", info.project),
+		attribute.String("sitepod.env", info.env),
+		attribute.String("sitepod.image_id", info.imageID),
+	)
+	h.logAccess(&accessLogEntry{
+		RequestID: reqID,
+		Project:   info.project,
+		Env:       info.env,
+		Method:    r.Method,
+		Host:      r.Host,
+		Path:      path,
+		Status:    status,
+		Bytes:     rec.bytes,
+		Duration:  duration,
+		ImageID:   info.imageID,
+		CacheHit:  info.cacheHit,
+		RemoteIP:  remoteIP(r),
+		UserAgent: r.UserAgent(),
+		Referer:   r.Referer(),
+	}, err)
+	h.analytics.Record(analytics.Hit{
+		Time:      start,
+		Project:   info.project,
+		Env:       info.env,
+		Host:      r.Host,
+		Path:      path,
+		Status:    status,
+		Bytes:     rec.bytes,
+		RemoteIP:  remoteIP(r),
+		UserAgent: r.UserAgent(),
+		Referer:   r.Referer(),
+	})
 
 	return err
 }
@@ -252,6 +339,10 @@ func (h *SitePodHandler) handleAPI(w http.ResponseWriter, r *http.Request) error
 	// Health & Metrics & Config
 	case path == "/health" && r.Method == "GET":
 		return h.apiHealth(w, r)
+	case path == "/health/live" && r.Method == "GET":
+		return h.apiHealthLive(w, r)
+	case path == "/health/ready" && r.Method == "GET":
+		return h.apiHealthReady(w, r)
 	case path == "/config" && r.Method == "GET":
 		return h.apiConfig(w, r)
 	case path == "/metrics" && r.Method == "GET":
@@ -260,8 +351,27 @@ func (h *SitePodHandler) handleAPI(w http.ResponseWriter, r *http.Request) error
 	// Cleanup & GC (should be protected by firewall in production)
 	case path == "/cleanup" && r.Method == "POST":
 		return h.apiCleanup(w, r)
-	case path == "/gc" && r.Method == "POST":
-		return h.apiGarbageCollect(w, r)
+	case (path == "/gc" || path == "/admin/gc") && r.Method == "POST":
+		return h.apiStartGC(w, r)
+	case path == "/gc" && r.Method == "GET":
+		return h.apiGCProgress(w, r)
+	case path == "/admin/gc/plan" && r.Method == "GET":
+		return h.apiGCPlan(w, r)
+	case path == "/admin/gc/runs" && r.Method == "GET":
+		return h.apiListGCRuns(w, r)
+	case strings.HasPrefix(path, "/admin/gc/jobs/") && r.Method == "GET":
+		return h.apiGetGCJob(w, r, gcJobID(path))
+	case path == "/admin/fsck" && r.Method == "POST":
+		return h.apiFsck(w, r)
+
+	// Cache invalidations from peer instances (authenticated by the
+	// shared invalidation secret)
+	case path == "/internal/invalidate" && r.Method == "POST":
+		if h.peers == nil {
+			return h.jsonError(w, http.StatusNotFound, "endpoint not found")
+		}
+		h.peers.ServeHTTP(w, r)
+		return nil
 
 	// Auth - register or login (creates account if not exists)
 	case path == "/auth/login" && r.Method == "POST":
@@ -275,6 +385,10 @@ func (h *SitePodHandler) handleAPI(w http.ResponseWriter, r *http.Request) error
 	case path == "/auth/info" && r.Method == "GET":
 		return h.apiAuthInfo(w, r)
 
+	// Event stream (authenticates itself; EventSource cannot set headers)
+	case path == "/events" && r.Method == "GET":
+		return h.apiEvents(w, r)
+
 	// Projects - supports both admin and user tokens
 	case path == "/projects" && r.Method == "GET":
 		return h.apiListProjectsAny(w, r)
@@ -291,6 +405,27 @@ func (h *SitePodHandler) handleAPI(w http.ResponseWriter, r *http.Request) error
 	case path == "/account" && r.Method == "DELETE":
 		return h.apiDeleteAccount(w, r, user)
 
+	// Project analytics
+	case strings.HasPrefix(path, "/projects/") && strings.HasSuffix(path, "/analytics") && r.Method == "GET":
+		projectName := strings.TrimSuffix(strings.TrimPrefix(path, "/projects/"), "/analytics")
+		return h.apiGetAnalytics(w, r, projectName, user)
+
+	// Project access logs
+	case strings.HasPrefix(path, "/projects/") && strings.HasSuffix(path, "/logs") && r.Method == "GET":
+		projectName := strings.TrimSuffix(strings.TrimPrefix(path, "/projects/"), "/logs")
+		return h.apiGetAccessLogs(w, r, projectName, user)
+	case strings.HasPrefix(path, "/projects/") && strings.HasSuffix(path, "/logs") && r.Method == "PUT":
+		projectName := strings.TrimSuffix(strings.TrimPrefix(path, "/projects/"), "/logs")
+		return h.apiSetAccessLog(w, r, projectName, user)
+
+	// Project image retention
+	case strings.HasPrefix(path, "/projects/") && strings.HasSuffix(path, "/retention") && r.Method == "GET":
+		projectName := strings.TrimSuffix(strings.TrimPrefix(path, "/projects/"), "/retention")
+		return h.apiGetRetention(w, r, projectName, user)
+	case strings.HasPrefix(path, "/projects/") && strings.HasSuffix(path, "/retention") && r.Method == "PUT":
+		projectName := strings.TrimSuffix(strings.TrimPrefix(path, "/projects/"), "/retention")
+		return h.apiSetRetention(w, r, projectName, user)
+
 	// Projects (single project - user only for now)
 	case strings.HasPrefix(path, "/projects/") && r.Method == "GET":
 		projectName := strings.TrimPrefix(path, "/projects/")
@@ -328,6 +463,9 @@ func (h *SitePodHandler) handleAPI(w http.ResponseWriter, r *http.Request) error
 		return h.apiGetHistory(w, r, user)
 	case path == "/images" && r.Method == "GET":
 		return h.apiListImages(w, r, user)
+	case strings.HasPrefix(path, "/images/") && strings.HasSuffix(path, "/pin") && (r.Method == "POST" || r.Method == "DELETE"):
+		imageID := strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/pin")
+		return h.apiPinImage(w, r, imageID, r.Method == "POST", user)
 
 	// Domain management
 	case path == "/domains" && r.Method == "POST":
@@ -343,6 +481,24 @@ func (h *SitePodHandler) handleAPI(w http.ResponseWriter, r *http.Request) error
 	case path == "/domains/rename" && r.Method == "PUT":
 		return h.apiRenameDomain(w, r, user)
 
+	// Webhooks
+	case path == "/webhooks" && r.Method == "GET":
+		return h.apiListWebhooks(w, r, user)
+	case path == "/webhooks" && r.Method == "POST":
+		return h.apiCreateWebhook(w, r, user)
+	case strings.HasPrefix(path, "/webhooks/") && strings.HasSuffix(path, "/redeliver") && r.Method == "POST":
+		id, deliveryID := parseWebhookPath(path)
+		return h.apiRedeliverWebhook(w, r, id, deliveryID, user)
+	case strings.HasPrefix(path, "/webhooks/") && strings.HasSuffix(path, "/deliveries") && r.Method == "GET":
+		id, _ := parseWebhookPath(path)
+		return h.apiListWebhookDeliveries(w, r, id, user)
+	case strings.HasPrefix(path, "/webhooks/") && r.Method == "PATCH":
+		id, _ := parseWebhookPath(path)
+		return h.apiUpdateWebhook(w, r, id, user)
+	case strings.HasPrefix(path, "/webhooks/") && r.Method == "DELETE":
+		id, _ := parseWebhookPath(path)
+		return h.apiDeleteWebhook(w, r, id, user)
+
 	// Admin routes
 	case path == "/admin/cache/invalidate" && r.Method == "POST":
 		return h.apiInvalidateCache(w, r)
@@ -0,0 +1,308 @@
+package caddy
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/gc"
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+const (
+	// healthCacheTTL is how long a readiness report is reused, so frequent
+	// probes from several sources cost one round of checks
+	healthCacheTTL = 5 * time.Second
+	// healthPingTimeout bounds the storage ping
+	healthPingTimeout = 3 * time.Second
+)
+
+// healthCheck is the result of one readiness check
+type healthCheck struct {
+	Status string         `json:"status"`
+	Error  string         `json:"error,omitempty"`
+	Info   map[string]any `json:"info,omitempty"`
+	// critical checks make the instance not ready when they fail
+	critical bool
+}
+
+func (c healthCheck) ok() bool {
+	return c.Status == "ok" || c.Status == "disabled" || c.Status == "pending" || c.Status == "standby"
+}
+
+// healthReport is the response of the readiness endpoint
+type healthReport struct {
+	Status    string                 `json:"status"` // ready, degraded or not_ready
+	Checks    map[string]healthCheck `json:"checks"`
+	CheckedAt time.Time              `json:"checked_at"`
+	Uptime    string                 `json:"uptime"`
+}
+
+func (r *healthReport) ready() bool {
+	return r.Status != "not_ready"
+}
+
+// healthCache holds the last readiness report. Its mutex is held while
+// checks run, so concurrent probes wait for one round instead of each
+// running their own.
+type healthCache struct {
+	mu     sync.Mutex
+	report *healthReport
+}
+
+// API: Liveness
+//
+// GET /api/v1/health/live reports whether the process is serving requests.
+// It checks no dependencies.
+func (h *SitePodHandler) apiHealthLive(w http.ResponseWriter, r *http.Request) error {
+	if h.ctx.Err() != nil {
+		return h.jsonResponse(w, http.StatusServiceUnavailable, map[string]any{"status": "stopping"})
+	}
+	return h.jsonResponse(w, http.StatusOK, map[string]any{
+		"status": "alive",
+		"uptime": time.Since(h.startTime).Round(time.Second).String(),
+	})
+}
+
+// API: Readiness
+//
+// GET /api/v1/health/ready returns 503 if the database, migrations, storage
+// or a background worker is not ready. A failing or stale GC is reported
+// as degraded but keeps the instance ready.
+func (h *SitePodHandler) apiHealthReady(w http.ResponseWriter, r *http.Request) error {
+	report := h.readiness(r.Context())
+	status := http.StatusOK
+	if !report.ready() {
+		status = http.StatusServiceUnavailable
+	}
+	return h.jsonResponse(w, status, report)
+}
+
+// API: Health
+//
+// GET /api/v1/health is the original summary endpoint. It is served from
+// the cached readiness report and always returns 200.
+func (h *SitePodHandler) apiHealth(w http.ResponseWriter, r *http.Request) error {
+	report := h.readiness(r.Context())
+
+	status := "healthy"
+	if report.Status != "ready" {
+		status = "degraded"
+	}
+	return h.jsonResponse(w, http.StatusOK, map[string]any{
+		"status":   status,
+		"database": report.Checks["database"].Status,
+		"storage":  report.Checks["storage"].Status,
+		"uptime":   time.Since(h.startTime).String(),
+		"checks":   report.Checks,
+	})
+}
+
+// readiness returns the cached readiness report, running the checks if it
+// is older than healthCacheTTL
+func (h *SitePodHandler) readiness(ctx context.Context) *healthReport {
+	h.health.mu.Lock()
+	defer h.health.mu.Unlock()
+
+	if r := h.health.report; r != nil && time.Since(r.CheckedAt) < healthCacheTTL {
+		return r
+	}
+
+	checks := map[string]healthCheck{
+		"database":   h.checkDatabase(),
+		"migrations": h.checkMigrations(),
+		"storage":    h.checkStorage(ctx),
+		"workers":    h.checkWorkers(),
+		"gc":         h.checkGC(),
+		"leases":     h.checkLeases(),
+	}
+
+	report := &healthReport{
+		Status:    "ready",
+		Checks:    checks,
+		CheckedAt: time.Now(),
+		Uptime:    time.Since(h.startTime).Round(time.Second).String(),
+	}
+	for _, c := range checks {
+		if c.ok() {
+			continue
+		}
+		if c.critical {
+			report.Status = "not_ready"
+			break
+		}
+		report.Status = "degraded"
+	}
+
+	h.health.report = report
+	return report
+}
+
+func (h *SitePodHandler) checkDatabase() healthCheck {
+	c := healthCheck{Status: "ok", critical: true}
+	var one int
+	if err := h.app.DB().NewQuery("SELECT 1").Row(&one); err != nil {
+		c.Status, c.Error = "error", err.Error()
+	}
+	return c
+}
+
+// checkMigrations reports registered migrations that have not been applied
+func (h *SitePodHandler) checkMigrations() healthCheck {
+	c := healthCheck{Status: "ok", critical: true}
+
+	var applied []string
+	err := h.app.DB().Select("file").From(core.DefaultMigrationsTable).Column(&applied)
+	if err != nil {
+		c.Status, c.Error = "error", err.Error()
+		return c
+	}
+	done := make(map[string]bool, len(applied))
+	for _, file := range applied {
+		done[file] = true
+	}
+
+	var pending []string
+	for _, list := range []*core.MigrationsList{&core.SystemMigrations, &core.AppMigrations} {
+		for _, m := range list.Items() {
+			if !done[m.File] {
+				pending = append(pending, m.File)
+			}
+		}
+	}
+	if len(pending) > 0 {
+		c.Status = "pending_migrations"
+		c.Info = map[string]any{"pending": pending}
+	}
+	return c
+}
+
+func (h *SitePodHandler) checkStorage(ctx context.Context) healthCheck {
+	c := healthCheck{Status: "ok", critical: true}
+	ctx, cancel := context.WithTimeout(ctx, healthPingTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := storage.Ping(ctx, h.storage)
+	c.Info = map[string]any{
+		"backend":    h.storageType,
+		"latency_ms": time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		c.Status, c.Error = "error", err.Error()
+	}
+	return c
+}
+
+// checkWorkers fails if a long-running background worker has stopped
+func (h *SitePodHandler) checkWorkers() healthCheck {
+	c := healthCheck{Status: "ok", critical: true, Info: map[string]any{}}
+
+	h.workersMu.Lock()
+	names := make([]string, 0, len(h.workers))
+	for name := range h.workers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var stopped []string
+	for _, name := range names {
+		state := "running"
+		if !h.workers[name] {
+			state = "stopped"
+			stopped = append(stopped, name)
+		}
+		c.Info[name] = state
+	}
+	h.workersMu.Unlock()
+
+	if len(stopped) > 0 {
+		c.Status = "error"
+		c.Error = "stopped: " + strings.Join(stopped, ", ")
+	}
+	return c
+}
+
+// checkGC reports when GC last succeeded. It is stale after two missed
+// intervals. Not critical: serving does not depend on GC.
+func (h *SitePodHandler) checkGC() healthCheck {
+	if h.gc == nil || !h.gc.Enabled() {
+		return healthCheck{Status: "disabled"}
+	}
+
+	c := healthCheck{Status: "ok", Info: map[string]any{"interval": h.gc.Interval().String()}}
+	if last := h.lastGC.Load(); last != nil {
+		c.Info["last_run"] = last.Started
+		if last.Err != nil {
+			c.Info["last_error"] = last.Err.Error()
+		}
+	}
+
+	lastOK := h.lastGCOK.Load()
+	if lastOK != nil {
+		c.Info["last_success"] = *lastOK
+	}
+
+	standby := h.gc.Standby()
+	if !standby.IsZero() {
+		c.Info["last_standby"] = standby
+	}
+
+	staleAfter := 2 * h.gc.Interval()
+	switch {
+	case lastOK != nil && time.Since(*lastOK) <= staleAfter:
+	case !standby.IsZero() && time.Since(standby) <= staleAfter:
+		c.Status = "standby" // another instance holds the GC lease
+	case lastOK == nil && time.Since(h.startTime) <= staleAfter:
+		c.Status = "pending" // no cycle has completed yet
+	default:
+		c.Status = "stale"
+		c.Error = "no successful GC run in " + staleAfter.String()
+	}
+	return c
+}
+
+// leaseNames are the storage leases reported by readiness
+var leaseNames = []string{gc.LeaseName}
+
+// checkLeases reports who holds each storage lease and until when. Not
+// critical: a lease that cannot be read only delays singleton jobs.
+func (h *SitePodHandler) checkLeases() healthCheck {
+	if h.leases == nil {
+		return healthCheck{Status: "disabled"}
+	}
+
+	c := healthCheck{Status: "ok", Info: map[string]any{
+		"instance": h.leases.Holder(),
+		"ttl":      h.leases.TTL().String(),
+	}}
+	for _, name := range leaseNames {
+		status := h.leaseStatus(name)
+		if err, ok := status["error"].(string); ok {
+			c.Status, c.Error = "error", err
+		}
+		c.Info[name] = status
+	}
+	return c
+}
+
+// leaseStatus describes the current holder of a lease
+func (h *SitePodHandler) leaseStatus(name string) map[string]any {
+	rec, err := h.leases.Status(name)
+	if err != nil {
+		return map[string]any{"error": err.Error()}
+	}
+	if !rec.Active(time.Now()) {
+		return map[string]any{"held": false}
+	}
+	return map[string]any{
+		"held":        true,
+		"holder":      rec.Holder,
+		"self":        rec.Holder == h.leases.Holder(),
+		"acquired_at": rec.AcquiredAt,
+		"expires_at":  rec.ExpiresAt,
+	}
+}
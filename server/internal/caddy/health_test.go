@@ -0,0 +1,88 @@
+package caddy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sitepod/sitepod/internal/gc"
+)
+
+func TestCheckWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := &SitePodHandler{appState: &appState{ctx: ctx, cancel: cancel}}
+
+	stop := make(chan struct{})
+	h.goWorker("blocking", func(ctx context.Context) { <-stop })
+	h.goWorker("returns", func(ctx context.Context) {})
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		h.workersMu.Lock()
+		done := !h.workers["returns"]
+		h.workersMu.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	c := h.checkWorkers()
+	if c.ok() || !c.critical {
+		t.Fatalf("status = %q, want a critical failure", c.Status)
+	}
+	if c.Info["blocking"] != "running" || c.Info["returns"] != "stopped" {
+		t.Errorf("info = %v", c.Info)
+	}
+
+	close(stop)
+	h.wg.Wait()
+}
+
+func TestCheckGC(t *testing.T) {
+	interval := time.Hour
+	ago := func(d time.Duration) *time.Time {
+		t := time.Now().Add(-d)
+		return &t
+	}
+
+	testCases := []struct {
+		name     string
+		disabled bool
+		uptime   time.Duration
+		last     *gc.Stats
+		lastOK   *time.Time
+		want     string
+	}{
+		{name: "disabled", disabled: true, uptime: 10 * interval, want: "disabled"},
+		{name: "first_cycle_pending", uptime: time.Minute, want: "pending"},
+		{name: "never_succeeded", uptime: 3 * interval, last: &gc.Stats{Err: errors.New("boom")}, want: "stale"},
+		{name: "recent_success", uptime: 10 * interval, lastOK: ago(interval), want: "ok"},
+		{name: "stale_success", uptime: 10 * interval, lastOK: ago(3 * interval), want: "stale"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &SitePodHandler{appState: &appState{
+				startTime: time.Now().Add(-tc.uptime),
+				gc:        gc.New(nil, nil, gc.Config{Enabled: !tc.disabled, Interval: interval}),
+			}}
+			if tc.last != nil {
+				h.lastGC.Store(tc.last)
+			}
+			if tc.lastOK != nil {
+				h.lastGCOK.Store(tc.lastOK)
+			}
+
+			c := h.checkGC()
+			if c.Status != tc.want {
+				t.Errorf("status = %q, want %q", c.Status, tc.want)
+			}
+			if c.critical {
+				t.Error("gc check must not be critical")
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package caddy
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sitepod/sitepod/internal/config"
+	"github.com/sitepod/sitepod/internal/invalidate"
+	"github.com/sitepod/sitepod/internal/storage"
+	"go.uber.org/zap"
+)
+
+// newInvalidationTransport creates the configured invalidation transport,
+// or nil if instances do not share invalidations. Peers also receive
+// messages over the API. The journal is kept in backend, which must hold
+// lock objects.
+func newInvalidationTransport(cfg config.InvalidationConfig, backend storage.Backend) (invalidate.Transport, *invalidate.Peers, error) {
+	switch cfg.Transport {
+	case "":
+		return nil, nil, nil
+	case "journal":
+		store, ok := storage.As[storage.Locker](backend)
+		if !ok {
+			return nil, nil, errors.New("cache invalidation transport \"journal\" needs a storage backend with lock objects")
+		}
+		return invalidate.NewJournal(store, cfg.PollInterval), nil, nil
+	case "redis":
+		t, err := invalidate.NewRedis(cfg.RedisURL, cfg.RedisChannel)
+		return t, nil, err
+	case "peers":
+		t := invalidate.NewPeers(cfg.Peers, cfg.Secret)
+		return t, t, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported cache invalidation transport %q", cfg.Transport)
+	}
+}
+
+// applyInvalidation drops what msg names from this instance's caches
+func (s *appState) applyInvalidation(msg invalidate.Message) {
+	if msg.All {
+		s.cache.Clear()
+		s.routingCache.Invalidate()
+		return
+	}
+	for _, key := range msg.Refs {
+		s.cache.Delete(key)
+	}
+	if msg.Routing {
+		s.routingCache.Invalidate()
+	}
+}
+
+// invalidateRefs drops the refs of a project's environments from the cache
+// of every instance
+func (h *SitePodHandler) invalidateRefs(project string, envs ...string) {
+	keys := make([]string, len(envs))
+	for i, env := range envs {
+		keys[i] = project + ":" + env
+	}
+	h.publishInvalidation(invalidate.Message{Refs: keys})
+}
+
+// invalidateRouting drops the routing index from the cache of every instance
+func (h *SitePodHandler) invalidateRouting() {
+	h.publishInvalidation(invalidate.Message{Routing: true})
+}
+
+// publishInvalidation invalidates the local caches at once and waits for
+// the message to be sent to the other instances, so a change is visible
+// everywhere when the request that made it returns. Failures are logged;
+// the other instances then pick up the change within the cache TTL.
+func (h *SitePodHandler) publishInvalidation(msg invalidate.Message) {
+	if err := h.invalidation.Publish(h.ctx, msg); err != nil {
+		h.logger.Warn("failed to send cache invalidation to other instances",
+			zap.Strings("refs", msg.Refs), zap.Bool("routing", msg.Routing), zap.Error(err))
+	}
+}
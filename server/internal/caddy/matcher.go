@@ -0,0 +1,155 @@
+package caddy
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(ProjectMatcher{})
+}
+
+// ProjectMatcher matches requests that resolve to a deployed SitePod project,
+// optionally restricted to specific projects and environments. On a match it
+// sets the {sitepod.project} and {sitepod.env} placeholders.
+//
+// Resolution uses the SitePod instance of a sitepod, sitepod_api or
+// sitepod_static handler with the same data_dir in the same config.
+type ProjectMatcher struct {
+	// Projects to match; empty matches any project
+	Projects []string `json:"projects,omitempty"`
+	// Envs to match (prod, beta, preview); empty matches any env
+	Envs []string `json:"envs,omitempty"`
+	// DataDir selects the SitePod instance (default ./data)
+	DataDir string `json:"data_dir,omitempty"`
+	// Domain overrides the base domain of the SitePod instance
+	Domain string `json:"domain,omitempty"`
+
+	key  string
+	view *atomic.Pointer[SitePodHandler]
+}
+
+// CaddyModule returns the Caddy module information
+func (ProjectMatcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.sitepod_project",
+		New: func() caddy.Module { return new(ProjectMatcher) },
+	}
+}
+
+// Provision sets defaults
+func (m *ProjectMatcher) Provision(ctx caddy.Context) error {
+	if m.DataDir == "" {
+		m.DataDir = "./data"
+	}
+	m.key = appKey(m.DataDir)
+	m.view = new(atomic.Pointer[SitePodHandler])
+	return nil
+}
+
+// resolver returns a handler view over the shared app state. Matchers are
+// provisioned before handlers, so the state is looked up on first use.
+func (m *ProjectMatcher) resolver() *SitePodHandler {
+	if view := m.view.Load(); view != nil {
+		return view
+	}
+
+	var state *appState
+	appPool.Range(func(key, value any) bool {
+		if key == m.key {
+			state = value.(*appState)
+			return false
+		}
+		return true
+	})
+	if state == nil {
+		return nil
+	}
+
+	domain := m.Domain
+	if domain == "" {
+		domain = state.domain
+	}
+	view := &SitePodHandler{Domain: domain}
+	view.useState(state)
+	m.view.Store(view)
+	return view
+}
+
+// Match returns true if the request resolves to a matching project and env
+func (m *ProjectMatcher) Match(r *http.Request) bool {
+	h := m.resolver()
+	if h == nil {
+		return false
+	}
+
+	project, env, _, _ := h.resolveRouting(requestHost(r), r.URL.Path)
+	if project == "" {
+		return false
+	}
+	if len(m.Projects) > 0 && !containsString(m.Projects, project) {
+		return false
+	}
+	if len(m.Envs) > 0 && !containsString(m.Envs, env) {
+		return false
+	}
+
+	setProjectPlaceholders(r, project, env)
+	return true
+}
+
+// UnmarshalCaddyfile parses:
+//
+//	sitepod_project [<projects...>] {
+//	    env      <envs...>
+//	    data_dir <path>
+//	    domain   <domain>
+//	}
+func (m *ProjectMatcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		m.Projects = append(m.Projects, d.RemainingArgs()...)
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "env":
+				envs := d.RemainingArgs()
+				if len(envs) == 0 {
+					return d.ArgErr()
+				}
+				m.Envs = append(m.Envs, envs...)
+			case "data_dir":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.DataDir = d.Val()
+			case "domain":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Domain = d.Val()
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Interface guards
+var (
+	_ caddyhttp.RequestMatcher = (*ProjectMatcher)(nil)
+	_ caddy.Provisioner        = (*ProjectMatcher)(nil)
+	_ caddyfile.Unmarshaler    = (*ProjectMatcher)(nil)
+)
@@ -0,0 +1,134 @@
+package caddy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+func TestUnmarshalCaddyfileProjectMatcher(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected ProjectMatcher
+		wantErr  bool
+	}{
+		{
+			name:     "any_project",
+			input:    `sitepod_project`,
+			expected: ProjectMatcher{},
+		},
+		{
+			name: "projects_and_envs",
+			input: `sitepod_project docs blog {
+				env prod beta
+				data_dir /srv/sitepod
+				domain example.com
+			}`,
+			expected: ProjectMatcher{
+				Projects: []string{"docs", "blog"},
+				Envs:     []string{"prod", "beta"},
+				DataDir:  "/srv/sitepod",
+				Domain:   "example.com",
+			},
+		},
+		{
+			name: "env_without_args",
+			input: `sitepod_project {
+				env
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "unknown_option",
+			input: `sitepod_project {
+				cache off
+			}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var m ProjectMatcher
+			err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tc.input))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(m.Projects, tc.expected.Projects) ||
+				!reflect.DeepEqual(m.Envs, tc.expected.Envs) ||
+				m.DataDir != tc.expected.DataDir ||
+				m.Domain != tc.expected.Domain {
+				t.Errorf("got %+v, want %+v", m, tc.expected)
+			}
+		})
+	}
+}
+
+func TestProjectMatcherWithoutHandler(t *testing.T) {
+	m := &ProjectMatcher{DataDir: t.TempDir()}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "http://docs.example.com/", nil)
+	if m.Match(r) {
+		t.Error("expected no match when no SitePod handler shares the data dir")
+	}
+}
+
+func TestProjectMatcherColdRoutingCache(t *testing.T) {
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, _ := json.Marshal(RoutingIndex{Entries: []RoutingEntry{
+		{Domain: "docs.example.org", Slug: "/", Project: "docs", Env: "beta"},
+	}})
+	if err := backend.PutRouting(index); err != nil {
+		t.Fatal(err)
+	}
+
+	dataDir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	key := appKey(dataDir)
+	_, _, err = appPool.LoadOrNew(key, func() (caddy.Destructor, error) {
+		return &appState{
+			backend:      backend,
+			domain:       "example.com",
+			cache:        newRefCache(testCacheConfig()),
+			routingCache: newRoutingCache(testCacheConfig()),
+			ctx:          ctx,
+			cancel:       cancel,
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = appPool.Delete(key) })
+
+	m := &ProjectMatcher{DataDir: dataDir, Envs: []string{"beta"}}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	// The routing index is loaded from storage on the first request
+	r := httptest.NewRequest("GET", "http://docs.example.org/guide/", nil)
+	if !m.Match(r) {
+		t.Error("expected the routed domain to match")
+	}
+	if m.Match(httptest.NewRequest("GET", "http://docs.example.com/", nil)) {
+		t.Error("prod of a subdomain matched an env filter of beta")
+	}
+}
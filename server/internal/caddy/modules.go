@@ -0,0 +1,103 @@
+package caddy
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(APIHandler{})
+	caddy.RegisterModule(StaticHandler{})
+	httpcaddyfile.RegisterHandlerDirective("sitepod_api", parseAPICaddyfile)
+	httpcaddyfile.RegisterHandlerDirective("sitepod_static", parseStaticCaddyfile)
+}
+
+// APIHandler serves only the SitePod API (/api/v1/*).
+// Other requests are passed to the next handler, so the API can live on its
+// own hostname or be combined with other Caddy handlers.
+//
+// It accepts the same options as the sitepod directive. Handlers configured
+// with the same data_dir share one SitePod instance (PocketBase, storage,
+// caches); the first one provisioned creates it.
+type APIHandler struct {
+	SitePodHandler
+}
+
+// CaddyModule returns the Caddy module information
+func (APIHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.sitepod_api",
+		New: func() caddy.Module { return new(APIHandler) },
+	}
+}
+
+// Provision sets up the handler
+func (h *APIHandler) Provision(ctx caddy.Context) error {
+	return h.provision(ctx, ctx.Logger(h))
+}
+
+// ServeHTTP serves API requests and passes everything else on
+func (h *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if isAPIPath(r.URL.Path) {
+		return h.serveAPI(w, r)
+	}
+	if isPocketBasePath(r.URL.Path) {
+		return caddyhttp.Error(http.StatusNotFound, nil)
+	}
+	return next.ServeHTTP(w, r)
+}
+
+// StaticHandler serves deployed sites only. Unlike the combined sitepod
+// handler it does not reserve /api/ paths, so sites may serve their own.
+// It sets the {sitepod.project} and {sitepod.env} placeholders.
+type StaticHandler struct {
+	SitePodHandler
+}
+
+// CaddyModule returns the Caddy module information
+func (StaticHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.sitepod_static",
+		New: func() caddy.Module { return new(StaticHandler) },
+	}
+}
+
+// Provision sets up the handler
+func (h *StaticHandler) Provision(ctx caddy.Context) error {
+	return h.provision(ctx, ctx.Logger(h))
+}
+
+// ServeHTTP serves a file from the deployed site resolved from the request
+func (h *StaticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	return h.serveStaticLogged(w, r)
+}
+
+// parseAPICaddyfile is the Caddyfile directive parser for sitepod_api
+func parseAPICaddyfile(helper httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var handler APIHandler
+	err := handler.UnmarshalCaddyfile(helper.Dispenser)
+	return &handler, err
+}
+
+// parseStaticCaddyfile is the Caddyfile directive parser for sitepod_static
+func parseStaticCaddyfile(helper httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var handler StaticHandler
+	err := handler.UnmarshalCaddyfile(helper.Dispenser)
+	return &handler, err
+}
+
+// Interface guards
+var (
+	_ caddyhttp.MiddlewareHandler = (*APIHandler)(nil)
+	_ caddy.Provisioner           = (*APIHandler)(nil)
+	_ caddy.CleanerUpper          = (*APIHandler)(nil)
+	_ caddyfile.Unmarshaler       = (*APIHandler)(nil)
+	_ caddyhttp.MiddlewareHandler = (*StaticHandler)(nil)
+	_ caddy.Provisioner           = (*StaticHandler)(nil)
+	_ caddy.CleanerUpper          = (*StaticHandler)(nil)
+	_ caddyfile.Unmarshaler       = (*StaticHandler)(nil)
+)
@@ -0,0 +1,93 @@
+package caddy
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/purge"
+	"github.com/sitepod/sitepod/internal/storage"
+	"go.uber.org/zap"
+)
+
+// purgeBases returns the origins a project environment is served from: its
+// system URL and, for prod, every active custom domain with its slug. An
+// empty env returns the origins of both environments.
+func (h *SitePodHandler) purgeBases(project *core.Record, env string) []string {
+	if h.purger == nil {
+		return nil
+	}
+	name := project.GetString("name")
+
+	var bases []string
+	if env == "" || env == "beta" {
+		bases = append(bases, h.buildURL(name, "beta"))
+	}
+	if env == "" || env == "prod" {
+		bases = append(bases, h.buildURL(name, "prod"))
+
+		domains, _ := h.app.FindRecordsByFilter(
+			"domains", "project_id = {:project_id} AND status = 'active' AND type != 'system'", "", 1000, 0,
+			map[string]any{"project_id": project.Id},
+		)
+		seen := make(map[string]bool)
+		for _, d := range domains {
+			base := "https://" + d.GetString("domain") + strings.TrimSuffix(d.GetString("slug"), "/")
+			if !seen[base] {
+				seen[base] = true
+				bases = append(bases, base)
+			}
+		}
+	}
+	return bases
+}
+
+// purgeRef purges the CDN after a ref moved from old to new, by the
+// surrogate keys of the changed files where the provider supports them and
+// by changed paths otherwise. A nil old ref purges everything, as does a
+// nil new ref (the environment was deleted).
+func (h *SitePodHandler) purgeRef(project *core.Record, env string, old, new *storage.RefData) {
+	if h.purger == nil {
+		return
+	}
+
+	req := purge.Request{
+		Project: project.GetString("name"),
+		Env:     env,
+		Bases:   h.purgeBases(project, env),
+	}
+	if old == nil || new == nil {
+		req.All = true
+		req.Keys = []string{purge.EnvKey(req.Project, env)}
+	} else {
+		req.Paths, req.All = purge.ChangedPaths(old.Manifest, new.Manifest)
+		req.Keys = purge.ChangedKeys(req.Project, env, old.Manifest, new.Manifest)
+	}
+	h.sendPurge(req)
+}
+
+// sendPurge runs a purge request in the background and logs the outcome
+func (h *SitePodHandler) sendPurge(req purge.Request) {
+	if h.purger == nil || req.Empty() {
+		return
+	}
+
+	purger, logger := h.purger, h.logger
+	h.goBackground(func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, purge.DefaultTimeout)
+		defer cancel()
+
+		fields := []zap.Field{
+			zap.String("project", req.Project),
+			zap.String("env", req.Env),
+			zap.Bool("all", req.All),
+			zap.Int("paths", len(req.Paths)),
+			zap.Int("keys", len(req.Keys)),
+		}
+		if err := purger.Purge(ctx, req); err != nil {
+			logger.Warn("CDN purge failed", append(fields, zap.Error(err))...)
+			return
+		}
+		logger.Info("CDN purged", fields...)
+	})
+}
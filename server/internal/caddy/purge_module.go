@@ -0,0 +1,304 @@
+package caddy
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/sitepod/sitepod/internal/config"
+	"github.com/sitepod/sitepod/internal/purge"
+)
+
+func init() {
+	caddy.RegisterModule(CloudflarePurge{})
+	caddy.RegisterModule(FastlyPurge{})
+	caddy.RegisterModule(BunnyPurge{})
+	caddy.RegisterModule(HTTPPurge{})
+}
+
+// PurgeProvider is implemented by modules in the sitepod.purge namespace.
+// The handler calls Purger once and uses it after every ref change.
+type PurgeProvider interface {
+	Purger() (purge.Purger, error)
+}
+
+// CloudflarePurge purges a Cloudflare zone
+type CloudflarePurge struct {
+	ZoneID   string `json:"zone_id,omitempty"`
+	APIToken string `json:"api_token,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information
+func (CloudflarePurge) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "sitepod.purge.cloudflare",
+		New: func() caddy.Module { return new(CloudflarePurge) },
+	}
+}
+
+// Validate validates the configuration
+func (p *CloudflarePurge) Validate() error {
+	if p.ZoneID == "" || p.APIToken == "" {
+		return errors.New("cloudflare purge: zone_id and api_token are required")
+	}
+	return nil
+}
+
+// Purger creates the Cloudflare purger
+func (p *CloudflarePurge) Purger() (purge.Purger, error) {
+	return purge.NewCloudflare(p.ZoneID, p.APIToken)
+}
+
+// UnmarshalCaddyfile parses:
+//
+//	purge cloudflare {
+//	    zone_id   <id>
+//	    api_token <token>
+//	}
+func (p *CloudflarePurge) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return unmarshalPurgeOptions(d, "cloudflare", map[string]*string{
+		"zone_id":   &p.ZoneID,
+		"api_token": &p.APIToken,
+	})
+}
+
+// FastlyPurge purges a Fastly service
+type FastlyPurge struct {
+	ServiceID string `json:"service_id,omitempty"`
+	APIToken  string `json:"api_token,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information
+func (FastlyPurge) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "sitepod.purge.fastly",
+		New: func() caddy.Module { return new(FastlyPurge) },
+	}
+}
+
+// Validate validates the configuration
+func (p *FastlyPurge) Validate() error {
+	if p.ServiceID == "" || p.APIToken == "" {
+		return errors.New("fastly purge: service_id and api_token are required")
+	}
+	return nil
+}
+
+// Purger creates the Fastly purger
+func (p *FastlyPurge) Purger() (purge.Purger, error) {
+	return purge.NewFastly(p.ServiceID, p.APIToken)
+}
+
+// UnmarshalCaddyfile parses:
+//
+//	purge fastly {
+//	    service_id <id>
+//	    api_token  <token>
+//	}
+func (p *FastlyPurge) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return unmarshalPurgeOptions(d, "fastly", map[string]*string{
+		"service_id": &p.ServiceID,
+		"api_token":  &p.APIToken,
+	})
+}
+
+// BunnyPurge purges a Bunny CDN pull zone
+type BunnyPurge struct {
+	APIKey     string `json:"api_key,omitempty"`
+	PullZoneID string `json:"pull_zone_id,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information
+func (BunnyPurge) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "sitepod.purge.bunny",
+		New: func() caddy.Module { return new(BunnyPurge) },
+	}
+}
+
+// Validate validates the configuration
+func (p *BunnyPurge) Validate() error {
+	if p.APIKey == "" {
+		return errors.New("bunny purge: api_key is required")
+	}
+	return nil
+}
+
+// Purger creates the Bunny purger
+func (p *BunnyPurge) Purger() (purge.Purger, error) {
+	return purge.NewBunny(p.APIKey, p.PullZoneID)
+}
+
+// UnmarshalCaddyfile parses:
+//
+//	purge bunny {
+//	    api_key      <key>
+//	    pull_zone_id <id>
+//	}
+func (p *BunnyPurge) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return unmarshalPurgeOptions(d, "bunny", map[string]*string{
+		"api_key":      &p.APIKey,
+		"pull_zone_id": &p.PullZoneID,
+	})
+}
+
+// HTTPPurge purges a self-hosted cache (Varnish, nginx, Squid) with
+// PURGE requests
+type HTTPPurge struct {
+	Endpoint  string            `json:"endpoint,omitempty"`
+	Method    string            `json:"method,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	KeyHeader string            `json:"key_header,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information
+func (HTTPPurge) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "sitepod.purge.http",
+		New: func() caddy.Module { return new(HTTPPurge) },
+	}
+}
+
+// Purger creates the HTTP purger
+func (p *HTTPPurge) Purger() (purge.Purger, error) {
+	return purge.NewHTTP(p.Endpoint, p.Method, p.KeyHeader, p.Headers)
+}
+
+// UnmarshalCaddyfile parses:
+//
+//	purge http [<endpoint>] {
+//	    endpoint   <url>
+//	    method     <method>
+//	    key_header <name>
+//	    header     <name> <value>
+//	}
+func (p *HTTPPurge) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			p.Endpoint = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			key := d.Val()
+			switch key {
+			case "endpoint", "method", "key_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				switch key {
+				case "endpoint":
+					p.Endpoint = d.Val()
+				case "method":
+					p.Method = d.Val()
+				case "key_header":
+					p.KeyHeader = d.Val()
+				}
+			case "header":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				if p.Headers == nil {
+					p.Headers = make(map[string]string)
+				}
+				p.Headers[args[0]] = args[1]
+			default:
+				return d.Errf("unrecognized http purge option: %s", key)
+			}
+		}
+	}
+	return nil
+}
+
+// unmarshalPurgeOptions parses a block of single-value options
+func unmarshalPurgeOptions(d *caddyfile.Dispenser, name string, options map[string]*string) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			key := d.Val()
+			dst, ok := options[key]
+			if !ok {
+				return d.Errf("unrecognized %s purge option: %s", name, key)
+			}
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			*dst = d.Val()
+		}
+	}
+	return nil
+}
+
+// defaultPurgeConfig builds the purge module config from the [purge] config
+// section. It is used when the handler config has no explicit purge block,
+// and returns nil if no provider is configured.
+func defaultPurgeConfig(cfg config.PurgeConfig) json.RawMessage {
+	switch cfg.Provider {
+	case "cloudflare":
+		return caddyconfig.JSONModuleObject(CloudflarePurge{
+			ZoneID:   cfg.Cloudflare.ZoneID,
+			APIToken: cfg.Cloudflare.APIToken,
+		}, "provider", "cloudflare", nil)
+	case "fastly":
+		return caddyconfig.JSONModuleObject(FastlyPurge{
+			ServiceID: cfg.Fastly.ServiceID,
+			APIToken:  cfg.Fastly.APIToken,
+		}, "provider", "fastly", nil)
+	case "bunny":
+		return caddyconfig.JSONModuleObject(BunnyPurge{
+			APIKey:     cfg.Bunny.APIKey,
+			PullZoneID: cfg.Bunny.PullZoneID,
+		}, "provider", "bunny", nil)
+	case "http":
+		return caddyconfig.JSONModuleObject(HTTPPurge{
+			Endpoint:  cfg.HTTP.Endpoint,
+			Method:    cfg.HTTP.Method,
+			Headers:   cfg.HTTP.Headers,
+			KeyHeader: cfg.HTTP.KeyHeader,
+		}, "provider", "http", nil)
+	default:
+		return nil
+	}
+}
+
+// loadPurger loads the configured sitepod.purge module, if any
+func (h *SitePodHandler) loadPurger(ctx caddy.Context) (purge.Purger, string, error) {
+	if h.PurgeRaw == nil {
+		return nil, "", nil
+	}
+	mod, err := ctx.LoadModule(h, "PurgeRaw")
+	if err != nil {
+		return nil, "", err
+	}
+	provider, ok := mod.(PurgeProvider)
+	if !ok {
+		return nil, "", errors.New("purge module does not implement PurgeProvider")
+	}
+
+	purger, err := provider.Purger()
+	if err != nil {
+		return nil, "", err
+	}
+	return purger, caddy.GetModuleName(mod), nil
+}
+
+// Interface guards
+var (
+	_ PurgeProvider         = (*CloudflarePurge)(nil)
+	_ caddy.Validator       = (*CloudflarePurge)(nil)
+	_ caddyfile.Unmarshaler = (*CloudflarePurge)(nil)
+	_ PurgeProvider         = (*FastlyPurge)(nil)
+	_ caddy.Validator       = (*FastlyPurge)(nil)
+	_ caddyfile.Unmarshaler = (*FastlyPurge)(nil)
+	_ PurgeProvider         = (*BunnyPurge)(nil)
+	_ caddy.Validator       = (*BunnyPurge)(nil)
+	_ caddyfile.Unmarshaler = (*BunnyPurge)(nil)
+	_ PurgeProvider         = (*HTTPPurge)(nil)
+	_ caddyfile.Unmarshaler = (*HTTPPurge)(nil)
+)
@@ -2,49 +2,27 @@ package caddy
 
 import (
 	"fmt"
-	"os"
-	"strconv"
 
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/config"
 )
 
 // QuotaConfig holds quota limits for deployments
-// Can be overridden via environment variables
+// Set via [quota] in config.toml or SITEPOD_MAX_* environment variables
 type QuotaConfig struct {
-	MaxFilesPerDeploy  int   // SITEPOD_MAX_FILES_PER_DEPLOY (default: 10000)
-	MaxFileSizeBytes   int64 // SITEPOD_MAX_FILE_SIZE (default: 100MB)
-	MaxDeploySizeBytes int64 // SITEPOD_MAX_DEPLOY_SIZE (default: 500MB)
-	MaxProjectsPerUser int   // SITEPOD_MAX_PROJECTS_PER_USER (default: 100)
+	MaxFilesPerDeploy  int   // quota.max_files_per_deploy (default: 10000)
+	MaxFileSizeBytes   int64 // quota.max_file_size (default: 100MB)
+	MaxDeploySizeBytes int64 // quota.max_deploy_size (default: 500MB)
+	MaxProjectsPerUser int   // quota.max_projects_per_user (default: 100)
 }
 
-// Global quota config (loaded once at startup)
-var quotaConfig = loadQuotaConfig()
-
-func loadQuotaConfig() QuotaConfig {
+func newQuotaConfig(cfg config.QuotaConfig) QuotaConfig {
 	return QuotaConfig{
-		MaxFilesPerDeploy:  getEnvInt("SITEPOD_MAX_FILES_PER_DEPLOY", 10000),
-		MaxFileSizeBytes:   getEnvInt64("SITEPOD_MAX_FILE_SIZE", 100*1024*1024),   // 100MB
-		MaxDeploySizeBytes: getEnvInt64("SITEPOD_MAX_DEPLOY_SIZE", 500*1024*1024), // 500MB
-		MaxProjectsPerUser: getEnvInt("SITEPOD_MAX_PROJECTS_PER_USER", 100),
-	}
-}
-
-func getEnvInt(key string, defaultVal int) int {
-	if v := os.Getenv(key); v != "" {
-		if i, err := strconv.Atoi(v); err == nil {
-			return i
-		}
-	}
-	return defaultVal
-}
-
-func getEnvInt64(key string, defaultVal int64) int64 {
-	if v := os.Getenv(key); v != "" {
-		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
-			return i
-		}
+		MaxFilesPerDeploy:  cfg.MaxFilesPerDeploy,
+		MaxFileSizeBytes:   cfg.MaxFileSize,
+		MaxDeploySizeBytes: cfg.MaxDeploySize,
+		MaxProjectsPerUser: cfg.MaxProjectsPerUser,
 	}
-	return defaultVal
 }
 
 // formatBytes formats bytes to human-readable string
@@ -78,25 +56,25 @@ type FileEntry struct {
 // checkDeployQuotas validates deployment against size and file count limits
 func (h *SitePodHandler) checkDeployQuotas(files []FileEntry) error {
 	// Check file count
-	if len(files) > quotaConfig.MaxFilesPerDeploy {
-		return fmt.Errorf("too many files: %d (max: %d)", len(files), quotaConfig.MaxFilesPerDeploy)
+	if len(files) > h.quota.MaxFilesPerDeploy {
+		return fmt.Errorf("too many files: %d (max: %d)", len(files), h.quota.MaxFilesPerDeploy)
 	}
 
 	// Calculate total size and check individual file sizes
 	var totalSize int64
 	for _, f := range files {
 		// Check individual file size
-		if f.Size > quotaConfig.MaxFileSizeBytes {
+		if f.Size > h.quota.MaxFileSizeBytes {
 			return fmt.Errorf("file too large: %s (%s, max: %s)",
-				f.Path, formatBytes(f.Size), formatBytes(quotaConfig.MaxFileSizeBytes))
+				f.Path, formatBytes(f.Size), formatBytes(h.quota.MaxFileSizeBytes))
 		}
 		totalSize += f.Size
 	}
 
 	// Check total deploy size
-	if totalSize > quotaConfig.MaxDeploySizeBytes {
+	if totalSize > h.quota.MaxDeploySizeBytes {
 		return fmt.Errorf("deployment too large: %s (max: %s)",
-			formatBytes(totalSize), formatBytes(quotaConfig.MaxDeploySizeBytes))
+			formatBytes(totalSize), formatBytes(h.quota.MaxDeploySizeBytes))
 	}
 
 	return nil
@@ -112,8 +90,8 @@ func (h *SitePodHandler) checkProjectCountQuota(userID string) error {
 		projects = []*core.Record{}
 	}
 
-	if len(projects) >= quotaConfig.MaxProjectsPerUser {
-		return fmt.Errorf("project limit reached: %d (max: %d)", len(projects), quotaConfig.MaxProjectsPerUser)
+	if len(projects) >= h.quota.MaxProjectsPerUser {
+		return fmt.Errorf("project limit reached: %d (max: %d)", len(projects), h.quota.MaxProjectsPerUser)
 	}
 
 	return nil
@@ -0,0 +1,123 @@
+package caddy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// responseRecorder records the status code and body size of a response
+type responseRecorder struct {
+	*caddyhttp.ResponseWriterWrapper
+	status int
+	bytes  int64
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}}
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 && status >= 200 {
+		rr.status = status
+	}
+	rr.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriterWrapper.Write(b)
+	rr.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps io.Copy on the fast path while counting bytes
+func (rr *responseRecorder) ReadFrom(r io.Reader) (int64, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriterWrapper.ReadFrom(r)
+	rr.bytes += n
+	return n, err
+}
+
+// statusFor returns the status of the response, or the status Caddy will
+// send for err if the handler returned an error without writing one
+func (rr *responseRecorder) statusFor(err error) int {
+	if rr.status != 0 {
+		return rr.status
+	}
+	if err != nil {
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) && handlerErr.StatusCode != 0 {
+			return handlerErr.StatusCode
+		}
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// requestInfo collects what a static request resolved to, for metrics and logs
+type requestInfo struct {
+	project string
+	env     string
+	// projectFound is set once the project is known to exist, from a
+	// routing entry, ref or preview; metrics only label such projects
+	projectFound bool
+	imageID      string
+	cacheHit     bool
+}
+
+// requestIDHeader carries the request ID to and from proxies and clients
+const requestIDHeader = "X-Request-ID"
+
+// requestID returns the request's X-Request-ID if it is a sensible token,
+// or a new random ID. The ID is echoed in the response.
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		var b [16]byte
+		_, _ = rand.Read(b[:])
+		id = hex.EncodeToString(b[:])
+	}
+	w.Header().Set(requestIDHeader, id)
+	return id
+}
+
+// validRequestID accepts up to 128 characters of [A-Za-z0-9._:-], which
+// covers UUIDs and the IDs common proxies generate
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == ':', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+type requestInfoKey struct{}
+
+// withRequestInfo attaches a new requestInfo to the request
+func withRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	info := new(requestInfo)
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+// getRequestInfo returns the request's requestInfo, or nil
+func getRequestInfo(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
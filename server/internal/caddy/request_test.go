@@ -0,0 +1,170 @@
+package caddy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/sitepod/sitepod/internal/config"
+	"github.com/sitepod/sitepod/internal/manifest"
+	"github.com/sitepod/sitepod/internal/metrics"
+	"github.com/sitepod/sitepod/internal/storage"
+	"go.uber.org/zap"
+)
+
+func TestRequestID(t *testing.T) {
+	testCases := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{name: "uuid", header: "0b6f6a3e-8f5c-4a8e-9d7a-2f1e0c9b8a7d", keep: true},
+		{name: "proxy_style", header: "req_01H8:abc.def", keep: true},
+		{name: "missing"},
+		{name: "spaces", header: "not a token"},
+		{name: "newline", header: "abc\r\nSet-Cookie: x"},
+		{name: "too_long", header: strings.Repeat("a", 129)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tc.header != "" {
+				r.Header.Set(requestIDHeader, tc.header)
+			}
+			w := httptest.NewRecorder()
+
+			id := requestID(w, r)
+			if tc.keep && id != tc.header {
+				t.Errorf("id = %q, want incoming %q", id, tc.header)
+			}
+			if !tc.keep && (id == tc.header || len(id) != 32) {
+				t.Errorf("id = %q, want a new 32-character id", id)
+			}
+			if got := w.Header().Get(requestIDHeader); got != id {
+				t.Errorf("response header = %q, want %q", got, id)
+			}
+		})
+	}
+}
+
+func TestResponseRecorderStatus(t *testing.T) {
+	testCases := []struct {
+		name  string
+		serve func(w http.ResponseWriter) error
+		want  int
+		bytes int64
+	}{
+		{
+			name:  "ok",
+			serve: func(w http.ResponseWriter) error { _, err := w.Write([]byte("hello")); return err },
+			want:  http.StatusOK,
+			bytes: 5,
+		},
+		{
+			name:  "not_modified",
+			serve: func(w http.ResponseWriter) error { w.WriteHeader(http.StatusNotModified); return nil },
+			want:  http.StatusNotModified,
+		},
+		{
+			name:  "gone_error",
+			serve: func(w http.ResponseWriter) error { return caddyhttp.Error(http.StatusGone, errors.New("expired")) },
+			want:  http.StatusGone,
+		},
+		{
+			name:  "plain_error",
+			serve: func(w http.ResponseWriter) error { return errors.New("boom") },
+			want:  http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := newResponseRecorder(httptest.NewRecorder())
+			err := tc.serve(rec)
+			if got := rec.statusFor(err); got != tc.want {
+				t.Errorf("status = %d, want %d", got, tc.want)
+			}
+			if rec.bytes != tc.bytes {
+				t.Errorf("bytes = %d, want %d", rec.bytes, tc.bytes)
+			}
+		})
+	}
+}
+
+func TestAccessLogSinkRecord(t *testing.T) {
+	s := newAccessLogSink(nil, zap.NewNop(), 0)
+	s.setProject("blog", "rec1", true)
+
+	s.record(&accessLogEntry{Project: "blog"})
+	s.record(&accessLogEntry{Project: "other"})
+	s.record(&accessLogEntry{})
+	if got := len(s.entries); got != 1 {
+		t.Fatalf("queued %d entries, want 1 (only opted-in projects)", got)
+	}
+
+	for i := 0; i < accessLogBuffer; i++ {
+		s.record(&accessLogEntry{Project: "blog"})
+	}
+	if got := s.dropped.Load(); got != 1 {
+		t.Errorf("dropped = %d, want 1 when the buffer is full", got)
+	}
+
+	s.setProject("blog", "", false)
+	var nilSink *accessLogSink
+	nilSink.record(&accessLogEntry{Project: "blog"})
+}
+
+func TestMetricsProjectLabel(t *testing.T) {
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := []byte(`{"image_id":"img_1","manifest":{}}`)
+	if err := backend.PutRef("site", "prod", ref); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &SitePodHandler{
+		Domain: "example.com",
+		appState: &appState{
+			cache:        newRefCache(testCacheConfig()),
+			routingCache: newRoutingCache(testCacheConfig()),
+			manifests:    manifest.NewStore(backend, 100),
+			metrics:      metrics.New(10, time.Now()),
+		},
+		storage: backend,
+		config:  config.Default(),
+		logger:  zap.NewNop(),
+	}
+	for _, host := range []string{"site.example.com", "random1.example.com", "random2.example.com"} {
+		r := httptest.NewRequest("GET", "http://"+host+"/missing.js", nil)
+		_ = h.serveStaticLogged(httptest.NewRecorder(), r)
+	}
+
+	// Only the deployed project gets its own label
+	families, err := h.metrics.Registry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "sitepod_http_requests_total" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "project" {
+					projects[label.GetValue()] += m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	if projects["site"] != 1 || projects[metrics.UnknownProject] != 2 || len(projects) != 2 {
+		t.Errorf("requests by project = %v, want site once and the rest %s", projects, metrics.UnknownProject)
+	}
+}
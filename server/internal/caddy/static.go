@@ -12,23 +12,24 @@ import (
 	"strings"
 	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/sitepod/sitepod/internal/purge"
 	"github.com/sitepod/sitepod/internal/storage"
 )
 
 // handleStatic serves static files for deployed sites
 func (h *SitePodHandler) handleStatic(w http.ResponseWriter, r *http.Request) error {
-	host := r.Host
 	path := r.URL.Path
 
-	if idx := strings.Index(host, ":"); idx != -1 {
-		host = host[:idx]
-	}
-
-	project, env, stripPath := h.resolveRouting(host, path)
+	project, env, stripPath, routed := h.resolveRouting(requestHost(r), path)
 	if project == "" {
 		return caddyhttp.Error(http.StatusNotFound, errors.New("site not found"))
 	}
+	setProjectPlaceholders(r, project, env)
+	if routed {
+		markProjectFound(r)
+	}
 
 	// Handle preview paths
 	if stripPath == "" && strings.HasPrefix(path, "/__preview__/") {
@@ -58,6 +59,7 @@ func (h *SitePodHandler) handleStatic(w http.ResponseWriter, r *http.Request) er
 		}
 		if cookie, err := r.Cookie("sitepod_env"); err == nil && cookie.Value == "beta" {
 			env = "beta"
+			setProjectPlaceholders(r, project, env)
 		}
 	}
 
@@ -72,8 +74,43 @@ func (h *SitePodHandler) handleStatic(w http.ResponseWriter, r *http.Request) er
 	return h.serveStatic(w, r, project, env, servePath)
 }
 
-// resolveRouting determines the project and environment from host and path
-func (h *SitePodHandler) resolveRouting(host, path string) (string, string, string) {
+// requestHost returns the request host without port
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if idx := strings.Index(host, ":"); idx != -1 {
+		host = host[:idx]
+	}
+	return host
+}
+
+// setProjectPlaceholders exposes the resolved project and environment as
+// {sitepod.project} and {sitepod.env} for use in later handlers and logs
+func setProjectPlaceholders(r *http.Request, project, env string) {
+	if info := getRequestInfo(r); info != nil {
+		info.project = project
+		info.env = env
+	}
+
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+	repl.Set("sitepod.project", project)
+	repl.Set("sitepod.env", env)
+}
+
+// markProjectFound records that the request's project exists, so metrics
+// may label the request with it
+func markProjectFound(r *http.Request) {
+	if info := getRequestInfo(r); info != nil {
+		info.projectFound = true
+	}
+}
+
+// resolveRouting determines the project and environment from host and
+// path and reports whether they came from a routing entry. Otherwise they
+// are parsed from the subdomain, and the project may not exist.
+func (h *SitePodHandler) resolveRouting(host, path string) (project, env, stripPath string, routed bool) {
 	index := h.getRoutingIndex()
 	if index != nil {
 		var matches []RoutingEntry
@@ -97,12 +134,12 @@ func (h *SitePodHandler) resolveRouting(host, path string) (string, string, stri
 			if env == "" {
 				env = "prod"
 			}
-			return match.Project, env, stripPath
+			return match.Project, env, stripPath, true
 		}
 	}
 
-	project, env := h.extractProjectAndEnv(host)
-	return project, env, ""
+	project, env = h.extractProjectAndEnv(host)
+	return project, env, "", false
 }
 
 // Reserved subdomains that map to system projects
@@ -159,30 +196,32 @@ func (h *SitePodHandler) extractProjectAndEnv(host string) (string, string) {
 
 // getRoutingIndex retrieves the cached routing index
 func (h *SitePodHandler) getRoutingIndex() *RoutingIndex {
-	if cached, ok := h.routingCache.Get(); ok {
-		return cached
-	}
-
-	data, err := h.storage.GetRouting()
-	if err != nil {
-		return nil
-	}
-
-	var index RoutingIndex
-	if err := json.Unmarshal(data, &index); err != nil {
-		return nil
-	}
-
-	h.routingCache.Set(&index)
-	return &index
+	index, hit := h.routingCache.Load(func() (*RoutingIndex, error) {
+		data, err := h.storage.GetRouting()
+		if err != nil {
+			return nil, err
+		}
+		var index RoutingIndex
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, err
+		}
+		return &index, nil
+	})
+	h.metrics.ObserveCache("routing", hit)
+	return index
 }
 
 // serveStatic serves a static file from a deployed environment
 func (h *SitePodHandler) serveStatic(w http.ResponseWriter, r *http.Request, project, env, path string) error {
-	ref, err := h.getRef(project, env)
+	ref, hit, err := h.getRef(project, env)
 	if err != nil {
 		return caddyhttp.Error(http.StatusNotFound, err)
 	}
+	if info := getRequestInfo(r); info != nil {
+		info.projectFound = true
+		info.imageID = ref.ImageID
+		info.cacheHit = hit
+	}
 
 	lookupPath := strings.TrimPrefix(path, "/")
 	if lookupPath == "" || strings.HasSuffix(lookupPath, "/") {
@@ -203,7 +242,7 @@ func (h *SitePodHandler) serveStatic(w http.ResponseWriter, r *http.Request, pro
 		}
 	}
 
-	return h.serveBlob(w, r, lookupPath, file)
+	return h.serveBlob(w, r, lookupPath, file, purge.FileKeys(project, env, ref.ImageID, file.Hash))
 }
 
 // servePreview serves files from a preview deployment
@@ -244,14 +283,24 @@ func (h *SitePodHandler) servePreviewBySlug(w http.ResponseWriter, r *http.Reque
 		return caddyhttp.Error(http.StatusInternalServerError, err)
 	}
 
+	if info := getRequestInfo(r); info != nil {
+		info.projectFound = true
+		info.imageID = preview.ImageID
+	}
+
 	if time.Now().After(preview.ExpiresAt) {
 		_ = h.storage.DeletePreview(project, slug)
 		return caddyhttp.Error(http.StatusGone, errors.New("preview expired"))
 	}
 
-	file, ok := preview.Manifest[filePath]
+	m, err := h.manifests.Ref(preview.ManifestHash, preview.Manifest)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	file, ok := m.Files[filePath]
 	if !ok {
-		if fallback, ok := preview.Manifest["index.html"]; ok {
+		if fallback, ok := m.Files["index.html"]; ok {
 			file = fallback
 			filePath = "index.html"
 		} else {
@@ -259,17 +308,21 @@ func (h *SitePodHandler) servePreviewBySlug(w http.ResponseWriter, r *http.Reque
 		}
 	}
 
-	return h.serveBlob(w, r, filePath, file)
+	return h.serveBlob(w, r, filePath, file, purge.FileKeys(project, "preview", preview.ImageID, file.Hash))
 }
 
-// getRef retrieves ref data for a project and environment
-func (h *SitePodHandler) getRef(project, env string) (*storage.RefData, error) {
-	cacheKey := project + ":" + env
-
-	if cached, ok := h.cache.Get(cacheKey); ok {
-		return cached, nil
-	}
+// getRef retrieves ref data for a project and environment and reports
+// whether it came from the cache
+func (h *SitePodHandler) getRef(project, env string) (*storage.RefData, bool, error) {
+	ref, hit, err := h.cache.Load(project+":"+env, func() (*storage.RefData, error) {
+		return h.loadRef(project, env)
+	})
+	h.metrics.ObserveCache("ref", hit)
+	return ref, hit, err
+}
 
+// loadRef reads a ref from storage with its manifest
+func (h *SitePodHandler) loadRef(project, env string) (*storage.RefData, error) {
 	data, err := h.storage.GetRef(project, env)
 	if err != nil {
 		return nil, err
@@ -279,13 +332,18 @@ func (h *SitePodHandler) getRef(project, env string) (*storage.RefData, error) {
 	if err := json.Unmarshal(data, &ref); err != nil {
 		return nil, err
 	}
-
-	h.cache.Set(cacheKey, &ref)
+	m, err := h.manifests.Ref(ref.ManifestHash, ref.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	ref.Manifest = m.Files
 	return &ref, nil
 }
 
-// serveBlob serves a blob file with proper headers
-func (h *SitePodHandler) serveBlob(w http.ResponseWriter, r *http.Request, path string, file storage.FileEntry) error {
+// serveBlob serves a blob file with proper headers. keys are sent as
+// Surrogate-Key (Fastly, Varnish xkey) and Cache-Tag (Cloudflare) so
+// releases can purge exactly the responses they change.
+func (h *SitePodHandler) serveBlob(w http.ResponseWriter, r *http.Request, path string, file storage.FileEntry, keys []string) error {
 	reader, err := h.storage.GetBlob(file.Hash)
 	if err != nil {
 		return caddyhttp.Error(http.StatusInternalServerError, err)
@@ -303,6 +361,10 @@ func (h *SitePodHandler) serveBlob(w http.ResponseWriter, r *http.Request, path
 
 	etag := `"` + file.Hash[:16] + `"`
 	w.Header().Set("ETag", etag)
+	if len(keys) > 0 {
+		w.Header().Set("Surrogate-Key", strings.Join(keys, " "))
+		w.Header().Set("Cache-Tag", strings.Join(keys, ","))
+	}
 
 	if r.Header.Get("If-None-Match") == etag {
 		w.WriteHeader(http.StatusNotModified)
@@ -311,6 +373,9 @@ func (h *SitePodHandler) serveBlob(w http.ResponseWriter, r *http.Request, path
 
 	if strings.HasPrefix(path, "assets/") || strings.HasPrefix(path, "_next/") {
 		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else if h.purger != nil && h.config.Purge.HTMLCacheControl != "" {
+		// Releases purge the CDN, so it may cache pages until then
+		w.Header().Set("Cache-Control", h.config.Purge.HTMLCacheControl)
 	} else {
 		w.Header().Set("Cache-Control", "public, max-age=0, must-revalidate")
 	}
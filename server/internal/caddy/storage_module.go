@@ -0,0 +1,194 @@
+package caddy
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/sitepod/sitepod/internal/config"
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+func init() {
+	caddy.RegisterModule(LocalStorage{})
+	caddy.RegisterModule(S3Storage{})
+}
+
+// StorageProvider is implemented by modules in the sitepod.storage namespace.
+// The handler calls Backend once, after the module has been provisioned and
+// validated, and uses the returned backend for all blob, ref and preview I/O.
+type StorageProvider interface {
+	Backend() (storage.Backend, error)
+}
+
+// LocalStorage stores blobs and refs on the local filesystem
+type LocalStorage struct {
+	// Path is the root directory for blobs, refs and previews
+	Path string `json:"path,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information
+func (LocalStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "sitepod.storage.local",
+		New: func() caddy.Module { return new(LocalStorage) },
+	}
+}
+
+// Provision sets defaults
+func (s *LocalStorage) Provision(ctx caddy.Context) error {
+	if s.Path == "" {
+		s.Path = "./data"
+	}
+	return nil
+}
+
+// Validate validates the configuration
+func (s *LocalStorage) Validate() error {
+	if s.Path == "" {
+		return errors.New("local storage: path is required")
+	}
+	return nil
+}
+
+// Backend creates the local storage backend
+func (s *LocalStorage) Backend() (storage.Backend, error) {
+	return storage.NewLocalBackend(s.Path)
+}
+
+// UnmarshalCaddyfile parses:
+//
+//	storage local [<path>] {
+//	    path <path>
+//	}
+func (s *LocalStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			s.Path = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "path":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				s.Path = d.Val()
+			default:
+				return d.Errf("unrecognized local storage option: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// S3Storage stores blobs and refs in an S3-compatible bucket (AWS S3, R2, OSS, MinIO).
+// Credentials and an unset region are resolved from the standard AWS
+// environment/credential chain.
+type S3Storage struct {
+	Bucket   string `json:"bucket,omitempty"`
+	Region   string `json:"region,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information
+func (S3Storage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "sitepod.storage.s3",
+		New: func() caddy.Module { return new(S3Storage) },
+	}
+}
+
+// Validate validates the configuration
+func (s *S3Storage) Validate() error {
+	if s.Bucket == "" {
+		return errors.New("s3 storage: bucket is required")
+	}
+	return nil
+}
+
+// Backend creates the S3 storage backend
+func (s *S3Storage) Backend() (storage.Backend, error) {
+	return storage.NewS3Backend(s.Bucket, s.Region, s.Endpoint)
+}
+
+// UnmarshalCaddyfile parses:
+//
+//	storage s3 {
+//	    bucket   <name>
+//	    region   <region>
+//	    endpoint <url>
+//	}
+func (s *S3Storage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			key := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch key {
+			case "bucket":
+				s.Bucket = d.Val()
+			case "region":
+				s.Region = d.Val()
+			case "endpoint":
+				s.Endpoint = d.Val()
+			default:
+				return d.Errf("unrecognized s3 storage option: %s", key)
+			}
+		}
+	}
+	return nil
+}
+
+// defaultStorageConfig builds the storage module config from the [storage]
+// config section (and its SITEPOD_STORAGE_TYPE / SITEPOD_S3_* overrides). It
+// is used when the handler config has no explicit storage block.
+func defaultStorageConfig(cfg config.StorageConfig) json.RawMessage {
+	switch cfg.Type {
+	case "s3", "oss", "r2":
+		return caddyconfig.JSONModuleObject(S3Storage{
+			Bucket:   cfg.S3.Bucket,
+			Region:   cfg.S3.Region,
+			Endpoint: cfg.S3.Endpoint,
+		}, "backend", "s3", nil)
+	default:
+		return caddyconfig.JSONModuleObject(LocalStorage{Path: cfg.Path}, "backend", "local", nil)
+	}
+}
+
+// loadStorage loads the configured sitepod.storage module and opens its backend
+func (h *SitePodHandler) loadStorage(ctx caddy.Context) (storage.Backend, string, error) {
+	mod, err := ctx.LoadModule(h, "StorageRaw")
+	if err != nil {
+		return nil, "", err
+	}
+	provider, ok := mod.(StorageProvider)
+	if !ok {
+		return nil, "", errors.New("storage module does not implement StorageProvider")
+	}
+
+	backend, err := provider.Backend()
+	if err != nil {
+		return nil, "", err
+	}
+	return backend, caddy.GetModuleName(mod), nil
+}
+
+// Interface guards
+var (
+	_ StorageProvider       = (*LocalStorage)(nil)
+	_ caddy.Provisioner     = (*LocalStorage)(nil)
+	_ caddy.Validator       = (*LocalStorage)(nil)
+	_ caddyfile.Unmarshaler = (*LocalStorage)(nil)
+	_ StorageProvider       = (*S3Storage)(nil)
+	_ caddy.Validator       = (*S3Storage)(nil)
+	_ caddyfile.Unmarshaler = (*S3Storage)(nil)
+)
@@ -0,0 +1,86 @@
+package caddy
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestUnmarshalCaddyfileStorage(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected map[string]string
+		wantErr  bool
+	}{
+		{
+			name: "s3_block",
+			input: `sitepod {
+				storage s3 {
+					bucket sitepod-data
+					region auto
+					endpoint https://r2.example.com
+				}
+			}`,
+			expected: map[string]string{
+				"backend":  "s3",
+				"bucket":   "sitepod-data",
+				"region":   "auto",
+				"endpoint": "https://r2.example.com",
+			},
+		},
+		{
+			name: "local_arg",
+			input: `sitepod {
+				storage local /srv/sitepod
+			}`,
+			expected: map[string]string{
+				"backend": "local",
+				"path":    "/srv/sitepod",
+			},
+		},
+		{
+			name: "unknown_backend",
+			input: `sitepod {
+				storage nope
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "unknown_option",
+			input: `sitepod {
+				storage s3 {
+					acl public
+				}
+			}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var h SitePodHandler
+			err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tc.input))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got map[string]string
+			if err := json.Unmarshal(h.StorageRaw, &got); err != nil {
+				t.Fatal(err)
+			}
+			for k, want := range tc.expected {
+				if got[k] != want {
+					t.Errorf("%s = %q, want %q", k, got[k], want)
+				}
+			}
+		})
+	}
+}
@@ -418,5 +418,9 @@ func (h *SitePodHandler) rebuildRoutingIndex() error {
 	}
 
 	indexJSON, _ := json.Marshal(index)
-	return h.storage.PutRouting(indexJSON)
+	if err := h.storage.PutRouting(indexJSON); err != nil {
+		return err
+	}
+	h.invalidateRouting()
+	return nil
 }
@@ -12,6 +12,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/manifest"
 	"github.com/sitepod/sitepod/internal/storage"
 	"github.com/zeebo/blake3"
 	"go.uber.org/zap"
@@ -165,18 +166,23 @@ func (h *SitePodHandler) ensureWelcomeSite(ownerID string) {
 	}
 
 	// Create manifest
-	manifest := map[string]storage.FileEntry{
+	files := map[string]storage.FileEntry{
 		"index.html": {
 			Hash: hash,
 			Size: int64(len(welcomeHTML)),
 		},
 	}
+	m := manifest.New(files)
+	if err := h.manifests.Put(m); err != nil {
+		h.logger.Warn("failed to write welcome manifest", zap.Error(err))
+		return
+	}
 
 	// Create image ID
 	imageID := fmt.Sprintf("img_%s", uuid.New().String()[:8])
 
 	// Calculate content hash
-	manifestBytes, _ := json.Marshal(manifest)
+	manifestBytes, _ := json.Marshal(files)
 	contentHasher := blake3.New()
 	if _, err := contentHasher.Write(manifestBytes); err != nil {
 		h.logger.Warn("failed to hash welcome manifest", zap.Error(err))
@@ -195,7 +201,7 @@ func (h *SitePodHandler) ensureWelcomeSite(ownerID string) {
 	image.Set("image_id", imageID)
 	image.Set("project_id", project.Id)
 	image.Set("content_hash", contentHash)
-	image.Set("manifest", manifest)
+	manifest.Set(image, m)
 	image.Set("file_count", 1)
 	image.Set("total_size", len(welcomeHTML))
 
@@ -206,10 +212,10 @@ func (h *SitePodHandler) ensureWelcomeSite(ownerID string) {
 
 	// Write ref for prod environment
 	refData := &storage.RefData{
-		ImageID:     imageID,
-		ContentHash: contentHash,
-		Manifest:    manifest,
-		UpdatedAt:   time.Now().UTC(),
+		ImageID:      imageID,
+		ContentHash:  contentHash,
+		ManifestHash: m.Hash,
+		UpdatedAt:    time.Now().UTC(),
 	}
 
 	refBytes, _ := json.Marshal(refData)
@@ -259,7 +265,7 @@ func (h *SitePodHandler) ensureConsoleSite(ownerID string) {
 	}
 
 	// Walk the dist directory and collect files
-	manifest := make(map[string]storage.FileEntry)
+	files := make(map[string]storage.FileEntry)
 	var totalSize int64
 
 	err = filepath.Walk(distPath, func(path string, info os.FileInfo, err error) error {
@@ -296,7 +302,7 @@ func (h *SitePodHandler) ensureConsoleSite(ownerID string) {
 		// Detect content type
 		contentType := mime.TypeByExtension(filepath.Ext(path))
 
-		manifest[relPath] = storage.FileEntry{
+		files[relPath] = storage.FileEntry{
 			Hash:        hash,
 			Size:        int64(len(content)),
 			ContentType: contentType,
@@ -311,16 +317,21 @@ func (h *SitePodHandler) ensureConsoleSite(ownerID string) {
 		return
 	}
 
-	if len(manifest) == 0 {
+	if len(files) == 0 {
 		h.logger.Warn("no files found in console dist")
 		return
 	}
+	m := manifest.New(files)
+	if err := h.manifests.Put(m); err != nil {
+		h.logger.Warn("failed to write console manifest", zap.Error(err))
+		return
+	}
 
 	// Create image record
 	imageID := fmt.Sprintf("img_%s", uuid.New().String()[:8])
 
 	// Calculate content hash from manifest
-	manifestBytes, _ := json.Marshal(manifest)
+	manifestBytes, _ := json.Marshal(files)
 	contentHasher := blake3.New()
 	if _, err := contentHasher.Write(manifestBytes); err != nil {
 		h.logger.Warn("failed to hash console manifest", zap.Error(err))
@@ -338,8 +349,8 @@ func (h *SitePodHandler) ensureConsoleSite(ownerID string) {
 	image.Set("image_id", imageID)
 	image.Set("project_id", project.Id)
 	image.Set("content_hash", contentHash)
-	image.Set("manifest", manifest)
-	image.Set("file_count", len(manifest))
+	manifest.Set(image, m)
+	image.Set("file_count", len(files))
 	image.Set("total_size", totalSize)
 
 	if err := h.app.Save(image); err != nil {
@@ -349,10 +360,10 @@ func (h *SitePodHandler) ensureConsoleSite(ownerID string) {
 
 	// Write ref for prod environment
 	refData := &storage.RefData{
-		ImageID:     imageID,
-		ContentHash: contentHash,
-		Manifest:    manifest,
-		UpdatedAt:   time.Now().UTC(),
+		ImageID:      imageID,
+		ContentHash:  contentHash,
+		ManifestHash: m.Hash,
+		UpdatedAt:    time.Now().UTC(),
 	}
 
 	refBytes, _ := json.Marshal(refData)
@@ -368,7 +379,7 @@ func (h *SitePodHandler) ensureConsoleSite(ownerID string) {
 
 	h.logger.Info("Console site deployed",
 		zap.String("url", fmt.Sprintf("%s://%s", scheme, h.Domain)),
-		zap.Int("files", len(manifest)),
+		zap.Int("files", len(files)),
 		zap.Int64("size", totalSize),
 	)
 }
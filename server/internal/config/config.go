@@ -0,0 +1,653 @@
+// Package config loads the SitePod server configuration.
+//
+// Values are resolved in this order, later sources overriding earlier ones:
+//
+//  1. Built-in defaults (Default)
+//  2. config.toml (see server/config.example.toml)
+//  3. SITEPOD_* environment variables (see ApplyEnv)
+//  4. Caddyfile / JSON handler options (domain, storage_path, data_dir,
+//     cache_ttl, storage), applied by the Caddy handler
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// DefaultPath is the config file loaded when no path is given and it exists
+const DefaultPath = "config.toml"
+
+// Config is the server configuration
+type Config struct {
+	Server    ServerConfig    `toml:"server,omitempty"`
+	Domain    DomainConfig    `toml:"domain"`
+	Storage   StorageConfig   `toml:"storage"`
+	Database  DatabaseConfig  `toml:"database"`
+	Cache     CacheConfig     `toml:"cache"`
+	GC        GCConfig        `toml:"gc"`
+	Quota     QuotaConfig     `toml:"quota"`
+	Log       LogConfig       `toml:"log"`
+	Analytics AnalyticsConfig `toml:"analytics"`
+	Metrics   MetricsConfig   `toml:"metrics"`
+	Purge     PurgeConfig     `toml:"purge"`
+
+	// Source is the config file that was loaded, if any
+	Source string `toml:"-"`
+	// Warnings lists non-fatal problems such as unknown keys
+	Warnings []string `toml:"-"`
+}
+
+// ServerConfig is accepted for compatibility. Listeners are configured in
+// the Caddyfile; these values are not used.
+type ServerConfig struct {
+	HTTPAddr  string `toml:"http_addr,omitempty"`
+	HTTPSAddr string `toml:"https_addr,omitempty"`
+	AdminAddr string `toml:"admin_addr,omitempty"`
+}
+
+// DomainConfig holds the base domain
+type DomainConfig struct {
+	Primary string `toml:"primary"`
+	// ACMEEmail is accepted for compatibility; set `email` in the Caddyfile
+	ACMEEmail string `toml:"acme_email,omitempty"`
+}
+
+// StorageConfig selects and configures the storage backend
+type StorageConfig struct {
+	Type string   `toml:"type"` // local, s3, oss, r2
+	Path string   `toml:"path"` // local storage root
+	S3   S3Config `toml:"s3"`
+	// DedupScope is "tenant" to let deploys reuse only blobs the project
+	// owner has uploaded or deployed before, or "global" to reuse any
+	// stored blob. Blobs are stored once either way.
+	DedupScope string `toml:"dedup_scope"`
+}
+
+// S3Config configures S3-compatible storage.
+// Credentials come from the standard AWS environment/credential chain.
+type S3Config struct {
+	Bucket   string `toml:"bucket"`
+	Region   string `toml:"region"`
+	Endpoint string `toml:"endpoint"`
+}
+
+// DatabaseConfig configures PocketBase
+type DatabaseConfig struct {
+	// DataDir is the PocketBase data directory (defaults to storage.path)
+	DataDir string `toml:"data_dir"`
+}
+
+// CacheConfig configures the in-memory ref cache
+type CacheConfig struct {
+	ManifestTTL time.Duration `toml:"manifest_ttl"`
+	MaxEntries  int           `toml:"max_entries"`
+	// NegativeTTL is how long refs and routing indexes found missing are
+	// remembered, so unknown hosts do not read storage on every request
+	NegativeTTL time.Duration `toml:"negative_ttl"`
+	// ManifestFiles is how many files the manifests kept in memory may
+	// list in total; 0 reads every manifest from storage
+	ManifestFiles int `toml:"manifest_files"`
+	// KnownBlobs is how many blobs seen in storage are remembered, so
+	// deploys do not check them again; 0 disables it. Only enable it on a
+	// single instance: a blob deleted by another instance's GC is still
+	// reported as stored until its entry is KnownBlobsTTL old.
+	KnownBlobs    int           `toml:"known_blobs"`
+	KnownBlobsTTL time.Duration `toml:"known_blobs_ttl"`
+
+	Invalidation InvalidationConfig `toml:"invalidation"`
+}
+
+// InvalidationConfig configures how instances sharing storage tell each
+// other to drop cached refs and routing after releases
+type InvalidationConfig struct {
+	// Transport is journal, redis or peers; empty only invalidates the
+	// cache of the instance that made the change
+	Transport string `toml:"transport"`
+	// PollInterval is how often instances read the journal
+	PollInterval time.Duration `toml:"poll_interval"`
+	// RedisURL is a redis:// or rediss:// URL
+	RedisURL     string `toml:"redis_url"`
+	RedisChannel string `toml:"redis_channel"`
+	// Peers are the base URLs of every instance, e.g. http://10.0.0.2:8080
+	Peers []string `toml:"peers"`
+	// Secret authenticates messages between peers
+	Secret string `toml:"secret"`
+}
+
+// GCConfig configures garbage collection
+type GCConfig struct {
+	Enabled     bool          `toml:"enabled"`
+	Interval    time.Duration `toml:"interval"`
+	GracePeriod time.Duration `toml:"grace_period"`
+	// Retention deletes the images of each project that min_versions and
+	// keep_days no longer keep. Off by default, so upgrading never
+	// deletes image history; GC dry runs show what it would delete.
+	Retention   bool `toml:"retention"`
+	MinVersions int  `toml:"min_versions"`
+	KeepDays    int  `toml:"keep_days"`
+	// ReconcileInterval is how often a cycle rebuilds the blob index with
+	// a full scan; other cycles sweep from the index
+	ReconcileInterval time.Duration `toml:"reconcile_interval"`
+}
+
+// QuotaConfig holds deployment limits
+type QuotaConfig struct {
+	MaxFilesPerDeploy  int   `toml:"max_files_per_deploy"`
+	MaxFileSize        int64 `toml:"max_file_size"`
+	MaxDeploySize      int64 `toml:"max_deploy_size"`
+	MaxProjectsPerUser int   `toml:"max_projects_per_user"`
+}
+
+// LogConfig configures SitePod's own log output
+type LogConfig struct {
+	// Level is the minimum level of SitePod log messages. Caddy's log
+	// configuration still applies on top of it.
+	Level string `toml:"level"`
+	// Access logs every static request at INFO level. Without it only
+	// errors and slow requests are logged, at DEBUG level.
+	Access bool `toml:"access"`
+	// AccessSampleRate is the fraction of successful requests written to
+	// the access log. Server errors and slow requests are always logged.
+	AccessSampleRate float64 `toml:"access_sample_rate"`
+	// AccessRetention is how long persisted per-project access logs are kept
+	AccessRetention time.Duration `toml:"access_retention"`
+}
+
+// AnalyticsConfig configures per-project traffic analytics
+type AnalyticsConfig struct {
+	Enabled bool `toml:"enabled"`
+	// FlushInterval is how often in-memory counters are written to the database
+	FlushInterval time.Duration `toml:"flush_interval"`
+	// RetentionDays is how many days of counters are kept (0 keeps them forever)
+	RetentionDays int `toml:"retention_days"`
+	// TopN bounds the stored top paths, referrers and 404 paths per day
+	TopN int `toml:"top_n"`
+}
+
+// MetricsConfig configures the Prometheus endpoint (/api/v1/metrics)
+type MetricsConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Token, if set, must be sent as a bearer token to read metrics.
+	// Admins (SITEPOD_ADMIN_TOKEN or is_admin users) are always allowed.
+	Token string `toml:"token"`
+	// MaxProjects bounds the number of distinct project label values;
+	// further projects are reported as "_other"
+	MaxProjects int `toml:"max_projects"`
+}
+
+// PurgeConfig configures CDN cache purging after releases and rollbacks
+type PurgeConfig struct {
+	// Provider is cloudflare, fastly, bunny or http; empty disables purging
+	Provider string `toml:"provider"`
+	// HTMLCacheControl replaces the Cache-Control header of non-asset files
+	// (HTML and other paths that change between releases) when a provider
+	// is configured, e.g. to let the CDN cache them with s-maxage
+	HTMLCacheControl string `toml:"html_cache_control"`
+
+	Cloudflare CloudflarePurgeConfig `toml:"cloudflare"`
+	Fastly     FastlyPurgeConfig     `toml:"fastly"`
+	Bunny      BunnyPurgeConfig      `toml:"bunny"`
+	HTTP       HTTPPurgeConfig       `toml:"http"`
+}
+
+// CloudflarePurgeConfig configures purging a Cloudflare zone
+type CloudflarePurgeConfig struct {
+	ZoneID   string `toml:"zone_id"`
+	APIToken string `toml:"api_token"`
+}
+
+// FastlyPurgeConfig configures purging a Fastly service
+type FastlyPurgeConfig struct {
+	ServiceID string `toml:"service_id"`
+	APIToken  string `toml:"api_token"`
+}
+
+// BunnyPurgeConfig configures purging a Bunny CDN pull zone
+type BunnyPurgeConfig struct {
+	APIKey     string `toml:"api_key"`
+	PullZoneID string `toml:"pull_zone_id"`
+}
+
+// HTTPPurgeConfig configures purging a cache with PURGE requests
+type HTTPPurgeConfig struct {
+	// Endpoint receives purge requests with the site's Host header; if
+	// empty, requests go to the site URLs
+	Endpoint string            `toml:"endpoint"`
+	Method   string            `toml:"method"`
+	Headers  map[string]string `toml:"headers"`
+	// KeyHeader sends surrogate keys in this header instead of purging URLs
+	KeyHeader string `toml:"key_header"`
+}
+
+// Default returns the built-in defaults
+func Default() *Config {
+	return &Config{
+		Domain: DomainConfig{
+			Primary: "localhost",
+		},
+		Storage: StorageConfig{
+			Type: "local",
+			Path: "./data",
+
+			DedupScope: "tenant",
+		},
+		Cache: CacheConfig{
+			ManifestTTL: 5 * time.Second,
+			MaxEntries:  1000,
+			NegativeTTL: time.Second,
+
+			ManifestFiles: 200000,
+			KnownBlobsTTL: 10 * time.Minute,
+
+			Invalidation: InvalidationConfig{
+				PollInterval: time.Second,
+				RedisChannel: "sitepod:invalidate",
+			},
+		},
+		GC: GCConfig{
+			Enabled:     true,
+			Interval:    24 * time.Hour,
+			GracePeriod: 1 * time.Hour,
+			MinVersions: 5,
+			KeepDays:    30,
+
+			ReconcileInterval: 7 * 24 * time.Hour,
+		},
+		Quota: QuotaConfig{
+			MaxFilesPerDeploy:  10000,
+			MaxFileSize:        100 * 1024 * 1024, // 100MB
+			MaxDeploySize:      500 * 1024 * 1024, // 500MB
+			MaxProjectsPerUser: 100,
+		},
+		Log: LogConfig{
+			Level:            "info",
+			AccessSampleRate: 1,
+			AccessRetention:  7 * 24 * time.Hour,
+		},
+		Metrics: MetricsConfig{
+			Enabled:     true,
+			MaxProjects: 100,
+		},
+		Analytics: AnalyticsConfig{
+			Enabled:       true,
+			FlushInterval: 30 * time.Second,
+			RetentionDays: 90,
+			TopN:          100,
+		},
+	}
+}
+
+// Load builds the configuration from defaults, the config file and the
+// process environment. If path is empty, SITEPOD_CONFIG is used, then
+// DefaultPath if it exists.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path == "" {
+		path = os.Getenv("SITEPOD_CONFIG")
+	}
+	if path == "" {
+		if _, err := os.Stat(DefaultPath); err == nil {
+			path = DefaultPath
+		}
+	}
+	if path != "" {
+		if err := cfg.LoadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.ApplyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadFile merges a TOML file into the configuration. Keys not present in
+// the file keep their current values; unknown keys are recorded as warnings.
+func (c *Config) LoadFile(path string) error {
+	md, err := toml.DecodeFile(path, c)
+	if err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	for _, key := range md.Undecoded() {
+		c.Warnings = append(c.Warnings, fmt.Sprintf("%s: unknown key %q", path, key.String()))
+	}
+	c.Source = path
+	return nil
+}
+
+// ApplyEnv overrides configuration values from environment variables:
+//
+//	SITEPOD_DOMAIN                     domain.primary
+//	SITEPOD_STORAGE_TYPE               storage.type
+//	SITEPOD_STORAGE_PATH               storage.path
+//	SITEPOD_S3_BUCKET                  storage.s3.bucket
+//	SITEPOD_S3_REGION                  storage.s3.region
+//	SITEPOD_S3_ENDPOINT                storage.s3.endpoint
+//	SITEPOD_DEDUP_SCOPE                storage.dedup_scope
+//	SITEPOD_DATA_DIR                   database.data_dir
+//	SITEPOD_CACHE_TTL                  cache.manifest_ttl
+//	SITEPOD_CACHE_MAX_ENTRIES          cache.max_entries
+//	SITEPOD_CACHE_NEGATIVE_TTL         cache.negative_ttl
+//	SITEPOD_CACHE_MANIFEST_FILES       cache.manifest_files
+//	SITEPOD_CACHE_KNOWN_BLOBS          cache.known_blobs
+//	SITEPOD_CACHE_KNOWN_BLOBS_TTL      cache.known_blobs_ttl
+//	SITEPOD_CACHE_INVALIDATION         cache.invalidation.transport
+//	SITEPOD_CACHE_INVALIDATION_POLL    cache.invalidation.poll_interval
+//	SITEPOD_CACHE_INVALIDATION_REDIS   cache.invalidation.redis_url
+//	SITEPOD_CACHE_INVALIDATION_PEERS   cache.invalidation.peers (comma-separated)
+//	SITEPOD_CACHE_INVALIDATION_SECRET  cache.invalidation.secret
+//	SITEPOD_GC_ENABLED                 gc.enabled
+//	SITEPOD_GC_INTERVAL                gc.interval
+//	SITEPOD_GC_GRACE_PERIOD            gc.grace_period
+//	SITEPOD_GC_RETENTION               gc.retention
+//	SITEPOD_GC_MIN_VERSIONS            gc.min_versions
+//	SITEPOD_GC_KEEP_DAYS               gc.keep_days
+//	SITEPOD_GC_RECONCILE_INTERVAL      gc.reconcile_interval
+//	SITEPOD_MAX_FILES_PER_DEPLOY       quota.max_files_per_deploy
+//	SITEPOD_MAX_FILE_SIZE              quota.max_file_size
+//	SITEPOD_MAX_DEPLOY_SIZE            quota.max_deploy_size
+//	SITEPOD_MAX_PROJECTS_PER_USER      quota.max_projects_per_user
+//	SITEPOD_LOG_LEVEL                  log.level
+//	SITEPOD_ACCESS_LOG                 log.access
+//	SITEPOD_ACCESS_LOG_SAMPLE_RATE     log.access_sample_rate
+//	SITEPOD_ACCESS_LOG_RETENTION       log.access_retention
+//	SITEPOD_METRICS_ENABLED            metrics.enabled
+//	SITEPOD_METRICS_TOKEN              metrics.token
+//	SITEPOD_METRICS_MAX_PROJECTS       metrics.max_projects
+//	SITEPOD_ANALYTICS_ENABLED          analytics.enabled
+//	SITEPOD_ANALYTICS_FLUSH_INTERVAL   analytics.flush_interval
+//	SITEPOD_ANALYTICS_RETENTION_DAYS   analytics.retention_days
+//	SITEPOD_ANALYTICS_TOP_N            analytics.top_n
+//	SITEPOD_PURGE_PROVIDER             purge.provider
+//	SITEPOD_PURGE_HTML_CACHE_CONTROL   purge.html_cache_control
+//	SITEPOD_CLOUDFLARE_ZONE_ID         purge.cloudflare.zone_id
+//	SITEPOD_CLOUDFLARE_API_TOKEN       purge.cloudflare.api_token
+//	SITEPOD_FASTLY_SERVICE_ID          purge.fastly.service_id
+//	SITEPOD_FASTLY_API_TOKEN           purge.fastly.api_token
+//	SITEPOD_BUNNY_API_KEY              purge.bunny.api_key
+//	SITEPOD_BUNNY_PULL_ZONE_ID         purge.bunny.pull_zone_id
+//	SITEPOD_PURGE_HTTP_ENDPOINT        purge.http.endpoint
+//
+// Empty variables are ignored. Values that cannot be parsed are reported
+// together in the returned error.
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	e := envReader{lookup: lookup}
+
+	e.str("SITEPOD_DOMAIN", &c.Domain.Primary)
+	e.str("SITEPOD_STORAGE_TYPE", &c.Storage.Type)
+	e.str("SITEPOD_STORAGE_PATH", &c.Storage.Path)
+	e.str("SITEPOD_S3_BUCKET", &c.Storage.S3.Bucket)
+	e.str("SITEPOD_S3_REGION", &c.Storage.S3.Region)
+	e.str("SITEPOD_S3_ENDPOINT", &c.Storage.S3.Endpoint)
+	e.str("SITEPOD_DEDUP_SCOPE", &c.Storage.DedupScope)
+	e.str("SITEPOD_DATA_DIR", &c.Database.DataDir)
+	e.duration("SITEPOD_CACHE_TTL", &c.Cache.ManifestTTL)
+	e.int("SITEPOD_CACHE_MAX_ENTRIES", &c.Cache.MaxEntries)
+	e.duration("SITEPOD_CACHE_NEGATIVE_TTL", &c.Cache.NegativeTTL)
+	e.int("SITEPOD_CACHE_MANIFEST_FILES", &c.Cache.ManifestFiles)
+	e.int("SITEPOD_CACHE_KNOWN_BLOBS", &c.Cache.KnownBlobs)
+	e.duration("SITEPOD_CACHE_KNOWN_BLOBS_TTL", &c.Cache.KnownBlobsTTL)
+	e.str("SITEPOD_CACHE_INVALIDATION", &c.Cache.Invalidation.Transport)
+	e.duration("SITEPOD_CACHE_INVALIDATION_POLL", &c.Cache.Invalidation.PollInterval)
+	e.str("SITEPOD_CACHE_INVALIDATION_REDIS", &c.Cache.Invalidation.RedisURL)
+	e.list("SITEPOD_CACHE_INVALIDATION_PEERS", &c.Cache.Invalidation.Peers)
+	e.str("SITEPOD_CACHE_INVALIDATION_SECRET", &c.Cache.Invalidation.Secret)
+	e.bool("SITEPOD_GC_ENABLED", &c.GC.Enabled)
+	e.duration("SITEPOD_GC_INTERVAL", &c.GC.Interval)
+	e.duration("SITEPOD_GC_GRACE_PERIOD", &c.GC.GracePeriod)
+	e.bool("SITEPOD_GC_RETENTION", &c.GC.Retention)
+	e.int("SITEPOD_GC_MIN_VERSIONS", &c.GC.MinVersions)
+	e.int("SITEPOD_GC_KEEP_DAYS", &c.GC.KeepDays)
+	e.duration("SITEPOD_GC_RECONCILE_INTERVAL", &c.GC.ReconcileInterval)
+	e.int("SITEPOD_MAX_FILES_PER_DEPLOY", &c.Quota.MaxFilesPerDeploy)
+	e.int64("SITEPOD_MAX_FILE_SIZE", &c.Quota.MaxFileSize)
+	e.int64("SITEPOD_MAX_DEPLOY_SIZE", &c.Quota.MaxDeploySize)
+	e.int("SITEPOD_MAX_PROJECTS_PER_USER", &c.Quota.MaxProjectsPerUser)
+	e.str("SITEPOD_LOG_LEVEL", &c.Log.Level)
+	e.bool("SITEPOD_ACCESS_LOG", &c.Log.Access)
+	e.float64("SITEPOD_ACCESS_LOG_SAMPLE_RATE", &c.Log.AccessSampleRate)
+	e.duration("SITEPOD_ACCESS_LOG_RETENTION", &c.Log.AccessRetention)
+	e.bool("SITEPOD_METRICS_ENABLED", &c.Metrics.Enabled)
+	e.str("SITEPOD_METRICS_TOKEN", &c.Metrics.Token)
+	e.int("SITEPOD_METRICS_MAX_PROJECTS", &c.Metrics.MaxProjects)
+	e.bool("SITEPOD_ANALYTICS_ENABLED", &c.Analytics.Enabled)
+	e.duration("SITEPOD_ANALYTICS_FLUSH_INTERVAL", &c.Analytics.FlushInterval)
+	e.int("SITEPOD_ANALYTICS_RETENTION_DAYS", &c.Analytics.RetentionDays)
+	e.int("SITEPOD_ANALYTICS_TOP_N", &c.Analytics.TopN)
+	e.str("SITEPOD_PURGE_PROVIDER", &c.Purge.Provider)
+	e.str("SITEPOD_PURGE_HTML_CACHE_CONTROL", &c.Purge.HTMLCacheControl)
+	e.str("SITEPOD_CLOUDFLARE_ZONE_ID", &c.Purge.Cloudflare.ZoneID)
+	e.str("SITEPOD_CLOUDFLARE_API_TOKEN", &c.Purge.Cloudflare.APIToken)
+	e.str("SITEPOD_FASTLY_SERVICE_ID", &c.Purge.Fastly.ServiceID)
+	e.str("SITEPOD_FASTLY_API_TOKEN", &c.Purge.Fastly.APIToken)
+	e.str("SITEPOD_BUNNY_API_KEY", &c.Purge.Bunny.APIKey)
+	e.str("SITEPOD_BUNNY_PULL_ZONE_ID", &c.Purge.Bunny.PullZoneID)
+	e.str("SITEPOD_PURGE_HTTP_ENDPOINT", &c.Purge.HTTP.Endpoint)
+
+	return errors.Join(e.errs...)
+}
+
+// DataDir returns the PocketBase data directory
+func (c *Config) DataDir() string {
+	if c.Database.DataDir != "" {
+		return c.Database.DataDir
+	}
+	return c.Storage.Path
+}
+
+// Validate checks the configuration for invalid values
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Domain.Primary != "", "domain.primary is required")
+
+	switch c.Storage.Type {
+	case "local":
+		check(c.Storage.Path != "", "storage.path is required for local storage")
+	case "s3", "oss", "r2":
+		check(c.Storage.S3.Bucket != "", "storage.s3.bucket is required for %s storage", c.Storage.Type)
+	default:
+		check(false, "storage.type: unsupported value %q (want local, s3, oss or r2)", c.Storage.Type)
+	}
+	switch c.Storage.DedupScope {
+	case "tenant", "global":
+	default:
+		check(false, "storage.dedup_scope: unsupported value %q (want tenant or global)", c.Storage.DedupScope)
+	}
+
+	check(c.Cache.ManifestTTL >= 0, "cache.manifest_ttl must not be negative")
+	check(c.Cache.MaxEntries >= 0, "cache.max_entries must not be negative")
+	check(c.Cache.NegativeTTL >= 0, "cache.negative_ttl must not be negative")
+	check(c.Cache.ManifestFiles >= 0, "cache.manifest_files must not be negative")
+	check(c.Cache.KnownBlobs >= 0, "cache.known_blobs must not be negative")
+	check(c.Cache.KnownBlobs == 0 || c.Cache.KnownBlobsTTL > 0,
+		"cache.known_blobs_ttl must be positive when cache.known_blobs is set")
+	switch inv := c.Cache.Invalidation; inv.Transport {
+	case "":
+	case "journal":
+		check(inv.PollInterval > 0, "cache.invalidation.poll_interval must be positive for journal invalidation")
+	case "redis":
+		check(inv.RedisURL != "", "cache.invalidation.redis_url is required for redis invalidation")
+	case "peers":
+		check(len(inv.Peers) > 0 && inv.Secret != "",
+			"cache.invalidation.peers and secret are required for peers invalidation")
+	default:
+		check(false, "cache.invalidation.transport: unsupported value %q (want journal, redis or peers)", inv.Transport)
+	}
+
+	check(!c.GC.Enabled || c.GC.Interval > 0, "gc.interval must be positive when gc is enabled")
+	check(c.GC.GracePeriod >= 0, "gc.grace_period must not be negative")
+	check(c.GC.MinVersions >= 1, "gc.min_versions must be at least 1")
+	check(c.GC.KeepDays >= 0, "gc.keep_days must not be negative")
+	check(c.GC.ReconcileInterval >= 0, "gc.reconcile_interval must not be negative")
+
+	check(c.Quota.MaxFilesPerDeploy > 0, "quota.max_files_per_deploy must be positive")
+	check(c.Quota.MaxFileSize > 0, "quota.max_file_size must be positive")
+	check(c.Quota.MaxDeploySize > 0, "quota.max_deploy_size must be positive")
+	check(c.Quota.MaxProjectsPerUser > 0, "quota.max_projects_per_user must be positive")
+
+	check(c.Metrics.MaxProjects >= 0, "metrics.max_projects must not be negative")
+
+	check(!c.Analytics.Enabled || c.Analytics.FlushInterval > 0,
+		"analytics.flush_interval must be positive when analytics is enabled")
+	check(c.Analytics.RetentionDays >= 0, "analytics.retention_days must not be negative")
+	check(c.Analytics.TopN > 0, "analytics.top_n must be positive")
+
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		check(false, "log.level: unsupported value %q (want debug, info, warn or error)", c.Log.Level)
+	}
+	check(c.Log.AccessSampleRate >= 0 && c.Log.AccessSampleRate <= 1,
+		"log.access_sample_rate must be between 0 and 1")
+	check(c.Log.AccessRetention > 0, "log.access_retention must be positive")
+
+	switch c.Purge.Provider {
+	case "", "http":
+	case "cloudflare":
+		check(c.Purge.Cloudflare.ZoneID != "" && c.Purge.Cloudflare.APIToken != "",
+			"purge.cloudflare.zone_id and api_token are required for cloudflare purging")
+	case "fastly":
+		check(c.Purge.Fastly.ServiceID != "" && c.Purge.Fastly.APIToken != "",
+			"purge.fastly.service_id and api_token are required for fastly purging")
+	case "bunny":
+		check(c.Purge.Bunny.APIKey != "", "purge.bunny.api_key is required for bunny purging")
+	default:
+		check(false, "purge.provider: unsupported value %q (want cloudflare, fastly, bunny or http)", c.Purge.Provider)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the configuration with secrets masked,
+// suitable for printing
+func (c *Config) Redacted() *Config {
+	out := *c
+	if out.Metrics.Token != "" {
+		out.Metrics.Token = "<redacted>"
+	}
+	if u, err := url.Parse(out.Cache.Invalidation.RedisURL); err == nil && u.User != nil {
+		out.Cache.Invalidation.RedisURL = u.Redacted()
+	}
+	for _, secret := range []*string{
+		&out.Cache.Invalidation.Secret, &out.Purge.Cloudflare.APIToken, &out.Purge.Fastly.APIToken, &out.Purge.Bunny.APIKey,
+	} {
+		if *secret != "" {
+			*secret = "<redacted>"
+		}
+	}
+	if len(out.Purge.HTTP.Headers) > 0 {
+		headers := make(map[string]string, len(out.Purge.HTTP.Headers))
+		for k := range out.Purge.HTTP.Headers {
+			headers[k] = "<redacted>"
+		}
+		out.Purge.HTTP.Headers = headers
+	}
+	return &out
+}
+
+// envReader applies environment overrides and collects parse errors
+type envReader struct {
+	lookup func(string) (string, bool)
+	errs   []error
+}
+
+func (e *envReader) get(key string) (string, bool) {
+	v, ok := e.lookup(key)
+	v = strings.TrimSpace(v)
+	return v, ok && v != ""
+}
+
+func (e *envReader) fail(key, value string, err error) {
+	e.errs = append(e.errs, fmt.Errorf("%s=%q: %w", key, value, err))
+}
+
+func (e *envReader) str(key string, dst *string) {
+	if v, ok := e.get(key); ok {
+		*dst = v
+	}
+}
+
+// list splits a comma-separated value
+func (e *envReader) list(key string, dst *[]string) {
+	if v, ok := e.get(key); ok {
+		var items []string
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		*dst = items
+	}
+}
+
+func (e *envReader) int(key string, dst *int) {
+	if v, ok := e.get(key); ok {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			e.fail(key, v, err)
+			return
+		}
+		*dst = i
+	}
+}
+
+func (e *envReader) int64(key string, dst *int64) {
+	if v, ok := e.get(key); ok {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			e.fail(key, v, err)
+			return
+		}
+		*dst = i
+	}
+}
+
+func (e *envReader) float64(key string, dst *float64) {
+	if v, ok := e.get(key); ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			e.fail(key, v, err)
+			return
+		}
+		*dst = f
+	}
+}
+
+func (e *envReader) bool(key string, dst *bool) {
+	if v, ok := e.get(key); ok {
+		switch strings.ToLower(v) {
+		case "1", "true", "yes", "on":
+			*dst = true
+		case "0", "false", "no", "off":
+			*dst = false
+		default:
+			e.fail(key, v, errors.New("invalid boolean"))
+		}
+	}
+}
+
+func (e *envReader) duration(key string, dst *time.Duration) {
+	if v, ok := e.get(key); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			e.fail(key, v, err)
+			return
+		}
+		*dst = d
+	}
+}
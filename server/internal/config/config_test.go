@@ -0,0 +1,270 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func envMap(m map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := m[key]
+		return v, ok
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := writeConfig(t, `
+[storage]
+type = "s3"
+[storage.s3]
+bucket = "sites"
+
+[cache]
+manifest_ttl = "10s"
+
+[gc]
+keep_days = 7
+
+[log]
+format = "json"
+`)
+
+	cfg := Default()
+	if err := cfg.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Storage.Type != "s3" || cfg.Storage.S3.Bucket != "sites" {
+		t.Errorf("storage = %+v", cfg.Storage)
+	}
+	if cfg.Cache.ManifestTTL != 10*time.Second {
+		t.Errorf("cache.manifest_ttl = %v, want 10s", cfg.Cache.ManifestTTL)
+	}
+	if cfg.GC.KeepDays != 7 {
+		t.Errorf("gc.keep_days = %d, want 7", cfg.GC.KeepDays)
+	}
+	// Keys missing from the file keep their defaults
+	if cfg.GC.MinVersions != 5 || cfg.Cache.MaxEntries != 1000 {
+		t.Errorf("defaults not preserved: gc=%+v cache=%+v", cfg.GC, cfg.Cache)
+	}
+	if len(cfg.Warnings) != 1 || !strings.Contains(cfg.Warnings[0], "log.format") {
+		t.Errorf("warnings = %v, want unknown key log.format", cfg.Warnings)
+	}
+	if cfg.Source != path {
+		t.Errorf("source = %q, want %q", cfg.Source, path)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	testCases := []struct {
+		name    string
+		env     map[string]string
+		check   func(*Config) bool
+		wantErr bool
+	}{
+		{
+			name:  "overrides_file_values",
+			env:   map[string]string{"SITEPOD_GC_KEEP_DAYS": "90", "SITEPOD_STORAGE_TYPE": "local"},
+			check: func(c *Config) bool { return c.GC.KeepDays == 90 && c.Storage.Type == "local" },
+		},
+		{
+			name:  "empty_ignored",
+			env:   map[string]string{"SITEPOD_DOMAIN": ""},
+			check: func(c *Config) bool { return c.Domain.Primary == "localhost" },
+		},
+		{
+			name:  "duration_and_bool",
+			env:   map[string]string{"SITEPOD_GC_INTERVAL": "6h", "SITEPOD_GC_ENABLED": "off"},
+			check: func(c *Config) bool { return c.GC.Interval == 6*time.Hour && !c.GC.Enabled },
+		},
+		{
+			name:  "quota",
+			env:   map[string]string{"SITEPOD_MAX_FILE_SIZE": "1024"},
+			check: func(c *Config) bool { return c.Quota.MaxFileSize == 1024 },
+		},
+		{
+			name:  "analytics",
+			env:   map[string]string{"SITEPOD_ANALYTICS_RETENTION_DAYS": "30", "SITEPOD_ANALYTICS_TOP_N": "20"},
+			check: func(c *Config) bool { return c.Analytics.RetentionDays == 30 && c.Analytics.TopN == 20 },
+		},
+		{
+			name: "invalidation_peers",
+			env: map[string]string{
+				"SITEPOD_CACHE_INVALIDATION":       "peers",
+				"SITEPOD_CACHE_INVALIDATION_PEERS": "http://10.0.0.2:8080, http://10.0.0.3:8080,",
+			},
+			check: func(c *Config) bool {
+				return c.Cache.Invalidation.Transport == "peers" && len(c.Cache.Invalidation.Peers) == 2 &&
+					c.Cache.Invalidation.Peers[1] == "http://10.0.0.3:8080"
+			},
+		},
+		{
+			name:    "invalid_int",
+			env:     map[string]string{"SITEPOD_GC_KEEP_DAYS": "forever"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid_bool",
+			env:     map[string]string{"SITEPOD_GC_ENABLED": "maybe"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Default()
+			cfg.Storage.Type = "s3"
+			cfg.GC.KeepDays = 7
+
+			err := cfg.ApplyEnv(envMap(tc.env))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.check(cfg) {
+				t.Errorf("unexpected config: %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, `
+[domain]
+primary = "file.example.com"
+
+[gc]
+min_versions = 3
+keep_days = 7
+`)
+	t.Setenv("SITEPOD_CONFIG", path)
+	t.Setenv("SITEPOD_GC_KEEP_DAYS", "14")
+
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Domain.Primary != "file.example.com" {
+		t.Errorf("domain.primary = %q, want value from file", cfg.Domain.Primary)
+	}
+	if cfg.GC.MinVersions != 3 {
+		t.Errorf("gc.min_versions = %d, want 3 from file", cfg.GC.MinVersions)
+	}
+	if cfg.GC.KeepDays != 14 {
+		t.Errorf("gc.keep_days = %d, want 14 from env", cfg.GC.KeepDays)
+	}
+}
+
+func TestLoadMissingExplicitFile(t *testing.T) {
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.toml")); err == nil {
+		t.Error("expected error for missing config file")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		modify  func(*Config)
+		wantErr string
+	}{
+		{
+			name:   "defaults",
+			modify: func(c *Config) {},
+		},
+		{
+			name:    "unknown_storage_type",
+			modify:  func(c *Config) { c.Storage.Type = "ftp" },
+			wantErr: "storage.type",
+		},
+		{
+			name:    "s3_without_bucket",
+			modify:  func(c *Config) { c.Storage.Type = "r2" },
+			wantErr: "storage.s3.bucket",
+		},
+		{
+			name:    "unknown_dedup_scope",
+			modify:  func(c *Config) { c.Storage.DedupScope = "project" },
+			wantErr: "storage.dedup_scope",
+		},
+		{
+			name:    "zero_interval",
+			modify:  func(c *Config) { c.GC.Interval = 0 },
+			wantErr: "gc.interval",
+		},
+		{
+			name:   "zero_interval_gc_disabled",
+			modify: func(c *Config) { c.GC.Interval = 0; c.GC.Enabled = false },
+		},
+		{
+			name:    "zero_min_versions",
+			modify:  func(c *Config) { c.GC.MinVersions = 0; c.GC.KeepDays = 0 },
+			wantErr: "gc.min_versions",
+		},
+		{
+			name:    "bad_log_level",
+			modify:  func(c *Config) { c.Log.Level = "verbose" },
+			wantErr: "log.level",
+		},
+		{
+			name:    "bad_access_sample_rate",
+			modify:  func(c *Config) { c.Log.AccessSampleRate = 1.5 },
+			wantErr: "log.access_sample_rate",
+		},
+		{
+			name:    "unknown_purge_provider",
+			modify:  func(c *Config) { c.Purge.Provider = "akamai" },
+			wantErr: "purge.provider",
+		},
+		{
+			name: "peers_without_secret",
+			modify: func(c *Config) {
+				c.Cache.Invalidation = InvalidationConfig{Transport: "peers", Peers: []string{"http://a"}}
+			},
+			wantErr: "cache.invalidation.peers",
+		},
+		{
+			name:    "unknown_invalidation_transport",
+			modify:  func(c *Config) { c.Cache.Invalidation.Transport = "nats" },
+			wantErr: "cache.invalidation.transport",
+		},
+		{
+			name:    "cloudflare_without_token",
+			modify:  func(c *Config) { c.Purge.Provider = "cloudflare"; c.Purge.Cloudflare.ZoneID = "z" },
+			wantErr: "purge.cloudflare",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Default()
+			tc.modify(cfg)
+			err := cfg.Validate()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Validate() = %v, want error mentioning %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+// Package dedup decides which stored blobs a deploy may reuse without
+// uploading them.
+//
+// Blobs are stored once, whoever uploaded them. If any tenant could reuse
+// any stored blob, it could find out whether another tenant has a file by
+// its hash, and deploy that file without having it. In the tenant scope a
+// blob is only reusable by tenants that have shown they hold it: by
+// uploading it, or by deploying an image that references it. Other
+// tenants upload the blob again; the upload is checked against its hash
+// and the stored copy is kept.
+package dedup
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/manifest"
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+// Scopes
+const (
+	// ScopeTenant reuses blobs the project owner holds
+	ScopeTenant = "tenant"
+	// ScopeGlobal reuses any stored blob; for single-tenant servers
+	ScopeGlobal = "global"
+)
+
+// collection holds (owner_id, hash) pairs of blobs owners hold
+const collection = "blob_owners"
+
+// chunk is the number of hashes looked up per query
+const chunk = 500
+
+// Index records which blobs each tenant holds. The tenant of a project
+// is its owner.
+type Index struct {
+	app       core.App
+	manifests *manifest.Store
+}
+
+// New creates an index backed by the blob_owners collection. Manifests of
+// new images are read from backend.
+func New(app core.App, backend storage.Backend) *Index {
+	return &Index{app: app, manifests: manifest.NewStore(backend, 0)}
+}
+
+// BindHooks records the blobs of every new image for the owner of its
+// project. Images are only committed once their blobs are stored and, in
+// the tenant scope, held by the owner, so this mostly covers images
+// created by the server itself.
+func (x *Index) BindHooks() {
+	x.app.OnRecordAfterCreateSuccess("images").BindFunc(func(e *core.RecordEvent) error {
+		if err := x.addImage(e.Record); err != nil {
+			log.Printf("dedup: failed to record blobs of image %s: %v", e.Record.GetString("image_id"), err)
+		}
+		return e.Next()
+	})
+}
+
+func (x *Index) addImage(image *core.Record) error {
+	project, err := x.app.FindRecordById("projects", image.GetString("project_id"))
+	if err != nil {
+		return err
+	}
+	m, err := x.manifests.Record(image)
+	if err != nil {
+		return fmt.Errorf("manifest: %w", err)
+	}
+	hashes := make([]string, 0, len(m.Files))
+	for _, file := range m.Files {
+		hashes = append(hashes, file.Hash)
+	}
+	return x.Add(project.GetString("owner_id"), hashes)
+}
+
+// Owned returns which of hashes owner holds. An empty owner holds nothing.
+func (x *Index) Owned(owner string, hashes []string) (map[string]bool, error) {
+	owned := make(map[string]bool)
+	if owner == "" {
+		return owned, nil
+	}
+	for start := 0; start < len(hashes); start += chunk {
+		var rows []struct {
+			Hash string `db:"hash"`
+		}
+		err := x.app.DB().Select("hash").From(collection).
+			Where(dbx.HashExp{"owner_id": owner}).
+			AndWhere(dbx.In("hash", values(hashes[start:min(start+chunk, len(hashes))])...)).
+			All(&rows)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			owned[row.Hash] = true
+		}
+	}
+	return owned, nil
+}
+
+// Add records that owner holds hashes. Hashes it already holds are
+// skipped; an empty owner is ignored.
+func (x *Index) Add(owner string, hashes []string) error {
+	if owner == "" || len(hashes) == 0 {
+		return nil
+	}
+	owners, err := x.app.FindCachedCollectionByNameOrId(collection)
+	if err != nil {
+		return nil // Not migrated yet
+	}
+	owned, err := x.Owned(owner, hashes)
+	if err != nil {
+		return err
+	}
+
+	return x.app.RunInTransaction(func(txApp core.App) error {
+		for _, hash := range hashes {
+			if owned[hash] || hash == "" {
+				continue
+			}
+			owned[hash] = true
+			row := core.NewRecord(owners)
+			row.Set("owner_id", owner)
+			row.Set("hash", hash)
+			if err := txApp.Save(row); err != nil {
+				// A concurrent Add recorded it first
+				if _, findErr := txApp.FindFirstRecordByFilter(collection,
+					"owner_id = {:owner} && hash = {:hash}",
+					dbx.Params{"owner": owner, "hash": hash}); findErr == nil {
+					continue
+				}
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Forget drops every owner of a blob that was deleted from storage.
+// Uploading it again proves possession anew.
+func (x *Index) Forget(hash string) error {
+	_, err := x.app.DB().Delete(collection, dbx.HashExp{"hash": hash}).Execute()
+	return err
+}
+
+func values(hashes []string) []any {
+	out := make([]any, len(hashes))
+	for i, hash := range hashes {
+		out[i] = hash
+	}
+	return out
+}
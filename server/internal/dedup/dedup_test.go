@@ -0,0 +1,212 @@
+package dedup
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/storage"
+	_ "github.com/sitepod/sitepod/migrations"
+)
+
+// newTestIndex creates an index over a migrated app in a temporary
+// directory
+func newTestIndex(t *testing.T) (*Index, core.App) {
+	t.Helper()
+	app := core.NewBaseApp(core.BaseAppConfig{DataDir: t.TempDir()})
+	if err := app.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.ResetBootstrapState() })
+	if err := app.RunAllMigrations(); err != nil {
+		t.Fatal(err)
+	}
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(app, backend), app
+}
+
+func testHash(i int) string {
+	return fmt.Sprintf("%064x", i)
+}
+
+// countOwners returns the number of rows recording that owner holds hash
+func countOwners(t *testing.T, app core.App, owner, hash string) int {
+	t.Helper()
+	var n int
+	err := app.DB().Select("COUNT(*)").From(collection).
+		Where(dbx.HashExp{"owner_id": owner, "hash": hash}).Row(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestOwned(t *testing.T) {
+	x, _ := newTestIndex(t)
+
+	// More hashes than one query looks up
+	hashes := make([]string, chunk+10)
+	for i := range hashes {
+		hashes[i] = testHash(i)
+	}
+	if err := x.Add("alice", hashes[1:]); err != nil {
+		t.Fatal(err)
+	}
+
+	owned, err := x.Owned("alice", hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owned) != len(hashes)-1 || owned[hashes[0]] || !owned[hashes[len(hashes)-1]] {
+		t.Errorf("alice owns %d of %d hashes", len(owned), len(hashes))
+	}
+
+	for _, owner := range []string{"bob", ""} {
+		if owned, err := x.Owned(owner, hashes); err != nil || len(owned) != 0 {
+			t.Errorf("%q owns %d hashes (%v), want none", owner, len(owned), err)
+		}
+	}
+}
+
+func TestAdd(t *testing.T) {
+	x, app := newTestIndex(t)
+
+	if err := x.Add("alice", []string{testHash(1), testHash(1), ""}); err != nil {
+		t.Fatal(err)
+	}
+	// Adding held hashes again is a no-op; an empty owner is ignored
+	if err := x.Add("alice", []string{testHash(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Add("", []string{testHash(2)}); err != nil {
+		t.Fatal(err)
+	}
+	if n := countOwners(t, app, "alice", testHash(1)); n != 1 {
+		t.Errorf("%d rows for alice's hash, want 1", n)
+	}
+	if n := countOwners(t, app, "", testHash(2)); n != 0 {
+		t.Errorf("%d rows for the empty owner", n)
+	}
+
+	// A concurrent Add records the hash between the lookup and the insert
+	raced := false
+	app.OnRecordCreate(collection).BindFunc(func(e *core.RecordEvent) error {
+		if !raced && e.Record.GetString("hash") == testHash(3) {
+			raced = true
+			_, err := e.App.DB().Insert(collection, dbx.Params{
+				"id":       "racedrow0000001",
+				"owner_id": e.Record.GetString("owner_id"),
+				"hash":     testHash(3),
+			}).Execute()
+			if err != nil {
+				return err
+			}
+		}
+		return e.Next()
+	})
+	if err := x.Add("alice", []string{testHash(3), testHash(4)}); err != nil {
+		t.Fatalf("losing a race: %v", err)
+	}
+	if !raced {
+		t.Fatal("the concurrent insert did not run")
+	}
+	for _, hash := range []string{testHash(3), testHash(4)} {
+		if n := countOwners(t, app, "alice", hash); n != 1 {
+			t.Errorf("%d rows for %s, want 1", n, hash)
+		}
+	}
+}
+
+func TestForget(t *testing.T) {
+	x, _ := newTestIndex(t)
+
+	for _, owner := range []string{"alice", "bob"} {
+		if err := x.Add(owner, []string{testHash(1), testHash(2)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := x.Forget(testHash(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, owner := range []string{"alice", "bob"} {
+		owned, err := x.Owned(owner, []string{testHash(1), testHash(2)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owned[testHash(1)] || !owned[testHash(2)] {
+			t.Errorf("%s owns %v after forgetting %s", owner, owned, testHash(1))
+		}
+	}
+}
+
+func TestTenantScope(t *testing.T) {
+	x, app := newTestIndex(t)
+	x.BindHooks()
+
+	users, err := app.FindCollectionByNameOrId("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects, err := app.FindCollectionByNameOrId("projects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := app.FindCollectionByNameOrId("images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant := func(name string) (owner string, project *core.Record) {
+		user := core.NewRecord(users)
+		user.SetEmail(name + "@example.com")
+		user.SetPassword("password123")
+		if err := app.Save(user); err != nil {
+			t.Fatal(err)
+		}
+		project = core.NewRecord(projects)
+		project.Set("name", name)
+		project.Set("subdomain", name)
+		project.Set("owner_id", user.Id)
+		if err := app.Save(project); err != nil {
+			t.Fatal(err)
+		}
+		return user.Id, project
+	}
+	alice, aliceSite := tenant("alice")
+	bob, _ := tenant("bob")
+
+	// Alice uploads a blob and commits an image referencing it
+	shared := testHash(1)
+	if err := x.Add(alice, []string{shared}); err != nil {
+		t.Fatal(err)
+	}
+	image := core.NewRecord(images)
+	image.Set("image_id", "img_alice")
+	image.Set("project_id", aliceSite.Id)
+	image.Set("content_hash", "content")
+	image.Set("manifest", map[string]storage.FileEntry{
+		"index.html": {Hash: shared, Size: 1},
+		"app.js":     {Hash: testHash(2), Size: 1},
+	})
+	if err := app.Save(image); err != nil {
+		t.Fatal(err)
+	}
+	if owned, _ := x.Owned(alice, []string{shared, testHash(2)}); !owned[shared] || !owned[testHash(2)] {
+		t.Errorf("alice owns %v after committing her image", owned)
+	}
+
+	// Bob's plan neither sees nor reuses it until he uploads it himself
+	if owned, _ := x.Owned(bob, []string{shared, testHash(2)}); len(owned) != 0 {
+		t.Errorf("bob owns %v without uploading", owned)
+	}
+	if err := x.Add(bob, []string{shared}); err != nil {
+		t.Fatal(err)
+	}
+	if owned, _ := x.Owned(bob, []string{shared, testHash(2)}); !owned[shared] || owned[testHash(2)] {
+		t.Errorf("bob owns %v after uploading %s", owned, shared)
+	}
+}
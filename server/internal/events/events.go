@@ -0,0 +1,179 @@
+// Package events fans out deploy, domain and GC events to live subscribers.
+//
+// Recent events are kept in a ring buffer so a client that reconnects with
+// the ID of the last event it saw receives what it missed. Event IDs are
+// only meaningful within one process: after a restart, or if the client
+// fell further behind than the buffer, resuming fails and the client has
+// to reload its state.
+package events
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	TypeRelease       = "release"
+	TypeRollback      = "rollback"
+	TypePreview       = "preview"
+	TypeDomainAdded   = "domain.added"
+	TypeDomainUpdated = "domain.updated"
+	TypeDomainRemoved = "domain.removed"
+	TypeGC            = "gc"
+)
+
+// subscriberBuffer is the number of events a subscriber may lag behind
+// before it is dropped
+const subscriberBuffer = 64
+
+// Event is one change pushed to subscribers
+type Event struct {
+	// ID is assigned by Publish
+	ID      string         `json:"id"`
+	Type    string         `json:"type"`
+	Project string         `json:"project,omitempty"`
+	Time    time.Time      `json:"time"`
+	Data    map[string]any `json:"data,omitempty"`
+
+	// ProjectID and OwnerID decide who may see the event. Events without
+	// a project (GC) are for admins only.
+	ProjectID string `json:"-"`
+	OwnerID   string `json:"-"`
+
+	seq uint64
+}
+
+// Broker assigns event IDs, keeps recent events and delivers new ones to
+// subscribers
+type Broker struct {
+	epoch string
+
+	mu   sync.Mutex
+	seq  uint64
+	ring []Event // the last len(ring) events, oldest first once full
+	next int     // write position in ring
+	subs map[*Subscription]struct{}
+}
+
+// NewBroker creates a broker replaying up to size events
+func NewBroker(size int) *Broker {
+	if size < 1 {
+		size = 1
+	}
+	return &Broker{
+		epoch: strconv.FormatInt(time.Now().UnixNano(), 36),
+		ring:  make([]Event, 0, size),
+		subs:  make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish assigns e an ID and delivers it. Subscribers that are too far
+// behind are closed; they can reconnect and resume from their last ID.
+func (b *Broker) Publish(e Event) Event {
+	if b == nil {
+		return e
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	e.seq = b.seq
+	e.ID = fmt.Sprintf("%s-%d", b.epoch, e.seq)
+
+	if len(b.ring) < cap(b.ring) {
+		b.ring = append(b.ring, e)
+	} else {
+		b.ring[b.next] = e
+		b.next = (b.next + 1) % len(b.ring)
+	}
+
+	for sub := range b.subs {
+		select {
+		case sub.events <- e:
+		default:
+			b.unsubscribe(sub)
+		}
+	}
+	return e
+}
+
+// Subscription receives events published after it was created
+type Subscription struct {
+	broker *Broker
+	events chan Event
+}
+
+// Events returns the channel of new events. It is closed when the
+// subscription is closed or falls behind.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Close stops the subscription
+func (s *Subscription) Close() {
+	s.broker.mu.Lock()
+	s.broker.unsubscribe(s)
+	s.broker.mu.Unlock()
+}
+
+func (b *Broker) unsubscribe(s *Subscription) {
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.events)
+	}
+}
+
+// Subscribe starts a subscription. If lastID is set, the buffered events
+// after it are returned for replay; resumed is false if they are no longer
+// all available.
+func (b *Broker) Subscribe(lastID string) (sub *Subscription, replay []Event, resumed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub = &Subscription{broker: b, events: make(chan Event, subscriberBuffer)}
+	b.subs[sub] = struct{}{}
+
+	if lastID == "" {
+		return sub, nil, true
+	}
+	seq, ok := b.parseID(lastID)
+	if !ok || seq > b.seq {
+		return sub, nil, false
+	}
+
+	buffered := b.buffered()
+	if seq < b.seq && (len(buffered) == 0 || buffered[0].seq > seq+1) {
+		return sub, nil, false // missed events were evicted
+	}
+	for _, e := range buffered {
+		if e.seq > seq {
+			replay = append(replay, e)
+		}
+	}
+	return sub, replay, true
+}
+
+// buffered returns the ring in publish order
+func (b *Broker) buffered() []Event {
+	out := make([]Event, 0, len(b.ring))
+	out = append(out, b.ring[b.next:]...)
+	return append(out, b.ring[:b.next]...)
+}
+
+// parseID returns the sequence number of an ID issued by this broker
+func (b *Broker) parseID(id string) (uint64, bool) {
+	epoch, seq, ok := strings.Cut(id, "-")
+	if !ok || epoch != b.epoch {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	return n, err == nil
+}
@@ -0,0 +1,72 @@
+package events
+
+import (
+	"testing"
+)
+
+func publishN(b *Broker, n int) []Event {
+	out := make([]Event, n)
+	for i := range out {
+		out[i] = b.Publish(Event{Type: TypeRelease, Project: "blog"})
+	}
+	return out
+}
+
+func TestSubscribeResume(t *testing.T) {
+	b := NewBroker(4)
+	published := publishN(b, 6) // ring holds 3..6
+
+	testCases := []struct {
+		name    string
+		lastID  string
+		resumed bool
+		replay  int
+	}{
+		{name: "fresh", lastID: "", resumed: true},
+		{name: "up_to_date", lastID: published[5].ID, resumed: true},
+		{name: "within_buffer", lastID: published[3].ID, resumed: true, replay: 2},
+		{name: "oldest_buffered_is_next", lastID: published[1].ID, resumed: true, replay: 4},
+		{name: "evicted", lastID: published[0].ID, resumed: false},
+		{name: "other_process", lastID: "abc-3", resumed: false},
+		{name: "future", lastID: b.epoch + "-99", resumed: false},
+		{name: "garbage", lastID: "garbage", resumed: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sub, replay, resumed := b.Subscribe(tc.lastID)
+			defer sub.Close()
+			if resumed != tc.resumed {
+				t.Errorf("resumed = %v, want %v", resumed, tc.resumed)
+			}
+			if len(replay) != tc.replay {
+				t.Fatalf("replayed %d events, want %d", len(replay), tc.replay)
+			}
+			if tc.replay > 0 && replay[len(replay)-1].ID != published[5].ID {
+				t.Errorf("last replayed = %s, want %s", replay[len(replay)-1].ID, published[5].ID)
+			}
+		})
+	}
+}
+
+func TestSubscriptionDelivery(t *testing.T) {
+	b := NewBroker(8)
+	sub, _, _ := b.Subscribe("")
+
+	e := b.Publish(Event{Type: TypeGC})
+	got := <-sub.Events()
+	if got.ID != e.ID || got.Type != TypeGC {
+		t.Errorf("got %+v, want %+v", got, e)
+	}
+
+	// A subscriber that stops reading is dropped instead of blocking Publish
+	publishN(b, subscriberBuffer+1)
+	n := 0
+	for range sub.Events() {
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Errorf("received %d events before close, want %d", n, subscriberBuffer)
+	}
+	sub.Close() // closing again is a no-op
+}
@@ -0,0 +1,607 @@
+// Package fsck checks the integrity of stored blobs and of everything that
+// points at them: images, refs, previews and the routing index.
+package fsck
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/manifest"
+	"github.com/sitepod/sitepod/internal/storage"
+	"github.com/zeebo/blake3"
+)
+
+// Issue kinds
+const (
+	// KindCorruptBlob is a blob whose content does not hash to its name
+	KindCorruptBlob = "corrupt_blob"
+	// KindMissingBlobs is an image, ref or preview referencing blobs that
+	// are not in storage, its manifest object included
+	KindMissingBlobs = "missing_blobs"
+	// KindInvalidManifest is an image, ref or preview that cannot be
+	// parsed, or whose manifest object cannot be decoded
+	KindInvalidManifest = "invalid_manifest"
+	// KindOrphanRef is a ref of a project that no longer exists
+	KindOrphanRef = "orphan_ref"
+	// KindOrphanPreview is a preview of a project that no longer exists
+	KindOrphanPreview = "orphan_preview"
+	// KindOrphanRoute is a routing index entry for a missing project
+	KindOrphanRoute = "orphan_route"
+)
+
+// Repair actions
+const (
+	RepairQuarantined = "quarantined"
+	RepairDeleted     = "deleted"
+)
+
+const (
+	// pageSize is the number of images loaded per query
+	pageSize = 500
+	// verifyWorkers is the number of blobs hashed concurrently
+	verifyWorkers = 4
+)
+
+// ErrRunning is returned when a check is requested while one is running
+var ErrRunning = errors.New("fsck: a check is already running")
+
+// Options select the optional checks and repairs
+type Options struct {
+	// Verify re-hashes every blob. It reads the whole blob store.
+	Verify bool `json:"verify"`
+	// Quarantine moves corrupt blobs out of the blob store
+	Quarantine bool `json:"quarantine"`
+	// DeleteOrphans deletes refs and previews of missing projects and
+	// rebuilds the routing index if it has entries for missing projects
+	DeleteOrphans bool `json:"delete_orphans"`
+}
+
+// Issue is one inconsistency found by a check
+type Issue struct {
+	Kind string `json:"kind"`
+	// Object names what is affected: blobs/<hash>, images/<image_id>,
+	// refs/<project>/<env>, previews/<project>/<slug> or
+	// routing/<domain><slug>
+	Object  string `json:"object"`
+	Project string `json:"project,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+	// Missing lists the blobs referenced but not in storage
+	Missing []string `json:"missing,omitempty"`
+	// Repair is the action taken, if any, or RepairError why it failed
+	Repair      string `json:"repair,omitempty"`
+	RepairError string `json:"repair_error,omitempty"`
+}
+
+// Report is the result of a check
+type Report struct {
+	StartedAt  time.Time `json:"started_at"`
+	DurationMS int64     `json:"duration_ms"`
+	Options    Options   `json:"options"`
+	// Objects checked
+	Blobs         int   `json:"blobs"`
+	VerifiedBlobs int   `json:"verified_blobs"`
+	VerifiedBytes int64 `json:"verified_bytes"`
+	Images        int   `json:"images"`
+	Refs          int   `json:"refs"`
+	Previews      int   `json:"previews"`
+	Routes        int   `json:"routes"`
+	// Issues found, and their number by kind
+	Issues   []Issue        `json:"issues"`
+	Summary  map[string]int `json:"summary"`
+	Repaired int            `json:"repaired"`
+	// Errors lists objects or checks that could not be read; they were not
+	// checked
+	Errors []string `json:"errors"`
+}
+
+// OK reports whether the check completed and found nothing
+func (r *Report) OK() bool {
+	return len(r.Issues) == 0 && len(r.Errors) == 0
+}
+
+func (r *Report) add(issue Issue) {
+	r.Issues = append(r.Issues, issue)
+	r.Summary[issue.Kind]++
+	if issue.Repair != "" {
+		r.Repaired++
+	}
+}
+
+func (r *Report) errorf(format string, args ...any) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// Checker runs integrity checks. Only one check runs at a time.
+type Checker struct {
+	app            core.App
+	storage        storage.Backend
+	manifests      *manifest.Store
+	rebuildRouting func() error
+
+	running sync.Mutex
+}
+
+// New creates a checker. rebuildRouting rewrites the routing index from
+// the database; it is called to drop entries for missing projects.
+func New(app core.App, backend storage.Backend, rebuildRouting func() error) *Checker {
+	return &Checker{
+		app:            app,
+		storage:        backend,
+		manifests:      manifest.NewStore(backend, 0),
+		rebuildRouting: rebuildRouting,
+	}
+}
+
+// Run checks storage against the database. Objects that cannot be read are
+// listed in the report's errors and the check goes on. It fails if the
+// blob or project lists cannot be read, since every other check relies
+// on them, or if ctx is cancelled.
+func (c *Checker) Run(ctx context.Context, opts Options) (*Report, error) {
+	if !c.running.TryLock() {
+		return nil, ErrRunning
+	}
+	defer c.running.Unlock()
+
+	r := &Report{
+		StartedAt: time.Now(),
+		Options:   opts,
+		Issues:    []Issue{},
+		Summary:   map[string]int{},
+		Errors:    []string{},
+	}
+
+	hashes, err := c.storage.ListBlobs()
+	if err != nil {
+		return nil, fmt.Errorf("listing blobs: %w", err)
+	}
+	r.Blobs = len(hashes)
+	blobs := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		blobs[hash] = true
+	}
+
+	if opts.Verify {
+		verifyBlobs(ctx, c.storage, hashes, opts.Quarantine, r, blobs)
+	}
+
+	projects, err := c.projects(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.checkImages(ctx, r, blobs, projects); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(projects))
+	for _, name := range projects {
+		names[name] = true
+	}
+	c.checkRefs(ctx, r, blobs, names, opts)
+	c.checkPreviews(ctx, r, blobs, names, opts)
+	c.checkRouting(r, projects, opts)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.DurationMS = time.Since(r.StartedAt).Milliseconds()
+	return r, nil
+}
+
+// verifyBlobs re-hashes blobs and reports those whose content does not
+// match their name. Blobs that are quarantined or deleted along the way
+// are removed from blobs.
+func verifyBlobs(ctx context.Context, backend storage.Backend, hashes []string, quarantine bool, r *Report, blobs map[string]bool) {
+	type result struct {
+		hash   string
+		actual string
+		size   int64
+		err    error
+	}
+
+	work := make(chan string)
+	results := make(chan result)
+	go func() {
+		defer close(work)
+		for _, hash := range hashes {
+			select {
+			case work <- hash:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < verifyWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for hash := range work {
+				res := result{hash: hash}
+				res.actual, res.size, res.err = hashBlob(backend, hash)
+				results <- res
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for res := range results {
+		switch {
+		case storage.IsNotFound(res.err):
+			// Deleted by GC since it was listed
+			delete(blobs, res.hash)
+		case res.err != nil:
+			r.errorf("blob %s: %v", res.hash, res.err)
+		case res.actual != res.hash:
+			issue := Issue{
+				Kind:   KindCorruptBlob,
+				Object: "blobs/" + res.hash,
+				Detail: "content hashes to " + res.actual,
+			}
+			if quarantine {
+				if err := quarantineBlob(backend, res.hash); err != nil {
+					issue.RepairError = err.Error()
+				} else {
+					issue.Repair = RepairQuarantined
+					delete(blobs, res.hash)
+				}
+			}
+			r.add(issue)
+		default:
+			r.VerifiedBlobs++
+			r.VerifiedBytes += res.size
+		}
+	}
+}
+
+// quarantineBlob quarantines a corrupt blob if the backend can
+func quarantineBlob(backend storage.Backend, hash string) error {
+	q, ok := storage.As[storage.Quarantiner](backend)
+	if !ok {
+		return errors.New("the storage backend cannot quarantine blobs")
+	}
+	return q.QuarantineBlob(hash)
+}
+
+// hashBlob returns the hex BLAKE3 hash and size of a blob's content
+func hashBlob(backend storage.Backend, hash string) (string, int64, error) {
+	rc, err := backend.GetBlob(hash)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rc.Close()
+
+	hasher := blake3.New()
+	n, err := io.Copy(hasher, rc)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), n, nil
+}
+
+// projects returns the name of every project by id
+func (c *Checker) projects(ctx context.Context) (map[string]string, error) {
+	projects := make(map[string]string)
+	err := c.eachRecord(ctx, "projects", func(project *core.Record) {
+		projects[project.Id] = project.GetString("name")
+	})
+	return projects, err
+}
+
+// checkImages reports images whose manifest references missing blobs
+func (c *Checker) checkImages(ctx context.Context, r *Report, blobs map[string]bool, projects map[string]string) error {
+	return c.eachRecord(ctx, "images", func(img *core.Record) {
+		r.Images++
+		object := "images/" + img.GetString("image_id")
+		project := projects[img.GetString("project_id")]
+
+		m, err := c.manifests.Record(img)
+		if err != nil {
+			c.reportManifest(r, Issue{Object: object, Project: project}, img.GetString("manifest_hash"), err)
+			return
+		}
+		missing, err := c.missingBlobs(m, blobs)
+		if err != nil {
+			r.errorf("image %s: %v", img.GetString("image_id"), err)
+			return
+		}
+		if len(missing) > 0 {
+			r.add(Issue{Kind: KindMissingBlobs, Object: object, Project: project, Missing: missing})
+		}
+	})
+}
+
+// checkRefs reports refs of missing projects and refs whose manifest
+// references missing blobs
+func (c *Checker) checkRefs(ctx context.Context, r *Report, blobs map[string]bool, names map[string]bool, opts Options) {
+	keys, err := c.refKeys(names)
+	if err != nil {
+		r.errorf("listing refs: %v", err)
+		return
+	}
+
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return
+		}
+		object := "refs/" + key.Project + "/" + key.Name
+
+		if !names[key.Project] {
+			r.Refs++
+			issue := Issue{Kind: KindOrphanRef, Object: object, Project: key.Project}
+			if opts.DeleteOrphans {
+				repair(&issue, c.storage.DeleteRef(key.Project, key.Name))
+			}
+			r.add(issue)
+			continue
+		}
+
+		data, err := c.storage.GetRef(key.Project, key.Name)
+		if storage.IsNotFound(err) {
+			continue
+		}
+		r.Refs++
+		if err != nil {
+			r.errorf("ref %s/%s: %v", key.Project, key.Name, err)
+			continue
+		}
+		var ref storage.RefData
+		if err := json.Unmarshal(data, &ref); err != nil {
+			r.add(Issue{Kind: KindInvalidManifest, Object: object, Project: key.Project, Detail: err.Error()})
+			continue
+		}
+		m, err := c.manifests.Ref(ref.ManifestHash, ref.Manifest)
+		if err != nil {
+			issue := Issue{Object: object, Project: key.Project, Detail: "image " + ref.ImageID}
+			c.reportManifest(r, issue, ref.ManifestHash, err)
+			continue
+		}
+		missing, err := c.missingBlobs(m, blobs)
+		if err != nil {
+			r.errorf("ref %s/%s: %v", key.Project, key.Name, err)
+			continue
+		}
+		if len(missing) > 0 {
+			r.add(Issue{
+				Kind:    KindMissingBlobs,
+				Object:  object,
+				Project: key.Project,
+				Detail:  "image " + ref.ImageID,
+				Missing: missing,
+			})
+		}
+	}
+}
+
+// checkPreviews reports previews of missing projects and live previews
+// whose manifest references missing blobs. Expired previews are left to
+// GC, which may already have swept their blobs.
+func (c *Checker) checkPreviews(ctx context.Context, r *Report, blobs map[string]bool, names map[string]bool, opts Options) {
+	keys, err := c.previewKeys(ctx)
+	if err != nil {
+		r.errorf("listing previews: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return
+		}
+		object := "previews/" + key.Project + "/" + key.Name
+
+		if !names[key.Project] {
+			r.Previews++
+			issue := Issue{Kind: KindOrphanPreview, Object: object, Project: key.Project}
+			if opts.DeleteOrphans {
+				repair(&issue, c.storage.DeletePreview(key.Project, key.Name))
+			}
+			r.add(issue)
+			continue
+		}
+
+		data, err := c.storage.GetPreview(key.Project, key.Name)
+		if storage.IsNotFound(err) {
+			continue
+		}
+		r.Previews++
+		if err != nil {
+			r.errorf("preview %s/%s: %v", key.Project, key.Name, err)
+			continue
+		}
+		var preview storage.PreviewRef
+		if err := json.Unmarshal(data, &preview); err != nil {
+			r.add(Issue{Kind: KindInvalidManifest, Object: object, Project: key.Project, Detail: err.Error()})
+			continue
+		}
+		if preview.ExpiresAt.Before(now) {
+			continue
+		}
+		m, err := c.manifests.Ref(preview.ManifestHash, preview.Manifest)
+		if err != nil {
+			issue := Issue{Object: object, Project: key.Project, Detail: "image " + preview.ImageID}
+			c.reportManifest(r, issue, preview.ManifestHash, err)
+			continue
+		}
+		missing, err := c.missingBlobs(m, blobs)
+		if err != nil {
+			r.errorf("preview %s/%s: %v", key.Project, key.Name, err)
+			continue
+		}
+		if len(missing) > 0 {
+			r.add(Issue{
+				Kind:    KindMissingBlobs,
+				Object:  object,
+				Project: key.Project,
+				Detail:  "image " + preview.ImageID,
+				Missing: missing,
+			})
+		}
+	}
+}
+
+// refKeys returns the refs to check. Backends that cannot list refs are
+// asked for the prod and beta refs of every project, which misses the
+// refs of deleted projects.
+func (c *Checker) refKeys(names map[string]bool) ([]storage.RefKey, error) {
+	if lister, ok := storage.As[storage.Lister](c.storage); ok {
+		return lister.ListRefs()
+	}
+	projects := make([]string, 0, len(names))
+	for name := range names {
+		projects = append(projects, name)
+	}
+	sort.Strings(projects)
+	keys := make([]storage.RefKey, 0, 2*len(projects))
+	for _, name := range projects {
+		keys = append(keys, storage.RefKey{Project: name, Name: "prod"}, storage.RefKey{Project: name, Name: "beta"})
+	}
+	return keys, nil
+}
+
+// previewKeys returns the previews to check. Backends that cannot list
+// previews are asked for those recorded in the database, which misses the
+// previews of deleted projects.
+func (c *Checker) previewKeys(ctx context.Context) ([]storage.RefKey, error) {
+	if lister, ok := storage.As[storage.Lister](c.storage); ok {
+		return lister.ListPreviews()
+	}
+	var keys []storage.RefKey
+	err := c.eachRecord(ctx, "previews", func(preview *core.Record) {
+		keys = append(keys, storage.RefKey{Project: preview.GetString("project"), Name: preview.GetString("slug")})
+	})
+	return keys, err
+}
+
+// routingIndex is the part of the routing index the check reads
+type routingIndex struct {
+	Entries []struct {
+		Domain    string `json:"domain"`
+		Slug      string `json:"slug"`
+		ProjectID string `json:"project_id"`
+		Project   string `json:"project"`
+	} `json:"entries"`
+}
+
+// checkRouting reports routing index entries for missing projects. The
+// repair rebuilds the index from the database, which skips them.
+func (c *Checker) checkRouting(r *Report, projects map[string]string, opts Options) {
+	data, err := c.storage.GetRouting()
+	if storage.IsNotFound(err) {
+		return
+	}
+	if err != nil {
+		r.errorf("routing index: %v", err)
+		return
+	}
+	var index routingIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		r.errorf("routing index: %v", err)
+		return
+	}
+	r.Routes = len(index.Entries)
+
+	var orphans []Issue
+	for _, entry := range index.Entries {
+		if _, ok := projects[entry.ProjectID]; ok {
+			continue
+		}
+		orphans = append(orphans, Issue{
+			Kind:    KindOrphanRoute,
+			Object:  "routing/" + entry.Domain + entry.Slug,
+			Project: entry.Project,
+		})
+	}
+	if len(orphans) > 0 && opts.DeleteOrphans && c.rebuildRouting != nil {
+		err := c.rebuildRouting()
+		for i := range orphans {
+			repair(&orphans[i], err)
+		}
+	}
+	for _, issue := range orphans {
+		r.add(issue)
+	}
+}
+
+// repair records the outcome of deleting an orphan
+func repair(issue *Issue, err error) {
+	if err != nil {
+		issue.RepairError = err.Error()
+		return
+	}
+	issue.Repair = RepairDeleted
+}
+
+// reportManifest reports the manifest of issue's object that could not be
+// read: a missing manifest object (hash) as missing blobs, one that cannot
+// be decoded as invalid. Other errors are listed in the report's errors.
+func (c *Checker) reportManifest(r *Report, issue Issue, hash string, err error) {
+	switch {
+	case storage.IsNotFound(err):
+		issue.Kind = KindMissingBlobs
+		issue.Missing = []string{hash}
+	case errors.Is(err, manifest.ErrInvalid):
+		issue.Kind = KindInvalidManifest
+		issue.Detail = err.Error()
+	default:
+		r.errorf("%s: %v", issue.Object, err)
+		return
+	}
+	r.add(issue)
+}
+
+// missingBlobs returns the sorted, distinct blobs of a manifest that are
+// not in storage. Blobs missing from blobs are looked up again, since they
+// may have been uploaded after blobs was listed; those found are added.
+func (c *Checker) missingBlobs(m *manifest.Manifest, blobs map[string]bool) ([]string, error) {
+	var missing []string
+	for hash := range m.Blobs() {
+		if blobs[hash] {
+			continue
+		}
+		exists, err := c.storage.HasBlob(hash)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			blobs[hash] = true
+			continue
+		}
+		missing = append(missing, hash)
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// eachRecord calls fn for every record of a collection, paging by id
+func (c *Checker) eachRecord(ctx context.Context, collection string, fn func(*core.Record)) error {
+	after := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		records, err := c.app.FindRecordsByFilter(
+			collection, "id > {:after}", "id", pageSize, 0, map[string]any{"after": after})
+		if err != nil {
+			return fmt.Errorf("listing %s: %w", collection, err)
+		}
+		for _, record := range records {
+			fn(record)
+		}
+		if len(records) < pageSize {
+			return nil
+		}
+		after = records[len(records)-1].Id
+	}
+}
@@ -0,0 +1,139 @@
+package fsck
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sitepod/sitepod/internal/manifest"
+	"github.com/sitepod/sitepod/internal/storage"
+	"github.com/zeebo/blake3"
+)
+
+func putBlob(t *testing.T, backend storage.Backend, content string) string {
+	t.Helper()
+	sum := blake3.Sum256([]byte(content))
+	hash := hex.EncodeToString(sum[:])
+	if err := backend.PutBlob(hash, bytes.NewReader([]byte(content)), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func newReport() *Report {
+	return &Report{Issues: []Issue{}, Summary: map[string]int{}, Errors: []string{}}
+}
+
+func TestVerifyBlobs(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := storage.NewLocalBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good := putBlob(t, backend, "good")
+	bad := putBlob(t, backend, "bad")
+	// Bit-rot
+	if err := os.WriteFile(filepath.Join(dir, "blobs", bad[:2], bad), []byte("bda"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gone := "00" + good[2:]
+
+	for _, quarantine := range []bool{false, true} {
+		r := newReport()
+		blobs := map[string]bool{good: true, bad: true, gone: true}
+		verifyBlobs(context.Background(), backend, []string{good, bad, gone}, quarantine, r, blobs)
+
+		if r.VerifiedBlobs != 1 || r.VerifiedBytes != 4 {
+			t.Errorf("verified %d blobs, %d bytes", r.VerifiedBlobs, r.VerifiedBytes)
+		}
+		if len(r.Issues) != 1 || r.Issues[0].Kind != KindCorruptBlob || r.Issues[0].Object != "blobs/"+bad {
+			t.Fatalf("issues = %+v", r.Issues)
+		}
+		if blobs[gone] {
+			t.Error("blob deleted since listing still counted")
+		}
+		if quarantine {
+			if r.Issues[0].Repair != RepairQuarantined || r.Repaired != 1 || blobs[bad] {
+				t.Errorf("corrupt blob not quarantined: %+v", r.Issues[0])
+			}
+			if exists, _ := backend.HasBlob(bad); exists {
+				t.Error("corrupt blob still in the blob store")
+			}
+		} else if r.Issues[0].Repair != "" || !blobs[bad] {
+			t.Errorf("corrupt blob repaired without quarantine: %+v", r.Issues[0])
+		}
+	}
+}
+
+func TestMissingBlobs(t *testing.T) {
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Checker{storage: backend}
+
+	listed := putBlob(t, backend, "listed")
+	// Uploaded after the blob list was taken
+	late := putBlob(t, backend, "late")
+
+	files := map[string]storage.FileEntry{
+		"index.html": {Hash: listed},
+		"app.js":     {Hash: late},
+		"a.css":      {Hash: "ffff"},
+		"b.css":      {Hash: "ffff"},
+		"logo.png":   {Hash: "eeee"},
+	}
+	blobs := map[string]bool{listed: true}
+	missing, err := c.missingBlobs(&manifest.Manifest{Files: files}, blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 2 || missing[0] != "eeee" || missing[1] != "ffff" {
+		t.Errorf("missing = %v", missing)
+	}
+	if !blobs[late] {
+		t.Error("blob found on lookup not added")
+	}
+}
+
+func TestWithoutOptionalInterfaces(t *testing.T) {
+	dir := t.TempDir()
+	local, err := storage.NewLocalBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the methods of Backend, as in backends written before fsck
+	var backend storage.Backend = struct{ storage.Backend }{local}
+
+	// Corrupt blobs are only reported
+	bad := putBlob(t, local, "bad")
+	if err := os.WriteFile(filepath.Join(dir, "blobs", bad[:2], bad), []byte("bda"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := newReport()
+	verifyBlobs(context.Background(), backend, []string{bad}, true, r, map[string]bool{bad: true})
+	if len(r.Issues) != 1 || r.Issues[0].Repair != "" || r.Issues[0].RepairError == "" {
+		t.Errorf("issues = %+v", r.Issues)
+	}
+	if exists, _ := local.HasBlob(bad); !exists {
+		t.Error("corrupt blob removed without quarantine support")
+	}
+
+	// Refs of existing projects are still checked; orphans cannot be found
+	ref := []byte(`{"image_id": "img", "manifest": {"index.html": {"hash": "ffff"}}}`)
+	for _, project := range []string{"site", "gone"} {
+		if err := local.PutRef(project, "prod", ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &Checker{storage: backend, manifests: manifest.NewStore(backend, 0)}
+	r = newReport()
+	c.checkRefs(context.Background(), r, map[string]bool{}, map[string]bool{"site": true}, Options{})
+	if r.Refs != 1 || len(r.Issues) != 1 || r.Issues[0].Kind != KindMissingBlobs || r.Issues[0].Object != "refs/site/prod" {
+		t.Errorf("refs = %d, issues = %+v", r.Refs, r.Issues)
+	}
+}
@@ -2,11 +2,16 @@ package gc
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"log"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/lease"
+	"github.com/sitepod/sitepod/internal/manifest"
 	"github.com/sitepod/sitepod/internal/storage"
 )
 
@@ -15,8 +20,14 @@ type Config struct {
 	Enabled     bool          `json:"enabled"`
 	Interval    time.Duration `json:"interval"`
 	GracePeriod time.Duration `json:"grace_period"`
-	MinVersions int           `json:"min_versions"`
-	KeepDays    int           `json:"keep_days"`
+	// Retention deletes images the retention policy no longer keeps;
+	// dry runs plan retention either way
+	Retention   bool `json:"retention"`
+	MinVersions int  `json:"min_versions"`
+	KeepDays    int  `json:"keep_days"`
+	// ReconcileInterval is how often a cycle scans everything and
+	// rebuilds the blob index; 0 makes every cycle a full one
+	ReconcileInterval time.Duration `json:"reconcile_interval"`
 }
 
 // DefaultConfig returns default GC configuration
@@ -27,25 +38,168 @@ func DefaultConfig() Config {
 		GracePeriod: 1 * time.Hour,
 		MinVersions: 5,
 		KeepDays:    30,
+
+		ReconcileInterval: 7 * 24 * time.Hour,
 	}
 }
 
-// GC handles garbage collection of unused blobs and expired data
+// ErrRunning is returned when a cycle is requested while one is running
+var ErrRunning = errors.New("gc: a cycle is already running")
+
+// LeaseName is the storage lease held by the instance running a cycle.
+// Preview cleanup and retention run inside the cycle, so it covers them.
+const LeaseName = "gc"
+
+// Phases of a GC cycle, in order
+const (
+	PhaseExpirePlans    = "expire_plans"
+	PhaseExpirePreviews = "expire_previews"
+	PhaseRetention      = "retention"
+	PhaseMark           = "mark"
+	PhaseSweep          = "sweep"
+	PhaseReconcile      = "reconcile"
+	PhaseDone           = "done"
+)
+
+// Stats summarizes a GC cycle
+type Stats struct {
+	// JobID identifies the run in gc_runs
+	JobID string
+	// Mode is ModeFull or ModeIncremental
+	Mode            string
+	Started         time.Time
+	Duration        time.Duration
+	ExpiredPlans    int
+	ExpiredPreviews int
+	// ImagesDeleted counts images removed by the retention policy
+	ImagesDeleted int
+	// ReferencedBlobs is the number of distinct blobs marked as live
+	ReferencedBlobs int
+	BlobsScanned    int
+	BlobsDeleted    int
+	BytesFreed      int64
+	// BlobsLeased counts unreferenced blobs kept because an in-flight
+	// deploy relies on them
+	BlobsLeased int
+	// BlobsRemaining and BytesRemaining are the blob store totals after
+	// the cycle. Sizes of referenced blobs come from their manifests;
+	// incremental cycles take the totals from the blob index.
+	BlobsRemaining int
+	BytesRemaining int64
+	// IndexDrift counts blob index rows a full cycle corrected
+	IndexDrift int
+	// Phases times each phase that ran
+	Phases []PhaseTiming
+	// Err is the first error encountered, if any
+	Err error
+}
+
+// Job is a reserved GC run. Only one job runs at a time.
+type Job struct {
+	ID      string
+	Trigger string
+	// Mode is chosen by NewJob; callers may set ModeFull to force a full
+	// cycle before passing the job to RunJob
+	Mode string
+
+	record *core.Record
+	lease  *lease.Lease
+}
+
+// GC collects blobs that nothing references, along with expired plans and
+// previews. A cycle expires plans and previews, deletes images the
+// retention policy no longer keeps, marks every blob referenced by images,
+// pending plans, refs and live previews, then sweeps blobs that are
+// unmarked, unleased and older than the grace period.
 type GC struct {
 	app     *pocketbase.PocketBase
 	storage storage.Backend
-	config  Config
+	// manifests reads manifests uncached: a cycle reads each once
+	manifests *manifest.Store
+	config    Config
+	onRun     []func(Stats)
+	onDelete  []func(hash string)
+	lock      *lease.Manager
+
+	// running is held by the job that is running
+	running sync.Mutex
+
+	mu       sync.Mutex
+	progress Run
+	// standby is when a scheduled cycle was last skipped because another
+	// instance held the lease
+	standby time.Time
 }
 
 // New creates a new GC instance
 func New(app *pocketbase.PocketBase, storage storage.Backend, config Config) *GC {
 	return &GC{
-		app:     app,
-		storage: storage,
-		config:  config,
+		app:       app,
+		storage:   storage,
+		manifests: manifest.NewStore(storage, 0),
+		config:    config,
+	}
+}
+
+// OnRun registers fn to be called with the stats of every GC cycle.
+// It must be called before Start.
+func (gc *GC) OnRun(fn func(Stats)) {
+	gc.onRun = append(gc.onRun, fn)
+}
+
+// OnDelete registers fn to be called with every blob a cycle deletes from
+// storage. It must be called before Start.
+func (gc *GC) OnDelete(fn func(hash string)) {
+	gc.onDelete = append(gc.onDelete, fn)
+}
+
+// deleted calls the OnDelete callbacks for a deleted blob. Callbacks may
+// write to the database, so the sweep calls it after its transaction.
+func (gc *GC) deleted(hash string) {
+	for _, fn := range gc.onDelete {
+		fn(hash)
 	}
 }
 
+// UseLease makes every cycle hold the GC lease, so only one of the
+// instances sharing the storage backend runs a cycle at a time. It must be
+// called before Start.
+func (gc *GC) UseLease(m *lease.Manager) {
+	gc.lock = m
+}
+
+// Standby returns when a scheduled cycle was last skipped because another
+// instance was running one, or the zero time
+func (gc *GC) Standby() time.Time {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return gc.standby
+}
+
+// Enabled reports whether periodic GC is enabled
+func (gc *GC) Enabled() bool {
+	return gc.config.Enabled
+}
+
+// Interval returns the time between periodic GC cycles
+func (gc *GC) Interval() time.Duration {
+	return gc.config.Interval
+}
+
+// Lease keeps blobs from being swept by any instance until the given time,
+// even if nothing references them yet. Deploys lease their manifest when
+// planning, before checking which blobs already exist.
+func (gc *GC) Lease(hashes []string, until time.Time) error {
+	return addLeases(gc.app, hashes, until)
+}
+
+// Progress returns the running or last run started by this process
+func (gc *GC) Progress() Run {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return gc.progress
+}
+
 // Start begins the GC background process
 func (gc *GC) Start(ctx context.Context) {
 	if !gc.config.Enabled {
@@ -75,238 +229,347 @@ func (gc *GC) Start(ctx context.Context) {
 	}
 }
 
-// Run performs a single GC cycle
-func (gc *GC) Run(ctx context.Context) {
-	log.Println("Starting GC cycle")
-	start := time.Now()
-
-	// 1. Clean up expired plans
-	expiredPlans, err := gc.cleanExpiredPlans()
+// Run performs a single scheduled GC cycle. If a cycle is already
+// running, it returns immediately with ErrRunning, or with an error
+// wrapping lease.ErrHeld if another instance is running one.
+func (gc *GC) Run(ctx context.Context) Stats {
+	job, err := gc.NewJob(TriggerSchedule)
+	if errors.Is(err, lease.ErrHeld) {
+		log.Printf("GC: skipping cycle: %v", err)
+		gc.mu.Lock()
+		gc.standby = time.Now()
+		gc.mu.Unlock()
+	}
 	if err != nil {
-		log.Printf("Error cleaning expired plans: %v", err)
+		return Stats{Started: time.Now(), Err: err}
 	}
+	return gc.RunJob(ctx, job)
+}
 
-	// 2. Clean up expired previews
-	expiredPreviews, err := gc.cleanExpiredPreviews()
-	if err != nil {
-		log.Printf("Error cleaning expired previews: %v", err)
+// NewJob reserves the next run, or returns ErrRunning if one is running.
+// With UseLease it also takes the GC lease, failing with an error wrapping
+// lease.ErrHeld if another instance holds it. The caller must pass the
+// job to RunJob.
+func (gc *GC) NewJob(trigger string) (*Job, error) {
+	if !gc.running.TryLock() {
+		return nil, ErrRunning
 	}
 
-	// 3. Clean up unreferenced blobs
-	deletedBlobs, err := gc.cleanUnreferencedBlobs()
-	if err != nil {
-		log.Printf("Error cleaning unreferenced blobs: %v", err)
+	job := &Job{ID: "gc_" + uuid.New().String()[:8], Trigger: trigger, Mode: gc.nextMode()}
+	if gc.lock != nil {
+		l, err := gc.lock.Acquire(LeaseName)
+		if err != nil {
+			gc.running.Unlock()
+			return nil, err
+		}
+		job.lease = l
 	}
 
-	log.Printf("GC cycle completed in %v: plans=%d, previews=%d, blobs=%d",
-		time.Since(start), expiredPlans, expiredPreviews, deletedBlobs)
+	gc.failInterrupted()
+	gc.setProgress(newRun(job, "", Stats{Mode: job.Mode, Started: time.Now()}))
+	return job, nil
 }
 
-func (gc *GC) cleanExpiredPlans() (int, error) {
-	// Check if collection exists
-	collection, err := gc.app.FindCollectionByNameOrId("plans")
-	if err != nil || collection == nil {
-		return 0, nil // Collection not ready yet, skip
+// RunJob runs a reserved job, recording its progress and result in
+// gc_runs, and releases the reservation and the lease. The cycle is
+// cancelled if the lease is lost.
+func (gc *GC) RunJob(ctx context.Context, job *Job) Stats {
+	defer gc.running.Unlock()
+	if job.lease != nil {
+		defer job.lease.Release()
+		var cancel context.CancelFunc
+		ctx, cancel = job.lease.Context(ctx)
+		defer cancel()
 	}
 
-	// Format now as ISO8601 string for PocketBase filter
-	now := time.Now().UTC().Format("2006-01-02 15:04:05.000Z")
-
-	// Find expired plans
-	plans, err := gc.app.FindRecordsByFilter(
-		"plans",
-		"status = 'pending' && expires_at < {:now}",
-		"",
-		100,
-		0,
-		map[string]any{"now": now},
-	)
-	if err != nil {
-		return 0, err
-	}
-
-	updated := 0
-	for _, plan := range plans {
-		plan.Set("status", "expired")
-		if err := gc.app.Save(plan); err != nil {
-			return updated, err
+	log.Printf("Starting %s GC cycle %s (%s)", job.Mode, job.ID, job.Trigger)
+	stats := gc.cycle(ctx, job.Mode, nil, func(phase string, stats Stats, persist bool) {
+		run := newRun(job, phase, stats)
+		gc.setProgress(run)
+		if persist {
+			gc.saveRun(job, run)
 		}
-		updated++
+	})
+	log.Printf("GC cycle %s completed in %v: plans=%d, previews=%d, images=%d, blobs=%d, bytes=%d",
+		job.ID, stats.Duration, stats.ExpiredPlans, stats.ExpiredPreviews, stats.ImagesDeleted,
+		stats.BlobsDeleted, stats.BytesFreed)
+	if stats.Err != nil {
+		log.Printf("GC cycle %s error: %v", job.ID, stats.Err)
 	}
+	gc.pruneHistory()
 
-	return updated, nil
+	stats.JobID = job.ID
+	for _, fn := range gc.onRun {
+		fn(stats)
+	}
+	return stats
 }
 
-func (gc *GC) cleanExpiredPreviews() (int, error) {
-	// Check if collection exists
-	collection, err := gc.app.FindCollectionByNameOrId("previews")
-	if err != nil || collection == nil {
-		return 0, nil // Collection not ready yet, skip
+// RunDryRun performs a dry run GC in the mode of the next cycle and
+// returns what would be deleted. Blobs only referenced by images that
+// retention would delete are not counted, since the images still exist.
+func (gc *GC) RunDryRun() (*DryRunResult, error) {
+	result := &DryRunResult{Mode: gc.nextMode()}
+	stats := gc.cycle(context.Background(), result.Mode, result, nil)
+	if stats.Err != nil {
+		return nil, stats.Err
 	}
-
-	// Format now as ISO8601 string for PocketBase filter
-	now := time.Now().UTC().Format("2006-01-02 15:04:05.000Z")
-
-	// Find expired previews
-	previews, err := gc.app.FindRecordsByFilter(
-		"previews",
-		"expires_at < {:now}",
-		"",
-		100,
-		0,
-		map[string]any{"now": now},
-	)
-	if err != nil {
-		return 0, err
+	result.ExpiredPlans = stats.ExpiredPlans
+	result.ExpiredPreviews = stats.ExpiredPreviews
+	if result.RetentionEnabled {
+		result.ExpiredImages = stats.ImagesDeleted
 	}
+	result.UnreferencedBlobs = stats.BlobsDeleted
+	result.ReclaimableBytes = stats.BytesFreed
+	return result, nil
+}
 
-	deleted := 0
-	var firstErr error
-	for _, preview := range previews {
-		// Delete preview file from storage
-		project := preview.GetString("project")
-		slug := preview.GetString("slug")
-		if err := gc.storage.DeletePreview(project, slug); err != nil && firstErr == nil {
-			firstErr = err
-		}
+// DryRunResult contains the results of a dry run
+type DryRunResult struct {
+	ExpiredPlans      int   `json:"expired_plans"`
+	ExpiredPreviews   int   `json:"expired_previews"`
+	ExpiredImages     int   `json:"expired_images"`
+	UnreferencedBlobs int   `json:"unreferenced_blobs"`
+	ReclaimableBytes  int64 `json:"reclaimable_bytes"`
+	// Retention lists the projects with images to delete, or that
+	// retention would delete if it were enabled
+	Retention        []*ProjectRetention `json:"retention"`
+	RetentionEnabled bool                `json:"retention_enabled"`
+	// Mode is the mode of the next cycle, which the dry run follows
+	Mode string `json:"mode"`
+}
 
-		// Delete record
-		if err := gc.app.Delete(preview); err != nil {
-			if firstErr == nil {
-				firstErr = err
-			}
-			continue
+// cycle runs every phase, calling report (if not nil) when a phase starts
+// and periodically during the sweep, with persist set only for phase
+// changes. A dry run (non-nil dry) counts what would be expired and
+// deleted without changing anything and fills in the retention plans.
+func (gc *GC) cycle(ctx context.Context, mode string, dry *DryRunResult, report func(phase string, stats Stats, persist bool)) Stats {
+	dryRun := dry != nil
+	now := time.Now()
+	stats := Stats{Mode: mode, Started: now}
+	if report == nil {
+		report = func(string, Stats, bool) {}
+	}
+	endPhase := func() {
+		if n := len(stats.Phases); n > 0 {
+			last := &stats.Phases[n-1]
+			last.DurationMS = time.Since(last.StartedAt).Milliseconds()
+		}
+	}
+	phase := func(name string) {
+		endPhase()
+		stats.Phases = append(stats.Phases, PhaseTiming{Name: name, StartedAt: time.Now()})
+		report(name, stats, true)
+	}
+	finish := func(err error) Stats {
+		if err != nil && stats.Err == nil {
+			stats.Err = err
 		}
-		deleted++
+		endPhase()
+		stats.Duration = time.Since(now)
+		report(PhaseDone, stats, true)
+		return stats
 	}
 
-	return deleted, firstErr
-}
+	// Collections are created by migrations; skip until they exist
+	for _, name := range []string{"images", "plans", "projects", "previews"} {
+		if c, err := gc.app.FindCollectionByNameOrId(name); err != nil || c == nil {
+			return finish(nil)
+		}
+	}
 
-func (gc *GC) cleanUnreferencedBlobs() (int, error) {
-	// Check if collection exists
-	collection, err := gc.app.FindCollectionByNameOrId("images")
-	if err != nil || collection == nil {
-		return 0, nil // Collection not ready yet, skip
+	// Expired plans and previews and images dropped by retention stop
+	// protecting their blobs, so remove them before marking. Failures in
+	// these phases only keep more blobs and do not block the sweep.
+	phase(PhaseExpirePlans)
+	n, err := gc.expirePlans(ctx, now, dryRun)
+	stats.ExpiredPlans = n
+	if err != nil {
+		stats.Err = err
 	}
 
-	// 1. Collect all referenced blob hashes from images
-	referencedBlobs := make(map[string]bool)
+	phase(PhaseExpirePreviews)
+	n, err = gc.expirePreviews(ctx, now, dryRun)
+	stats.ExpiredPreviews = n
+	if err != nil && stats.Err == nil {
+		stats.Err = err
+	}
 
-	images, err := gc.app.FindRecordsByFilter("images", "1=1", "", 10000, 0, nil)
-	if err != nil {
-		return 0, err
+	phase(PhaseRetention)
+	if dryRun || gc.config.Retention {
+		plans, err := gc.retain(ctx, now, dryRun, &stats)
+		if dryRun {
+			dry.Retention = plans
+			dry.RetentionEnabled = gc.config.Retention
+		}
+		if err != nil && stats.Err == nil {
+			stats.Err = err
+		}
 	}
 
-	for _, img := range images {
-		var manifest map[string]storage.FileEntry
-		if err := json.Unmarshal([]byte(img.GetString("manifest")), &manifest); err != nil {
-			continue
+	phase(PhaseMark)
+	if !dryRun {
+		if err := pruneLeases(gc.app, now); err != nil && stats.Err == nil {
+			stats.Err = err
 		}
-		for _, file := range manifest {
-			referencedBlobs[file.Hash] = true
+	}
+	tick := func() { report(PhaseSweep, stats, false) }
+
+	if mode == ModeIncremental {
+		// Referenced blobs are counted in the index; only pending plans
+		// list blobs that no image references yet
+		m := make(marks)
+		if err := gc.markPlans(ctx, now, m); err != nil {
+			return finish(err)
 		}
+		phase(PhaseSweep)
+		return finish(gc.sweepIndex(ctx, m, now, dryRun, &stats, tick))
 	}
 
-	// 2. List all blobs in storage
-	allBlobs, err := gc.storage.ListBlobs()
+	markStart := time.Now()
+	counts := make(map[string]int)
+	m, err := gc.mark(ctx, now, counts)
 	if err != nil {
-		return 0, err
+		return finish(err)
 	}
+	stats.ReferencedBlobs = len(m)
 
-	// 3. Find and delete unreferenced blobs (with grace period)
-	deleted := 0
-	for _, hash := range allBlobs {
-		if referencedBlobs[hash] {
-			continue
-		}
+	phase(PhaseSweep)
+	remaining := make(map[string]int64)
+	if err := gc.sweep(ctx, m, now, dryRun, &stats, tick, remaining); err != nil || dryRun {
+		return finish(err)
+	}
 
-		// Check grace period
-		info, err := gc.storage.StatBlob(hash)
-		if err != nil {
-			continue
-		}
+	phase(PhaseReconcile)
+	stats.IndexDrift, err = gc.reconcile(ctx, counts, m, remaining, markStart)
+	return finish(err)
+}
 
-		if time.Since(info.ModTime) < gc.config.GracePeriod {
-			continue // Too new, might be in progress
-		}
+// expirePlans marks pending plans past their expiry as expired. Blobs they
+// uploaded that no image references are added to the blob index as
+// unreferenced, so incremental cycles can collect them.
+func (gc *GC) expirePlans(ctx context.Context, now time.Time, dryRun bool) (int, error) {
+	expired := 0
+	err := gc.eachRecord(ctx, "plans", "status = 'pending' && expires_at < {:now}",
+		map[string]any{"now": formatTime(now)}, func(plan *core.Record) error {
+			if !dryRun {
+				if blobs, err := gc.manifestBlobs(plan); err == nil {
+					if err := gc.indexAdd(blobs, 0); err != nil {
+						return err
+					}
+				}
+				// Presigned uploads never committed stay out of the blob store
+				stager, staged := storage.As[storage.UploadStager](gc.storage)
+				if staged && plan.GetString("upload_mode") == "presigned" {
+					if err := stager.DeleteUploads(plan.GetString("plan_id")); err != nil {
+						log.Printf("GC: failed to delete uploads of plan %s: %v", plan.GetString("plan_id"), err)
+					}
+				}
+				plan.Set("status", "expired")
+				if err := gc.app.Save(plan); err != nil {
+					return err
+				}
+			}
+			expired++
+			return nil
+		})
+	return expired, err
+}
 
-		// Delete
-		if err := gc.storage.DeleteBlob(hash); err == nil {
+// expirePreviews deletes previews past their expiry from storage and
+// PocketBase
+func (gc *GC) expirePreviews(ctx context.Context, now time.Time, dryRun bool) (int, error) {
+	deleted := 0
+	var errs []error
+	err := gc.eachRecord(ctx, "previews", "expires_at < {:now}",
+		map[string]any{"now": formatTime(now)}, func(preview *core.Record) error {
+			if dryRun {
+				deleted++
+				return nil
+			}
+			project, slug := preview.GetString("project"), preview.GetString("slug")
+			if err := gc.storage.DeletePreview(project, slug); err != nil {
+				errs = append(errs, err)
+			}
+			if err := gc.app.Delete(preview); err != nil {
+				errs = append(errs, err)
+				return nil
+			}
 			deleted++
-		}
-	}
-
-	return deleted, nil
+			return nil
+		})
+	return deleted, errors.Join(append([]error{err}, errs...)...)
 }
 
-// RunDryRun performs a dry run GC and returns what would be deleted
-func (gc *GC) RunDryRun() (*DryRunResult, error) {
-	result := &DryRunResult{}
-
-	// Format now as ISO8601 string for PocketBase filter
-	now := time.Now().UTC().Format("2006-01-02 15:04:05.000Z")
-
-	// Count expired plans
-	plans, err := gc.app.FindRecordsByFilter(
-		"plans",
-		"status = 'pending' && expires_at < {:now}",
-		"",
-		1000,
-		0,
-		map[string]any{"now": now},
-	)
-	if err == nil {
-		result.ExpiredPlans = len(plans)
+// sweep deletes blobs that are not marked, not leased and older than the
+// grace period, and records the blobs it keeps in remaining
+func (gc *GC) sweep(ctx context.Context, m marks, now time.Time, dryRun bool, stats *Stats, tick func(), remaining map[string]int64) error {
+	hashes, err := gc.storage.ListBlobs()
+	if err != nil {
+		return err
 	}
 
-	// Count expired previews
-	previews, err := gc.app.FindRecordsByFilter(
-		"previews",
-		"expires_at < {:now}",
-		"",
-		1000,
-		0,
-		map[string]any{"now": now},
-	)
-	if err == nil {
-		result.ExpiredPreviews = len(previews)
+	keep := func(hash string, size int64) {
+		stats.BlobsRemaining++
+		stats.BytesRemaining += size
+		remaining[hash] = size
 	}
+	var firstErr error
+	for i, hash := range hashes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		stats.BlobsScanned++
+		if i%1000 == 999 {
+			tick()
+		}
 
-	// Count unreferenced blobs
-	referencedBlobs := make(map[string]bool)
-	images, _ := gc.app.FindRecordsByFilter("images", "1=1", "", 10000, 0, nil)
-	for _, img := range images {
-		var manifest map[string]storage.FileEntry
-		if err := json.Unmarshal([]byte(img.GetString("manifest")), &manifest); err != nil {
+		if size, ok := m[hash]; ok {
+			keep(hash, size)
 			continue
 		}
-		for _, file := range manifest {
-			referencedBlobs[file.Hash] = true
-		}
-	}
 
-	allBlobs, _ := gc.storage.ListBlobs()
-	for _, hash := range allBlobs {
-		if !referencedBlobs[hash] {
-			info, err := gc.storage.StatBlob(hash)
-			if err != nil {
-				continue
+		info, err := gc.storage.StatBlob(hash)
+		if err != nil {
+			// Deleted concurrently, or unreadable; either way leave it
+			if !storage.IsNotFound(err) {
+				keep(hash, 0)
 			}
-			if time.Since(info.ModTime) >= gc.config.GracePeriod {
-				result.UnreferencedBlobs++
-				result.ReclaimableBytes += info.Size
+			continue
+		}
+		if time.Since(info.ModTime) < gc.config.GracePeriod {
+			// Too new, an upload may be in progress
+			keep(hash, info.Size)
+			continue
+		}
+
+		var del func(core.App) error
+		if !dryRun {
+			del = func(core.App) error { return gc.storage.DeleteBlob(hash) }
+		}
+		leased, err := deleteUnlessLeased(gc.app, hash, now, del)
+		if !leased && err == nil && !dryRun {
+			gc.deleted(hash)
+		}
+		switch {
+		case leased:
+			stats.BlobsLeased++
+			keep(hash, info.Size)
+		case err != nil:
+			if firstErr == nil {
+				firstErr = err
 			}
+			keep(hash, info.Size)
+		default:
+			stats.BlobsDeleted++
+			stats.BytesFreed += info.Size
 		}
 	}
-
-	return result, nil
+	return firstErr
 }
 
-// DryRunResult contains the results of a dry run
-type DryRunResult struct {
-	ExpiredPlans      int   `json:"expired_plans"`
-	ExpiredPreviews   int   `json:"expired_previews"`
-	UnreferencedBlobs int   `json:"unreferenced_blobs"`
-	ReclaimableBytes  int64 `json:"reclaimable_bytes"`
+func (gc *GC) setProgress(run Run) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	gc.progress = run
 }
@@ -0,0 +1,238 @@
+package gc
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// historyLimit is the number of runs kept in gc_runs
+const historyLimit = 200
+
+// Run statuses
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Triggers of a run
+const (
+	TriggerSchedule = "schedule"
+	TriggerAdmin    = "admin"
+)
+
+// Run is a GC run as reported by the admin API and stored in gc_runs
+type Run struct {
+	JobID           string        `json:"job_id"`
+	Trigger         string        `json:"trigger"`
+	Mode            string        `json:"mode"`
+	Status          string        `json:"status"`
+	Phase           string        `json:"phase"`
+	StartedAt       time.Time     `json:"started_at"`
+	FinishedAt      *time.Time    `json:"finished_at,omitempty"`
+	DurationMS      int64         `json:"duration_ms"`
+	ExpiredPlans    int           `json:"expired_plans"`
+	ExpiredPreviews int           `json:"expired_previews"`
+	DeletedImages   int           `json:"deleted_images"`
+	ReferencedBlobs int           `json:"referenced_blobs"`
+	ScannedBlobs    int           `json:"scanned_blobs"`
+	DeletedBlobs    int           `json:"deleted_blobs"`
+	LeasedBlobs     int           `json:"leased_blobs"`
+	BytesFreed      int64         `json:"bytes_freed"`
+	IndexDrift      int           `json:"index_drift"`
+	Phases          []PhaseTiming `json:"phases"`
+	Error           string        `json:"error,omitempty"`
+}
+
+// PhaseTiming records when a phase of a run started and how long it took
+type PhaseTiming struct {
+	Name       string    `json:"name"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// newRun describes a run from its current stats
+func newRun(job *Job, phase string, stats Stats) Run {
+	run := Run{
+		JobID:           job.ID,
+		Trigger:         job.Trigger,
+		Mode:            stats.Mode,
+		Status:          StatusRunning,
+		Phase:           phase,
+		StartedAt:       stats.Started,
+		DurationMS:      time.Since(stats.Started).Milliseconds(),
+		ExpiredPlans:    stats.ExpiredPlans,
+		ExpiredPreviews: stats.ExpiredPreviews,
+		DeletedImages:   stats.ImagesDeleted,
+		ReferencedBlobs: stats.ReferencedBlobs,
+		ScannedBlobs:    stats.BlobsScanned,
+		DeletedBlobs:    stats.BlobsDeleted,
+		LeasedBlobs:     stats.BlobsLeased,
+		BytesFreed:      stats.BytesFreed,
+		IndexDrift:      stats.IndexDrift,
+		Phases:          append([]PhaseTiming(nil), stats.Phases...),
+	}
+	if phase == PhaseDone {
+		finished := stats.Started.Add(stats.Duration)
+		run.FinishedAt = &finished
+		run.DurationMS = stats.Duration.Milliseconds()
+		run.Status = StatusSucceeded
+		if stats.Err != nil {
+			run.Status = StatusFailed
+			run.Error = stats.Err.Error()
+		}
+	}
+	return run
+}
+
+// runFromRecord reads a gc_runs record
+func runFromRecord(record *core.Record) Run {
+	run := Run{
+		JobID:           record.GetString("job_id"),
+		Trigger:         record.GetString("trigger"),
+		Mode:            record.GetString("mode"),
+		Status:          record.GetString("status"),
+		Phase:           record.GetString("phase"),
+		StartedAt:       record.GetDateTime("started").Time(),
+		DurationMS:      int64(record.GetInt("duration_ms")),
+		ExpiredPlans:    record.GetInt("expired_plans"),
+		ExpiredPreviews: record.GetInt("expired_previews"),
+		DeletedImages:   record.GetInt("deleted_images"),
+		ReferencedBlobs: record.GetInt("referenced_blobs"),
+		ScannedBlobs:    record.GetInt("scanned_blobs"),
+		DeletedBlobs:    record.GetInt("deleted_blobs"),
+		LeasedBlobs:     record.GetInt("leased_blobs"),
+		BytesFreed:      int64(record.GetFloat("bytes_freed")),
+		IndexDrift:      record.GetInt("index_drift"),
+		Error:           record.GetString("error"),
+	}
+	if finished := record.GetDateTime("finished"); !finished.IsZero() {
+		t := finished.Time()
+		run.FinishedAt = &t
+	}
+	_ = record.UnmarshalJSONField("phases", &run.Phases)
+	return run
+}
+
+// saveRun writes a run to gc_runs, creating its record on first save.
+// History is best effort: failures are logged and do not fail the run.
+func (gc *GC) saveRun(job *Job, run Run) {
+	if job.record == nil {
+		collection, err := gc.app.FindCollectionByNameOrId("gc_runs")
+		if err != nil {
+			return // Collection not ready yet, skip
+		}
+		job.record = core.NewRecord(collection)
+	}
+
+	r := job.record
+	r.Set("job_id", run.JobID)
+	r.Set("trigger", run.Trigger)
+	r.Set("mode", run.Mode)
+	r.Set("status", run.Status)
+	r.Set("phase", run.Phase)
+	r.Set("started", run.StartedAt)
+	if run.FinishedAt != nil {
+		r.Set("finished", *run.FinishedAt)
+	}
+	r.Set("duration_ms", run.DurationMS)
+	r.Set("expired_plans", run.ExpiredPlans)
+	r.Set("expired_previews", run.ExpiredPreviews)
+	r.Set("deleted_images", run.DeletedImages)
+	r.Set("referenced_blobs", run.ReferencedBlobs)
+	r.Set("scanned_blobs", run.ScannedBlobs)
+	r.Set("deleted_blobs", run.DeletedBlobs)
+	r.Set("leased_blobs", run.LeasedBlobs)
+	r.Set("bytes_freed", run.BytesFreed)
+	r.Set("index_drift", run.IndexDrift)
+	phases, _ := json.Marshal(run.Phases)
+	r.Set("phases", types.JSONRaw(phases))
+	r.Set("error", run.Error)
+
+	if err := gc.app.Save(r); err != nil {
+		log.Printf("GC: failed to save run %s: %v", run.JobID, err)
+	}
+}
+
+// failInterrupted marks runs left running by a previous process as failed.
+// It is called with the run lock held, so none of them is still running.
+func (gc *GC) failInterrupted() {
+	records, err := gc.app.FindRecordsByFilter(
+		"gc_runs", "status = 'running'", "", 0, 0, nil)
+	if err != nil {
+		return
+	}
+	for _, r := range records {
+		r.Set("status", StatusFailed)
+		r.Set("error", "interrupted")
+		if err := gc.app.Save(r); err != nil {
+			log.Printf("GC: failed to update interrupted run %s: %v", r.GetString("job_id"), err)
+		}
+	}
+}
+
+// pruneHistory deletes all but the newest historyLimit runs. The newest
+// successful full run is kept regardless, since it schedules the next one.
+func (gc *GC) pruneHistory() {
+	old, err := gc.app.FindRecordsByFilter(
+		"gc_runs", "status != 'running'", "-started", 0, historyLimit, nil)
+	if err != nil {
+		return
+	}
+	lastFull := gc.lastFullRun()
+	for _, r := range old {
+		if lastFull != nil && r.Id == lastFull.Id {
+			continue
+		}
+		if err := gc.app.Delete(r); err != nil {
+			log.Printf("GC: failed to prune run %s: %v", r.GetString("job_id"), err)
+		}
+	}
+}
+
+// Runs returns past and running runs, newest first, and the total count
+func (gc *GC) Runs(limit, offset int) ([]Run, int, error) {
+	total, err := gc.app.CountRecords("gc_runs")
+	if err != nil {
+		return nil, 0, err
+	}
+	records, err := gc.app.FindRecordsByFilter("gc_runs", "1=1", "-started", limit, offset, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	runs := make([]Run, len(records))
+	for i, r := range records {
+		runs[i] = gc.liveRun(runFromRecord(r))
+	}
+	return runs, int(total), nil
+}
+
+// FindRun returns a run by job ID
+func (gc *GC) FindRun(jobID string) (*Run, error) {
+	record, err := gc.app.FindFirstRecordByData("gc_runs", "job_id", jobID)
+	if err != nil {
+		// The run may have started before gc_runs existed
+		if p := gc.Progress(); p.JobID == jobID {
+			return &p, nil
+		}
+		return nil, err
+	}
+	run := gc.liveRun(runFromRecord(record))
+	return &run, nil
+}
+
+// liveRun replaces a stored running run with its in-memory progress, which
+// is updated more often than the record
+func (gc *GC) liveRun(run Run) Run {
+	if run.Status != StatusRunning {
+		return run
+	}
+	if p := gc.Progress(); p.JobID == run.JobID {
+		return p
+	}
+	return run
+}
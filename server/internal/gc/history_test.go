@@ -0,0 +1,46 @@
+package gc
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewRun(t *testing.T) {
+	job := &Job{ID: "gc_1", Trigger: TriggerAdmin}
+	started := time.Now().Add(-time.Minute)
+	stats := Stats{
+		Mode:         ModeIncremental,
+		Started:      started,
+		BlobsDeleted: 3,
+		BytesFreed:   300,
+		Phases:       []PhaseTiming{{Name: PhaseMark, StartedAt: started, DurationMS: 5}},
+	}
+
+	run := newRun(job, PhaseSweep, stats)
+	if run.Status != StatusRunning || run.Phase != PhaseSweep || run.FinishedAt != nil {
+		t.Errorf("running run = %+v", run)
+	}
+	if run.JobID != "gc_1" || run.Trigger != TriggerAdmin || run.Mode != ModeIncremental ||
+		run.DeletedBlobs != 3 || run.BytesFreed != 300 {
+		t.Errorf("run fields = %+v", run)
+	}
+
+	stats.Duration = 2 * time.Second
+	run = newRun(job, PhaseDone, stats)
+	if run.Status != StatusSucceeded || run.FinishedAt == nil || run.DurationMS != 2000 {
+		t.Errorf("finished run = %+v", run)
+	}
+
+	stats.Err = errors.New("listing blobs: boom")
+	run = newRun(job, PhaseDone, stats)
+	if run.Status != StatusFailed || run.Error != "listing blobs: boom" {
+		t.Errorf("failed run = %+v", run)
+	}
+
+	// The run keeps its own copy of the phases
+	stats.Phases[0].DurationMS = 99
+	if run.Phases[0].DurationMS != 5 {
+		t.Error("run shares phases with stats")
+	}
+}
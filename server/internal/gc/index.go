@@ -0,0 +1,382 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+// The blob index (blob_refs) counts, for every blob, the images whose
+// manifest references it. Image hooks keep the counts current, expiring a
+// plan indexes the blobs it uploaded with a count of 0, and full cycles
+// rebuild the index from a scan to correct drift. Incremental cycles
+// delete blobs whose count has been 0 for longer than the grace period
+// without listing storage or reading every manifest.
+
+// indexCollection is the collection holding the blob index
+const indexCollection = "blob_refs"
+
+// indexChunk is the number of hashes looked up per index query
+const indexChunk = 500
+
+// Cycle modes
+const (
+	// ModeFull marks from every image, plan, ref and preview, sweeps
+	// every blob in storage and rebuilds the blob index
+	ModeFull = "full"
+	// ModeIncremental sweeps the blobs the index reports unreferenced
+	ModeIncremental = "incremental"
+)
+
+// errReferenced aborts the deletion of a blob that gained a reference
+var errReferenced = errors.New("blob is referenced")
+
+// BindHooks keeps the blob index in step with images as they are created
+// and deleted, whether by a deploy, retention or a project deletion.
+// Failures are logged; the next full cycle corrects the index.
+func (gc *GC) BindHooks() {
+	gc.app.OnRecordAfterCreateSuccess("images").BindFunc(func(e *core.RecordEvent) error {
+		if err := gc.indexImage(e.Record, 1); err != nil {
+			log.Printf("GC: failed to index image %s: %v", e.Record.GetString("image_id"), err)
+		}
+		return e.Next()
+	})
+	gc.app.OnRecordAfterDeleteSuccess("images").BindFunc(func(e *core.RecordEvent) error {
+		if err := gc.indexImage(e.Record, -1); err != nil {
+			log.Printf("GC: failed to unindex image %s: %v", e.Record.GetString("image_id"), err)
+		}
+		return e.Next()
+	})
+}
+
+// manifestBlobs returns the distinct blobs an image or plan references,
+// with their sizes: the files of its manifest and the manifest object
+func (gc *GC) manifestBlobs(record *core.Record) (map[string]int64, error) {
+	m, err := gc.manifests.Record(record)
+	if err != nil {
+		return nil, err
+	}
+	return m.Blobs(), nil
+}
+
+// indexImage adds delta to the count of every blob an image references
+func (gc *GC) indexImage(image *core.Record, delta int) error {
+	blobs, err := gc.manifestBlobs(image)
+	if err != nil {
+		return fmt.Errorf("invalid manifest: %w", err)
+	}
+	return gc.indexAdd(blobs, delta)
+}
+
+// indexAdd adds delta to the count of each blob, creating missing rows. A
+// delta of 0 only indexes blobs that have no row yet. A blob whose count
+// drops to 0 is unreferenced from now on.
+func (gc *GC) indexAdd(blobs map[string]int64, delta int) error {
+	return gc.app.RunInTransaction(func(txApp core.App) error {
+		return indexAddTx(txApp, blobs, delta)
+	})
+}
+
+// indexAddTx is indexAdd within the transaction of txApp
+func indexAddTx(txApp core.App, blobs map[string]int64, delta int) error {
+	collection, err := txApp.FindCachedCollectionByNameOrId(indexCollection)
+	if err != nil {
+		return nil // Not migrated yet; the first full cycle builds the index
+	}
+
+	hashes := make([]string, 0, len(blobs))
+	for hash := range blobs {
+		hashes = append(hashes, hash)
+	}
+	now := types.NowDateTime()
+
+	for start := 0; start < len(hashes); start += indexChunk {
+		chunk := hashes[start:min(start+indexChunk, len(hashes))]
+		rows, err := findIndexRows(txApp, chunk)
+		if err != nil {
+			return err
+		}
+		for _, hash := range chunk {
+			row, ok := rows[hash]
+			if ok && delta == 0 {
+				continue
+			}
+			if !ok {
+				row = core.NewRecord(collection)
+				row.Set("hash", hash)
+				row.Set("size", blobs[hash])
+				row.Set("first_seen", now)
+			}
+
+			old := row.GetInt("refcount")
+			count := max(old+delta, 0)
+			row.Set("refcount", count)
+			switch {
+			case count > 0:
+				row.Set("unreferenced_at", "")
+			case old > 0 || row.GetDateTime("unreferenced_at").IsZero():
+				row.Set("unreferenced_at", now)
+			}
+			if err := txApp.Save(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findIndexRows returns the index rows of hashes, keyed by hash
+func findIndexRows(app core.App, hashes []string) (map[string]*core.Record, error) {
+	values := make([]any, len(hashes))
+	for i, hash := range hashes {
+		values[i] = hash
+	}
+	records, err := app.FindAllRecords(indexCollection, dbx.In("hash", values...))
+	if err != nil {
+		return nil, err
+	}
+	rows := make(map[string]*core.Record, len(records))
+	for _, r := range records {
+		rows[r.GetString("hash")] = r
+	}
+	return rows, nil
+}
+
+// nextMode returns the mode of the next cycle: full if the index has never
+// been rebuilt or was last rebuilt ReconcileInterval ago, else incremental
+func (gc *GC) nextMode() string {
+	if gc.config.ReconcileInterval <= 0 {
+		return ModeFull
+	}
+	if _, err := gc.app.FindCachedCollectionByNameOrId(indexCollection); err != nil {
+		return ModeFull
+	}
+	last := gc.lastFullRun()
+	if last == nil || time.Since(last.GetDateTime("started").Time()) >= gc.config.ReconcileInterval {
+		return ModeFull
+	}
+	return ModeIncremental
+}
+
+// lastFullRun returns the newest successful full run, or nil
+func (gc *GC) lastFullRun() *core.Record {
+	runs, err := gc.app.FindRecordsByFilter(
+		"gc_runs", "mode = 'full' && status = 'succeeded'", "-started", 1, 0, nil)
+	if err != nil || len(runs) == 0 {
+		return nil
+	}
+	return runs[0]
+}
+
+// sweepIndex deletes blobs the index has reported unreferenced since before
+// the grace period, unless a pending plan lists them (m) or they are
+// leased. The count is checked again right before deleting, since an image
+// may have been committed after the row was read.
+func (gc *GC) sweepIndex(ctx context.Context, m marks, now time.Time, dryRun bool, stats *Stats, tick func()) error {
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	err := gc.eachRecord(ctx, indexCollection,
+		"refcount = 0 && unreferenced_at != '' && unreferenced_at < {:cutoff}",
+		map[string]any{"cutoff": formatTime(now.Add(-gc.config.GracePeriod))},
+		func(row *core.Record) error {
+			stats.BlobsScanned++
+			if stats.BlobsScanned%1000 == 0 {
+				tick()
+			}
+
+			hash := row.GetString("hash")
+			if _, ok := m[hash]; ok {
+				return nil
+			}
+
+			info, err := gc.storage.StatBlob(hash)
+			if storage.IsNotFound(err) {
+				// Already gone; drop the row unless it gained a reference
+				if !dryRun {
+					if err := gc.dropIndexRow(row.Id); err != nil {
+						fail(err)
+					}
+				}
+				return nil
+			}
+			if err != nil {
+				fail(err)
+				return nil
+			}
+			if time.Since(info.ModTime) < gc.config.GracePeriod {
+				// Uploaded again since it became unreferenced
+				return nil
+			}
+
+			var del func(core.App) error
+			var deleted bool
+			if !dryRun {
+				del = func(txApp core.App) error {
+					current, err := txApp.FindRecordById(indexCollection, row.Id)
+					if err != nil {
+						return err
+					}
+					if current.GetInt("refcount") > 0 {
+						return errReferenced
+					}
+					if err := gc.storage.DeleteBlob(hash); err != nil {
+						return err
+					}
+					deleted = true
+					return txApp.Delete(current)
+				}
+			}
+			leased, err := deleteUnlessLeased(gc.app, hash, now, del)
+			if deleted {
+				gc.deleted(hash)
+			}
+			switch {
+			case leased:
+				stats.BlobsLeased++
+			case errors.Is(err, errReferenced):
+			case err != nil:
+				fail(err)
+			default:
+				stats.BlobsDeleted++
+				stats.BytesFreed += info.Size
+			}
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	if err := gc.indexTotals(stats); err != nil {
+		fail(err)
+	}
+	return firstErr
+}
+
+// dropIndexRow deletes an index row if its count is still 0
+func (gc *GC) dropIndexRow(id string) error {
+	row, err := gc.app.FindRecordById(indexCollection, id)
+	if err != nil || row.GetInt("refcount") > 0 {
+		return nil
+	}
+	return gc.app.Delete(row)
+}
+
+// indexTotals sets the blob store totals and referenced blob count from
+// the index, which lists every blob once a full cycle has built it
+func (gc *GC) indexTotals(stats *Stats) error {
+	var totals struct {
+		Blobs      int   `db:"blobs"`
+		Bytes      int64 `db:"bytes"`
+		Referenced int   `db:"referenced"`
+	}
+	err := gc.app.DB().NewQuery(
+		"SELECT COUNT(*) AS blobs, COALESCE(SUM(size), 0) AS bytes, " +
+			"COALESCE(SUM(refcount > 0), 0) AS referenced FROM " + indexCollection).
+		One(&totals)
+	if err != nil {
+		return err
+	}
+	stats.BlobsRemaining = totals.Blobs
+	stats.BytesRemaining = totals.Bytes
+	stats.ReferencedBlobs = totals.Referenced
+	return nil
+}
+
+// reconcile corrects the index after a full mark and sweep. counts holds
+// the number of images referencing each blob, sizes the size of every
+// marked blob and remaining the blobs left in storage. Rows changed after
+// since were updated by image hooks with newer information than the scan
+// and are left alone. It returns the number of rows corrected.
+func (gc *GC) reconcile(ctx context.Context, counts map[string]int, sizes marks, remaining map[string]int64, since time.Time) (int, error) {
+	collection, err := gc.app.FindCachedCollectionByNameOrId(indexCollection)
+	if err != nil {
+		return 0, nil
+	}
+	now := types.NowDateTime()
+	drift := 0
+
+	err = gc.eachRecord(ctx, indexCollection, "1=1", nil, func(row *core.Record) error {
+		hash := row.GetString("hash")
+		want := counts[hash]
+		_, stored := remaining[hash]
+		delete(counts, hash)
+		delete(remaining, hash)
+		if !row.GetDateTime("updated").Time().Before(since) {
+			return nil
+		}
+
+		if want == 0 && !stored {
+			drift++
+			return gc.app.Delete(row)
+		}
+
+		changed := row.GetInt("refcount") != want
+		row.Set("refcount", want)
+		hasSince := !row.GetDateTime("unreferenced_at").IsZero()
+		switch {
+		case want > 0 && hasSince:
+			row.Set("unreferenced_at", "")
+			changed = true
+		case want == 0 && !hasSince:
+			row.Set("unreferenced_at", now)
+			changed = true
+		}
+		if !changed {
+			return nil
+		}
+		drift++
+		return gc.app.Save(row)
+	})
+	if err != nil {
+		return drift, err
+	}
+
+	// Blobs with no row: referenced ones, then unreferenced ones the sweep
+	// kept (too new or leased). An image hook may have added a row behind
+	// the scan.
+	add := func(hash string, size int64, count int) error {
+		if _, err := gc.app.FindFirstRecordByData(indexCollection, "hash", hash); err == nil {
+			return nil
+		}
+		row := core.NewRecord(collection)
+		row.Set("hash", hash)
+		row.Set("size", size)
+		row.Set("refcount", count)
+		row.Set("first_seen", now)
+		if count == 0 {
+			row.Set("unreferenced_at", now)
+		}
+		drift++
+		return gc.app.Save(row)
+	}
+	for hash, count := range counts {
+		if err := ctx.Err(); err != nil {
+			return drift, err
+		}
+		if err := add(hash, sizes[hash], count); err != nil {
+			return drift, err
+		}
+		delete(remaining, hash)
+	}
+	for hash, size := range remaining {
+		if err := ctx.Err(); err != nil {
+			return drift, err
+		}
+		if err := add(hash, size, 0); err != nil {
+			return drift, err
+		}
+	}
+	return drift, nil
+}
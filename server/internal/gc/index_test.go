@@ -0,0 +1,64 @@
+package gc
+
+import (
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/manifest"
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+func TestManifestBlobs(t *testing.T) {
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc := &GC{manifests: manifest.NewStore(backend, 0)}
+
+	images := core.NewBaseCollection("images")
+	images.Fields.Add(&core.TextField{Name: "manifest_hash"})
+	images.Fields.Add(&core.JSONField{Name: "manifest"})
+
+	// Two paths share a blob; an image references it once
+	legacy := core.NewRecord(images)
+	legacy.Set("manifest", `{
+		"index.html": {"hash": "aaa", "size": 10},
+		"404.html": {"hash": "aaa", "size": 10},
+		"app.js": {"hash": "bbb", "size": 20}
+	}`)
+	blobs, err := gc.manifestBlobs(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 2 || blobs["aaa"] != 10 || blobs["bbb"] != 20 {
+		t.Errorf("manifestBlobs = %v", blobs)
+	}
+
+	// The manifest object is a blob of the image
+	m := manifest.New(map[string]storage.FileEntry{
+		"index.html": {Hash: "aaa", Size: 10},
+		"app.js":     {Hash: "bbb", Size: 20},
+	})
+	if err := gc.manifests.Put(m); err != nil {
+		t.Fatal(err)
+	}
+	image := core.NewRecord(images)
+	manifest.Set(image, m)
+	blobs, err = gc.manifestBlobs(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 3 || blobs[m.Hash] != m.Size {
+		t.Errorf("manifestBlobs = %v", blobs)
+	}
+
+	invalid := core.NewRecord(images)
+	invalid.Set("manifest", "not json")
+	if _, err := gc.manifestBlobs(invalid); err == nil {
+		t.Error("expected error for invalid manifest")
+	}
+	image.Set("manifest_hash", manifest.New(nil).Hash)
+	if _, err := gc.manifestBlobs(image); !storage.IsNotFound(err) {
+		t.Errorf("missing manifest object: %v", err)
+	}
+}
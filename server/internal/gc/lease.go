@@ -0,0 +1,93 @@
+package gc
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// leaseCollection holds leases on blobs that an in-flight deploy relies
+// on but that no image references yet. They are kept in the database with
+// the plans and images GC marks from, so every instance sharing it sees
+// the leases of the others.
+//
+// A plan leases its manifest before checking which blobs already exist,
+// and the sweep checks the lease and deletes the blob in one transaction
+// that holds the database write lock, so a blob is either deleted before
+// the plan sees it (and gets uploaded again) or kept.
+const leaseCollection = "blob_leases"
+
+// leaseChunk is the number of hashes leased per statement
+const leaseChunk = 500
+
+// addLeases leases hashes until the given time, extending existing leases
+func addLeases(app core.App, hashes []string, until time.Time) error {
+	expires := formatTime(until)
+	return app.RunInTransaction(func(txApp core.App) error {
+		for start := 0; start < len(hashes); start += leaseChunk {
+			chunk := hashes[start:min(start+leaseChunk, len(hashes))]
+			params := dbx.Params{"expires": expires}
+			rows := make([]string, 0, len(chunk))
+			for i, hash := range chunk {
+				key := "h" + strconv.Itoa(i)
+				params[key] = hash
+				rows = append(rows, "('r' || lower(hex(randomblob(7))), {:"+key+"}, {:expires})")
+			}
+			_, err := txApp.DB().NewQuery(
+				"INSERT INTO " + leaseCollection + " (id, hash, expires) VALUES " + strings.Join(rows, ", ") +
+					" ON CONFLICT (hash) DO UPDATE SET expires = max(expires, excluded.expires)").
+				Bind(params).Execute()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// pruneLeases drops leases that expired before now. It runs only when a
+// cycle starts marking, so leases taken during a cycle outlive its sweep
+// even if they expire first; by the next cycle a committed plan is marked
+// from its image instead.
+func pruneLeases(app core.App, now time.Time) error {
+	_, err := app.DB().Delete(leaseCollection,
+		dbx.NewExp("expires < {:now}", dbx.Params{"now": formatTime(now)})).Execute()
+	return err
+}
+
+// deleteUnlessLeased calls del for an unleased hash and reports whether the
+// hash was leased. del runs in the transaction of txApp, which holds the
+// write lock from before the lease is checked, so plans leasing the hash
+// meanwhile wait for it. now is when the cycle started pruning leases. A
+// nil del only checks the lease, for dry runs.
+func deleteUnlessLeased(app core.App, hash string, now time.Time, del func(txApp core.App) error) (leased bool, err error) {
+	if del == nil {
+		return isLeased(app, hash)
+	}
+	err = app.RunInTransaction(func(txApp core.App) error {
+		// A write takes the lock before the read; it prunes what the cycle
+		// already pruned at its start
+		_, err := txApp.DB().Delete(leaseCollection, dbx.And(
+			dbx.HashExp{"hash": hash},
+			dbx.NewExp("expires < {:now}", dbx.Params{"now": formatTime(now)}),
+		)).Execute()
+		if err != nil {
+			return err
+		}
+		if leased, err = isLeased(txApp, hash); err != nil || leased {
+			return err
+		}
+		return del(txApp)
+	})
+	return leased, err
+}
+
+func isLeased(app core.App, hash string) (bool, error) {
+	var n int
+	err := app.DB().Select("COUNT(*)").From(leaseCollection).
+		Where(dbx.HashExp{"hash": hash}).Row(&n)
+	return n > 0, err
+}
@@ -0,0 +1,102 @@
+package gc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	_ "github.com/sitepod/sitepod/migrations"
+)
+
+// newTestApp creates a migrated app in a temporary directory
+func newTestApp(t *testing.T) core.App {
+	t.Helper()
+	app := openTestApp(t, t.TempDir())
+	if err := app.RunAllMigrations(); err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+// openTestApp opens the app in dir, as another instance sharing its
+// database would
+func openTestApp(t *testing.T, dir string) core.App {
+	t.Helper()
+	app := core.NewBaseApp(core.BaseAppConfig{DataDir: dir})
+	if err := app.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.ResetBootstrapState() })
+	return app
+}
+
+func TestLeases(t *testing.T) {
+	app := newTestApp(t)
+	// Another instance sees the leases through the database
+	other := openTestApp(t, app.DataDir())
+
+	now := time.Now()
+	if err := addLeases(app, []string{"a", "b"}, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	// Does not shorten b
+	if err := addLeases(app, []string{"b"}, now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted := map[string]bool{}
+	del := func(hash string) func(core.App) error {
+		return func(core.App) error { deleted[hash] = true; return nil }
+	}
+
+	for _, hash := range []string{"a", "b"} {
+		if leased, _ := deleteUnlessLeased(other, hash, now, del(hash)); !leased || deleted[hash] {
+			t.Errorf("%s: leased = %v, deleted = %v; want leased and kept", hash, leased, deleted[hash])
+		}
+	}
+	if leased, _ := deleteUnlessLeased(other, "c", now, del("c")); leased || !deleted["c"] {
+		t.Errorf("c: leased = %v, deleted = %v; want deleted", leased, deleted["c"])
+	}
+
+	// Expired leases keep protecting blobs until the next cycle prunes them
+	if err := addLeases(app, []string{"d"}, now.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if leased, _ := deleteUnlessLeased(other, "d", now.Add(-time.Minute), del("d")); !leased {
+		t.Error("d: expired lease should hold until pruned")
+	}
+	if leased, _ := deleteUnlessLeased(other, "d", now, nil); !leased {
+		t.Error("d: a dry run should not prune the lease")
+	}
+	if err := pruneLeases(other, now); err != nil {
+		t.Fatal(err)
+	}
+	if leased, _ := deleteUnlessLeased(other, "d", now, del("d")); leased || !deleted["d"] {
+		t.Error("d: pruned lease should no longer protect the blob")
+	}
+	if leased, _ := deleteUnlessLeased(other, "a", now, del("a")); !leased {
+		t.Error("a: unexpired lease was pruned")
+	}
+
+	// A plan leasing a blob while it is deleted waits for the deletion
+	leasedE := make(chan error, 1)
+	_, err := deleteUnlessLeased(other, "e", now, func(core.App) error {
+		go func() { leasedE <- addLeases(app, []string{"e"}, now.Add(time.Minute)) }()
+		select {
+		case err := <-leasedE:
+			leasedE <- err
+			t.Error("e: leased during the deletion")
+		case <-time.After(50 * time.Millisecond):
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-leasedE; err != nil {
+		t.Fatal(err)
+	}
+	if leased, _ := isLeased(other, "e"); !leased {
+		t.Error("e: lease taken after the deletion is missing")
+	}
+}
@@ -0,0 +1,79 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/manifest"
+)
+
+// ConvertManifests stores the inline manifests of images and pending plans
+// written by earlier versions as manifest objects, and points the records
+// at them. A converted image counts its manifest object in the blob index,
+// as a new image would. Records converted in the meantime, by another
+// instance, are left alone. Refs and previews keep their inline manifest
+// until the next release replaces them. It returns the number of records
+// converted.
+func (gc *GC) ConvertManifests(ctx context.Context) (int, error) {
+	converted := 0
+	var errs []error
+	for _, c := range []struct {
+		collection, filter string
+		// index counts the manifest object in the blob index
+		index bool
+	}{
+		{"images", "manifest_hash = ''", true},
+		{"plans", "manifest_hash = '' && status = 'pending'", false},
+	} {
+		err := gc.eachRecord(ctx, c.collection, c.filter, nil, func(record *core.Record) error {
+			ok, err := gc.convertManifest(record, c.index)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s %s: %w", c.collection, record.Id, err))
+			}
+			if ok {
+				converted++
+			}
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return converted, errors.Join(errs...)
+}
+
+// convertManifest converts the inline manifest of one record and reports
+// whether it did. The object is stored first: until the record names it,
+// it is an unreferenced blob within the grace period.
+func (gc *GC) convertManifest(record *core.Record, index bool) (bool, error) {
+	inline, err := gc.manifests.Record(record)
+	if err != nil {
+		return false, err
+	}
+	m := manifest.New(inline.Files)
+	if err := gc.manifests.Put(m); err != nil {
+		return false, err
+	}
+
+	converted := false
+	err = gc.app.RunInTransaction(func(txApp core.App) error {
+		current, err := txApp.FindRecordById(record.Collection(), record.Id)
+		if err != nil || current.GetString("manifest_hash") != "" {
+			return nil // Deleted or converted since it was read
+		}
+		manifest.Set(current, m)
+		if err := txApp.Save(current); err != nil {
+			return err
+		}
+		if index {
+			if err := indexAddTx(txApp, map[string]int64{m.Hash: m.Size}, 1); err != nil {
+				return err
+			}
+		}
+		converted = true
+		return nil
+	})
+	return converted, err
+}
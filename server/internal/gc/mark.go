@@ -0,0 +1,168 @@
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+// pageSize is the number of records loaded per query while marking
+const pageSize = 500
+
+// envs are the environments a project can have a ref for
+var envs = []string{"prod", "beta"}
+
+// marks maps every referenced blob hash to its size
+type marks map[string]int64
+
+func (m marks) add(blobs map[string]int64) {
+	for hash, size := range blobs {
+		m[hash] = size
+	}
+}
+
+// mark collects every blob referenced by an image, a pending plan that has
+// not expired, a ref or a live preview, and counts in counts the images
+// referencing each blob. Manifest objects are blobs of whatever names
+// them. Any error aborts the cycle before the sweep: a blob must never be
+// deleted because its reference could not be read.
+func (gc *GC) mark(ctx context.Context, now time.Time, counts map[string]int) (marks, error) {
+	m := make(marks)
+	nowStr := formatTime(now)
+
+	err := gc.eachRecord(ctx, "images", "1=1", nil, func(img *core.Record) error {
+		blobs, err := gc.manifestBlobs(img)
+		if err != nil {
+			return fmt.Errorf("image %s: manifest: %w", img.GetString("image_id"), err)
+		}
+		for hash, size := range blobs {
+			m[hash] = size
+			counts[hash]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := gc.markPlans(ctx, now, m); err != nil {
+		return nil, err
+	}
+
+	err = gc.eachRecord(ctx, "projects", "1=1", nil, func(project *core.Record) error {
+		name := project.GetString("name")
+		for _, env := range envs {
+			data, err := gc.storage.GetRef(name, env)
+			if storage.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("ref %s/%s: %w", name, env, err)
+			}
+			var ref storage.RefData
+			if err := json.Unmarshal(data, &ref); err != nil {
+				return fmt.Errorf("ref %s/%s: %w", name, env, err)
+			}
+			if err := gc.markManifest(m, ref.ManifestHash, ref.Manifest); err != nil {
+				return fmt.Errorf("ref %s/%s: %w", name, env, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = gc.eachRecord(ctx, "previews", "expires_at >= {:now}",
+		map[string]any{"now": nowStr}, func(preview *core.Record) error {
+			project, slug := preview.GetString("project"), preview.GetString("slug")
+			data, err := gc.storage.GetPreview(project, slug)
+			if storage.IsNotFound(err) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("preview %s/%s: %w", project, slug, err)
+			}
+			var ref storage.PreviewRef
+			if err := json.Unmarshal(data, &ref); err != nil {
+				return fmt.Errorf("preview %s/%s: %w", project, slug, err)
+			}
+			if err := gc.markManifest(m, ref.ManifestHash, ref.Manifest); err != nil {
+				return fmt.Errorf("preview %s/%s: %w", project, slug, err)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// markPlans marks the blobs of pending plans that have not expired. The
+// blobs may not be referenced by any image yet.
+func (gc *GC) markPlans(ctx context.Context, now time.Time, m marks) error {
+	return gc.eachRecord(ctx, "plans", "status = 'pending' && expires_at >= {:now}",
+		map[string]any{"now": formatTime(now)}, func(plan *core.Record) error {
+			blobs, err := gc.manifestBlobs(plan)
+			if err != nil {
+				return fmt.Errorf("plan %s: manifest: %w", plan.GetString("plan_id"), err)
+			}
+			m.add(blobs)
+			return nil
+		})
+}
+
+// markManifest marks the blobs of the manifest of a ref or preview: the
+// object named hash, or inline. An object already marked was marked with
+// its files, by the image or plan it came from, and is not read again.
+func (gc *GC) markManifest(m marks, hash string, inline map[string]storage.FileEntry) error {
+	if _, ok := m[hash]; ok && hash != "" {
+		return nil
+	}
+	manifest, err := gc.manifests.Ref(hash, inline)
+	if err != nil {
+		return err
+	}
+	m.add(manifest.Blobs())
+	return nil
+}
+
+// eachRecord calls fn for every record of a collection matching filter. It
+// pages by id rather than offset so records updated or deleted along the
+// way do not shift later pages.
+func (gc *GC) eachRecord(ctx context.Context, collection, filter string, params map[string]any, fn func(*core.Record) error) error {
+	args := map[string]any{"after": ""}
+	for k, v := range params {
+		args[k] = v
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		records, err := gc.app.FindRecordsByFilter(
+			collection, "("+filter+") && id > {:after}", "id", pageSize, 0, args)
+		if err != nil {
+			return fmt.Errorf("listing %s: %w", collection, err)
+		}
+		for _, record := range records {
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+		if len(records) < pageSize {
+			return nil
+		}
+		args["after"] = records[len(records)-1].Id
+	}
+}
+
+// formatTime formats t for comparison with PocketBase date fields
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05.000Z")
+}
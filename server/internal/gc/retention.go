@@ -0,0 +1,198 @@
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+// Retention is the image retention policy of a project
+type Retention struct {
+	// MinVersions is how many of the newest images are always kept
+	MinVersions int `json:"min_versions"`
+	// KeepDays keeps every image created within this many days
+	KeepDays int `json:"keep_days"`
+}
+
+// Reasons an image is kept by retention
+const (
+	KeepReferenced  = "referenced"
+	KeepPinned      = "pinned"
+	KeepMinVersions = "min_versions"
+	KeepRecent      = "keep_days"
+)
+
+// ImageRetention is the retention decision for one image
+type ImageRetention struct {
+	ImageID   string    `json:"image_id"`
+	CreatedAt time.Time `json:"created_at"`
+	TotalSize int64     `json:"total_size"`
+	// Keep is why the image is kept; empty means it is deleted
+	Keep string `json:"keep,omitempty"`
+
+	pinned bool
+	record *core.Record
+}
+
+// ProjectRetention is the retention plan for one project
+type ProjectRetention struct {
+	Project string           `json:"project"`
+	Policy  Retention        `json:"policy"`
+	Images  []ImageRetention `json:"images"`
+	// Delete is the number of images without a reason to keep them
+	Delete int `json:"delete"`
+}
+
+// Policy returns the retention policy of a project: its overrides, or the
+// server defaults for those it leaves at 0
+func (gc *GC) Policy(project *core.Record) Retention {
+	policy := Retention{MinVersions: gc.config.MinVersions, KeepDays: gc.config.KeepDays}
+	if n := project.GetInt("retention_min_versions"); n > 0 {
+		policy.MinVersions = n
+	}
+	if n := project.GetInt("retention_keep_days"); n > 0 {
+		policy.KeepDays = n
+	}
+	return policy
+}
+
+// PlanRetention decides which images of a project retention keeps and
+// why. Images referenced by a ref or an existing preview and pinned images
+// are always kept, then the newest MinVersions images and any created in
+// the last KeepDays days.
+func (gc *GC) PlanRetention(project *core.Record, now time.Time) (*ProjectRetention, error) {
+	name := project.GetString("name")
+	policy := gc.Policy(project)
+
+	referenced, err := gc.referencedImages(project)
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := gc.app.FindRecordsByFilter(
+		"images", "project_id = {:project_id}", "-created,-id", 0, 0,
+		map[string]any{"project_id": project.Id},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("listing images of %s: %w", name, err)
+	}
+
+	plan := &ProjectRetention{Project: name, Policy: policy, Images: make([]ImageRetention, len(images))}
+	for i, img := range images {
+		plan.Images[i] = ImageRetention{
+			ImageID:   img.GetString("image_id"),
+			CreatedAt: img.GetDateTime("created").Time(),
+			TotalSize: int64(img.GetInt("total_size")),
+			pinned:    img.GetBool("pinned"),
+			record:    img,
+		}
+	}
+	plan.Delete = policy.apply(plan.Images, referenced, now)
+	return plan, nil
+}
+
+// apply sets the reason to keep each image, newest first, and returns how
+// many have none
+func (p Retention) apply(images []ImageRetention, referenced map[string]bool, now time.Time) int {
+	cutoff := now.AddDate(0, 0, -p.KeepDays)
+	deleted := 0
+	for i := range images {
+		img := &images[i]
+		switch {
+		case referenced[img.ImageID] || (img.record != nil && referenced[img.record.Id]):
+			img.Keep = KeepReferenced
+		case img.pinned:
+			img.Keep = KeepPinned
+		case i < p.MinVersions:
+			img.Keep = KeepMinVersions
+		case p.KeepDays > 0 && img.CreatedAt.After(cutoff):
+			img.Keep = KeepRecent
+		default:
+			img.Keep = ""
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// referencedImages returns the images a project's refs and previews point
+// to, keyed by both image_id (refs) and record id (preview records)
+func (gc *GC) referencedImages(project *core.Record) (map[string]bool, error) {
+	name := project.GetString("name")
+	referenced := make(map[string]bool)
+
+	for _, env := range envs {
+		data, err := gc.storage.GetRef(name, env)
+		if storage.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ref %s/%s: %w", name, env, err)
+		}
+		var ref storage.RefData
+		if err := json.Unmarshal(data, &ref); err != nil {
+			return nil, fmt.Errorf("ref %s/%s: %w", name, env, err)
+		}
+		referenced[ref.ImageID] = true
+	}
+
+	previews, err := gc.app.FindRecordsByFilter(
+		"previews", "project = {:project}", "", 0, 0,
+		map[string]any{"project": name},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("listing previews of %s: %w", name, err)
+	}
+	for _, preview := range previews {
+		referenced[preview.GetString("image_id")] = true
+	}
+	return referenced, nil
+}
+
+// retain applies retention to every project. It returns the plans of
+// projects with images to delete; a dry run deletes nothing.
+func (gc *GC) retain(ctx context.Context, now time.Time, dryRun bool, stats *Stats) ([]*ProjectRetention, error) {
+	var plans []*ProjectRetention
+	var errs []error
+
+	err := gc.eachRecord(ctx, "projects", "1=1", nil, func(project *core.Record) error {
+		plan, err := gc.PlanRetention(project, now)
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		if plan.Delete == 0 {
+			return nil
+		}
+		plans = append(plans, plan)
+		if dryRun {
+			stats.ImagesDeleted += plan.Delete
+			return nil
+		}
+
+		// A release may have moved a ref to one of these images since the
+		// plan was made
+		referenced, err := gc.referencedImages(project)
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		for _, img := range plan.Images {
+			if img.Keep != "" || referenced[img.ImageID] || referenced[img.record.Id] {
+				continue
+			}
+			if err := gc.app.Delete(img.record); err != nil {
+				errs = append(errs, fmt.Errorf("deleting image %s: %w", img.ImageID, err))
+				continue
+			}
+			stats.ImagesDeleted++
+		}
+		return nil
+	})
+	return plans, errors.Join(append([]error{err}, errs...)...)
+}
@@ -0,0 +1,62 @@
+package gc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionApply(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	// Newest first, as PlanRetention loads them
+	images := []ImageRetention{
+		{ImageID: "img_1", CreatedAt: now.Add(-1 * day)},
+		{ImageID: "img_2", CreatedAt: now.Add(-5 * day)},
+		{ImageID: "img_3", CreatedAt: now.Add(-40 * day)},
+		{ImageID: "img_4", CreatedAt: now.Add(-50 * day)},
+		{ImageID: "img_5", CreatedAt: now.Add(-60 * day), pinned: true},
+		{ImageID: "img_6", CreatedAt: now.Add(-70 * day)},
+		{ImageID: "img_7", CreatedAt: now.Add(-80 * day)},
+	}
+	referenced := map[string]bool{"img_6": true}
+
+	testCases := []struct {
+		name   string
+		policy Retention
+		keep   []string
+		delete int
+	}{
+		{
+			name:   "defaults",
+			policy: Retention{MinVersions: 3, KeepDays: 30},
+			keep:   []string{KeepMinVersions, KeepMinVersions, KeepMinVersions, "", KeepPinned, KeepReferenced, ""},
+			delete: 2,
+		},
+		{
+			name:   "keep_days_only",
+			policy: Retention{KeepDays: 45},
+			keep:   []string{KeepRecent, KeepRecent, KeepRecent, "", KeepPinned, KeepReferenced, ""},
+			delete: 2,
+		},
+		{
+			name:   "nothing_but_references",
+			policy: Retention{},
+			keep:   []string{"", "", "", "", KeepPinned, KeepReferenced, ""},
+			delete: 5,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			imgs := append([]ImageRetention(nil), images...)
+			if got := tc.policy.apply(imgs, referenced, now); got != tc.delete {
+				t.Errorf("delete = %d, want %d", got, tc.delete)
+			}
+			for i, img := range imgs {
+				if img.Keep != tc.keep[i] {
+					t.Errorf("%s: keep = %q, want %q", img.ImageID, img.Keep, tc.keep[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+// Package invalidate tells every instance sharing a storage backend to drop
+// cached refs and the routing index when they change.
+//
+// A Bus applies a Message to the local caches at once and sends it to the
+// other instances through a Transport: a change journal kept in storage and
+// polled by every instance, Redis pub/sub, or HTTP requests to each peer.
+// A transport that may have missed messages, after a reconnect or when the
+// journal moved on too far, delivers a Message with All set instead, so the
+// cache TTL only bounds staleness when a transport is down.
+package invalidate
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultTimeout bounds publishing one message to the other instances
+const DefaultTimeout = 2 * time.Second
+
+// Message names what to drop from the caches
+type Message struct {
+	// Origin is the instance that published the message; instances skip
+	// their own messages
+	Origin string `json:"origin,omitempty"`
+	// Refs are ref cache keys, "project:env"
+	Refs []string `json:"refs,omitempty"`
+	// Routing drops the routing index
+	Routing bool `json:"routing,omitempty"`
+	// All drops every cached ref and the routing index
+	All bool `json:"all,omitempty"`
+}
+
+// Transport carries messages between instances
+type Transport interface {
+	// Publish sends msg to the other instances
+	Publish(ctx context.Context, msg Message) error
+	// Subscribe calls deliver with the messages published by any instance,
+	// possibly including this one, until ctx is done. It retries on errors
+	// and delivers a Message with All set when messages may have been lost.
+	Subscribe(ctx context.Context, deliver func(Message))
+}
+
+// Bus publishes invalidations and applies those of other instances
+type Bus struct {
+	transport Transport
+	origin    string
+	apply     func(Message)
+}
+
+// NewBus creates a bus that applies messages with apply and identifies this
+// instance as origin. A nil transport only invalidates the local caches.
+func NewBus(transport Transport, origin string, apply func(Message)) *Bus {
+	return &Bus{transport: transport, origin: origin, apply: apply}
+}
+
+// Publish applies msg to the local caches and sends it to the other
+// instances. The caches are invalidated locally even if sending fails.
+func (b *Bus) Publish(ctx context.Context, msg Message) error {
+	msg.Origin = b.origin
+	b.apply(msg)
+	if b.transport == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+	defer cancel()
+	return b.transport.Publish(ctx, msg)
+}
+
+// Run applies the messages of other instances until ctx is done
+func (b *Bus) Run(ctx context.Context) {
+	if b.transport == nil {
+		<-ctx.Done()
+		return
+	}
+	b.transport.Subscribe(ctx, func(msg Message) {
+		if msg.Origin != "" && msg.Origin == b.origin {
+			return
+		}
+		b.apply(msg)
+	})
+}
+
+// Origin returns the name identifying this instance
+func (b *Bus) Origin() string {
+	return b.origin
+}
+
+// Enabled reports whether messages reach other instances
+func (b *Bus) Enabled() bool {
+	return b.transport != nil
+}
+
+// backoff returns the delay before retry n (from 0) of a failed
+// subscription, doubling from one second up to 30 seconds
+func backoff(n int) time.Duration {
+	d := time.Second
+	for range n {
+		d *= 2
+		if d >= 30*time.Second {
+			return 30 * time.Second
+		}
+	}
+	return d
+}
+
+// sleep waits for d and reports whether ctx is still active
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -0,0 +1,244 @@
+package invalidate
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+// recorder collects applied messages
+type recorder struct {
+	mu   sync.Mutex
+	msgs []Message
+}
+
+func (r *recorder) apply(msg Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = append(r.msgs, msg)
+}
+
+// wait returns the messages once there are n
+func (r *recorder) wait(t *testing.T, n int) []Message {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		msgs := slices.Clone(r.msgs)
+		r.mu.Unlock()
+		if len(msgs) >= n {
+			return msgs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d messages, want %d: %+v", len(msgs), n, msgs)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// runBus starts a bus with the transport until the test ends
+func runBus(t *testing.T, transport Transport, origin string) (*Bus, *recorder) {
+	t.Helper()
+	rec := &recorder{}
+	bus := NewBus(transport, origin, rec.apply)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bus.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return bus, rec
+}
+
+func TestBusLocal(t *testing.T) {
+	bus, rec := runBus(t, nil, "a")
+	if err := bus.Publish(context.Background(), Message{Refs: []string{"site:prod"}}); err != nil {
+		t.Fatal(err)
+	}
+	msgs := rec.wait(t, 1)
+	if msgs[0].Origin != "a" || msgs[0].Refs[0] != "site:prod" {
+		t.Errorf("applied %+v", msgs[0])
+	}
+}
+
+func TestJournal(t *testing.T) {
+	store, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := runBus(t, NewJournal(store, 5*time.Millisecond), "a")
+	_, recB := runBus(t, NewJournal(store, 5*time.Millisecond), "b")
+	// Let b read the journal before anything is published
+	time.Sleep(50 * time.Millisecond)
+
+	for _, ref := range []string{"one:prod", "two:beta"} {
+		if err := a.Publish(context.Background(), Message{Refs: []string{ref}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs := recB.wait(t, 2)
+	if msgs[0].Refs[0] != "one:prod" || msgs[1].Refs[0] != "two:beta" {
+		t.Errorf("b applied %+v", msgs)
+	}
+}
+
+func TestJournalGap(t *testing.T) {
+	cur := &journal{Seq: 150}
+	for seq := uint64(51); seq <= 150; seq++ {
+		cur.Entries = append(cur.Entries, journalEntry{Seq: seq, Message: Message{Routing: true}})
+	}
+
+	var got []Message
+	deliver := func(msg Message) { got = append(got, msg) }
+
+	if seq := cur.deliver(148, deliver); seq != 150 || len(got) != 2 || got[0].All {
+		t.Errorf("caught up to %d with %+v", seq, got)
+	}
+	got = nil
+	// Entries 11 to 50 were dropped from the journal
+	if cur.deliver(10, deliver); len(got) != 1 || !got[0].All {
+		t.Errorf("after a gap: %+v", got)
+	}
+	got = nil
+	// The journal was deleted and started over
+	if cur.deliver(500, deliver); len(got) != 1 || !got[0].All {
+		t.Errorf("after a reset: %+v", got)
+	}
+}
+
+// fakeRedis is a Redis server that supports PUBLISH and SUBSCRIBE
+type fakeRedis struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	subs []net.Conn
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	for {
+		reply, err := r.read()
+		if err != nil {
+			return
+		}
+		args, _ := reply.([]any)
+		if len(args) == 0 {
+			return
+		}
+		switch strings.ToUpper(args[0].(string)) {
+		case "SUBSCRIBE":
+			s.mu.Lock()
+			s.subs = append(s.subs, conn)
+			conn.Write([]byte("*3\r\n$9\r\nsubscribe\r\n$" + strconv.Itoa(len(args[1].(string))) + "\r\n" + args[1].(string) + "\r\n:1\r\n"))
+			s.mu.Unlock()
+		case "PUBLISH":
+			channel, payload := args[1].(string), args[2].(string)
+			s.mu.Lock()
+			for _, sub := range s.subs {
+				sub.Write([]byte("*3\r\n$7\r\nmessage\r\n$" + strconv.Itoa(len(channel)) + "\r\n" + channel + "\r\n$" +
+					strconv.Itoa(len(payload)) + "\r\n" + payload + "\r\n"))
+			}
+			n := len(s.subs)
+			s.mu.Unlock()
+			conn.Write([]byte(":" + strconv.Itoa(n) + "\r\n"))
+		default:
+			conn.Write([]byte("-ERR unknown command\r\n"))
+		}
+	}
+}
+
+func TestRedis(t *testing.T) {
+	server := newFakeRedis(t)
+	url := "redis://" + server.ln.Addr().String()
+
+	pub, err := NewRedis(url, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := NewRedis(url, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := runBus(t, pub, "a")
+	_, recB := runBus(t, sub, "b")
+
+	// A new subscription drops everything
+	if msgs := recB.wait(t, 1); !msgs[0].All {
+		t.Fatalf("first message %+v", msgs[0])
+	}
+	if err := a.Publish(context.Background(), Message{Routing: true}); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := recB.wait(t, 2); !msgs[1].Routing || msgs[1].Origin != "a" {
+		t.Errorf("b applied %+v", msgs[1])
+	}
+
+	if _, err := NewRedis("http://localhost", ""); err == nil {
+		t.Error("expected error for http url")
+	}
+}
+
+func TestPeers(t *testing.T) {
+	peerB := NewPeers(nil, "secret")
+	_, recB := runBus(t, peerB, "b")
+	server := httptest.NewServer(peerB)
+	defer server.Close()
+
+	a, _ := runBus(t, NewPeers([]string{server.URL}, "secret"), "a")
+	// b is not subscribed until its bus runs; wait for it
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		peerB.mu.Lock()
+		ready := peerB.deliver != nil
+		peerB.mu.Unlock()
+		if ready || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := a.Publish(context.Background(), Message{Refs: []string{"site:prod"}}); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := recB.wait(t, 1); msgs[0].Refs[0] != "site:prod" {
+		t.Errorf("b applied %+v", msgs[0])
+	}
+
+	wrong := NewBus(NewPeers([]string{server.URL}, "wrong"), "c", func(Message) {})
+	if err := wrong.Publish(context.Background(), Message{All: true}); err == nil {
+		t.Error("expected error for wrong secret")
+	}
+}
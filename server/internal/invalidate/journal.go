@@ -0,0 +1,144 @@
+package invalidate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+// JournalLock is the lock object holding the journal
+const JournalLock = "cache-invalidation"
+
+// journalKeep is how many recent messages the journal holds. An instance
+// that falls further behind drops its whole cache.
+const journalKeep = 100
+
+// Store holds lock objects, as storage backends implementing
+// storage.Locker do
+type Store interface {
+	GetLock(name string) ([]byte, string, error)
+	PutLock(name string, data []byte, version string) (string, error)
+}
+
+// journal is the content of the journal lock object
+type journal struct {
+	// Seq numbers the last message
+	Seq     uint64         `json:"seq"`
+	Entries []journalEntry `json:"entries"`
+}
+
+type journalEntry struct {
+	Seq     uint64    `json:"seq"`
+	Message Message   `json:"message"`
+	At      time.Time `json:"at"`
+}
+
+// Journal is a transport that appends messages to a lock object in storage
+// with conditional puts. Every instance polls it, so messages take up to
+// the poll interval to arrive, but no other infrastructure is needed.
+type Journal struct {
+	store    Store
+	interval time.Duration
+}
+
+// NewJournal creates a journal transport that polls store every interval
+func NewJournal(store Store, interval time.Duration) *Journal {
+	return &Journal{store: store, interval: interval}
+}
+
+// Publish appends msg to the journal, retrying when another instance
+// appended at the same time
+func (j *Journal) Publish(ctx context.Context, msg Message) error {
+	for {
+		cur, version, err := j.read()
+		if err != nil {
+			return err
+		}
+		cur.Seq++
+		cur.Entries = append(cur.Entries, journalEntry{Seq: cur.Seq, Message: msg, At: time.Now().UTC()})
+		if len(cur.Entries) > journalKeep {
+			cur.Entries = cur.Entries[len(cur.Entries)-journalKeep:]
+		}
+		data, err := json.Marshal(cur)
+		if err != nil {
+			return err
+		}
+		_, err = j.store.PutLock(JournalLock, data, version)
+		if !errors.Is(err, storage.ErrLockConflict) {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// Subscribe polls the journal and delivers the messages appended since the
+// last poll. Messages appended before it started are not delivered.
+func (j *Journal) Subscribe(ctx context.Context, deliver func(Message)) {
+	var seq uint64
+	var version string
+	started := false
+	failures := 0
+
+	for {
+		cur, v, err := j.read()
+		switch {
+		case err != nil:
+			if failures == 0 {
+				log.Printf("invalidate: failed to read journal: %v", err)
+			}
+			failures++
+		case !started:
+			seq, version, started = cur.Seq, v, true
+		case v != version:
+			version = v
+			seq = cur.deliver(seq, deliver)
+		}
+		if err == nil {
+			failures = 0
+		}
+		if !sleep(ctx, j.interval) {
+			return
+		}
+	}
+}
+
+// deliver delivers the entries after seq and returns the last sequence. If
+// entries after seq were dropped, or the journal was reset, it delivers a
+// message dropping everything instead.
+func (cur *journal) deliver(seq uint64, deliver func(Message)) uint64 {
+	if cur.Seq < seq || (cur.Seq > seq && (len(cur.Entries) == 0 || cur.Entries[0].Seq > seq+1)) {
+		deliver(Message{All: true})
+		return cur.Seq
+	}
+	for _, e := range cur.Entries {
+		if e.Seq > seq {
+			deliver(e.Message)
+		}
+	}
+	return cur.Seq
+}
+
+// read returns the journal and its version; an empty one if there is none.
+// A journal that cannot be decoded reads as empty, so the next message
+// replaces it and subscribers drop their caches.
+func (j *Journal) read() (*journal, string, error) {
+	data, version, err := j.store.GetLock(JournalLock)
+	if storage.IsNotFound(err) {
+		return &journal{}, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var cur journal
+	if err := json.Unmarshal(data, &cur); err != nil {
+		log.Printf("invalidate: ignoring invalid journal: %v", err)
+		return &journal{}, version, nil
+	}
+	return &cur, version, nil
+}
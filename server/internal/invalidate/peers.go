@@ -0,0 +1,118 @@
+package invalidate
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// PeerPath is the API path instances receive peer messages on
+const PeerPath = "/api/v1/internal/invalidate"
+
+// Peers is a transport that posts messages to every peer instance, which
+// receive them with ServeHTTP. Requests carry a shared secret as a bearer
+// token. The peer list may include the instance itself; it skips its own
+// messages.
+type Peers struct {
+	peers  []string
+	secret string
+	client *http.Client
+
+	mu      sync.Mutex
+	deliver func(Message)
+}
+
+// NewPeers creates a peer transport for the base URLs of the peers, e.g.
+// http://10.0.0.2:8080
+func NewPeers(peers []string, secret string) *Peers {
+	return &Peers{peers: peers, secret: secret, client: &http.Client{}}
+}
+
+// Publish posts msg to every peer at once. It fails if any peer did not
+// accept it.
+func (p *Peers) Publish(ctx context.Context, msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, len(p.peers))
+	var wg sync.WaitGroup
+	for i, peer := range p.peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.post(ctx, peer, body); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", peer, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (p *Peers) post(ctx context.Context, peer string, body []byte) error {
+	url := strings.TrimSuffix(peer, "/") + PeerPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.secret)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Subscribe delivers the messages received by ServeHTTP until ctx is done
+func (p *Peers) Subscribe(ctx context.Context, deliver func(Message)) {
+	p.mu.Lock()
+	p.deliver = deliver
+	p.mu.Unlock()
+
+	<-ctx.Done()
+
+	p.mu.Lock()
+	p.deliver = nil
+	p.mu.Unlock()
+}
+
+// ServeHTTP receives a message posted by a peer
+func (p *Peers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(p.secret)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var msg Message
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&msg); err != nil {
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	deliver := p.deliver
+	p.mu.Unlock()
+	if deliver == nil {
+		http.Error(w, "not subscribed", http.StatusServiceUnavailable)
+		return
+	}
+	deliver(msg)
+	w.WriteHeader(http.StatusNoContent)
+}
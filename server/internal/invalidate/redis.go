@@ -0,0 +1,263 @@
+package invalidate
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRedisChannel is the channel messages are published on
+const DefaultRedisChannel = "sitepod:invalidate"
+
+// redisDialTimeout bounds connecting and authenticating
+const redisDialTimeout = 5 * time.Second
+
+// Redis is a transport that publishes messages on a Redis pub/sub channel.
+// It speaks the Redis protocol directly, so servers compatible with it
+// (Valkey, KeyDB, Dragonfly) work too.
+type Redis struct {
+	addr     string
+	username string
+	password string
+	tls      bool
+	channel  string
+
+	// pub is the connection used for publishing, dialled on first use
+	mu  sync.Mutex
+	pub *redisConn
+}
+
+// NewRedis creates a Redis transport from a redis:// or rediss:// (TLS)
+// URL with an optional username and password, publishing on channel
+func NewRedis(rawURL, channel string) (*Redis, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("invalid redis url: unsupported scheme %q (want redis or rediss)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("invalid redis url: missing host")
+	}
+	if channel == "" {
+		channel = DefaultRedisChannel
+	}
+	r := &Redis{addr: u.Host, tls: u.Scheme == "rediss", channel: channel}
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		r.username = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+	return r, nil
+}
+
+// Publish publishes msg on the channel, reconnecting once if the
+// connection was lost since the last message
+func (r *Redis) Publish(ctx context.Context, msg Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if r.pub == nil {
+			if r.pub, err = r.dial(ctx); err != nil {
+				return err
+			}
+		}
+		err = r.pub.do(ctx, "PUBLISH", r.channel, string(payload))
+		if err == nil {
+			return nil
+		}
+		r.pub.Close()
+		r.pub = nil
+		var redisErr redisError
+		if attempt > 0 || errors.As(err, &redisErr) || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// Subscribe subscribes to the channel and delivers its messages,
+// reconnecting with a backoff. Every subscription starts with a message
+// dropping everything, since messages may have been published while
+// there was none.
+func (r *Redis) Subscribe(ctx context.Context, deliver func(Message)) {
+	for failures := 0; ; failures++ {
+		err := r.subscribe(ctx, deliver)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("invalidate: redis subscription failed: %v", err)
+		if !sleep(ctx, backoff(failures)) {
+			return
+		}
+	}
+}
+
+// subscribe runs one subscription until its connection fails or ctx is done
+func (r *Redis) subscribe(ctx context.Context, deliver func(Message)) error {
+	conn, err := r.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.do(ctx, "SUBSCRIBE", r.channel); err != nil {
+		return err
+	}
+	deliver(Message{All: true})
+
+	// Reads block until a message arrives; closing the connection ends them
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	for {
+		reply, err := conn.read()
+		if err != nil {
+			return err
+		}
+		parts, ok := reply.([]any)
+		if !ok || len(parts) != 3 || parts[0] != "message" {
+			continue
+		}
+		payload, _ := parts[2].(string)
+		var msg Message
+		if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+			log.Printf("invalidate: ignoring invalid redis message: %v", err)
+			continue
+		}
+		deliver(msg)
+	}
+}
+
+// dial connects and authenticates
+func (r *Redis) dial(ctx context.Context) (*redisConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisDialTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	raw, err := d.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return nil, err
+	}
+	if r.tls {
+		host, _, _ := net.SplitHostPort(r.addr)
+		tlsConn := tls.Client(raw, &tls.Config{ServerName: host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			raw.Close()
+			return nil, err
+		}
+		raw = tlsConn
+	}
+
+	conn := &redisConn{Conn: raw, r: bufio.NewReader(raw)}
+	if r.password != "" {
+		args := []string{"AUTH", r.password}
+		if r.username != "" {
+			args = []string{"AUTH", r.username, r.password}
+		}
+		if err := conn.do(ctx, args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis auth: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// redisConn is a connection speaking RESP, the Redis protocol
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// redisError is an error reply
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// do sends a command and reads its reply, failing on error replies
+func (c *redisConn) do(ctx context.Context, args ...string) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+		defer c.SetDeadline(time.Time{})
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.Conn, b.String()); err != nil {
+		return err
+	}
+	reply, err := c.read()
+	if err != nil {
+		return err
+	}
+	if err, ok := reply.(redisError); ok {
+		return err
+	}
+	return nil
+}
+
+// read reads one reply: a string, an integer, an array of replies, nil or
+// a redisError
+func (c *redisConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	kind, rest := line[0], line[1:]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return redisError(rest), nil
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,264 @@
+// Package lease lets instances sharing a storage backend agree on which
+// one runs a singleton job. A lease is a lock object written with
+// conditional puts: an instance takes it when it is free or expired, renews
+// it while the job runs and releases it when done. If the holder dies, the
+// lease expires after its TTL and another instance can take it.
+package lease
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+// DefaultTTL is how long a lease lasts without renewal. Holders renew it
+// every third of the TTL.
+const DefaultTTL = 2 * time.Minute
+
+// ErrHeld is returned when another instance holds an unexpired lease
+var ErrHeld = errors.New("lease: held by another instance")
+
+// Store holds lock objects, as storage backends implementing
+// storage.Locker do
+type Store interface {
+	GetLock(name string) ([]byte, string, error)
+	PutLock(name string, data []byte, version string) (string, error)
+}
+
+// Record is the content of a lock object
+type Record struct {
+	Name       string    `json:"name"`
+	Holder     string    `json:"holder"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	RenewedAt  time.Time `json:"renewed_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Active reports whether the lease is held at now
+func (r *Record) Active(now time.Time) bool {
+	return r != nil && now.Before(r.ExpiresAt)
+}
+
+// Manager acquires leases on behalf of one instance
+type Manager struct {
+	store  Store
+	holder string
+	ttl    time.Duration
+}
+
+// NewManager creates a manager that identifies this instance as holder.
+// A ttl of 0 means DefaultTTL.
+func NewManager(store Store, holder string, ttl time.Duration) *Manager {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return &Manager{store: store, holder: holder, ttl: ttl}
+}
+
+// InstanceID returns a holder name for this process: host, pid and a
+// random suffix, so restarts on the same host are distinct holders
+func InstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), uuid.New().String()[:8])
+}
+
+// Holder returns the holder name of this instance
+func (m *Manager) Holder() string {
+	return m.holder
+}
+
+// TTL returns how long a lease lasts without renewal
+func (m *Manager) TTL() time.Duration {
+	return m.ttl
+}
+
+// Status returns the current lock record of a lease, or nil if it has
+// never been taken
+func (m *Manager) Status(name string) (*Record, error) {
+	rec, _, err := m.read(name)
+	return rec, err
+}
+
+// read returns a lock record and its version, or nil if there is none
+func (m *Manager) read(name string) (*Record, string, error) {
+	data, version, err := m.store.GetLock(name)
+	if storage.IsNotFound(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var rec Record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		// An unreadable lock is treated as expired and overwritten
+		return &Record{Name: name}, version, nil
+	}
+	return &rec, version, nil
+}
+
+// write replaces a lock record if it is still at version
+func (m *Manager) write(rec Record, version string) (string, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	return m.store.PutLock(rec.Name, data, version)
+}
+
+// Acquire takes a lease if it is free or expired and renews it until
+// Release is called. It returns an error wrapping ErrHeld if another
+// instance holds it.
+func (m *Manager) Acquire(name string) (*Lease, error) {
+	current, version, err := m.read(name)
+	if err != nil {
+		return nil, fmt.Errorf("reading lease %s: %w", name, err)
+	}
+	now := time.Now()
+	if current.Active(now) && current.Holder != m.holder {
+		return nil, fmt.Errorf("%w: %s until %s", ErrHeld, current.Holder, current.ExpiresAt.Format(time.RFC3339))
+	}
+
+	rec := Record{Name: name, Holder: m.holder, AcquiredAt: now, RenewedAt: now, ExpiresAt: now.Add(m.ttl)}
+	version, err = m.write(rec, version)
+	if errors.Is(err, storage.ErrLockConflict) {
+		return nil, fmt.Errorf("%w: lost the race for %s", ErrHeld, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("writing lease %s: %w", name, err)
+	}
+
+	// Stores that ignore conditional writes let the last writer win;
+	// read back to make sure that is us
+	check, checkVersion, err := m.read(name)
+	if err != nil {
+		return nil, fmt.Errorf("reading lease %s: %w", name, err)
+	}
+	if check == nil || check.Holder != m.holder || checkVersion != version {
+		return nil, fmt.Errorf("%w: lost the race for %s", ErrHeld, name)
+	}
+
+	l := &Lease{
+		m:       m,
+		record:  rec,
+		version: version,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		lost:    make(chan struct{}),
+	}
+	go l.renew()
+	return l, nil
+}
+
+// Lease is a lease held by this instance
+type Lease struct {
+	m *Manager
+
+	mu      sync.Mutex
+	record  Record
+	version string
+
+	stop     chan struct{} // closed by Release
+	done     chan struct{} // closed when renew returns
+	lost     chan struct{} // closed if the lease is lost
+	stopOnce sync.Once
+}
+
+// Record returns the lock record as last written
+func (l *Lease) Record() Record {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.record
+}
+
+// Lost is closed if the lease could not be renewed before it expired or
+// was taken over. The holder must stop the job.
+func (l *Lease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Context returns a context that is cancelled when parent is or when the
+// lease is lost
+func (l *Lease) Context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-l.lost:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// renew extends the lease every third of its TTL until Release or until
+// it is lost. Failed renewals are retried until the lease expires.
+func (l *Lease) renew() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.m.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		l.mu.Lock()
+		rec, version := l.record, l.version
+		l.mu.Unlock()
+
+		now := time.Now()
+		rec.RenewedAt = now
+		rec.ExpiresAt = now.Add(l.m.ttl)
+		newVersion, err := l.m.write(rec, version)
+		switch {
+		case err == nil:
+			l.mu.Lock()
+			l.record, l.version = rec, newVersion
+			l.mu.Unlock()
+		case errors.Is(err, storage.ErrLockConflict):
+			log.Printf("lease: %s was taken over by another instance", rec.Name)
+			close(l.lost)
+			return
+		case !now.Before(l.Record().ExpiresAt):
+			log.Printf("lease: %s expired after failed renewals: %v", rec.Name, err)
+			close(l.lost)
+			return
+		default:
+			log.Printf("lease: failed to renew %s: %v", rec.Name, err)
+		}
+	}
+}
+
+// Release stops renewing the lease and marks it expired so another
+// instance can take it at once
+func (l *Lease) Release() {
+	l.stopOnce.Do(func() { close(l.stop) })
+	<-l.done
+
+	select {
+	case <-l.lost:
+		return
+	default:
+	}
+
+	l.mu.Lock()
+	rec, version := l.record, l.version
+	l.mu.Unlock()
+	rec.ExpiresAt = time.Now()
+	if _, err := l.m.write(rec, version); err != nil && !errors.Is(err, storage.ErrLockConflict) {
+		log.Printf("lease: failed to release %s: %v", rec.Name, err)
+	}
+}
@@ -0,0 +1,134 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+func newStore(t *testing.T) *storage.LocalBackend {
+	t.Helper()
+	store, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestAcquire(t *testing.T) {
+	store := newStore(t)
+	a := NewManager(store, "a", time.Minute)
+	b := NewManager(store, "b", time.Minute)
+
+	la, err := a.Acquire("gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Acquire("gc"); !errors.Is(err, ErrHeld) {
+		t.Fatalf("b.Acquire while a holds the lease: %v", err)
+	}
+
+	rec, err := b.Status("gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.Active(time.Now()) || rec.Holder != "a" {
+		t.Errorf("Status = %+v, want active lease held by a", rec)
+	}
+
+	// Released leases can be taken at once
+	la.Release()
+	lb, err := b.Acquire("gc")
+	if err != nil {
+		t.Fatalf("b.Acquire after release: %v", err)
+	}
+	lb.Release()
+}
+
+func TestAcquireExpired(t *testing.T) {
+	store := newStore(t)
+	a := NewManager(store, "a", time.Minute)
+
+	// A holder that died without releasing
+	rec := Record{Name: "gc", Holder: "dead", ExpiresAt: time.Now().Add(-time.Second)}
+	if _, err := a.write(rec, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := a.Acquire("gc")
+	if err != nil {
+		t.Fatalf("Acquire of expired lease: %v", err)
+	}
+	defer l.Release()
+	if got := l.Record().Holder; got != "a" {
+		t.Errorf("holder = %q, want a", got)
+	}
+}
+
+func TestRenew(t *testing.T) {
+	store := newStore(t)
+	m := NewManager(store, "a", 60*time.Millisecond)
+
+	l, err := m.Acquire("gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Release()
+	first := l.Record().ExpiresAt
+
+	time.Sleep(150 * time.Millisecond)
+	select {
+	case <-l.Lost():
+		t.Fatal("lease lost while renewing")
+	default:
+	}
+	rec, err := m.Status("gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.ExpiresAt.After(first) || !rec.Active(time.Now()) {
+		t.Errorf("lease not renewed: expires %v, first %v", rec.ExpiresAt, first)
+	}
+}
+
+func TestLost(t *testing.T) {
+	store := newStore(t)
+	m := NewManager(store, "a", 60*time.Millisecond)
+
+	l, err := m.Acquire("gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Release()
+	ctx, cancel := l.Context(context.Background())
+	defer cancel()
+
+	// Another instance overwrites the lock, e.g. after a long pause here
+	_, version, err := store.GetLock("gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := NewManager(store, "b", time.Minute)
+	if _, err := other.write(Record{Name: "gc", Holder: "b", ExpiresAt: time.Now().Add(time.Minute)}, version); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context not cancelled after the lease was taken over")
+	}
+
+	// Releasing a lost lease must not clear the new holder's lock
+	l.Release()
+	rec, err := m.Status("gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Holder != "b" || !rec.Active(time.Now()) {
+		t.Errorf("Status = %+v, want b's lease intact", rec)
+	}
+}
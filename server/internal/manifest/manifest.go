@@ -0,0 +1,153 @@
+// Package manifest stores deploy manifests as content-addressed objects.
+//
+// A manifest maps the paths of a deploy to its files. It is encoded once,
+// sorted by path, and stored in the blob store under the BLAKE3 hash of
+// its encoding, like any other blob. Images, plans, refs and previews name
+// their manifest by that hash instead of carrying a copy, so identical
+// deploys share one object and a ref stays small whatever the size of the
+// site.
+//
+// Records and refs written by earlier versions carry the manifest inline;
+// they are still read, with an empty hash.
+package manifest
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/storage"
+	"github.com/zeebo/blake3"
+)
+
+// version is the version of the encoding
+const version = 1
+
+// ErrInvalid is returned for a manifest that cannot be decoded or whose
+// content does not match its hash
+var ErrInvalid = errors.New("invalid manifest")
+
+// Manifest is a decoded manifest
+type Manifest struct {
+	// Hash names the manifest object; it is empty for a manifest stored
+	// inline by an earlier version
+	Hash string
+	// Size is the size of the manifest object
+	Size int64
+	// Files maps paths to files. It is shared by every user of the
+	// manifest and must not be modified.
+	Files map[string]storage.FileEntry
+
+	// data is the encoding of a manifest created by New, for Put
+	data []byte
+}
+
+// object is the encoding of a manifest: files sorted by path, each as a
+// [path, hash, size, content type] array
+type object struct {
+	Version int     `json:"v"`
+	Files   []entry `json:"files"`
+}
+
+type entry struct {
+	Path string
+	storage.FileEntry
+}
+
+func (e entry) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{e.Path, e.Hash, e.Size, e.ContentType})
+}
+
+func (e *entry) UnmarshalJSON(data []byte) error {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if len(fields) != 4 {
+		return fmt.Errorf("file has %d fields, want 4", len(fields))
+	}
+	for i, dst := range []any{&e.Path, &e.Hash, &e.Size, &e.ContentType} {
+		if err := json.Unmarshal(fields[i], dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// New encodes files as a manifest object
+func New(files map[string]storage.FileEntry) *Manifest {
+	obj := object{Version: version, Files: make([]entry, 0, len(files))}
+	for path, file := range files {
+		obj.Files = append(obj.Files, entry{Path: path, FileEntry: file})
+	}
+	sort.Slice(obj.Files, func(i, j int) bool {
+		return obj.Files[i].Path < obj.Files[j].Path
+	})
+	data, _ := json.Marshal(obj)
+
+	if files == nil {
+		files = make(map[string]storage.FileEntry)
+	}
+	return &Manifest{Hash: sum(data), Size: int64(len(data)), Files: files, data: data}
+}
+
+// Decode decodes the manifest object named hash
+func Decode(hash string, data []byte) (*Manifest, error) {
+	if got := sum(data); got != hash {
+		return nil, fmt.Errorf("%w: content hashes to %s", ErrInvalid, got)
+	}
+	var obj object
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if obj.Version != version {
+		return nil, fmt.Errorf("%w: unknown version %d", ErrInvalid, obj.Version)
+	}
+	files := make(map[string]storage.FileEntry, len(obj.Files))
+	for _, e := range obj.Files {
+		files[e.Path] = e.FileEntry
+	}
+	return &Manifest{Hash: hash, Size: int64(len(data)), Files: files}, nil
+}
+
+// Inline returns the files of a manifest that has no object, which must be
+// stored inline; it returns nil for a manifest object
+func (m *Manifest) Inline() map[string]storage.FileEntry {
+	if m.Hash != "" {
+		return nil
+	}
+	return m.Files
+}
+
+// Blobs returns the distinct blobs the manifest references with their
+// sizes: its files and the manifest object itself
+func (m *Manifest) Blobs() map[string]int64 {
+	blobs := make(map[string]int64, len(m.Files)+1)
+	for _, file := range m.Files {
+		blobs[file.Hash] = file.Size
+	}
+	if m.Hash != "" {
+		blobs[m.Hash] = m.Size
+	}
+	return blobs
+}
+
+// Set stores m in an image or plan record: its hash, or the files inline
+// for a manifest without an object
+func Set(record *core.Record, m *Manifest) {
+	record.Set("manifest_hash", m.Hash)
+	if m.Hash == "" {
+		record.Set("manifest", m.Files)
+	} else {
+		record.Set("manifest", nil)
+	}
+}
+
+// sum returns the hex BLAKE3 hash of data
+func sum(data []byte) string {
+	h := blake3.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
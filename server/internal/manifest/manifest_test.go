@@ -0,0 +1,164 @@
+package manifest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+func testFiles(n int) map[string]storage.FileEntry {
+	files := make(map[string]storage.FileEntry, n)
+	for i := range n {
+		files[fmt.Sprintf("page%d.html", i)] = storage.FileEntry{
+			Hash:        fmt.Sprintf("%064x", i),
+			Size:        int64(i),
+			ContentType: "text/html",
+		}
+	}
+	return files
+}
+
+func TestEncodeDecode(t *testing.T) {
+	files := testFiles(50)
+	m := New(files)
+
+	// The encoding does not depend on map order
+	for range 5 {
+		if again := New(testFiles(50)); again.Hash != m.Hash || !bytes.Equal(again.data, m.data) {
+			t.Fatal("encoding is not stable")
+		}
+	}
+
+	decoded, err := Decode(m.Hash, m.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Size != int64(len(m.data)) || len(decoded.Files) != len(files) {
+		t.Fatalf("decoded %d files of size %d", len(decoded.Files), decoded.Size)
+	}
+	for path, file := range files {
+		if decoded.Files[path] != file {
+			t.Errorf("%s = %+v, want %+v", path, decoded.Files[path], file)
+		}
+	}
+
+	tampered := bytes.Replace(m.data, []byte("page1.html"), []byte("page1.htm!"), 1)
+	if _, err := Decode(m.Hash, tampered); !errors.Is(err, ErrInvalid) {
+		t.Errorf("tampered object: %v", err)
+	}
+
+	blobs := m.Blobs()
+	if len(blobs) != 51 || blobs[m.Hash] != m.Size {
+		t.Errorf("blobs = %d, object size %d", len(blobs), blobs[m.Hash])
+	}
+}
+
+// countingBackend counts blob reads and writes
+type countingBackend struct {
+	storage.Backend
+	reads, writes int
+}
+
+func (c *countingBackend) PutBlob(hash string, r io.Reader, size int64) error {
+	c.writes++
+	return c.Backend.PutBlob(hash, r, size)
+}
+
+func (c *countingBackend) GetBlob(hash string) (io.ReadCloser, error) {
+	c.reads++
+	return c.Backend.GetBlob(hash)
+}
+
+func TestStore(t *testing.T) {
+	local, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &countingBackend{Backend: local}
+	store := NewStore(backend, 100)
+
+	small, large := New(testFiles(40)), New(testFiles(70))
+	if err := store.Put(small); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(large); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := local.HasBlob(small.Hash); !ok {
+		t.Fatal("manifest object not stored")
+	}
+
+	// Putting the large manifest evicted the small one
+	if _, err := store.Get(large.Hash); err != nil {
+		t.Fatal(err)
+	}
+	if backend.reads != 0 {
+		t.Errorf("%d reads for a cached manifest", backend.reads)
+	}
+	m, err := store.Get(small.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backend.reads != 1 || len(m.Files) != 40 {
+		t.Errorf("%d reads, %d files", backend.reads, len(m.Files))
+	}
+
+	if _, err := store.Get(New(testFiles(1)).Hash); !storage.IsNotFound(err) {
+		t.Errorf("missing manifest: %v", err)
+	}
+
+	// An existing manifest is not uploaded again, whether or not the
+	// store has it cached
+	if err := store.Put(New(testFiles(40))); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewStore(backend, 100).Put(New(testFiles(70))); err != nil {
+		t.Fatal(err)
+	}
+	if backend.writes != 2 {
+		t.Errorf("%d writes for two manifests", backend.writes)
+	}
+	if small.data == nil {
+		t.Error("Put modified the manifest")
+	}
+}
+
+func TestRecord(t *testing.T) {
+	local, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStore(local, 0)
+
+	images := core.NewBaseCollection("images")
+	images.Fields.Add(&core.TextField{Name: "manifest_hash"})
+	images.Fields.Add(&core.JSONField{Name: "manifest"})
+
+	// Inline manifests of earlier versions are read without an object
+	legacy := core.NewRecord(images)
+	legacy.Set("manifest", testFiles(3))
+	m, err := store.Record(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Hash != "" || len(m.Files) != 3 || m.Inline() == nil {
+		t.Errorf("inline manifest: %q with %d files", m.Hash, len(m.Files))
+	}
+
+	obj := New(m.Files)
+	if err := store.Put(obj); err != nil {
+		t.Fatal(err)
+	}
+	Set(legacy, obj)
+	if legacy.GetString("manifest_hash") != obj.Hash {
+		t.Fatal("hash not set")
+	}
+	if m, err = store.Record(legacy); err != nil || m.Hash != obj.Hash || len(m.Files) != 3 {
+		t.Errorf("object manifest: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package manifest
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+// Store reads and writes manifest objects in a blob store. With a positive
+// maxFiles it keeps the manifests it reads and writes in memory, up to
+// that many files across them, evicting the least recently used. Objects
+// never change, so cached manifests never go stale.
+type Store struct {
+	backend  storage.Backend
+	maxFiles int
+
+	mu    sync.Mutex
+	items map[string]*list.Element
+	// lru holds cached manifests, most recently used first
+	lru   *list.List
+	files int
+}
+
+// NewStore creates a store over backend, caching up to maxFiles files
+func NewStore(backend storage.Backend, maxFiles int) *Store {
+	return &Store{
+		backend:  backend,
+		maxFiles: maxFiles,
+		items:    make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Put stores a manifest created by New, unless the object already exists.
+// The cache is not trusted for that: GC on any instance may have deleted
+// the object since. m is not modified, so it may be shared; the cache
+// keeps a copy without the encoding.
+func (s *Store) Put(m *Manifest) error {
+	if m.Hash == "" {
+		return errors.New("manifest has no object")
+	}
+	if m.data != nil {
+		exists, err := s.backend.HasBlob(m.Hash)
+		if err != nil {
+			return fmt.Errorf("checking manifest %s: %w", m.Hash, err)
+		}
+		if !exists {
+			if err := s.backend.PutBlob(m.Hash, bytes.NewReader(m.data), m.Size); err != nil {
+				return fmt.Errorf("storing manifest %s: %w", m.Hash, err)
+			}
+		}
+	}
+	s.add(&Manifest{Hash: m.Hash, Size: m.Size, Files: m.Files})
+	return nil
+}
+
+// Get returns the manifest object named hash. A missing object is a
+// storage not-found error; a corrupt one wraps ErrInvalid.
+func (s *Store) Get(hash string) (*Manifest, error) {
+	if m, ok := s.cached(hash); ok {
+		return m, nil
+	}
+
+	rc, err := s.backend.GetBlob(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	m, err := Decode(hash, data)
+	if err != nil {
+		return nil, err
+	}
+	s.add(m)
+	return m, nil
+}
+
+// Record returns the manifest of an image or plan record
+func (s *Store) Record(record *core.Record) (*Manifest, error) {
+	if hash := record.GetString("manifest_hash"); hash != "" {
+		return s.Get(hash)
+	}
+	var files map[string]storage.FileEntry
+	if err := record.UnmarshalJSONField("manifest", &files); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return &Manifest{Files: files}, nil
+}
+
+// Ref returns the manifest of a ref or preview: the object named hash, or
+// inline if hash is empty
+func (s *Store) Ref(hash string, inline map[string]storage.FileEntry) (*Manifest, error) {
+	if hash != "" {
+		return s.Get(hash)
+	}
+	return &Manifest{Files: inline}, nil
+}
+
+func (s *Store) cached(hash string) (*Manifest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[hash]
+	if !ok {
+		return nil, false
+	}
+	s.lru.MoveToFront(el)
+	return el.Value.(*Manifest), true
+}
+
+// add caches m, evicting the least recently used manifests beyond
+// maxFiles. The newest manifest is kept even if it alone is larger.
+func (s *Store) add(m *Manifest) {
+	if s.maxFiles <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[m.Hash]; ok {
+		s.lru.MoveToFront(el)
+		return
+	}
+	s.items[m.Hash] = s.lru.PushFront(m)
+	s.files += len(m.Files)
+	for s.files > s.maxFiles && s.lru.Len() > 1 {
+		oldest := s.lru.Back()
+		evicted := oldest.Value.(*Manifest)
+		s.lru.Remove(oldest)
+		delete(s.items, evicted.Hash)
+		s.files -= len(evicted.Files)
+	}
+}
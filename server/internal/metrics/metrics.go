@@ -0,0 +1,291 @@
+// Package metrics exposes SitePod's Prometheus metrics.
+//
+// All methods are safe to call on a nil *Metrics, which records nothing.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sitepod/sitepod/internal/gc"
+)
+
+const namespace = "sitepod"
+
+// Project label values used instead of a project name
+const (
+	// OtherProject is used once the project label limit is reached
+	OtherProject = "_other"
+	// UnknownProject is used for requests that did not resolve to an
+	// existing project
+	UnknownProject = "_unknown"
+)
+
+// Metrics holds SitePod's collectors and the registry they are served from
+type Metrics struct {
+	registry *prometheus.Registry
+	projects *projectLimiter
+
+	httpRequests *prometheus.CounterVec
+	httpBytes    *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+
+	cacheRequests *prometheus.CounterVec
+
+	storageDuration *prometheus.HistogramVec
+	storageErrors   *prometheus.CounterVec
+
+	deployOps      *prometheus.CounterVec
+	deployDuration *prometheus.HistogramVec
+
+	gcRuns         *prometheus.CounterVec
+	gcDuration     prometheus.Histogram
+	gcBlobsScanned prometheus.Counter
+	gcBlobsDeleted prometheus.Counter
+	gcBytesFreed   prometheus.Counter
+	gcLastRun      prometheus.Gauge
+
+	blobs     prometheus.Gauge
+	blobBytes prometheus.Gauge
+}
+
+// New creates the metrics and registers them on a new registry.
+// At most maxProjects distinct project names are used as label values.
+func New(maxProjects int, startTime time.Time) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		projects: newProjectLimiter(maxProjects),
+
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Static site requests by project, environment and status code.",
+		}, []string{"project", "env", "status"}),
+		httpBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_response_bytes_total",
+			Help:      "Static site response body bytes by project, environment and status code.",
+		}, []string{"project", "env", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Static site request latency by project, environment and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"project", "env", "status"}),
+
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_requests_total",
+			Help:      "In-memory cache lookups by cache (ref, routing) and result (hit, miss).",
+		}, []string{"cache", "result"}),
+
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "storage_operation_duration_seconds",
+			Help:      "Storage backend operation latency by backend and operation.",
+			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"backend", "operation"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "storage_operation_errors_total",
+			Help:      "Storage backend operation errors (excluding not found) by backend and operation.",
+		}, []string{"backend", "operation"}),
+
+		deployOps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "deploy_operations_total",
+			Help:      "Deploy API calls by operation (plan, upload, commit, release, rollback, preview) and result.",
+		}, []string{"operation", "result"}),
+		deployDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "deploy_operation_duration_seconds",
+			Help:      "Deploy API call latency by operation.",
+			Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"operation"}),
+
+		gcRuns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "gc_runs_total",
+			Help:      "Garbage collection cycles by result.",
+		}, []string{"result"}),
+		gcDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "gc_duration_seconds",
+			Help:      "Garbage collection cycle duration.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 4, 8),
+		}),
+		gcBlobsScanned: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "gc_blobs_scanned_total",
+			Help:      "Blobs examined by garbage collection.",
+		}),
+		gcBlobsDeleted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "gc_blobs_deleted_total",
+			Help:      "Blobs deleted by garbage collection.",
+		}),
+		gcBytesFreed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "gc_freed_bytes_total",
+			Help:      "Bytes freed by garbage collection.",
+		}),
+		gcLastRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "gc_last_run_timestamp_seconds",
+			Help:      "Unix time of the last completed garbage collection cycle.",
+		}),
+
+		blobs: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "blobs",
+			Help:      "Blobs in the blob store, as of the last garbage collection.",
+		}),
+		blobBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "blob_bytes",
+			Help:      "Total size of the blob store, as of the last garbage collection.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "up",
+			Help:      "SitePod is running.",
+		}, func() float64 { return 1 }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "uptime_seconds",
+			Help:      "Uptime in seconds.",
+		}, func() float64 { return time.Since(startTime).Seconds() }),
+		m.httpRequests, m.httpBytes, m.httpDuration,
+		m.cacheRequests,
+		m.storageDuration, m.storageErrors,
+		m.deployOps, m.deployDuration,
+		m.gcRuns, m.gcDuration, m.gcBlobsScanned, m.gcBlobsDeleted, m.gcBytesFreed, m.gcLastRun,
+		m.blobs, m.blobBytes,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Registry returns the registry the metrics are registered on
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// ObserveRequest records a served static site request
+func (m *Metrics) ObserveRequest(project, env string, status int, bytes int64, d time.Duration) {
+	if m == nil {
+		return
+	}
+	labels := prometheus.Labels{
+		"project": m.projects.label(project),
+		"env":     env,
+		"status":  strconv.Itoa(status),
+	}
+	m.httpRequests.With(labels).Inc()
+	m.httpBytes.With(labels).Add(float64(bytes))
+	m.httpDuration.With(labels).Observe(d.Seconds())
+}
+
+// ObserveCache records a cache lookup
+func (m *Metrics) ObserveCache(cache string, hit bool) {
+	if m == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheRequests.WithLabelValues(cache, result).Inc()
+}
+
+// ObserveDeploy records a deploy API call
+func (m *Metrics) ObserveDeploy(operation string, ok bool, d time.Duration) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if !ok {
+		result = "error"
+	}
+	m.deployOps.WithLabelValues(operation, result).Inc()
+	m.deployDuration.WithLabelValues(operation).Observe(d.Seconds())
+}
+
+// ObserveGC records a garbage collection cycle
+func (m *Metrics) ObserveGC(stats gc.Stats) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if stats.Err != nil {
+		result = "error"
+	}
+	m.gcRuns.WithLabelValues(result).Inc()
+	m.gcDuration.Observe(stats.Duration.Seconds())
+	m.gcBlobsScanned.Add(float64(stats.BlobsScanned))
+	m.gcBlobsDeleted.Add(float64(stats.BlobsDeleted))
+	m.gcBytesFreed.Add(float64(stats.BytesFreed))
+	m.gcLastRun.SetToCurrentTime()
+	if stats.BlobsScanned > 0 {
+		m.SetBlobTotals(stats.BlobsRemaining, stats.BytesRemaining)
+	}
+}
+
+// SetBlobTotals records the number and total size of stored blobs
+func (m *Metrics) SetBlobTotals(count int, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.blobs.Set(float64(count))
+	m.blobBytes.Set(float64(bytes))
+}
+
+// projectLimiter bounds the number of distinct project label values.
+// The first max projects seen keep their name; later ones share OtherProject.
+type projectLimiter struct {
+	mu    sync.RWMutex
+	max   int
+	known map[string]struct{}
+}
+
+func newProjectLimiter(max int) *projectLimiter {
+	return &projectLimiter{max: max, known: make(map[string]struct{})}
+}
+
+func (l *projectLimiter) label(project string) string {
+	if project == "" {
+		return UnknownProject
+	}
+
+	l.mu.RLock()
+	_, ok := l.known[project]
+	l.mu.RUnlock()
+	if ok {
+		return project
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.known[project]; ok {
+		return project
+	}
+	if len(l.known) >= l.max {
+		return OtherProject
+	}
+	l.known[project] = struct{}{}
+	return project
+}
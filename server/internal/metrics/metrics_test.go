@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sitepod/sitepod/internal/gc"
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+func TestProjectLabelLimit(t *testing.T) {
+	m := New(2, time.Now())
+
+	m.ObserveRequest("alpha", "prod", 200, 10, time.Millisecond)
+	m.ObserveRequest("beta", "prod", 200, 10, time.Millisecond)
+	m.ObserveRequest("gamma", "prod", 200, 10, time.Millisecond)
+	m.ObserveRequest("alpha", "prod", 200, 10, time.Millisecond)
+	m.ObserveRequest("", "", 404, 0, time.Millisecond)
+
+	testCases := []struct {
+		project string
+		status  string
+		want    float64
+	}{
+		{"alpha", "200", 2},
+		{"beta", "200", 1},
+		{"gamma", "200", 0},
+		{OtherProject, "200", 1},
+		{UnknownProject, "404", 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.project, func(t *testing.T) {
+			env := "prod"
+			if tc.project == UnknownProject {
+				env = ""
+			}
+			got := testutil.ToFloat64(m.httpRequests.WithLabelValues(tc.project, env, tc.status))
+			if got != tc.want {
+				t.Errorf("requests{project=%q} = %v, want %v", tc.project, got, tc.want)
+			}
+		})
+	}
+
+	if got := testutil.ToFloat64(m.httpBytes.WithLabelValues("alpha", "prod", "200")); got != 20 {
+		t.Errorf("bytes{project=alpha} = %v, want 20", got)
+	}
+}
+
+func TestInstrumentStorageErrors(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sitepod-metrics-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend, err := storage.NewLocalBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(10, time.Now())
+	s := m.InstrumentStorage(backend, "local")
+
+	// Not found is not an error
+	if _, err := s.GetRef("missing", "prod"); err == nil {
+		t.Fatal("expected not found error")
+	}
+	// Hash mismatch is
+	if err := s.PutBlob(strings.Repeat("0", 64), strings.NewReader("x"), 1); err == nil {
+		t.Fatal("expected hash mismatch error")
+	}
+
+	if got := testutil.ToFloat64(m.storageErrors.WithLabelValues("local", "get_ref")); got != 0 {
+		t.Errorf("get_ref errors = %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(m.storageErrors.WithLabelValues("local", "put_blob")); got != 1 {
+		t.Errorf("put_blob errors = %v, want 1", got)
+	}
+	if got := testutil.CollectAndCount(m.storageDuration); got != 2 {
+		t.Errorf("duration series = %d, want 2", got)
+	}
+}
+
+func TestObserveGC(t *testing.T) {
+	m := New(10, time.Now())
+
+	m.ObserveGC(gc.Stats{
+		Duration:       time.Second,
+		BlobsScanned:   10,
+		BlobsDeleted:   3,
+		BytesFreed:     300,
+		BlobsRemaining: 7,
+		BytesRemaining: 700,
+	})
+	m.ObserveGC(gc.Stats{Err: errors.New("boom")})
+
+	if got := testutil.ToFloat64(m.gcBlobsDeleted); got != 3 {
+		t.Errorf("blobs deleted = %v, want 3", got)
+	}
+	if got := testutil.ToFloat64(m.gcRuns.WithLabelValues("error")); got != 1 {
+		t.Errorf("failed runs = %v, want 1", got)
+	}
+	// A run that scanned nothing leaves the blob totals alone
+	if got := testutil.ToFloat64(m.blobBytes); got != 700 {
+		t.Errorf("blob bytes = %v, want 700", got)
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	m.ObserveRequest("p", "prod", 200, 1, time.Millisecond)
+	m.ObserveCache("ref", true)
+	m.ObserveDeploy("plan", true, time.Millisecond)
+	m.ObserveGC(gc.Stats{})
+}
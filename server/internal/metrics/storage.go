@@ -0,0 +1,202 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+// InstrumentStorage wraps a storage backend to record operation latency and
+// errors under the given backend name. It returns b unchanged if m is nil.
+func (m *Metrics) InstrumentStorage(b storage.Backend, name string) storage.Backend {
+	if m == nil {
+		return b
+	}
+	return &instrumentedStorage{next: b, m: m, name: name}
+}
+
+type instrumentedStorage struct {
+	next storage.Backend
+	m    *Metrics
+	name string
+}
+
+// Unwrap returns the wrapped backend
+func (s *instrumentedStorage) Unwrap() storage.Backend {
+	return s.next
+}
+
+// observe records an operation that started at start. Not-found errors and
+// lost lock races are part of normal operation and are not counted as
+// errors.
+func (s *instrumentedStorage) observe(op string, start time.Time, err error) {
+	s.m.storageDuration.WithLabelValues(s.name, op).Observe(time.Since(start).Seconds())
+	if err != nil && !expected(err) {
+		s.m.storageErrors.WithLabelValues(s.name, op).Inc()
+	}
+}
+
+func expected(err error) bool {
+	return storage.IsNotFound(err) || errors.Is(err, storage.ErrLockConflict)
+}
+
+func (s *instrumentedStorage) PutBlob(hash string, r io.Reader, size int64) (err error) {
+	start := time.Now()
+	defer func() { s.observe("put_blob", start, err) }()
+	return s.next.PutBlob(hash, r, size)
+}
+
+func (s *instrumentedStorage) GetBlob(hash string) (rc io.ReadCloser, err error) {
+	start := time.Now()
+	defer func() { s.observe("get_blob", start, err) }()
+	return s.next.GetBlob(hash)
+}
+
+func (s *instrumentedStorage) HasBlob(hash string) (ok bool, err error) {
+	start := time.Now()
+	defer func() { s.observe("has_blob", start, err) }()
+	return s.next.HasBlob(hash)
+}
+
+func (s *instrumentedStorage) HasBlobs(hashes []string) (found map[string]bool, err error) {
+	start := time.Now()
+	defer func() { s.observe("has_blobs", start, err) }()
+	return storage.HasBlobs(s.next, hashes)
+}
+
+func (s *instrumentedStorage) DeleteBlob(hash string) (err error) {
+	start := time.Now()
+	defer func() { s.observe("delete_blob", start, err) }()
+	return s.next.DeleteBlob(hash)
+}
+
+func (s *instrumentedStorage) ListBlobs() (hashes []string, err error) {
+	start := time.Now()
+	defer func() { s.observe("list_blobs", start, err) }()
+	return s.next.ListBlobs()
+}
+
+func (s *instrumentedStorage) StatBlob(hash string) (info *storage.BlobInfo, err error) {
+	start := time.Now()
+	defer func() { s.observe("stat_blob", start, err) }()
+	return s.next.StatBlob(hash)
+}
+
+func (s *instrumentedStorage) QuarantineBlob(hash string) (err error) {
+	start := time.Now()
+	defer func() { s.observe("quarantine_blob", start, err) }()
+	return storage.QuarantineBlob(s.next, hash)
+}
+
+func (s *instrumentedStorage) PutRef(project, env string, data []byte) (err error) {
+	start := time.Now()
+	defer func() { s.observe("put_ref", start, err) }()
+	return s.next.PutRef(project, env, data)
+}
+
+func (s *instrumentedStorage) GetRef(project, env string) (data []byte, err error) {
+	start := time.Now()
+	defer func() { s.observe("get_ref", start, err) }()
+	return s.next.GetRef(project, env)
+}
+
+func (s *instrumentedStorage) DeleteRef(project, env string) (err error) {
+	start := time.Now()
+	defer func() { s.observe("delete_ref", start, err) }()
+	return s.next.DeleteRef(project, env)
+}
+
+func (s *instrumentedStorage) PutPreview(project, slug string, data []byte) (err error) {
+	start := time.Now()
+	defer func() { s.observe("put_preview", start, err) }()
+	return s.next.PutPreview(project, slug, data)
+}
+
+func (s *instrumentedStorage) GetPreview(project, slug string) (data []byte, err error) {
+	start := time.Now()
+	defer func() { s.observe("get_preview", start, err) }()
+	return s.next.GetPreview(project, slug)
+}
+
+func (s *instrumentedStorage) DeletePreview(project, slug string) (err error) {
+	start := time.Now()
+	defer func() { s.observe("delete_preview", start, err) }()
+	return s.next.DeletePreview(project, slug)
+}
+
+func (s *instrumentedStorage) ListRefs() (keys []storage.RefKey, err error) {
+	start := time.Now()
+	defer func() { s.observe("list_refs", start, err) }()
+	return storage.ListRefs(s.next)
+}
+
+func (s *instrumentedStorage) ListPreviews() (keys []storage.RefKey, err error) {
+	start := time.Now()
+	defer func() { s.observe("list_previews", start, err) }()
+	return storage.ListPreviews(s.next)
+}
+
+func (s *instrumentedStorage) PutRouting(data []byte) (err error) {
+	start := time.Now()
+	defer func() { s.observe("put_routing", start, err) }()
+	return s.next.PutRouting(data)
+}
+
+func (s *instrumentedStorage) GetRouting() (data []byte, err error) {
+	start := time.Now()
+	defer func() { s.observe("get_routing", start, err) }()
+	return s.next.GetRouting()
+}
+
+func (s *instrumentedStorage) GetLock(name string) (data []byte, version string, err error) {
+	start := time.Now()
+	defer func() { s.observe("get_lock", start, err) }()
+	return storage.GetLock(s.next, name)
+}
+
+func (s *instrumentedStorage) PutLock(name string, data []byte, version string) (newVersion string, err error) {
+	start := time.Now()
+	defer func() { s.observe("put_lock", start, err) }()
+	return storage.PutLock(s.next, name, data, version)
+}
+
+func (s *instrumentedStorage) GenerateUploadURL(hash, sha256Base64 string, size int64) (url string, err error) {
+	start := time.Now()
+	defer func() { s.observe("generate_upload_url", start, err) }()
+	return s.next.GenerateUploadURL(hash, sha256Base64, size)
+}
+
+func (s *instrumentedStorage) GeneratePlanUploadURL(plan, hash, sha256Base64 string, size int64) (url string, err error) {
+	start := time.Now()
+	defer func() { s.observe("generate_upload_url", start, err) }()
+	return storage.GeneratePlanUploadURL(s.next, plan, hash, sha256Base64, size)
+}
+
+func (s *instrumentedStorage) CommitUpload(plan, hash string, size int64) (err error) {
+	start := time.Now()
+	defer func() { s.observe("commit_upload", start, err) }()
+	return storage.CommitUpload(s.next, plan, hash, size)
+}
+
+func (s *instrumentedStorage) DeleteUploads(plan string) (err error) {
+	start := time.Now()
+	defer func() { s.observe("delete_uploads", start, err) }()
+	return storage.DeleteUploads(s.next, plan)
+}
+
+func (s *instrumentedStorage) Ping(ctx context.Context) (err error) {
+	start := time.Now()
+	defer func() { s.observe("ping", start, err) }()
+	return storage.Ping(ctx, s.next)
+}
+
+func (s *instrumentedStorage) UploadMode() string {
+	return s.next.UploadMode()
+}
+
+func (s *instrumentedStorage) BlobBasePath() string {
+	return s.next.BlobBasePath()
+}
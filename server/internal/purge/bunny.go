@@ -0,0 +1,77 @@
+package purge
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Bunny purges a Bunny CDN pull zone
+type Bunny struct {
+	APIKey string
+	// PullZoneID is needed to purge by cache tag; without it, purging
+	// everything uses wildcard URLs
+	PullZoneID string
+
+	client *http.Client
+	api    string
+}
+
+// NewBunny creates a Bunny CDN purger using an account API key
+func NewBunny(apiKey, pullZoneID string) (*Bunny, error) {
+	if apiKey == "" {
+		return nil, errors.New("bunny purge: api_key is required")
+	}
+	return &Bunny{
+		APIKey:     apiKey,
+		PullZoneID: pullZoneID,
+		client:     &http.Client{Timeout: DefaultTimeout},
+		api:        "https://api.bunny.net",
+	}, nil
+}
+
+// Purge purges by cache tag when keys are given and a pull zone is set,
+// by wildcard URL when everything changed, and by URL otherwise
+func (b *Bunny) Purge(ctx context.Context, req Request) error {
+	switch {
+	case len(req.Keys) > 0 && b.PullZoneID != "":
+		var errs []error
+		for _, key := range req.Keys {
+			r, err := newJSONRequest(ctx, http.MethodPost,
+				b.api+"/pullzone/"+b.PullZoneID+"/purgeCache", map[string]string{"CacheTag": key})
+			if err != nil {
+				return err
+			}
+			errs = append(errs, b.send(r))
+		}
+		return errors.Join(errs...)
+	case req.All || len(req.Paths) == 0:
+		urls := make([]string, len(req.Bases))
+		for i, base := range req.Bases {
+			urls[i] = strings.TrimSuffix(base, "/") + "/*"
+		}
+		return b.purgeURLs(ctx, urls)
+	default:
+		return b.purgeURLs(ctx, req.URLs())
+	}
+}
+
+func (b *Bunny) purgeURLs(ctx context.Context, urls []string) error {
+	var errs []error
+	for _, u := range urls {
+		r, err := newJSONRequest(ctx, http.MethodPost,
+			b.api+"/purge?async=false&url="+url.QueryEscape(u), nil)
+		if err != nil {
+			return err
+		}
+		errs = append(errs, b.send(r))
+	}
+	return errors.Join(errs...)
+}
+
+func (b *Bunny) send(r *http.Request) error {
+	r.Header.Set("AccessKey", b.APIKey)
+	return do(b.client, r)
+}
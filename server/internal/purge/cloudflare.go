@@ -0,0 +1,73 @@
+package purge
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// cloudflareBatch is the most files, tags, hosts or prefixes Cloudflare
+// accepts in one purge call
+const cloudflareBatch = 30
+
+// Cloudflare purges a zone through the Cloudflare API
+type Cloudflare struct {
+	ZoneID   string
+	APIToken string
+
+	client *http.Client
+	api    string
+}
+
+// NewCloudflare creates a Cloudflare purger. The token needs the
+// Zone.Cache Purge permission.
+func NewCloudflare(zoneID, apiToken string) (*Cloudflare, error) {
+	if zoneID == "" || apiToken == "" {
+		return nil, errors.New("cloudflare purge: zone_id and api_token are required")
+	}
+	return &Cloudflare{
+		ZoneID:   zoneID,
+		APIToken: apiToken,
+		client:   &http.Client{Timeout: DefaultTimeout},
+		api:      "https://api.cloudflare.com/client/v4",
+	}, nil
+}
+
+// Purge purges by cache tag when keys are given, by host or prefix when
+// everything changed, and by URL otherwise
+func (c *Cloudflare) Purge(ctx context.Context, req Request) error {
+	switch {
+	case len(req.Keys) > 0:
+		return c.purge(ctx, "tags", req.Keys)
+	case req.All:
+		var hosts, prefixes []string
+		for _, base := range req.Bases {
+			hp := hostPath(base)
+			if strings.Contains(hp, "/") {
+				prefixes = append(prefixes, hp)
+			} else {
+				hosts = append(hosts, hp)
+			}
+		}
+		return errors.Join(c.purge(ctx, "hosts", hosts), c.purge(ctx, "prefixes", prefixes))
+	default:
+		return c.purge(ctx, "files", req.URLs())
+	}
+}
+
+// purge sends items under field ("files", "tags", ...) in batches
+func (c *Cloudflare) purge(ctx context.Context, field string, items []string) error {
+	for _, batch := range chunks(items, cloudflareBatch) {
+		req, err := newJSONRequest(ctx, http.MethodPost,
+			c.api+"/zones/"+c.ZoneID+"/purge_cache", map[string][]string{field: batch})
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+c.APIToken)
+		if err := do(c.client, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
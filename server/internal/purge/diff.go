@@ -0,0 +1,54 @@
+package purge
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+// MaxPaths is the most changed paths purged one by one; larger changes
+// purge everything
+const MaxPaths = 500
+
+// fallbackFile is served for extensionless paths missing from the
+// manifest, so a change to it can affect any URL
+const fallbackFile = "index.html"
+
+// ChangedPaths diffs two manifests and returns the URL paths whose
+// responses changed: added, removed and modified files, with index.html
+// files also listed as their directory. all is true if any URL may have
+// changed, either because the fallback page changed or there are more
+// than MaxPaths paths. A nil old manifest means everything is new.
+func ChangedPaths(old, new map[string]storage.FileEntry) (paths []string, all bool) {
+	if old == nil {
+		return nil, true
+	}
+
+	var files []string
+	for name, entry := range new {
+		if prev, ok := old[name]; !ok || prev.Hash != entry.Hash {
+			files = append(files, name)
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			files = append(files, name)
+		}
+	}
+
+	for _, name := range files {
+		if name == fallbackFile {
+			return nil, true
+		}
+		paths = append(paths, "/"+name)
+		if dir, ok := strings.CutSuffix(name, fallbackFile); ok && strings.HasSuffix(dir, "/") {
+			paths = append(paths, "/"+dir)
+		}
+	}
+	if len(paths) > MaxPaths {
+		return nil, true
+	}
+	sort.Strings(paths)
+	return paths, false
+}
@@ -0,0 +1,75 @@
+package purge
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// fastlyBatch is the most surrogate keys Fastly accepts in one purge call
+const fastlyBatch = 256
+
+// Fastly purges a Fastly service
+type Fastly struct {
+	ServiceID string
+	APIToken  string
+
+	client *http.Client
+	api    string
+}
+
+// NewFastly creates a Fastly purger. The token needs the purge_select
+// scope, or purge_all to purge the whole service.
+func NewFastly(serviceID, apiToken string) (*Fastly, error) {
+	if serviceID == "" || apiToken == "" {
+		return nil, errors.New("fastly purge: service_id and api_token are required")
+	}
+	return &Fastly{
+		ServiceID: serviceID,
+		APIToken:  apiToken,
+		client:    &http.Client{Timeout: DefaultTimeout},
+		api:       "https://api.fastly.com",
+	}, nil
+}
+
+// Purge purges by surrogate key when keys are given, the whole service
+// when everything changed, and single URLs otherwise
+func (f *Fastly) Purge(ctx context.Context, req Request) error {
+	switch {
+	case len(req.Keys) > 0:
+		for _, batch := range chunks(req.Keys, fastlyBatch) {
+			r, err := newJSONRequest(ctx, http.MethodPost,
+				f.api+"/service/"+f.ServiceID+"/purge", map[string][]string{"surrogate_keys": batch})
+			if err != nil {
+				return err
+			}
+			if err := f.send(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	case req.All:
+		r, err := newJSONRequest(ctx, http.MethodPost, f.api+"/service/"+f.ServiceID+"/purge_all", nil)
+		if err != nil {
+			return err
+		}
+		return f.send(r)
+	default:
+		// Fastly purges a single URL when it receives PURGE for it
+		var errs []error
+		for _, url := range req.URLs() {
+			r, err := newJSONRequest(ctx, "PURGE", url, nil)
+			if err != nil {
+				return err
+			}
+			errs = append(errs, f.send(r))
+		}
+		return errors.Join(errs...)
+	}
+}
+
+func (f *Fastly) send(r *http.Request) error {
+	r.Header.Set("Fastly-Key", f.APIToken)
+	r.Header.Set("Accept", "application/json")
+	return do(f.client, r)
+}
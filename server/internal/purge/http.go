@@ -0,0 +1,94 @@
+package purge
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HTTP purges a self-hosted cache such as Varnish, nginx or Squid by
+// sending it requests with a purge method
+type HTTP struct {
+	// Endpoint, if set, receives every purge request with the site's Host
+	// header (e.g. http://varnish:6081). Otherwise requests go to the site
+	// URLs themselves.
+	Endpoint string
+	// Method defaults to PURGE
+	Method string
+	// Headers are added to every request (e.g. an auth token)
+	Headers map[string]string
+	// KeyHeader, if set, purges by surrogate key: one request per origin
+	// with the keys space-separated in this header (e.g. xkey-purge)
+	KeyHeader string
+
+	client *http.Client
+}
+
+// NewHTTP creates a purger sending method requests
+func NewHTTP(endpoint, method, keyHeader string, headers map[string]string) (*HTTP, error) {
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, errors.New("http purge: endpoint must be an absolute http or https URL")
+		}
+	}
+	if method == "" {
+		method = "PURGE"
+	}
+	return &HTTP{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Method:    method,
+		Headers:   headers,
+		KeyHeader: keyHeader,
+		client:    &http.Client{Timeout: DefaultTimeout},
+	}, nil
+}
+
+// Purge sends one request per origin carrying the keys when a key header
+// is configured, one per origin for "/*" when everything changed, and one
+// per changed URL otherwise
+func (h *HTTP) Purge(ctx context.Context, req Request) error {
+	var errs []error
+	switch {
+	case len(req.Keys) > 0 && h.KeyHeader != "":
+		for _, base := range req.Bases {
+			errs = append(errs, h.send(ctx, strings.TrimSuffix(base, "/")+"/", strings.Join(req.Keys, " ")))
+		}
+	case req.All || len(req.Paths) == 0:
+		for _, base := range req.Bases {
+			errs = append(errs, h.send(ctx, strings.TrimSuffix(base, "/")+"/*", ""))
+		}
+	default:
+		for _, u := range req.URLs() {
+			errs = append(errs, h.send(ctx, u, ""))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// send purges target, through the endpoint if one is configured
+func (h *HTTP) send(ctx context.Context, target, keys string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	dest := target
+	if h.Endpoint != "" {
+		dest = h.Endpoint + u.RequestURI()
+	}
+
+	r, err := http.NewRequestWithContext(ctx, h.Method, dest, nil)
+	if err != nil {
+		return err
+	}
+	r.Host = u.Host
+	for k, v := range h.Headers {
+		r.Header.Set(k, v)
+	}
+	if keys != "" {
+		r.Header.Set(h.KeyHeader, keys)
+	}
+	return do(h.client, r)
+}
@@ -0,0 +1,95 @@
+package purge
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+// Surrogate keys tag every served file so a CDN can purge exactly the
+// responses a release invalidates:
+//
+//	sp:<project>                     every environment of a project
+//	sp:<project>:<env>               one environment
+//	sp:<image_id>                    files served from one image
+//	sp:<project>:<env>:<hash16>      one blob served by an environment
+//
+// Blob keys are scoped to the environment so purging a changed file does
+// not evict the same content served by other sites.
+
+// ProjectKey returns the key shared by every file of a project
+func ProjectKey(project string) string {
+	return "sp:" + project
+}
+
+// EnvKey returns the key shared by every file of a project environment
+func EnvKey(project, env string) string {
+	return "sp:" + project + ":" + env
+}
+
+// ImageKey returns the key shared by every file of an image
+func ImageKey(imageID string) string {
+	return "sp:" + imageID
+}
+
+// BlobKey returns the key of one blob served by a project environment
+func BlobKey(project, env, hash string) string {
+	if len(hash) > 16 {
+		hash = hash[:16]
+	}
+	return "sp:" + project + ":" + env + ":" + hash
+}
+
+// FileKeys returns the keys of a file served from an image
+func FileKeys(project, env, imageID, hash string) []string {
+	keys := []string{ProjectKey(project), EnvKey(project, env)}
+	if imageID != "" {
+		keys = append(keys, ImageKey(imageID))
+	}
+	return append(keys, BlobKey(project, env, hash))
+}
+
+// ChangedKeys diffs two manifests of a project environment and returns the
+// keys of the responses that changed: the old blobs of modified and
+// removed files, and the old fallback page for added files that used to be
+// served by it. A nil old manifest invalidates the whole environment.
+// Added files that used to return 404 carry no key and are not covered.
+func ChangedKeys(project, env string, old, new map[string]storage.FileEntry) []string {
+	if old == nil {
+		return []string{EnvKey(project, env)}
+	}
+
+	seen := make(map[string]bool)
+	add := func(hash string) {
+		seen[BlobKey(project, env, hash)] = true
+	}
+	fallback, hasFallback := old[fallbackFile]
+	for name, entry := range new {
+		prev, ok := old[name]
+		switch {
+		case ok && prev.Hash != entry.Hash:
+			add(prev.Hash)
+		case !ok && hasFallback && servesFallback(name):
+			add(fallback.Hash)
+		}
+	}
+	for name, entry := range old {
+		if _, ok := new[name]; !ok {
+			add(entry.Hash)
+		}
+	}
+
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// servesFallback reports whether a manifest path missing from an image is
+// answered with the fallback page, mirroring the static handler
+func servesFallback(name string) bool {
+	return !strings.Contains(name, ".") || strings.HasPrefix(name, "index")
+}
@@ -0,0 +1,115 @@
+// Package purge invalidates CDN caches when a deployed environment changes.
+//
+// A Request names the origins serving the environment and what changed:
+// either specific paths (from a manifest diff), surrogate keys, or
+// everything. Each provider maps that onto its own purge API.
+package purge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout bounds one purge, including every API call it makes
+const DefaultTimeout = 30 * time.Second
+
+// Purger invalidates cached responses
+type Purger interface {
+	Purge(ctx context.Context, req Request) error
+}
+
+// Request describes what to invalidate for one project environment
+type Request struct {
+	Project string
+	Env     string
+	// Bases are the origins serving the environment, as scheme://host with
+	// an optional path prefix (custom domains bound to a slug)
+	Bases []string
+	// Paths are changed URL paths under every base, e.g. "/", "/about/"
+	Paths []string
+	// Keys are surrogate keys; providers that support them purge by key
+	// instead of by URL. Others fall back to Paths, or purge everything
+	// when there are none.
+	Keys []string
+	// All means any URL under Bases may have changed
+	All bool
+}
+
+// URLs returns every changed URL: each path under each base
+func (r Request) URLs() []string {
+	urls := make([]string, 0, len(r.Bases)*len(r.Paths))
+	for _, base := range r.Bases {
+		base = strings.TrimSuffix(base, "/")
+		for _, p := range r.Paths {
+			urls = append(urls, base+p)
+		}
+	}
+	return urls
+}
+
+// Empty reports whether there is nothing to purge
+func (r Request) Empty() bool {
+	return !r.All && len(r.Paths) == 0 && len(r.Keys) == 0
+}
+
+// chunks splits items into batches of at most n
+func chunks(items []string, n int) [][]string {
+	var out [][]string
+	for len(items) > n {
+		out = append(out, items[:n])
+		items = items[n:]
+	}
+	if len(items) > 0 {
+		out = append(out, items)
+	}
+	return out
+}
+
+// hostPath returns a base URL without its scheme, e.g. example.com/blog
+func hostPath(base string) string {
+	if _, rest, ok := strings.Cut(base, "://"); ok {
+		base = rest
+	}
+	return strings.TrimSuffix(base, "/")
+}
+
+// do sends a request and returns an error for non-2xx responses
+func do(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %d %s", req.Method, req.URL.Redacted(), resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return nil
+}
+
+// newJSONRequest builds a request with a JSON body (nil for none)
+func newJSONRequest(ctx context.Context, method, url string, body any) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
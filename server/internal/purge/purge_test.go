@@ -0,0 +1,294 @@
+package purge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sitepod/sitepod/internal/storage"
+)
+
+func TestChangedPaths(t *testing.T) {
+	base := map[string]storage.FileEntry{
+		"index.html":       {Hash: "a"},
+		"about/index.html": {Hash: "b"},
+		"app.js":           {Hash: "c"},
+		"logo.png":         {Hash: "d"},
+	}
+	with := func(changes map[string]string, remove ...string) map[string]storage.FileEntry {
+		m := make(map[string]storage.FileEntry)
+		for k, v := range base {
+			m[k] = v
+		}
+		for k, h := range changes {
+			m[k] = storage.FileEntry{Hash: h}
+		}
+		for _, k := range remove {
+			delete(m, k)
+		}
+		return m
+	}
+
+	testCases := []struct {
+		name  string
+		old   map[string]storage.FileEntry
+		new   map[string]storage.FileEntry
+		paths []string
+		all   bool
+	}{
+		{name: "first_release", old: nil, new: base, all: true},
+		{name: "unchanged", old: base, new: base},
+		{name: "asset_changed", old: base, new: with(map[string]string{"app.js": "x"}), paths: []string{"/app.js"}},
+		{name: "added_and_removed", old: base, new: with(map[string]string{"new.css": "x"}, "logo.png"),
+			paths: []string{"/logo.png", "/new.css"}},
+		{name: "directory_index", old: base, new: with(map[string]string{"about/index.html": "x"}),
+			paths: []string{"/about/", "/about/index.html"}},
+		{name: "fallback_changed", old: base, new: with(map[string]string{"index.html": "x"}), all: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			paths, all := ChangedPaths(tc.old, tc.new)
+			if all != tc.all {
+				t.Errorf("all = %v, want %v", all, tc.all)
+			}
+			if !reflect.DeepEqual(paths, tc.paths) {
+				t.Errorf("paths = %v, want %v", paths, tc.paths)
+			}
+		})
+	}
+
+	many := make(map[string]storage.FileEntry)
+	for i := 0; i <= MaxPaths; i++ {
+		many[fmt.Sprintf("f%d.js", i)] = storage.FileEntry{Hash: "x"}
+	}
+	if _, all := ChangedPaths(map[string]storage.FileEntry{}, many); !all {
+		t.Errorf("more than MaxPaths changes should purge everything")
+	}
+}
+
+func TestChangedKeys(t *testing.T) {
+	old := map[string]storage.FileEntry{
+		"index.html": {Hash: "aaaaaaaaaaaaaaaaaaaa"},
+		"app.js":     {Hash: "cccc"},
+		"logo.png":   {Hash: "dddd"},
+	}
+
+	testCases := []struct {
+		name string
+		old  map[string]storage.FileEntry
+		new  map[string]storage.FileEntry
+		keys []string
+	}{
+		{name: "first_release", old: nil, new: old, keys: []string{"sp:blog:prod"}},
+		{name: "unchanged", old: old, new: old, keys: []string{}},
+		{
+			name: "changed_and_removed",
+			old:  old,
+			new: map[string]storage.FileEntry{
+				"index.html": {Hash: "aaaaaaaaaaaaaaaaaaaa"},
+				"app.js":     {Hash: "xxxx"},
+			},
+			keys: []string{"sp:blog:prod:cccc", "sp:blog:prod:dddd"},
+		},
+		{
+			name: "added_page_was_fallback",
+			old:  old,
+			new: map[string]storage.FileEntry{
+				"index.html": {Hash: "aaaaaaaaaaaaaaaaaaaa"},
+				"app.js":     {Hash: "cccc"},
+				"logo.png":   {Hash: "dddd"},
+				"about":      {Hash: "eeee"},
+				"extra.css":  {Hash: "ffff"},
+			},
+			keys: []string{"sp:blog:prod:aaaaaaaaaaaaaaaa"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			keys := ChangedKeys("blog", "prod", tc.old, tc.new)
+			if !reflect.DeepEqual(keys, tc.keys) {
+				t.Errorf("keys = %q, want %q", keys, tc.keys)
+			}
+		})
+	}
+}
+
+func TestFileKeys(t *testing.T) {
+	got := FileKeys("blog", "beta", "img_1", "0123456789abcdef0123")
+	want := []string{"sp:blog", "sp:blog:beta", "sp:img_1", "sp:blog:beta:0123456789abcdef"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FileKeys = %q, want %q", got, want)
+	}
+}
+
+// recorder is a test server recording the requests it receives
+type recorder struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []string // "METHOD path?query host body"
+	headers  []http.Header
+}
+
+func newRecorder(t *testing.T) *recorder {
+	rec := &recorder{}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rec.mu.Lock()
+		rec.requests = append(rec.requests, strings.TrimSpace(fmt.Sprintf("%s %s %s %s", r.Method, r.URL.RequestURI(), r.Host, body)))
+		rec.headers = append(rec.headers, r.Header.Clone())
+		rec.mu.Unlock()
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+func TestCloudflare(t *testing.T) {
+	srv := newRecorder(t)
+	cf, _ := NewCloudflare("zone1", "token")
+	cf.api = srv.URL
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	err := cf.Purge(context.Background(), Request{
+		Bases: []string{"https://blog.example.com", "https://example.org/blog"},
+		Paths: []string{"/app.js"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `POST /zones/zone1/purge_cache ` + host + ` {"files":["https://blog.example.com/app.js","https://example.org/blog/app.js"]}`
+	if len(srv.requests) != 1 || srv.requests[0] != want {
+		t.Errorf("requests = %q, want %q", srv.requests, want)
+	}
+	if got := srv.headers[0].Get("Authorization"); got != "Bearer token" {
+		t.Errorf("Authorization = %q", got)
+	}
+
+	srv.requests = nil
+	if err := cf.Purge(context.Background(), Request{
+		Bases: []string{"https://blog.example.com", "https://example.org/blog"},
+		All:   true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.requests) != 2 ||
+		!strings.HasSuffix(srv.requests[0], `{"hosts":["blog.example.com"]}`) ||
+		!strings.HasSuffix(srv.requests[1], `{"prefixes":["example.org/blog"]}`) {
+		t.Errorf("requests = %q", srv.requests)
+	}
+}
+
+func TestFastly(t *testing.T) {
+	srv := newRecorder(t)
+	f, _ := NewFastly("svc", "token")
+	f.api = srv.URL
+
+	if err := f.Purge(context.Background(), Request{Bases: []string{srv.URL}, Paths: []string{"/a.js"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Purge(context.Background(), Request{Bases: []string{srv.URL}, All: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Purge(context.Background(), Request{Keys: []string{"k1", "k2"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(srv.requests) != 3 ||
+		!strings.HasPrefix(srv.requests[0], "PURGE /a.js ") ||
+		!strings.HasPrefix(srv.requests[1], "POST /service/svc/purge_all ") ||
+		!strings.HasSuffix(srv.requests[2], `{"surrogate_keys":["k1","k2"]}`) {
+		t.Errorf("requests = %q", srv.requests)
+	}
+	for _, h := range srv.headers {
+		if h.Get("Fastly-Key") != "token" {
+			t.Errorf("Fastly-Key = %q", h.Get("Fastly-Key"))
+		}
+	}
+}
+
+func TestBunny(t *testing.T) {
+	srv := newRecorder(t)
+	b, _ := NewBunny("key", "")
+	b.api = srv.URL
+
+	if err := b.Purge(context.Background(), Request{Bases: []string{"https://cdn.example.com"}, All: true}); err != nil {
+		t.Fatal(err)
+	}
+	want := "POST /purge?async=false&url=https%3A%2F%2Fcdn.example.com%2F%2A"
+	if len(srv.requests) != 1 || !strings.HasPrefix(srv.requests[0], want) {
+		t.Errorf("requests = %q, want prefix %q", srv.requests, want)
+	}
+	if srv.headers[0].Get("AccessKey") != "key" {
+		t.Errorf("AccessKey = %q", srv.headers[0].Get("AccessKey"))
+	}
+
+	srv.requests = nil
+	b.PullZoneID = "42"
+	if err := b.Purge(context.Background(), Request{Keys: []string{"blog"}}); err != nil {
+		t.Fatal(err)
+	}
+	var body map[string]string
+	parts := strings.SplitN(srv.requests[0], " ", 4)
+	_ = json.Unmarshal([]byte(parts[3]), &body)
+	if parts[1] != "/pullzone/42/purgeCache" || body["CacheTag"] != "blog" {
+		t.Errorf("requests = %q", srv.requests)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	srv := newRecorder(t)
+	h, err := NewHTTP(srv.URL, "", "xkey-purge", map[string]string{"X-Token": "t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Purge(context.Background(), Request{
+		Bases: []string{"https://example.org/blog"},
+		Paths: []string{"/", "/app.js"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Purge(context.Background(), Request{Bases: []string{"https://example.org"}, Keys: []string{"a", "b"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"PURGE /blog/ example.org",
+		"PURGE /blog/app.js example.org",
+		"PURGE / example.org",
+	}
+	if !reflect.DeepEqual(srv.requests, want) {
+		t.Errorf("requests = %q, want %q", srv.requests, want)
+	}
+	if got := srv.headers[2].Get("xkey-purge"); got != "a b" {
+		t.Errorf("key header = %q", got)
+	}
+	if got := srv.headers[0].Get("X-Token"); got != "t" {
+		t.Errorf("X-Token = %q", got)
+	}
+
+	plain, _ := NewHTTP(srv.URL, "", "", nil)
+	srv.requests = nil
+	if err := plain.Purge(context.Background(), Request{
+		Bases: []string{"https://example.org"},
+		Paths: []string{"/app.js"},
+		Keys:  []string{"a"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"PURGE /app.js example.org"}; !reflect.DeepEqual(srv.requests, want) {
+		t.Errorf("requests without key header = %q, want %q", srv.requests, want)
+	}
+
+	if _, err := NewHTTP("varnish:6081", "", "", nil); err == nil {
+		t.Error("expected an error for an endpoint without scheme")
+	}
+}
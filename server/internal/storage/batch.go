@@ -0,0 +1,65 @@
+package storage
+
+import "sync"
+
+// Concurrency of HasBlobs checks
+const (
+	localStatConcurrency = 16
+	s3HeadConcurrency    = 32
+)
+
+// hasBlobs checks hashes with up to workers concurrent calls to has and
+// returns the ones that exist. Duplicate hashes are checked once. It
+// stops at the first error.
+func hasBlobs(hashes []string, workers int, has func(hash string) (bool, error)) (map[string]bool, error) {
+	found := make(map[string]bool)
+	unique := make([]string, 0, len(hashes))
+	seen := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		if !seen[hash] {
+			seen[hash] = true
+			unique = append(unique, hash)
+		}
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	work := make(chan string)
+	for range min(workers, len(unique)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for hash := range work {
+				ok, err := has(hash)
+				mu.Lock()
+				switch {
+				case err != nil && firstErr == nil:
+					firstErr = err
+				case ok:
+					found[hash] = true
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, hash := range unique {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		work <- hash
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return found, nil
+}
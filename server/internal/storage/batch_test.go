@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHasBlobs(t *testing.T) {
+	var calls atomic.Int32
+	stored := map[string]bool{"a": true, "c": true}
+	has := func(hash string) (bool, error) {
+		calls.Add(1)
+		if hash == "bad" {
+			return false, errors.New("unreachable")
+		}
+		return stored[hash], nil
+	}
+
+	found, err := hasBlobs([]string{"a", "b", "c", "a", "a"}, 4, has)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || !found["a"] || !found["c"] {
+		t.Errorf("found = %v", found)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("checked %d hashes, want 3", calls.Load())
+	}
+
+	if _, err := hasBlobs([]string{"a", "bad", "c"}, 2, has); err == nil {
+		t.Error("expected error")
+	}
+	if found, err := hasBlobs(nil, 4, has); err != nil || len(found) != 0 {
+		t.Errorf("no hashes: %v, %v", found, err)
+	}
+}
+
+func TestHasBlobsFallback(t *testing.T) {
+	local, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := computeHash([]byte("one"))
+	if err := local.PutBlob(hash, bytes.NewReader([]byte("one")), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the methods of Backend, as in backends written before batches
+	var backend Backend = struct{ Backend }{local}
+	if _, ok := backend.(BatchChecker); ok {
+		t.Fatal("backend should not check batches")
+	}
+	found, err := HasBlobs(backend, []string{hash, computeHash([]byte("two"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || !found[hash] {
+		t.Errorf("found = %v", found)
+	}
+
+	// A wrapper with batch checks over such a backend checks blob by blob
+	wrapped := &batchWrapper{Backend: backend}
+	found, err = HasBlobs(wrapped, []string{hash, computeHash([]byte("two"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || !found[hash] || wrapped.batches != 0 {
+		t.Errorf("found = %v in %d batches", found, wrapped.batches)
+	}
+}
+
+// batchWrapper is a wrapper that checks batches whatever it wraps
+type batchWrapper struct {
+	Backend
+	batches int
+}
+
+func (w *batchWrapper) HasBlobs(hashes []string) (map[string]bool, error) {
+	w.batches++
+	return map[string]bool{}, nil
+}
+
+func (w *batchWrapper) Unwrap() Backend { return w.Backend }
+
+// countingBackend counts existence checks that reach the backend
+type countingBackend struct {
+	Backend
+	checks atomic.Int32
+}
+
+func (c *countingBackend) HasBlob(hash string) (bool, error) {
+	c.checks.Add(1)
+	return c.Backend.HasBlob(hash)
+}
+
+func (c *countingBackend) HasBlobs(hashes []string) (map[string]bool, error) {
+	c.checks.Add(int32(len(hashes)))
+	return HasBlobs(c.Backend, hashes)
+}
+
+func TestKnownBlobs(t *testing.T) {
+	local, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &countingBackend{Backend: local}
+	known := WithKnownBlobs(backend, 2, time.Hour)
+
+	var hashes []string
+	for _, content := range []string{"one", "two", "three"} {
+		hash := computeHash([]byte(content))
+		if err := local.PutBlob(hash, bytes.NewReader([]byte(content)), int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	missing := computeHash([]byte("missing"))
+
+	found, err := HasBlobs(known, []string{hashes[0], hashes[1], missing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || backend.checks.Load() != 3 {
+		t.Fatalf("found %v with %d checks", found, backend.checks.Load())
+	}
+
+	// Known blobs are not checked again; missing ones are
+	found, _ = HasBlobs(known, []string{hashes[0], hashes[1], missing})
+	if len(found) != 2 || backend.checks.Load() != 4 {
+		t.Errorf("second check: found %v with %d checks", found, backend.checks.Load())
+	}
+
+	// The least recently used blob is evicted beyond the limit
+	if ok, _ := known.HasBlob(hashes[2]); !ok {
+		t.Fatal("blob not found")
+	}
+	backend.checks.Store(0)
+	HasBlobs(known, []string{hashes[1], hashes[2]})
+	known.HasBlob(hashes[0])
+	if backend.checks.Load() != 1 {
+		t.Errorf("%d checks after eviction, want 1", backend.checks.Load())
+	}
+
+	// Deleting through the cache forgets the blob
+	if err := known.DeleteBlob(hashes[0]); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := known.HasBlob(hashes[0]); ok {
+		t.Error("deleted blob still known")
+	}
+
+	if WithKnownBlobs(local, 0, time.Hour) != Backend(local) {
+		t.Error("disabled cache should return the backend")
+	}
+}
+
+// BenchmarkPlanBlobCheck measures the existence checks of a plan for a
+// 1,000 file site against a backend with a 1ms round trip, as with S3
+func BenchmarkPlanBlobCheck(b *testing.B) {
+	const files = 1000
+	hashes := make([]string, files)
+	for i := range hashes {
+		hashes[i] = fmt.Sprintf("%064x", i)
+	}
+	remote := func(hash string) (bool, error) {
+		time.Sleep(time.Millisecond)
+		return true, nil
+	}
+
+	b.Run("sequential", func(b *testing.B) {
+		for b.Loop() {
+			for _, hash := range hashes {
+				if _, err := remote(hash); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := hasBlobs(hashes, s3HeadConcurrency, remote); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkLocalHasBlobs measures plan existence checks of a 10,000 file
+// site against local storage
+func BenchmarkLocalHasBlobs(b *testing.B) {
+	backend, err := NewLocalBackend(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	hashes := make([]string, 10000)
+	for i := range hashes {
+		content := []byte(fmt.Sprint(i))
+		hashes[i] = computeHash(content)
+		if i%2 == 0 {
+			if err := backend.PutBlob(hashes[i], bytes.NewReader(content), int64(len(content))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("sequential", func(b *testing.B) {
+		for b.Loop() {
+			for _, hash := range hashes {
+				if _, err := backend.HasBlob(hash); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := backend.HasBlobs(hashes); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// WithKnownBlobs wraps b so that blobs seen to exist are remembered for
+// ttl, up to maxEntries of them, and HasBlob and HasBlobs only ask b
+// about the others. Blobs deleted or quarantined through the wrapper are
+// forgotten at once; blobs deleted by another instance sharing the
+// storage are only forgotten when their entry expires. It returns b
+// unchanged if maxEntries is not positive.
+func WithKnownBlobs(b Backend, maxEntries int, ttl time.Duration) Backend {
+	if maxEntries <= 0 || ttl <= 0 {
+		return b
+	}
+	return &knownBlobs{
+		Backend: b,
+		blobSet: &blobSet{
+			maxEntries: maxEntries,
+			ttl:        ttl,
+			items:      make(map[string]*list.Element),
+			lru:        list.New(),
+		},
+	}
+}
+
+type knownBlobs struct {
+	Backend
+	*blobSet
+}
+
+// blobSet holds the known blobs, shared by every view of the wrapper
+type blobSet struct {
+	maxEntries int
+	ttl        time.Duration
+
+	mu    sync.Mutex
+	items map[string]*list.Element
+	// lru holds knownBlob entries, most recently used first
+	lru *list.List
+}
+
+type knownBlob struct {
+	hash      string
+	expiresAt time.Time
+}
+
+// known reports whether hash was seen to exist within the ttl
+func (k *blobSet) known(hash string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	el, ok := k.items[hash]
+	if !ok {
+		return false
+	}
+	if time.Now().After(el.Value.(*knownBlob).expiresAt) {
+		k.lru.Remove(el)
+		delete(k.items, hash)
+		return false
+	}
+	k.lru.MoveToFront(el)
+	return true
+}
+
+// remember records that hashes exist, evicting the least recently used
+// entries beyond maxEntries
+func (k *blobSet) remember(hashes ...string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	expiresAt := time.Now().Add(k.ttl)
+	for _, hash := range hashes {
+		if el, ok := k.items[hash]; ok {
+			el.Value.(*knownBlob).expiresAt = expiresAt
+			k.lru.MoveToFront(el)
+			continue
+		}
+		k.items[hash] = k.lru.PushFront(&knownBlob{hash: hash, expiresAt: expiresAt})
+		for k.lru.Len() > k.maxEntries {
+			oldest := k.lru.Back()
+			k.lru.Remove(oldest)
+			delete(k.items, oldest.Value.(*knownBlob).hash)
+		}
+	}
+}
+
+func (k *blobSet) forget(hash string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if el, ok := k.items[hash]; ok {
+		k.lru.Remove(el)
+		delete(k.items, hash)
+	}
+}
+
+// Unwrap returns the wrapped backend
+func (k *knownBlobs) Unwrap() Backend {
+	return k.Backend
+}
+
+// WithContext returns a view of the wrapper that passes ctx on to the
+// wrapped backend and shares the known blobs
+func (k *knownBlobs) WithContext(ctx context.Context) Backend {
+	return &knownBlobs{Backend: WithContext(k.Backend, ctx), blobSet: k.blobSet}
+}
+
+func (k *knownBlobs) HasBlob(hash string) (bool, error) {
+	if k.known(hash) {
+		return true, nil
+	}
+	ok, err := k.Backend.HasBlob(hash)
+	if ok {
+		k.remember(hash)
+	}
+	return ok, err
+}
+
+func (k *knownBlobs) HasBlobs(hashes []string) (map[string]bool, error) {
+	found := make(map[string]bool, len(hashes))
+	unknown := make([]string, 0, len(hashes))
+	for _, hash := range hashes {
+		if k.known(hash) {
+			found[hash] = true
+		} else {
+			unknown = append(unknown, hash)
+		}
+	}
+	if len(unknown) == 0 {
+		return found, nil
+	}
+
+	stored, err := HasBlobs(k.Backend, unknown)
+	if err != nil {
+		return nil, err
+	}
+	hashesFound := make([]string, 0, len(stored))
+	for hash := range stored {
+		found[hash] = true
+		hashesFound = append(hashesFound, hash)
+	}
+	k.remember(hashesFound...)
+	return found, nil
+}
+
+func (k *knownBlobs) PutBlob(hash string, r io.Reader, size int64) error {
+	if err := k.Backend.PutBlob(hash, r, size); err != nil {
+		return err
+	}
+	k.remember(hash)
+	return nil
+}
+
+func (k *knownBlobs) GeneratePlanUploadURL(plan, hash, sha256Base64 string, size int64) (string, error) {
+	return GeneratePlanUploadURL(k.Backend, plan, hash, sha256Base64, size)
+}
+
+func (k *knownBlobs) CommitUpload(plan, hash string, size int64) error {
+	if err := CommitUpload(k.Backend, plan, hash, size); err != nil {
+		return err
+	}
+	k.remember(hash)
+	return nil
+}
+
+func (k *knownBlobs) DeleteUploads(plan string) error {
+	return DeleteUploads(k.Backend, plan)
+}
+
+func (k *knownBlobs) DeleteBlob(hash string) error {
+	err := k.Backend.DeleteBlob(hash)
+	k.forget(hash)
+	return err
+}
+
+func (k *knownBlobs) QuarantineBlob(hash string) error {
+	err := QuarantineBlob(k.Backend, hash)
+	k.forget(hash)
+	return err
+}
+
+func (k *knownBlobs) Ping(ctx context.Context) error {
+	return Ping(ctx, k.Backend)
+}
+
+func (k *knownBlobs) GetLock(name string) ([]byte, string, error) {
+	return GetLock(k.Backend, name)
+}
+
+func (k *knownBlobs) PutLock(name string, data []byte, version string) (string, error) {
+	return PutLock(k.Backend, name, data, version)
+}
+
+func (k *knownBlobs) ListRefs() ([]RefKey, error) {
+	return ListRefs(k.Backend)
+}
+
+func (k *knownBlobs) ListPreviews() ([]RefKey, error) {
+	return ListPreviews(k.Backend)
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/zeebo/blake3"
@@ -19,9 +21,20 @@ type LocalBackend struct {
 	blobPath string
 	refPath  string
 	prevPath string
+	lockPath string
+	quarPath string
 	tmpPath  string
 }
 
+const (
+	// lockGuardWait bounds how long PutLock waits for another process
+	// updating the same lock
+	lockGuardWait = 5 * time.Second
+	// lockGuardStale is the age after which a guard file is assumed to
+	// be left by a crashed process
+	lockGuardStale = 30 * time.Second
+)
+
 // NewLocalBackend creates a new local storage backend
 func NewLocalBackend(basePath string) (*LocalBackend, error) {
 	b := &LocalBackend{
@@ -29,11 +42,13 @@ func NewLocalBackend(basePath string) (*LocalBackend, error) {
 		blobPath: filepath.Join(basePath, "blobs"),
 		refPath:  filepath.Join(basePath, "refs"),
 		prevPath: filepath.Join(basePath, "previews"),
+		lockPath: filepath.Join(basePath, "locks"),
+		quarPath: filepath.Join(basePath, "quarantine"),
 		tmpPath:  filepath.Join(basePath, "tmp"),
 	}
 
 	// Create directories
-	dirs := []string{b.blobPath, b.refPath, b.prevPath, b.tmpPath}
+	dirs := []string{b.blobPath, b.refPath, b.prevPath, b.lockPath, b.tmpPath}
 	for _, dir := range dirs {
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			return nil, fmt.Errorf("failed to create directory %s: %w", dir, err)
@@ -43,6 +58,23 @@ func NewLocalBackend(basePath string) (*LocalBackend, error) {
 	return b, nil
 }
 
+// Ping writes and reads back a sentinel file in the tmp directory
+func (b *LocalBackend) Ping(ctx context.Context) error {
+	sentinel := filepath.Join(b.tmpPath, ".ping")
+	want := []byte(uuid.New().String())
+	if err := os.WriteFile(sentinel, want, 0644); err != nil {
+		return fmt.Errorf("storage not writable: %w", err)
+	}
+	got, err := os.ReadFile(sentinel)
+	if err != nil {
+		return fmt.Errorf("storage not readable: %w", err)
+	}
+	if string(got) != string(want) {
+		return errors.New("storage sentinel mismatch")
+	}
+	return nil
+}
+
 // BlobBasePath returns the base path for blobs
 func (b *LocalBackend) BlobBasePath() string {
 	return b.blobPath
@@ -61,13 +93,14 @@ func (b *LocalBackend) blobFilePath(hash string) string {
 	return filepath.Join(b.blobPath, hash[:2], hash)
 }
 
-// PutBlob stores a blob, verifying its hash
+// PutBlob stores a blob, verifying its hash. The content of a blob that
+// is already stored is still read and verified, since a successful upload
+// proves the uploader holds it, but the stored copy is kept.
 func (b *LocalBackend) PutBlob(hash string, r io.Reader, size int64) error {
 	targetPath := b.blobFilePath(hash)
 
-	// Check if already exists
 	if _, err := os.Stat(targetPath); err == nil {
-		return nil // Already exists, idempotent
+		return verifyContent(hash, r, size)
 	}
 
 	// Create parent directory
@@ -101,7 +134,7 @@ func (b *LocalBackend) PutBlob(hash string, r io.Reader, size int64) error {
 
 	// Verify size if provided
 	if size > 0 && written != size {
-		return fmt.Errorf("size mismatch: expected %d, got %d", size, written)
+		return &SizeMismatchError{Hash: hash, Expected: size, Actual: written}
 	}
 
 	// Atomic move
@@ -112,6 +145,22 @@ func (b *LocalBackend) PutBlob(hash string, r io.Reader, size int64) error {
 	return nil
 }
 
+// verifyContent reads r and checks its hash and size
+func verifyContent(hash string, r io.Reader, size int64) error {
+	hasher := blake3.New()
+	written, err := io.Copy(hasher, r)
+	if err != nil {
+		return fmt.Errorf("failed to read blob: %w", err)
+	}
+	if actualHash := hex.EncodeToString(hasher.Sum(nil)); actualHash != hash {
+		return &HashMismatchError{Expected: hash, Actual: actualHash}
+	}
+	if size > 0 && written != size {
+		return &SizeMismatchError{Hash: hash, Expected: size, Actual: written}
+	}
+	return nil
+}
+
 // GetBlob retrieves a blob
 func (b *LocalBackend) GetBlob(hash string) (io.ReadCloser, error) {
 	path := b.blobFilePath(hash)
@@ -138,6 +187,11 @@ func (b *LocalBackend) HasBlob(hash string) (bool, error) {
 	return false, err
 }
 
+// HasBlobs checks blobs with concurrent stats
+func (b *LocalBackend) HasBlobs(hashes []string) (map[string]bool, error) {
+	return hasBlobs(hashes, localStatConcurrency, b.HasBlob)
+}
+
 // DeleteBlob removes a blob
 func (b *LocalBackend) DeleteBlob(hash string) error {
 	path := b.blobFilePath(hash)
@@ -168,6 +222,18 @@ func (b *LocalBackend) ListBlobs() ([]string, error) {
 	return hashes, err
 }
 
+// QuarantineBlob moves a blob to the quarantine directory
+func (b *LocalBackend) QuarantineBlob(hash string) error {
+	if err := os.MkdirAll(b.quarPath, 0755); err != nil {
+		return err
+	}
+	err := os.Rename(b.blobFilePath(hash), filepath.Join(b.quarPath, hash))
+	if os.IsNotExist(err) {
+		return &BlobNotFoundError{Hash: hash}
+	}
+	return err
+}
+
 // StatBlob returns metadata about a blob
 func (b *LocalBackend) StatBlob(hash string) (*BlobInfo, error) {
 	path := b.blobFilePath(hash)
@@ -265,6 +331,43 @@ func (b *LocalBackend) DeletePreview(project, slug string) error {
 	return nil
 }
 
+// ListRefs returns every ref file
+func (b *LocalBackend) ListRefs() ([]RefKey, error) {
+	return listJSON(b.refPath)
+}
+
+// ListPreviews returns every preview file
+func (b *LocalBackend) ListPreviews() ([]RefKey, error) {
+	return listJSON(b.prevPath)
+}
+
+// listJSON returns the <project>/<name>.json files under dir, skipping
+// temp files left by interrupted writes
+func listJSON(dir string) ([]RefKey, error) {
+	projects, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var keys []RefKey
+	for _, project := range projects {
+		if !project.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(dir, project.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			name, ok := strings.CutSuffix(f.Name(), ".json")
+			if f.IsDir() || !ok {
+				continue
+			}
+			keys = append(keys, RefKey{Project: project.Name(), Name: name})
+		}
+	}
+	return keys, nil
+}
+
 // PutRouting writes the routing index file
 func (b *LocalBackend) PutRouting(data []byte) error {
 	path := filepath.Join(b.basePath, "routing", "index.json")
@@ -292,13 +395,89 @@ func (b *LocalBackend) GetRouting() ([]byte, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, errors.New("routing index not found")
+			return nil, ErrRoutingNotFound
 		}
 		return nil, err
 	}
 	return data, nil
 }
 
+// GetLock reads a lock file. Its version is the hash of its content.
+func (b *LocalBackend) GetLock(name string) ([]byte, string, error) {
+	data, err := os.ReadFile(filepath.Join(b.lockPath, name+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, "", &LockNotFoundError{Name: name}
+		}
+		return nil, "", err
+	}
+	return data, lockVersion(data), nil
+}
+
+// PutLock replaces a lock file if it is still at version. A guard file
+// created with O_EXCL makes the check and the write atomic across
+// processes sharing the directory.
+func (b *LocalBackend) PutLock(name string, data []byte, version string) (string, error) {
+	path := filepath.Join(b.lockPath, name+".json")
+	release, err := b.guardLock(path + ".guard")
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	current, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		if version != "" {
+			return "", ErrLockConflict
+		}
+	case err != nil:
+		return "", err
+	case lockVersion(current) != version:
+		return "", ErrLockConflict
+	}
+
+	tmpPath := path + ".tmp." + uuid.New().String()
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return lockVersion(data), nil
+}
+
+// guardLock creates the guard file, waiting up to lockGuardWait for
+// another holder, and returns a func that removes it
+func (b *LocalBackend) guardLock(guard string) (func(), error) {
+	deadline := time.Now().Add(lockGuardWait)
+	for {
+		f, err := os.OpenFile(guard, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(guard) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(guard); err == nil && time.Since(info.ModTime()) > lockGuardStale {
+			os.Remove(guard)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrLockConflict
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// lockVersion identifies the content of a lock file
+func lockVersion(data []byte) string {
+	sum := blake3.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
 // GenerateUploadURL is not supported for local storage
 func (b *LocalBackend) GenerateUploadURL(hash, sha256Base64 string, size int64) (string, error) {
 	return "", errors.New("presigned URLs not supported for local storage")
@@ -333,6 +512,16 @@ func (e *HashMismatchError) Error() string {
 	return fmt.Sprintf("hash mismatch: expected %s, got %s", e.Expected, e.Actual)
 }
 
+type SizeMismatchError struct {
+	Hash     string
+	Expected int64
+	Actual   int64
+}
+
+func (e *SizeMismatchError) Error() string {
+	return fmt.Sprintf("size mismatch for %s: expected %d, got %d", e.Hash, e.Expected, e.Actual)
+}
+
 type BlobNotFoundError struct {
 	Hash string
 }
@@ -350,6 +539,14 @@ func (e *RefNotFoundError) Error() string {
 	return fmt.Sprintf("ref not found: %s/%s", e.Project, e.Env)
 }
 
+type LockNotFoundError struct {
+	Name string
+}
+
+func (e *LockNotFoundError) Error() string {
+	return fmt.Sprintf("lock not found: %s", e.Name)
+}
+
 type PreviewNotFoundError struct {
 	Project string
 	Slug    string
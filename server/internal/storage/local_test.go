@@ -2,11 +2,14 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/zeebo/blake3"
 )
@@ -110,6 +113,19 @@ func TestLocalBackend(t *testing.T) {
 		}
 	})
 
+	t.Run("SizeMismatch", func(t *testing.T) {
+		content := []byte("short content")
+		hash := computeHash(content)
+
+		err := backend.PutBlob(hash, bytes.NewReader(content), int64(len(content))+1)
+		if _, ok := err.(*SizeMismatchError); !ok {
+			t.Errorf("expected SizeMismatchError, got %T", err)
+		}
+		if exists, _ := backend.HasBlob(hash); exists {
+			t.Error("blob stored despite size mismatch")
+		}
+	})
+
 	t.Run("PutRef", func(t *testing.T) {
 		data := []byte(`{"image_id":"img_123","content_hash":"abc"}`)
 
@@ -185,9 +201,172 @@ func TestLocalBackend(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+
+		// Storing a blob again still requires its content
+		other := []byte("not the content")
+		err = backend.PutBlob(hash, bytes.NewReader(other), int64(len(other)))
+		if _, ok := err.(*HashMismatchError); !ok {
+			t.Errorf("expected HashMismatchError for existing blob, got %v", err)
+		}
+	})
+
+	t.Run("Lock", func(t *testing.T) {
+		if _, _, err := backend.GetLock("job"); !IsNotFound(err) {
+			t.Fatalf("GetLock on missing lock: %v", err)
+		}
+
+		v1, err := backend.PutLock("job", []byte(`{"holder":"a"}`), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Creating again must fail
+		if _, err := backend.PutLock("job", []byte(`{"holder":"b"}`), ""); !errors.Is(err, ErrLockConflict) {
+			t.Fatalf("second create: %v", err)
+		}
+
+		v2, err := backend.PutLock("job", []byte(`{"holder":"a","renewed":1}`), v1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A stale version must fail
+		if _, err := backend.PutLock("job", []byte(`{"holder":"b"}`), v1); !errors.Is(err, ErrLockConflict) {
+			t.Fatalf("stale update: %v", err)
+		}
+
+		data, version, err := backend.GetLock("job")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != v2 || string(data) != `{"holder":"a","renewed":1}` {
+			t.Errorf("GetLock = %s@%s, want second write@%s", data, version, v2)
+		}
+	})
+
+	t.Run("ListRefs", func(t *testing.T) {
+		// Left behind by an interrupted write
+		tmp := filepath.Join(tmpDir, "refs", "myproject", "beta.json.tmp.x")
+		if err := os.WriteFile(tmp, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		keys, err := backend.ListRefs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[RefKey]bool{{"myproject", "prod"}: true, {"gettest", "beta"}: true}
+		if len(keys) != len(want) {
+			t.Fatalf("ListRefs = %v", keys)
+		}
+		for _, key := range keys {
+			if !want[key] {
+				t.Errorf("unexpected ref %v", key)
+			}
+		}
+
+		previews, err := backend.ListPreviews()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(previews) != 1 || previews[0] != (RefKey{"myproject", "abc123"}) {
+			t.Errorf("ListPreviews = %v", previews)
+		}
+	})
+
+	t.Run("QuarantineBlob", func(t *testing.T) {
+		content := []byte("quarantined")
+		hash := computeHash(content)
+		if err := backend.PutBlob(hash, bytes.NewReader(content), int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := backend.QuarantineBlob(hash); err != nil {
+			t.Fatal(err)
+		}
+		if exists, _ := backend.HasBlob(hash); exists {
+			t.Error("quarantined blob still in the blob store")
+		}
+		if _, err := os.Stat(filepath.Join(tmpDir, "quarantine", hash)); err != nil {
+			t.Errorf("quarantined blob not kept: %v", err)
+		}
+		if err := backend.QuarantineBlob(hash); !IsNotFound(err) {
+			t.Errorf("quarantining a missing blob: %v", err)
+		}
+	})
+
+	t.Run("Ping", func(t *testing.T) {
+		if err := backend.Ping(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Ping must not leave anything in the blob store
+		hashes, err := backend.ListBlobs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, hash := range hashes {
+			if len(hash) != 64 {
+				t.Errorf("unexpected blob %q after ping", hash)
+			}
+		}
+	})
+
+	t.Run("PingFallback", func(t *testing.T) {
+		// Only the methods of Backend, as in backends written before Ping
+		var plain Backend = struct{ Backend }{backend}
+		if err := Ping(context.Background(), plain); err != nil {
+			t.Fatal(err)
+		}
+		release := make(chan struct{})
+		defer close(release)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := Ping(ctx, stalled{release: release}); err != context.Canceled {
+			t.Errorf("ping of a stalled backend: %v", err)
+		}
 	})
 }
 
+func TestAs(t *testing.T) {
+	local, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := As[Locker](WithKnownBlobs(local, 10, time.Hour)); !ok {
+		t.Error("wrapped local backend should hold locks")
+	}
+
+	// Wrappers implement Locker whatever they wrap
+	plain := WithKnownBlobs(struct{ Backend }{local}, 10, time.Hour)
+	if _, ok := plain.(Locker); !ok {
+		t.Fatal("wrapper should implement Locker")
+	}
+	if _, ok := As[Locker](plain); ok {
+		t.Error("wrapped backend without locks should not hold locks")
+	}
+	if _, _, err := GetLock(plain, "gc"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("GetLock through the wrapper: %v", err)
+	}
+
+	// Local storage does not stage uploads
+	if _, ok := As[UploadStager](WithKnownBlobs(local, 10, time.Hour)); ok {
+		t.Error("local backend should not stage uploads")
+	}
+	if err := CommitUpload(plain, "plan", "hash", 1); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("CommitUpload through the wrapper: %v", err)
+	}
+}
+
+// stalled is a backend whose existence checks wait for release
+type stalled struct {
+	Backend
+	release chan struct{}
+}
+
+func (s stalled) HasBlob(string) (bool, error) {
+	<-s.release
+	return false, nil
+}
+
 func computeHash(content []byte) string {
 	hasher := blake3.New()
 	if _, err := hasher.Write(content); err != nil {
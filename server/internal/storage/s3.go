@@ -3,15 +3,24 @@ package storage
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"os"
 	"path"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/google/uuid"
+	"github.com/zeebo/blake3"
 )
 
 // S3Backend implements storage using S3-compatible object storage
@@ -65,31 +74,183 @@ func (b *S3Backend) previewKey(project, slug string) string {
 	return path.Join("previews", project, slug+".json")
 }
 
+func (b *S3Backend) lockKey(name string) string {
+	return path.Join("locks", name+".json")
+}
+
 // BlobBasePath returns empty for S3 (not used directly)
 func (b *S3Backend) BlobBasePath() string {
 	return ""
 }
 
+// Ping checks access to the bucket with HeadBucket
+func (b *S3Backend) Ping(ctx context.Context) error {
+	_, err := b.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(b.bucket)})
+	return err
+}
+
 // UploadMode returns the upload mode for this backend
 func (b *S3Backend) UploadMode() string {
 	return "presigned"
 }
 
-// PutBlob uploads a blob to S3
+// uploadKey is where a presigned upload is kept until it is verified
+func (b *S3Backend) uploadKey(plan, hash string) string {
+	return path.Join("uploads", plan, hash)
+}
+
+// PutBlob hashes a blob, uploads it to a temporary key if the content
+// matches its hash and size, and copies it into place. The body is sent
+// seekable, as the SDK rewinds it to sign the payload on plain-HTTP
+// endpoints; bodies that cannot seek are spooled to a temporary file.
 func (b *S3Backend) PutBlob(hash string, r io.Reader, size int64) error {
 	ctx := context.Background()
 
-	input := &s3.PutObjectInput{
+	body, n, actual, cleanup, err := hashBody(r)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if size >= 0 && n != size {
+		return &SizeMismatchError{Hash: hash, Expected: size, Actual: n}
+	}
+	if actual != hash {
+		return &HashMismatchError{Expected: hash, Actual: actual}
+	}
+
+	tmpKey := path.Join("tmp", uuid.New().String())
+	// Also removes what a failed put may have left
+	defer b.deleteKey(tmpKey)
+	result, err := b.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(b.bucket),
+		Key:           aws.String(tmpKey),
+		Body:          body,
+		ContentLength: aws.Int64(n),
+	})
+	if err != nil {
+		return err
+	}
+	return b.copyToBlob(tmpKey, hash, result.ETag)
+}
+
+// hashBody returns r as a seekable body positioned where r was, with its
+// size and BLAKE3 hash. Readers that cannot seek are copied to a temporary
+// file, which cleanup removes.
+func hashBody(r io.Reader) (body io.ReadSeeker, n int64, hash string, cleanup func(), err error) {
+	cleanup = func() {}
+	hasher := blake3.New()
+
+	if rs, ok := r.(io.ReadSeeker); ok {
+		start, err := rs.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, 0, "", cleanup, err
+		}
+		if n, err = io.Copy(hasher, rs); err != nil {
+			return nil, 0, "", cleanup, err
+		}
+		if _, err := rs.Seek(start, io.SeekStart); err != nil {
+			return nil, 0, "", cleanup, err
+		}
+		return rs, n, hex.EncodeToString(hasher.Sum(nil)), cleanup, nil
+	}
+
+	f, err := os.CreateTemp("", "sitepod-blob-*")
+	if err != nil {
+		return nil, 0, "", cleanup, err
+	}
+	cleanup = func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if n, err = io.Copy(io.MultiWriter(f, hasher), r); err != nil {
+		return nil, 0, "", cleanup, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, "", cleanup, err
+	}
+	return f, n, hex.EncodeToString(hasher.Sum(nil)), cleanup, nil
+}
+
+// CommitUpload reads a presigned upload back, checks its size and BLAKE3
+// hash and copies it into the blob store. The upload is deleted once read,
+// whether or not it matched.
+func (b *S3Backend) CommitUpload(plan, hash string, size int64) error {
+	ctx := context.Background()
+	key := b.uploadKey(plan, hash)
+
+	result, err := b.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(b.bucket),
-		Key:    aws.String(b.blobKey(hash)),
-		Body:   r,
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isNoSuchKey(err) {
+			return &BlobNotFoundError{Hash: hash}
+		}
+		return err
+	}
+	hasher := blake3.New()
+	n, err := io.Copy(hasher, result.Body)
+	result.Body.Close()
+	if err != nil {
+		return err
+	}
+	defer b.deleteKey(key)
+
+	if n != size {
+		return &SizeMismatchError{Hash: hash, Expected: size, Actual: n}
 	}
-	if size >= 0 {
-		input.ContentLength = aws.Int64(size)
+	if actual := hex.EncodeToString(hasher.Sum(nil)); actual != hash {
+		return &HashMismatchError{Expected: hash, Actual: actual}
 	}
+	return b.copyToBlob(key, hash, result.ETag)
+}
 
-	_, err := b.client.PutObject(ctx, input)
+// copyToBlob copies a verified object into the blob store. The copy is
+// conditional on etag, so content replaced since it was verified is not
+// copied.
+func (b *S3Backend) copyToBlob(key, hash string, etag *string) error {
+	ctx := context.Background()
 
+	_, err := b.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(b.bucket),
+		Key:               aws.String(b.blobKey(hash)),
+		CopySource:        aws.String(path.Join(b.bucket, key)),
+		CopySourceIfMatch: etag,
+	})
+	if isPreconditionFailed(err) {
+		return ErrUploadChanged
+	}
+	return err
+}
+
+// DeleteUploads deletes the uploads of a plan that were never committed
+func (b *S3Backend) DeleteUploads(plan string) error {
+	ctx := context.Background()
+
+	paginator := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(path.Join("uploads", plan) + "/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			if err := b.deleteKey(aws.ToString(obj.Key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteKey deletes an object
+func (b *S3Backend) deleteKey(key string) error {
+	_, err := b.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
 	return err
 }
 
@@ -102,6 +263,9 @@ func (b *S3Backend) GetBlob(hash string) (io.ReadCloser, error) {
 		Key:    aws.String(b.blobKey(hash)),
 	})
 	if err != nil {
+		if isNoSuchKey(err) {
+			return nil, &BlobNotFoundError{Hash: hash}
+		}
 		return nil, err
 	}
 
@@ -126,6 +290,11 @@ func (b *S3Backend) HasBlob(hash string) (bool, error) {
 	return true, nil
 }
 
+// HasBlobs checks blobs with concurrent HEAD requests
+func (b *S3Backend) HasBlobs(hashes []string) (map[string]bool, error) {
+	return hasBlobs(hashes, s3HeadConcurrency, b.HasBlob)
+}
+
 // DeleteBlob removes a blob from S3
 func (b *S3Backend) DeleteBlob(hash string) error {
 	ctx := context.Background()
@@ -166,6 +335,24 @@ func (b *S3Backend) ListBlobs() ([]string, error) {
 	return hashes, nil
 }
 
+// QuarantineBlob copies a blob to quarantine/<hash> and deletes the original
+func (b *S3Backend) QuarantineBlob(hash string) error {
+	ctx := context.Background()
+
+	_, err := b.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(b.bucket),
+		Key:        aws.String(path.Join("quarantine", hash)),
+		CopySource: aws.String(path.Join(b.bucket, b.blobKey(hash))),
+	})
+	if err != nil {
+		if isNoSuchKey(err) {
+			return &BlobNotFoundError{Hash: hash}
+		}
+		return err
+	}
+	return b.DeleteBlob(hash)
+}
+
 // StatBlob returns metadata about a blob
 func (b *S3Backend) StatBlob(hash string) (*BlobInfo, error) {
 	ctx := context.Background()
@@ -175,6 +362,10 @@ func (b *S3Backend) StatBlob(hash string) (*BlobInfo, error) {
 		Key:    aws.String(b.blobKey(hash)),
 	})
 	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return nil, &BlobNotFoundError{Hash: hash}
+		}
 		return nil, err
 	}
 
@@ -208,6 +399,9 @@ func (b *S3Backend) GetRef(project, env string) ([]byte, error) {
 		Key:    aws.String(b.refKey(project, env)),
 	})
 	if err != nil {
+		if isNoSuchKey(err) {
+			return nil, &RefNotFoundError{Project: project, Env: env}
+		}
 		return nil, err
 	}
 	defer result.Body.Close()
@@ -250,6 +444,9 @@ func (b *S3Backend) GetPreview(project, slug string) ([]byte, error) {
 		Key:    aws.String(b.previewKey(project, slug)),
 	})
 	if err != nil {
+		if isNoSuchKey(err) {
+			return nil, &PreviewNotFoundError{Project: project, Slug: slug}
+		}
 		return nil, err
 	}
 	defer result.Body.Close()
@@ -269,6 +466,48 @@ func (b *S3Backend) DeletePreview(project, slug string) error {
 	return err
 }
 
+// ListRefs returns every ref object
+func (b *S3Backend) ListRefs() ([]RefKey, error) {
+	return b.listJSON("refs/")
+}
+
+// ListPreviews returns every preview object
+func (b *S3Backend) ListPreviews() ([]RefKey, error) {
+	return b.listJSON("previews/")
+}
+
+// listJSON returns the <prefix><project>/<name>.json objects
+func (b *S3Backend) listJSON(prefix string) ([]RefKey, error) {
+	ctx := context.Background()
+	var keys []RefKey
+
+	paginator := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range page.Contents {
+			parts := strings.Split(strings.TrimPrefix(*obj.Key, prefix), "/")
+			if len(parts) != 2 {
+				continue
+			}
+			name, ok := strings.CutSuffix(parts[1], ".json")
+			if !ok {
+				continue
+			}
+			keys = append(keys, RefKey{Project: parts[0], Name: name})
+		}
+	}
+
+	return keys, nil
+}
+
 // PutRouting writes the routing index file
 func (b *S3Backend) PutRouting(data []byte) error {
 	ctx := context.Background()
@@ -292,6 +531,9 @@ func (b *S3Backend) GetRouting() ([]byte, error) {
 		Key:    aws.String("routing/index.json"),
 	})
 	if err != nil {
+		if isNoSuchKey(err) {
+			return nil, ErrRoutingNotFound
+		}
 		return nil, err
 	}
 	defer result.Body.Close()
@@ -299,13 +541,68 @@ func (b *S3Backend) GetRouting() ([]byte, error) {
 	return io.ReadAll(result.Body)
 }
 
-// GenerateUploadURL generates a presigned URL for uploading
+// GetLock reads a lock object. Its version is the object's ETag.
+func (b *S3Backend) GetLock(name string) ([]byte, string, error) {
+	ctx := context.Background()
+
+	result, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.lockKey(name)),
+	})
+	if err != nil {
+		if isNoSuchKey(err) {
+			return nil, "", &LockNotFoundError{Name: name}
+		}
+		return nil, "", err
+	}
+	defer result.Body.Close()
+
+	data, err := io.ReadAll(result.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, aws.ToString(result.ETag), nil
+}
+
+// PutLock writes a lock object with a conditional put: If-None-Match: *
+// to create it, If-Match: <etag> to replace it. The SDK version in use
+// has no fields for these headers, so they are added to the request.
+func (b *S3Backend) PutLock(name string, data []byte, version string) (string, error) {
+	ctx := context.Background()
+
+	condition := smithyhttp.SetHeaderValue("If-None-Match", "*")
+	if version != "" {
+		condition = smithyhttp.SetHeaderValue("If-Match", version)
+	}
+	result, err := b.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(b.bucket),
+		Key:         aws.String(b.lockKey(name)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	}, s3.WithAPIOptions(condition))
+	if err != nil {
+		if isPreconditionFailed(err) {
+			return "", ErrLockConflict
+		}
+		return "", err
+	}
+	return aws.ToString(result.ETag), nil
+}
+
+// GenerateUploadURL is not supported: S3 uploads are staged per plan with
+// GeneratePlanUploadURL, so they are verified before entering the blob store
 func (b *S3Backend) GenerateUploadURL(hash, sha256Base64 string, size int64) (string, error) {
+	return "", errors.New("S3 uploads are staged per plan, use GeneratePlanUploadURL")
+}
+
+// GeneratePlanUploadURL generates a presigned URL for uploading a blob of a
+// plan. The blob lands under uploads/ until CommitUpload verifies it.
+func (b *S3Backend) GeneratePlanUploadURL(plan, hash, sha256Base64 string, size int64) (string, error) {
 	ctx := context.Background()
 
 	input := &s3.PutObjectInput{
 		Bucket:        aws.String(b.bucket),
-		Key:           aws.String(b.blobKey(hash)),
+		Key:           aws.String(b.uploadKey(plan, hash)),
 		ContentLength: aws.Int64(size),
 	}
 
@@ -322,3 +619,19 @@ func (b *S3Backend) GenerateUploadURL(hash, sha256Base64 string, size int64) (st
 
 	return presignResult.URL, nil
 }
+
+// isNoSuchKey reports whether err is S3's missing-object error
+func isNoSuchKey(err error) bool {
+	var nsk *types.NoSuchKey
+	return errors.As(err, &nsk)
+}
+
+// isPreconditionFailed reports whether a conditional write lost: 412, or
+// 409 when a concurrent conditional write to the same key is in progress
+func isPreconditionFailed(err error) bool {
+	var re *awshttp.ResponseError
+	if !errors.As(err, &re) {
+		return false
+	}
+	return re.HTTPStatusCode() == http.StatusPreconditionFailed || re.HTTPStatusCode() == http.StatusConflict
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is a plain-HTTP, path-style S3 endpoint keeping objects in memory.
+// Requests for keys under fail get 403.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	fail    string
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// /{bucket}/{key}
+	_, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if s.fail != "" && strings.HasPrefix(key, s.fail) && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			_, srcKey, _ := strings.Cut(strings.TrimPrefix(src, "/"), "/")
+			data, ok := s.objects[srcKey]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			s.objects[key] = data
+			io.WriteString(w, `<CopyObjectResult><ETag>"etag"</ETag></CopyObjectResult>`)
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = data
+		w.Header().Set("ETag", `"etag"`)
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// failAt makes requests for keys under prefix fail
+func (s *fakeS3) failAt(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = prefix
+}
+
+// keys returns the stored keys with prefix
+func (s *fakeS3) keys(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestS3PutBlob(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	backend, err := NewS3Backend("bucket", "us-east-1", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("served over plain http")
+	hash := computeHash(content)
+
+	// Request bodies cannot seek; the signer still needs to rewind them
+	body := struct{ io.Reader }{bytes.NewReader(content)}
+	if err := backend.PutBlob(hash, body, int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if keys := fake.keys(backend.blobKey(hash)); len(keys) != 1 || !bytes.Equal(fake.objects[keys[0]], content) {
+		t.Errorf("blob not stored: %v", keys)
+	}
+
+	if err := backend.PutBlob(hash, bytes.NewReader(content), int64(len(content))+1); err == nil {
+		t.Error("expected a size mismatch")
+	}
+	if err := backend.PutBlob(computeHash([]byte("other")), bytes.NewReader(content), -1); err == nil {
+		t.Error("expected a hash mismatch")
+	}
+
+	// Failed puts and copies leave no temporary objects
+	for _, fail := range []string{"tmp/", "blobs/"} {
+		fake.failAt(fail)
+		other := []byte("fails at " + fail)
+		if err := backend.PutBlob(computeHash(other), bytes.NewReader(other), int64(len(other))); err == nil {
+			t.Errorf("expected an error when %s fails", fail)
+		}
+	}
+	if keys := fake.keys("tmp/"); len(keys) != 0 {
+		t.Errorf("temporary objects left: %v", keys)
+	}
+}
@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"io"
 	"time"
 )
@@ -46,6 +48,245 @@ type Backend interface {
 	BlobBasePath() string
 }
 
+// BatchChecker is implemented by backends that check many blobs at once
+type BatchChecker interface {
+	// HasBlobs returns which of hashes exist
+	HasBlobs(hashes []string) (map[string]bool, error)
+}
+
+// HasBlobs returns which of hashes exist in b, in one batch if b and the
+// backends it wraps are BatchCheckers and with one HasBlob call per hash
+// otherwise
+func HasBlobs(b Backend, hashes []string) (map[string]bool, error) {
+	if bc, ok := As[BatchChecker](b); ok {
+		return bc.HasBlobs(hashes)
+	}
+	return hasBlobs(hashes, 1, b.HasBlob)
+}
+
+// Pinger is implemented by backends that check their health cheaply
+type Pinger interface {
+	// Ping checks that the backend is reachable and writable without
+	// scanning its contents. It is called by readiness probes.
+	Ping(ctx context.Context) error
+}
+
+// pingHash is the blob Ping looks up in backends that are not Pingers
+const pingHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// Ping checks that b is reachable. Backends that are not Pingers, or wrap
+// one that is not, are probed by looking up a blob with HasBlob, which does
+// not check that they are writable.
+func Ping(ctx context.Context, b Backend) error {
+	if p, ok := As[Pinger](b); ok {
+		return p.Ping(ctx)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := b.HasBlob(pingHash)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Locker is implemented by backends that hold lock objects, the leases
+// shared by every instance using the storage. Without it instances cannot
+// take turns: GC must be enabled on one instance only.
+type Locker interface {
+	// GetLock returns a lock and its version. PutLock replaces a lock only
+	// if its version is still version, or creates it if version is empty,
+	// and returns the new version; otherwise it fails with ErrLockConflict.
+	GetLock(name string) (data []byte, version string, err error)
+	PutLock(name string, data []byte, version string) (string, error)
+}
+
+// GetLock reads a lock from b, failing with errors.ErrUnsupported if b is
+// not a Locker
+func GetLock(b Backend, name string) ([]byte, string, error) {
+	l, ok := b.(Locker)
+	if !ok {
+		return nil, "", errors.ErrUnsupported
+	}
+	return l.GetLock(name)
+}
+
+// PutLock writes a lock to b, failing with errors.ErrUnsupported if b is
+// not a Locker
+func PutLock(b Backend, name string, data []byte, version string) (string, error) {
+	l, ok := b.(Locker)
+	if !ok {
+		return "", errors.ErrUnsupported
+	}
+	return l.PutLock(name, data, version)
+}
+
+// Lister is implemented by backends that list refs and previews. Without
+// it fsck checks the refs and previews of existing projects only and
+// cannot find those of deleted projects.
+type Lister interface {
+	// ListRefs and ListPreviews return every ref or preview in storage,
+	// including those of projects that no longer exist
+	ListRefs() ([]RefKey, error)
+	ListPreviews() ([]RefKey, error)
+}
+
+// ListRefs lists the refs in b, failing with errors.ErrUnsupported if b is
+// not a Lister
+func ListRefs(b Backend) ([]RefKey, error) {
+	l, ok := b.(Lister)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return l.ListRefs()
+}
+
+// ListPreviews lists the previews in b, failing with errors.ErrUnsupported
+// if b is not a Lister
+func ListPreviews(b Backend) ([]RefKey, error) {
+	l, ok := b.(Lister)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return l.ListPreviews()
+}
+
+// Quarantiner is implemented by backends that can set corrupt blobs
+// aside. Without it fsck only reports corrupt blobs.
+type Quarantiner interface {
+	// QuarantineBlob moves a blob out of the blob store, so it is no
+	// longer served or reused, and keeps it under quarantine/ for
+	// inspection
+	QuarantineBlob(hash string) error
+}
+
+// QuarantineBlob quarantines a blob in b, failing with
+// errors.ErrUnsupported if b is not a Quarantiner
+func QuarantineBlob(b Backend, hash string) error {
+	q, ok := b.(Quarantiner)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return q.QuarantineBlob(hash)
+}
+
+// UploadStager is implemented by remote backends that keep presigned
+// uploads apart from the blob store, per plan, until CommitUpload has
+// checked their size and BLAKE3 hash, so unverified content is never
+// served or reused. Without it plans upload through the API instead,
+// which verifies blobs as they are stored.
+type UploadStager interface {
+	// GeneratePlanUploadURL returns a presigned URL staging a blob for plan
+	GeneratePlanUploadURL(plan, hash, sha256Base64 string, size int64) (string, error)
+	// CommitUpload verifies a staged blob and moves it into the blob store
+	CommitUpload(plan, hash string, size int64) error
+	// DeleteUploads deletes the staged blobs of a plan never committed
+	DeleteUploads(plan string) error
+}
+
+// GeneratePlanUploadURL returns a presigned URL staging a blob for plan in
+// b, failing with errors.ErrUnsupported if b is not an UploadStager
+func GeneratePlanUploadURL(b Backend, plan, hash, sha256Base64 string, size int64) (string, error) {
+	s, ok := b.(UploadStager)
+	if !ok {
+		return "", errors.ErrUnsupported
+	}
+	return s.GeneratePlanUploadURL(plan, hash, sha256Base64, size)
+}
+
+// CommitUpload commits a staged blob of plan in b, failing with
+// errors.ErrUnsupported if b is not an UploadStager
+func CommitUpload(b Backend, plan, hash string, size int64) error {
+	s, ok := b.(UploadStager)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return s.CommitUpload(plan, hash, size)
+}
+
+// DeleteUploads deletes the staged blobs of plan in b, failing with
+// errors.ErrUnsupported if b is not an UploadStager
+func DeleteUploads(b Backend, plan string) error {
+	s, ok := b.(UploadStager)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return s.DeleteUploads(plan)
+}
+
+// Wrapper is implemented by backends that wrap another one, such as
+// instrumentation. Wrappers implement every optional interface and pass
+// calls on to the backend they wrap.
+type Wrapper interface {
+	Unwrap() Backend
+}
+
+// As returns b as the optional interface T if b and every backend it wraps
+// implement T, so calls through the wrappers reach a backend that has
+// the methods
+func As[T any](b Backend) (T, bool) {
+	t, ok := b.(T)
+	for inner := b; ok; {
+		w, isWrapper := inner.(Wrapper)
+		if !isWrapper {
+			break
+		}
+		inner = w.Unwrap()
+		_, ok = inner.(T)
+	}
+	return t, ok
+}
+
+// ContextBackend is implemented by backends and wrappers that can tie
+// their calls to a context, such as the request being served
+type ContextBackend interface {
+	WithContext(ctx context.Context) Backend
+}
+
+// WithContext returns a view of b whose calls belong to ctx, e.g. so they
+// are traced as children of the request span in ctx. Backends that do not
+// implement ContextBackend are returned unchanged.
+func WithContext(b Backend, ctx context.Context) Backend {
+	if cb, ok := b.(ContextBackend); ok {
+		return cb.WithContext(ctx)
+	}
+	return b
+}
+
+// ErrLockConflict is returned by PutLock when the lock was changed or
+// created by someone else since it was read
+var ErrLockConflict = errors.New("storage: lock changed concurrently")
+
+// ErrUploadChanged is returned by CommitUpload when the upload was
+// replaced while it was being verified
+var ErrUploadChanged = errors.New("storage: upload changed while being verified")
+
+// ErrRoutingNotFound is returned by GetRouting before the routing index
+// has been written
+var ErrRoutingNotFound = errors.New("routing index not found")
+
+// IsNotFound reports whether err means a blob, ref, preview, lock or the
+// routing index does not exist
+func IsNotFound(err error) bool {
+	var blob *BlobNotFoundError
+	var ref *RefNotFoundError
+	var preview *PreviewNotFoundError
+	var lock *LockNotFoundError
+	return errors.As(err, &blob) || errors.As(err, &ref) || errors.As(err, &preview) || errors.As(err, &lock) ||
+		errors.Is(err, ErrRoutingNotFound)
+}
+
+// RefKey names a ref or a preview: Name is the environment of a ref and
+// the slug of a preview
+type RefKey struct {
+	Project string `json:"project"`
+	Name    string `json:"name"`
+}
+
 // FileEntry represents a file in a manifest
 type FileEntry struct {
 	Hash        string `json:"hash"`
@@ -53,18 +294,24 @@ type FileEntry struct {
 	ContentType string `json:"content_type,omitempty"`
 }
 
-// RefData represents the content of a ref file
+// RefData represents the content of a ref file. ManifestHash names the
+// manifest object of the image; refs written before manifests were stored
+// as objects carry the Manifest inline instead. Readers resolve the
+// object into Manifest.
 type RefData struct {
-	ImageID     string               `json:"image_id"`
-	ContentHash string               `json:"content_hash"`
-	Manifest    map[string]FileEntry `json:"manifest"`
-	UpdatedAt   time.Time            `json:"updated_at"`
+	ImageID      string               `json:"image_id"`
+	ContentHash  string               `json:"content_hash"`
+	ManifestHash string               `json:"manifest_hash,omitempty"`
+	Manifest     map[string]FileEntry `json:"manifest,omitempty"`
+	UpdatedAt    time.Time            `json:"updated_at"`
 }
 
-// PreviewRef represents a preview deployment
+// PreviewRef represents a preview deployment. Its manifest is stored as
+// in RefData.
 type PreviewRef struct {
-	ImageID   string               `json:"image_id"`
-	Manifest  map[string]FileEntry `json:"manifest"`
-	ExpiresAt time.Time            `json:"expires_at"`
-	CreatedAt time.Time            `json:"created_at"`
+	ImageID      string               `json:"image_id"`
+	ManifestHash string               `json:"manifest_hash,omitempty"`
+	Manifest     map[string]FileEntry `json:"manifest,omitempty"`
+	ExpiresAt    time.Time            `json:"expires_at"`
+	CreatedAt    time.Time            `json:"created_at"`
 }
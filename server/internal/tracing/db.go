@@ -0,0 +1,77 @@
+package tracing
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxStatementLen bounds the db.statement attribute
+const maxStatementLen = 2048
+
+// InstrumentDB records queries and statements run on db as children of the
+// span in their context. Queries run without one, as PocketBase's record
+// helpers do, are not traced. Existing log hooks keep being called.
+//
+// dbx reports a query once it has finished, so spans are created after the
+// fact with their start time set from the reported duration.
+func (p *Provider) InstrumentDB(db *dbx.DB) {
+	if p == nil || db == nil {
+		return
+	}
+
+	prevQuery := db.QueryLogFunc
+	db.QueryLogFunc = func(ctx context.Context, t time.Duration, sql string, rows *sql.Rows, err error) {
+		p.recordQuery(ctx, t, sql, err)
+		if prevQuery != nil {
+			prevQuery(ctx, t, sql, rows, err)
+		}
+	}
+
+	prevExec := db.ExecLogFunc
+	db.ExecLogFunc = func(ctx context.Context, t time.Duration, sql string, result sql.Result, err error) {
+		p.recordQuery(ctx, t, sql, err)
+		if prevExec != nil {
+			prevExec(ctx, t, sql, result, err)
+		}
+	}
+}
+
+func (p *Provider) recordQuery(ctx context.Context, t time.Duration, statement string, err error) {
+	end := time.Now()
+	span := p.startChild(ctx, queryName(statement),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(end.Add(-t)),
+		trace.WithAttributes(
+			attribute.String("db.system", "sqlite"),
+			attribute.String("db.statement", truncate(statement, maxStatementLen)),
+		),
+	)
+	if err != nil && err != sql.ErrNoRows {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+// queryName names a span after the statement's operation, e.g. "db.SELECT"
+func queryName(statement string) string {
+	op, _, _ := strings.Cut(strings.TrimSpace(statement), " ")
+	if op == "" {
+		return "db.query"
+	}
+	return "db." + strings.ToUpper(op)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,227 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/sitepod/sitepod/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentStorage wraps a storage backend so calls made through a view
+// from storage.WithContext are recorded as children of the span in its
+// context. Calls without one are not traced. It returns b unchanged if p
+// is nil.
+func (p *Provider) InstrumentStorage(b storage.Backend, name string) storage.Backend {
+	if p == nil {
+		return b
+	}
+	return &tracedStorage{next: b, p: p, name: name}
+}
+
+type tracedStorage struct {
+	next storage.Backend
+	p    *Provider
+	name string
+	ctx  context.Context
+}
+
+// Unwrap returns the wrapped backend
+func (s *tracedStorage) Unwrap() storage.Backend {
+	return s.next
+}
+
+// WithContext returns a view that traces its calls under the span in ctx
+func (s *tracedStorage) WithContext(ctx context.Context) storage.Backend {
+	return &tracedStorage{next: storage.WithContext(s.next, ctx), p: s.p, name: s.name, ctx: ctx}
+}
+
+func (s *tracedStorage) start(op string, attrs ...attribute.KeyValue) trace.Span {
+	attrs = append(attrs, attribute.String("sitepod.storage.backend", s.name))
+	return s.p.startChild(s.ctx, "storage."+op, trace.WithAttributes(attrs...))
+}
+
+// isNotFound reports errors that are part of normal operation
+func isNotFound(err error) bool {
+	return storage.IsNotFound(err)
+}
+
+func blobAttr(hash string) attribute.KeyValue {
+	return attribute.String("sitepod.blob.hash", hash)
+}
+
+func planAttr(plan string) attribute.KeyValue {
+	return attribute.String("sitepod.plan", plan)
+}
+
+func refAttrs(project, env string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("sitepod.project", project),
+		attribute.String("sitepod.env", env),
+	}
+}
+
+func (s *tracedStorage) PutBlob(hash string, r io.Reader, size int64) (err error) {
+	span := s.start("PutBlob", blobAttr(hash), attribute.Int64("sitepod.blob.size", size))
+	defer func() { endSpan(span, err, nil) }()
+	return s.next.PutBlob(hash, r, size)
+}
+
+func (s *tracedStorage) GetBlob(hash string) (rc io.ReadCloser, err error) {
+	span := s.start("GetBlob", blobAttr(hash))
+	defer func() { endSpan(span, err, isNotFound) }()
+	return s.next.GetBlob(hash)
+}
+
+func (s *tracedStorage) HasBlob(hash string) (ok bool, err error) {
+	span := s.start("HasBlob", blobAttr(hash))
+	defer func() { endSpan(span, err, nil) }()
+	return s.next.HasBlob(hash)
+}
+
+func (s *tracedStorage) HasBlobs(hashes []string) (found map[string]bool, err error) {
+	span := s.start("HasBlobs", attribute.Int("sitepod.blob.count", len(hashes)))
+	defer func() { endSpan(span, err, nil) }()
+	return storage.HasBlobs(s.next, hashes)
+}
+
+func (s *tracedStorage) DeleteBlob(hash string) (err error) {
+	span := s.start("DeleteBlob", blobAttr(hash))
+	defer func() { endSpan(span, err, isNotFound) }()
+	return s.next.DeleteBlob(hash)
+}
+
+func (s *tracedStorage) ListBlobs() (hashes []string, err error) {
+	span := s.start("ListBlobs")
+	defer func() { endSpan(span, err, nil) }()
+	return s.next.ListBlobs()
+}
+
+func (s *tracedStorage) StatBlob(hash string) (info *storage.BlobInfo, err error) {
+	span := s.start("StatBlob", blobAttr(hash))
+	defer func() { endSpan(span, err, isNotFound) }()
+	return s.next.StatBlob(hash)
+}
+
+func (s *tracedStorage) QuarantineBlob(hash string) (err error) {
+	span := s.start("QuarantineBlob", blobAttr(hash))
+	defer func() { endSpan(span, err, nil) }()
+	return storage.QuarantineBlob(s.next, hash)
+}
+
+func (s *tracedStorage) PutRef(project, env string, data []byte) (err error) {
+	span := s.start("PutRef", refAttrs(project, env)...)
+	defer func() { endSpan(span, err, nil) }()
+	return s.next.PutRef(project, env, data)
+}
+
+func (s *tracedStorage) GetRef(project, env string) (data []byte, err error) {
+	span := s.start("GetRef", refAttrs(project, env)...)
+	defer func() { endSpan(span, err, isNotFound) }()
+	return s.next.GetRef(project, env)
+}
+
+func (s *tracedStorage) DeleteRef(project, env string) (err error) {
+	span := s.start("DeleteRef", refAttrs(project, env)...)
+	defer func() { endSpan(span, err, isNotFound) }()
+	return s.next.DeleteRef(project, env)
+}
+
+func (s *tracedStorage) PutPreview(project, slug string, data []byte) (err error) {
+	span := s.start("PutPreview", attribute.String("sitepod.project", project), attribute.String("sitepod.preview", slug))
+	defer func() { endSpan(span, err, nil) }()
+	return s.next.PutPreview(project, slug, data)
+}
+
+func (s *tracedStorage) GetPreview(project, slug string) (data []byte, err error) {
+	span := s.start("GetPreview", attribute.String("sitepod.project", project), attribute.String("sitepod.preview", slug))
+	defer func() { endSpan(span, err, isNotFound) }()
+	return s.next.GetPreview(project, slug)
+}
+
+func (s *tracedStorage) DeletePreview(project, slug string) (err error) {
+	span := s.start("DeletePreview", attribute.String("sitepod.project", project), attribute.String("sitepod.preview", slug))
+	defer func() { endSpan(span, err, isNotFound) }()
+	return s.next.DeletePreview(project, slug)
+}
+
+func (s *tracedStorage) ListRefs() (keys []storage.RefKey, err error) {
+	span := s.start("ListRefs")
+	defer func() { endSpan(span, err, nil) }()
+	return storage.ListRefs(s.next)
+}
+
+func (s *tracedStorage) ListPreviews() (keys []storage.RefKey, err error) {
+	span := s.start("ListPreviews")
+	defer func() { endSpan(span, err, nil) }()
+	return storage.ListPreviews(s.next)
+}
+
+func (s *tracedStorage) PutRouting(data []byte) (err error) {
+	span := s.start("PutRouting")
+	defer func() { endSpan(span, err, nil) }()
+	return s.next.PutRouting(data)
+}
+
+func (s *tracedStorage) GetRouting() (data []byte, err error) {
+	span := s.start("GetRouting")
+	defer func() { endSpan(span, err, isNotFound) }()
+	return s.next.GetRouting()
+}
+
+func (s *tracedStorage) GetLock(name string) (data []byte, version string, err error) {
+	span := s.start("GetLock", attribute.String("sitepod.lock", name))
+	defer func() { endSpan(span, err, isNotFound) }()
+	return storage.GetLock(s.next, name)
+}
+
+func (s *tracedStorage) PutLock(name string, data []byte, version string) (newVersion string, err error) {
+	span := s.start("PutLock", attribute.String("sitepod.lock", name))
+	defer func() { endSpan(span, err, isLockConflict) }()
+	return storage.PutLock(s.next, name, data, version)
+}
+
+// isLockConflict reports a lost lease race, which is expected
+func isLockConflict(err error) bool {
+	return errors.Is(err, storage.ErrLockConflict)
+}
+
+func (s *tracedStorage) GenerateUploadURL(hash, sha256Base64 string, size int64) (url string, err error) {
+	span := s.start("GenerateUploadURL", blobAttr(hash))
+	defer func() { endSpan(span, err, nil) }()
+	return s.next.GenerateUploadURL(hash, sha256Base64, size)
+}
+
+func (s *tracedStorage) GeneratePlanUploadURL(plan, hash, sha256Base64 string, size int64) (url string, err error) {
+	span := s.start("GeneratePlanUploadURL", planAttr(plan), blobAttr(hash))
+	defer func() { endSpan(span, err, nil) }()
+	return storage.GeneratePlanUploadURL(s.next, plan, hash, sha256Base64, size)
+}
+
+func (s *tracedStorage) CommitUpload(plan, hash string, size int64) (err error) {
+	span := s.start("CommitUpload", planAttr(plan), blobAttr(hash), attribute.Int64("sitepod.blob.size", size))
+	defer func() { endSpan(span, err, isNotFound) }()
+	return storage.CommitUpload(s.next, plan, hash, size)
+}
+
+func (s *tracedStorage) DeleteUploads(plan string) (err error) {
+	span := s.start("DeleteUploads", planAttr(plan))
+	defer func() { endSpan(span, err, nil) }()
+	return storage.DeleteUploads(s.next, plan)
+}
+
+func (s *tracedStorage) Ping(ctx context.Context) (err error) {
+	span := s.p.startChild(ctx, "storage.Ping", trace.WithAttributes(attribute.String("sitepod.storage.backend", s.name)))
+	defer func() { endSpan(span, err, nil) }()
+	return storage.Ping(ctx, s.next)
+}
+
+func (s *tracedStorage) UploadMode() string {
+	return s.next.UploadMode()
+}
+
+func (s *tracedStorage) BlobBasePath() string {
+	return s.next.BlobBasePath()
+}
@@ -0,0 +1,180 @@
+// Package tracing provides OpenTelemetry spans for SitePod's API handlers,
+// static serving, storage calls and PocketBase queries.
+//
+// All methods are safe to call on a nil *Provider, which traces nothing.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/sitepod/sitepod"
+
+// Config configures span export over OTLP/gRPC. Standard OTEL_EXPORTER_OTLP_*
+// environment variables apply to anything not set here.
+type Config struct {
+	// Endpoint is the collector address (host:port)
+	Endpoint string `json:"endpoint,omitempty"`
+	// Insecure disables TLS to the collector
+	Insecure bool `json:"insecure,omitempty"`
+	// Headers are sent with every export request (e.g. API keys)
+	Headers map[string]string `json:"headers,omitempty"`
+	// SampleRatio is the fraction of new traces to sample (default 1).
+	// Requests with a sampled traceparent are always traced.
+	SampleRatio *float64 `json:"sample_ratio,omitempty"`
+	// ServiceName is reported as service.name (default "sitepod")
+	ServiceName string `json:"service_name,omitempty"`
+}
+
+// Validate checks the configuration
+func (c *Config) Validate() error {
+	if c.SampleRatio != nil && (*c.SampleRatio < 0 || *c.SampleRatio > 1) {
+		return fmt.Errorf("tracing: sample_ratio must be between 0 and 1, got %v", *c.SampleRatio)
+	}
+	return nil
+}
+
+// Provider creates SitePod's spans and owns the exporter pipeline
+type Provider struct {
+	tp         *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// New creates a provider exporting to an OTLP/gRPC collector
+func New(ctx context.Context, cfg Config) (*Provider, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	var opts []otlptracegrpc.Option
+	if cfg.Endpoint != "" {
+		opts = append(opts, otlptracegrpc.WithEndpoint(cfg.Endpoint))
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, otlptracegrpc.WithHeaders(cfg.Headers))
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP exporter: %w", err)
+	}
+
+	return NewWithSpanProcessor(sdktrace.NewBatchSpanProcessor(exporter), cfg)
+}
+
+// NewWithSpanProcessor creates a provider that sends spans to sp.
+// Tests use it with a synchronous processor and an in-memory exporter.
+func NewWithSpanProcessor(sp sdktrace.SpanProcessor, cfg Config) (*Provider, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "sitepod"
+	}
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, err
+	}
+
+	ratio := 1.0
+	if cfg.SampleRatio != nil {
+		ratio = *cfg.SampleRatio
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(sp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	return &Provider{
+		tp:         tp,
+		tracer:     tp.Tracer(instrumentationName),
+		propagator: propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+	}, nil
+}
+
+// Shutdown flushes pending spans and stops the exporter
+func (p *Provider) Shutdown(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	return p.tp.Shutdown(ctx)
+}
+
+// StartRequest starts a server span for an incoming request. The parent is
+// the span already in the request context (e.g. from Caddy's tracing
+// directive) or else the remote span in the traceparent header.
+func (p *Provider) StartRequest(r *http.Request, name string, attrs ...attribute.KeyValue) (*http.Request, trace.Span) {
+	if p == nil {
+		return r, trace.SpanFromContext(r.Context())
+	}
+
+	ctx := r.Context()
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = p.propagator.Extract(ctx, propagation.HeaderCarrier(r.Header))
+	}
+
+	attrs = append(attrs,
+		attribute.String("http.request.method", r.Method),
+		attribute.String("url.path", r.URL.Path),
+		attribute.String("server.address", r.Host),
+	)
+	ctx, span := p.tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...),
+	)
+	return r.WithContext(ctx), span
+}
+
+// EndRequest records the response status and attrs on a span started by
+// StartRequest and ends it
+func (p *Provider) EndRequest(span trace.Span, status int, err error, attrs ...attribute.KeyValue) {
+	if p == nil {
+		return
+	}
+	span.SetAttributes(append(attrs, attribute.Int("http.response.status_code", status))...)
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+		if err != nil {
+			span.RecordError(err)
+		}
+	}
+	span.End()
+}
+
+// startChild starts a span under the span in ctx. Without a recording
+// span there, it returns a non-recording span.
+func (p *Provider) startChild(ctx context.Context, name string, opts ...trace.SpanStartOption) trace.Span {
+	if p == nil || ctx == nil || !trace.SpanFromContext(ctx).IsRecording() {
+		return trace.SpanFromContext(context.Background())
+	}
+	_, span := p.tracer.Start(ctx, name, opts...)
+	return span
+}
+
+// endSpan records err (if any) on span and ends it. ignore reports errors
+// that are part of normal operation, such as not found.
+func endSpan(span trace.Span, err error, ignore func(error) bool) {
+	if err != nil && (ignore == nil || !ignore(err)) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,142 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sitepod/sitepod/internal/storage"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestProvider(t *testing.T) (*Provider, *tracetest.InMemoryExporter) {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	p, err := NewWithSpanProcessor(sdktrace.NewSimpleSpanProcessor(exporter), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, exporter
+}
+
+func spanNamed(spans tracetest.SpanStubs, name string) *tracetest.SpanStub {
+	for i := range spans {
+		if spans[i].Name == name {
+			return &spans[i]
+		}
+	}
+	return nil
+}
+
+func TestRequestSpans(t *testing.T) {
+	p, exporter := newTestProvider(t)
+
+	dir, err := os.MkdirTemp("", "sitepod-tracing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend, err := storage.NewLocalBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Views pass the context through wrappers above the traced backend
+	s := storage.WithKnownBlobs(p.InstrumentStorage(backend, "local"), 10, time.Minute)
+
+	// Not tied to a request: no span
+	_, _ = s.GetRef("blog", "prod")
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("GET", "/api/v1/current", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+
+	req, span := p.StartRequest(req, "GET /api/v1/current")
+	view := storage.WithContext(s, req.Context())
+	_, _ = view.GetRef("blog", "prod")
+	_ = view.PutBlob(strings.Repeat("0", 64), strings.NewReader("x"), 1)
+	p.recordQuery(req.Context(), 3*time.Millisecond, `SELECT * FROM "projects" WHERE name = {:name}`, nil)
+	p.recordQuery(context.Background(), time.Millisecond, "SELECT 1", nil)
+	_, _ = s.GetRef("blog", "beta")
+	p.EndRequest(span, 200, nil)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 4 {
+		t.Fatalf("got %d spans, want 4: %v", len(spans), spans)
+	}
+
+	server := spanNamed(spans, "GET /api/v1/current")
+	if server == nil {
+		t.Fatal("missing request span")
+	}
+	if got := server.SpanContext.TraceID().String(); got != traceID {
+		t.Errorf("trace id = %s, want %s from traceparent", got, traceID)
+	}
+	if got := server.Parent.SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("parent span = %s, want remote span", got)
+	}
+
+	testCases := []struct {
+		name    string
+		failed  bool
+		minTime time.Duration
+	}{
+		{name: "storage.GetRef"}, // not found is not an error
+		{name: "storage.PutBlob", failed: true},
+		{name: "db.SELECT", minTime: 3 * time.Millisecond},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			child := spanNamed(spans, tc.name)
+			if child == nil {
+				t.Fatal("missing span")
+			}
+			if child.Parent.SpanID() != server.SpanContext.SpanID() {
+				t.Error("span is not a child of the request span")
+			}
+			if failed := len(child.Events) > 0; failed != tc.failed {
+				t.Errorf("recorded error = %v, want %v", failed, tc.failed)
+			}
+			if d := child.EndTime.Sub(child.StartTime); d < tc.minTime {
+				t.Errorf("duration = %v, want >= %v", d, tc.minTime)
+			}
+		})
+	}
+}
+
+func TestUnsampledRequest(t *testing.T) {
+	p, exporter := newTestProvider(t)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	req, span := p.StartRequest(req, "sitepod.static")
+	p.recordQuery(req.Context(), time.Millisecond, "SELECT 1", nil)
+	p.EndRequest(span, 500, errors.New("boom"))
+
+	if n := len(exporter.GetSpans()); n != 0 {
+		t.Errorf("got %d spans for an unsampled trace, want 0", n)
+	}
+}
+
+func TestNilProvider(t *testing.T) {
+	var p *Provider
+	req := httptest.NewRequest("GET", "/", nil)
+	got, span := p.StartRequest(req, "x")
+	if got != req {
+		t.Error("nil provider changed the request")
+	}
+	if span.SpanContext().IsValid() {
+		t.Error("nil provider started a span")
+	}
+	if p.startChild(req.Context(), "x").SpanContext().IsValid() {
+		t.Error("nil provider started a child span")
+	}
+	p.EndRequest(span, 200, nil)
+	if p.InstrumentStorage(nil, "local") != nil {
+		t.Error("nil provider wrapped storage")
+	}
+}
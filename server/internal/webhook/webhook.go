@@ -0,0 +1,347 @@
+// Package webhook delivers project events to subscribed HTTP endpoints.
+//
+// Each delivery is a webhook_deliveries record. A worker sends due
+// deliveries and reschedules failures with exponential backoff, so pending
+// deliveries survive restarts and the records double as the delivery log.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Delivery headers
+const (
+	SignatureHeader = "X-Sitepod-Signature"
+	EventHeader     = "X-Sitepod-Event"
+	DeliveryHeader  = "X-Sitepod-Delivery"
+)
+
+const (
+	// MaxAttempts is the number of tries before a delivery is failed
+	MaxAttempts = 8
+	// firstRetry is the delay before the second attempt; it doubles after
+	// every failure up to maxRetry
+	firstRetry = 30 * time.Second
+	maxRetry   = time.Hour
+
+	requestTimeout    = 10 * time.Second
+	pollInterval      = 30 * time.Second
+	batchSize         = 50
+	deliveryRetention = 30 * 24 * time.Hour
+	pruneInterval     = time.Hour
+	// maxLoggedBody bounds the response body kept in the delivery log
+	maxLoggedBody = 512
+)
+
+// Delivery statuses
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// Payload is the JSON body of a delivery
+type Payload struct {
+	Event           string    `json:"event"`
+	Project         string    `json:"project"`
+	Environment     string    `json:"environment,omitempty"`
+	URL             string    `json:"url,omitempty"`
+	Image           *Image    `json:"image,omitempty"`
+	PreviousImageID string    `json:"previous_image_id,omitempty"`
+	Preview         *Preview  `json:"preview,omitempty"`
+	Domain          *Domain   `json:"domain,omitempty"`
+	Time            time.Time `json:"time"`
+}
+
+// Image describes the deployed image and its git metadata
+type Image struct {
+	ID          string `json:"id"`
+	ContentHash string `json:"content_hash,omitempty"`
+	GitCommit   string `json:"git_commit,omitempty"`
+	GitBranch   string `json:"git_branch,omitempty"`
+	GitMessage  string `json:"git_message,omitempty"`
+}
+
+// Preview describes a preview deployment
+type Preview struct {
+	Slug      string    `json:"slug"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Domain describes a domain binding
+type Domain struct {
+	Domain string `json:"domain"`
+	Slug   string `json:"slug,omitempty"`
+	Type   string `json:"type,omitempty"`
+	Status string `json:"status,omitempty"`
+}
+
+// Sign returns the X-Sitepod-Signature value for body:
+// "sha256=" followed by the hex HMAC-SHA256 of body keyed with secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Matches reports whether a subscription's event filter includes event.
+// An empty filter matches everything; "domain.*" matches every domain event.
+func Matches(filter []string, event string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, f := range filter {
+		if f == "*" || f == event {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(f, "*"); ok && strings.HasPrefix(event, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Backoff returns the delay after the given failed attempt (1-based)
+func Backoff(attempt int) time.Duration {
+	d := firstRetry
+	for i := 1; i < attempt && d < maxRetry; i++ {
+		d *= 2
+	}
+	return min(d, maxRetry)
+}
+
+// Dispatcher queues and sends deliveries
+type Dispatcher struct {
+	app    core.App
+	client *http.Client
+	wake   chan struct{}
+}
+
+// New creates a dispatcher storing deliveries in app
+func New(app core.App) *Dispatcher {
+	return &Dispatcher{
+		app:    app,
+		client: &http.Client{Timeout: requestTimeout},
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Emit queues p for every active webhook of the project subscribed to
+// p.Event. It is safe to call on a nil Dispatcher.
+func (d *Dispatcher) Emit(projectID string, p Payload) error {
+	if d == nil {
+		return nil
+	}
+	if p.Time.IsZero() {
+		p.Time = time.Now().UTC()
+	}
+
+	hooks, err := d.app.FindAllRecords("webhooks", dbx.HashExp{"project_id": projectID, "active": true})
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	queued := 0
+	for _, hook := range hooks {
+		var filter []string
+		if raw := hook.GetString("events"); raw != "" && raw != "null" {
+			if err := json.Unmarshal([]byte(raw), &filter); err != nil {
+				return fmt.Errorf("webhook %s: invalid events filter: %w", hook.Id, err)
+			}
+		}
+		if !Matches(filter, p.Event) {
+			continue
+		}
+		if _, err := d.queue(hook.Id, p.Event, body, ""); err != nil {
+			return err
+		}
+		queued++
+	}
+	if queued > 0 {
+		d.notify()
+	}
+	return nil
+}
+
+// Redeliver queues a new delivery with the payload of an earlier one
+func (d *Dispatcher) Redeliver(delivery *core.Record) (*core.Record, error) {
+	record, err := d.queue(
+		delivery.GetString("webhook_id"),
+		delivery.GetString("event"),
+		[]byte(delivery.GetString("payload")),
+		delivery.Id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	d.notify()
+	return record, nil
+}
+
+func (d *Dispatcher) queue(webhookID, event string, body []byte, redeliveryOf string) (*core.Record, error) {
+	collection, err := d.app.FindCachedCollectionByNameOrId("webhook_deliveries")
+	if err != nil {
+		return nil, err
+	}
+	record := core.NewRecord(collection)
+	record.Set("webhook_id", webhookID)
+	record.Set("event", event)
+	record.Set("payload", types.JSONRaw(body))
+	record.Set("status", StatusPending)
+	record.Set("attempts", 0)
+	record.Set("next_attempt", types.NowDateTime())
+	record.Set("redelivery_of", redeliveryOf)
+	if err := d.app.Save(record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (d *Dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends due deliveries until ctx is cancelled
+func (d *Dispatcher) Run(ctx context.Context) {
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+	prune := time.NewTicker(pruneInterval)
+	defer prune.Stop()
+
+	d.prune()
+	for {
+		d.sendDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-poll.C:
+		case <-prune.C:
+			d.prune()
+		}
+	}
+}
+
+// sendDue sends pending deliveries whose next attempt is due
+func (d *Dispatcher) sendDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		due, err := d.app.FindRecordsByFilter(
+			"webhook_deliveries",
+			"status = {:status} && next_attempt <= {:now}",
+			"next_attempt", batchSize, 0,
+			dbx.Params{"status": StatusPending, "now": types.NowDateTime().String()},
+		)
+		if err != nil {
+			log.Printf("webhook: failed to load deliveries: %v", err)
+			return
+		}
+		for _, delivery := range due {
+			if ctx.Err() != nil {
+				return
+			}
+			d.send(ctx, delivery)
+		}
+		if len(due) < batchSize {
+			return
+		}
+	}
+}
+
+// send makes one attempt at a delivery and records the outcome
+func (d *Dispatcher) send(ctx context.Context, delivery *core.Record) {
+	attempt := delivery.GetInt("attempts") + 1
+	delivery.Set("attempts", attempt)
+
+	status, err := d.post(ctx, delivery)
+	delivery.Set("response_status", status)
+	switch {
+	case err == nil:
+		delivery.Set("status", StatusDelivered)
+		delivery.Set("error", "")
+	case attempt >= MaxAttempts:
+		delivery.Set("status", StatusFailed)
+		delivery.Set("error", err.Error())
+	default:
+		delivery.Set("error", err.Error())
+		next, _ := types.ParseDateTime(time.Now().Add(Backoff(attempt)))
+		delivery.Set("next_attempt", next)
+	}
+
+	if err := d.app.Save(delivery); err != nil {
+		log.Printf("webhook: failed to update delivery %s: %v", delivery.Id, err)
+	}
+}
+
+// post sends the delivery and returns the response status. Any non-2xx
+// status is an error.
+func (d *Dispatcher) post(ctx context.Context, delivery *core.Record) (int, error) {
+	start := time.Now()
+	defer func() {
+		delivery.Set("duration_ms", time.Since(start).Milliseconds())
+	}()
+
+	hook, err := d.app.FindRecordById("webhooks", delivery.GetString("webhook_id"))
+	if err != nil {
+		return 0, fmt.Errorf("webhook not found: %w", err)
+	}
+
+	body := []byte(delivery.GetString("payload"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.GetString("url"), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "SitePod-Webhook/1")
+	req.Header.Set(EventHeader, delivery.GetString("event"))
+	req.Header.Set(DeliveryHeader, delivery.Id)
+	req.Header.Set(SignatureHeader, Sign(hook.GetString("secret"), body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, maxLoggedBody))
+		return resp.StatusCode, fmt.Errorf("endpoint returned %d: %s", resp.StatusCode, strings.TrimSpace(string(snippet)))
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+// prune deletes finished deliveries older than the retention period
+func (d *Dispatcher) prune() {
+	cutoff, err := types.ParseDateTime(time.Now().Add(-deliveryRetention))
+	if err != nil {
+		return
+	}
+	_, err = d.app.DB().NewQuery(
+		"DELETE FROM webhook_deliveries WHERE status != {:pending} AND created < {:cutoff}",
+	).Bind(dbx.Params{"pending": StatusPending, "cutoff": cutoff.String()}).Execute()
+	if err != nil {
+		log.Printf("webhook: failed to prune deliveries: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package webhook
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	// echo -n '{"event":"release"}' | openssl dgst -sha256 -hmac secret
+	got := Sign("secret", []byte(`{"event":"release"}`))
+	want := "sha256=0663c2ac3355a478dad171b38adad7de348ea929516155c934ed0fe478b540d7"
+	if got != want {
+		t.Errorf("Sign() = %q, want %q", got, want)
+	}
+	if Sign("secret", []byte("a")) == Sign("other", []byte("a")) {
+		t.Error("signature does not depend on the secret")
+	}
+}
+
+func TestMatches(t *testing.T) {
+	testCases := []struct {
+		filter []string
+		event  string
+		want   bool
+	}{
+		{nil, "release", true},
+		{[]string{"release"}, "release", true},
+		{[]string{"release"}, "rollback", false},
+		{[]string{"*"}, "preview", true},
+		{[]string{"domain.*"}, "domain.added", true},
+		{[]string{"domain.*"}, "release", false},
+		{[]string{"rollback", "preview"}, "preview", true},
+	}
+	for _, tc := range testCases {
+		if got := Matches(tc.filter, tc.event); got != tc.want {
+			t.Errorf("Matches(%v, %q) = %v, want %v", tc.filter, tc.event, got, tc.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	testCases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{4, 4 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{20, time.Hour},
+	}
+	for _, tc := range testCases {
+		if got := Backoff(tc.attempt); got != tc.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tc.attempt, got, tc.want)
+		}
+	}
+}
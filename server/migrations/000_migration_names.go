@@ -0,0 +1,43 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// renamedMigrations maps the names the released migrations were applied
+// under before they were numbered with three digits to their current names
+var renamedMigrations = map[string]string{
+	"1_init.go":           "001_init.go",
+	"2_domains.go":        "002_domains.go",
+	"3_acl.go":            "003_acl.go",
+	"4_domains_status.go": "004_domains_status.go",
+	"5_user_admin.go":     "005_user_admin.go",
+}
+
+func init() {
+	m.Register(func(app core.App) error {
+		// Databases record applied migrations by name. This runs before
+		// every other migration and renames the records of those applied
+		// under their old names, so they are not applied again.
+		return renameMigrations(app, renamedMigrations)
+	}, func(app core.App) error {
+		old := make(map[string]string, len(renamedMigrations))
+		for from, to := range renamedMigrations {
+			old[to] = from
+		}
+		return renameMigrations(app, old)
+	})
+}
+
+func renameMigrations(app core.App, names map[string]string) error {
+	for from, to := range names {
+		_, err := app.DB().Update(core.DefaultMigrationsTable,
+			dbx.Params{"file": to}, dbx.HashExp{"file": from}).Execute()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		projects, err := app.FindCollectionByNameOrId("projects")
+		if err != nil {
+			return err
+		}
+
+		// Opt-in: persist this project's access logs
+		projects.Fields.Add(&core.BoolField{
+			Name:     "access_log",
+			Required: false,
+		})
+		if err := app.Save(projects); err != nil {
+			return err
+		}
+
+		// Access logs are written and read by the server only
+		logs := core.NewBaseCollection("access_logs")
+		logs.ListRule = nil
+		logs.ViewRule = nil
+		logs.CreateRule = nil
+		logs.UpdateRule = nil
+		logs.DeleteRule = nil
+
+		logs.Fields.Add(&core.RelationField{
+			Name:          "project_id",
+			Required:      true,
+			CollectionId:  projects.Id,
+			MaxSelect:     1,
+			CascadeDelete: true,
+		})
+		logs.Fields.Add(&core.TextField{Name: "env"})
+		logs.Fields.Add(&core.TextField{Name: "request_id"})
+		logs.Fields.Add(&core.TextField{Name: "method"})
+		logs.Fields.Add(&core.TextField{Name: "host"})
+		logs.Fields.Add(&core.TextField{Name: "path"})
+		logs.Fields.Add(&core.NumberField{Name: "status"})
+		logs.Fields.Add(&core.NumberField{Name: "bytes"})
+		logs.Fields.Add(&core.NumberField{Name: "duration_ms"})
+		logs.Fields.Add(&core.TextField{Name: "image_id"})
+		logs.Fields.Add(&core.BoolField{Name: "cache_hit"})
+		logs.Fields.Add(&core.TextField{Name: "remote_ip"})
+		logs.Fields.Add(&core.TextField{Name: "user_agent"})
+		logs.Fields.Add(&core.TextField{Name: "referer"})
+		logs.Fields.Add(&core.AutodateField{
+			Name:     "created",
+			OnCreate: true,
+		})
+
+		logs.AddIndex("idx_access_logs_project_created", false, "project_id, created", "")
+		logs.AddIndex("idx_access_logs_created", false, "created", "")
+
+		return app.Save(logs)
+	}, func(app core.App) error {
+		logs, err := app.FindCollectionByNameOrId("access_logs")
+		if err == nil {
+			if err := app.Delete(logs); err != nil {
+				return err
+			}
+		}
+
+		projects, err := app.FindCollectionByNameOrId("projects")
+		if err != nil {
+			return err
+		}
+		projects.Fields.RemoveByName("access_log")
+		return app.Save(projects)
+	})
+}
@@ -0,0 +1,61 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		projects, err := app.FindCollectionByNameOrId("projects")
+		if err != nil {
+			return err
+		}
+
+		// Daily traffic counters per project environment; server access only
+		daily := core.NewBaseCollection("analytics_daily")
+		daily.Fields.Add(&core.RelationField{
+			Name:          "project_id",
+			Required:      true,
+			CollectionId:  projects.Id,
+			MaxSelect:     1,
+			CascadeDelete: true,
+		})
+		daily.Fields.Add(&core.TextField{Name: "env"})
+		daily.Fields.Add(&core.TextField{Name: "day", Required: true})
+		daily.Fields.Add(&core.NumberField{Name: "requests"})
+		daily.Fields.Add(&core.NumberField{Name: "bytes"})
+		daily.Fields.Add(&core.NumberField{Name: "visitors"})
+		daily.Fields.Add(&core.TextField{Name: "visitors_sketch"})
+		daily.Fields.Add(&core.JSONField{Name: "paths"})
+		daily.Fields.Add(&core.JSONField{Name: "referrers"})
+		daily.Fields.Add(&core.JSONField{Name: "statuses"})
+		daily.Fields.Add(&core.JSONField{Name: "not_found"})
+
+		daily.AddIndex("idx_analytics_daily_key", true, "project_id, env, day", "")
+		daily.AddIndex("idx_analytics_daily_day", false, "day", "")
+
+		if err := app.Save(daily); err != nil {
+			return err
+		}
+
+		// Visitor hash salts, one per day; deleted with the day's counters
+		salts := core.NewBaseCollection("analytics_salts")
+		salts.Fields.Add(&core.TextField{Name: "day", Required: true})
+		salts.Fields.Add(&core.TextField{Name: "salt", Required: true})
+		salts.AddIndex("idx_analytics_salts_day", true, "day", "")
+
+		return app.Save(salts)
+	}, func(app core.App) error {
+		for _, name := range []string{"analytics_salts", "analytics_daily"} {
+			collection, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				continue
+			}
+			if err := app.Delete(collection); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
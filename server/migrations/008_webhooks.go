@@ -0,0 +1,79 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		projects, err := app.FindCollectionByNameOrId("projects")
+		if err != nil {
+			return err
+		}
+
+		// Webhook subscriptions, managed through the SitePod API only
+		webhooks := core.NewBaseCollection("webhooks")
+		webhooks.Fields.Add(&core.RelationField{
+			Name:          "project_id",
+			Required:      true,
+			CollectionId:  projects.Id,
+			MaxSelect:     1,
+			CascadeDelete: true,
+		})
+		webhooks.Fields.Add(&core.URLField{Name: "url", Required: true})
+		webhooks.Fields.Add(&core.TextField{Name: "secret", Required: true, Hidden: true})
+		// Event types to deliver; empty means all
+		webhooks.Fields.Add(&core.JSONField{Name: "events"})
+		webhooks.Fields.Add(&core.BoolField{Name: "active"})
+		webhooks.Fields.Add(&core.AutodateField{Name: "created", OnCreate: true})
+
+		webhooks.AddIndex("idx_webhooks_project", false, "project_id", "")
+
+		if err := app.Save(webhooks); err != nil {
+			return err
+		}
+
+		// One row per delivery attempt chain; also the delivery log
+		deliveries := core.NewBaseCollection("webhook_deliveries")
+		deliveries.Fields.Add(&core.RelationField{
+			Name:          "webhook_id",
+			Required:      true,
+			CollectionId:  webhooks.Id,
+			MaxSelect:     1,
+			CascadeDelete: true,
+		})
+		deliveries.Fields.Add(&core.TextField{Name: "event", Required: true})
+		deliveries.Fields.Add(&core.JSONField{Name: "payload", Required: true})
+		deliveries.Fields.Add(&core.SelectField{
+			Name:      "status",
+			Required:  true,
+			Values:    []string{"pending", "delivered", "failed"},
+			MaxSelect: 1,
+		})
+		deliveries.Fields.Add(&core.NumberField{Name: "attempts"})
+		deliveries.Fields.Add(&core.DateField{Name: "next_attempt"})
+		deliveries.Fields.Add(&core.NumberField{Name: "response_status"})
+		deliveries.Fields.Add(&core.TextField{Name: "error"})
+		deliveries.Fields.Add(&core.NumberField{Name: "duration_ms"})
+		deliveries.Fields.Add(&core.TextField{Name: "redelivery_of"})
+		deliveries.Fields.Add(&core.AutodateField{Name: "created", OnCreate: true})
+		deliveries.Fields.Add(&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true})
+
+		deliveries.AddIndex("idx_webhook_deliveries_due", false, "status, next_attempt", "")
+		deliveries.AddIndex("idx_webhook_deliveries_webhook", false, "webhook_id, created", "")
+
+		return app.Save(deliveries)
+	}, func(app core.App) error {
+		for _, name := range []string{"webhook_deliveries", "webhooks"} {
+			collection, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				continue
+			}
+			if err := app.Delete(collection); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
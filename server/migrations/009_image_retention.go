@@ -0,0 +1,85 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		images, err := app.FindCollectionByNameOrId("images")
+		if err != nil {
+			return err
+		}
+
+		// Retention keeps the newest images, so images need a creation time;
+		// existing images are treated as created now
+		images.Fields.Add(&core.AutodateField{Name: "created", OnCreate: true})
+		// Pinned images are never deleted by retention
+		images.Fields.Add(&core.BoolField{Name: "pinned"})
+		images.AddIndex("idx_images_project_created", false, "project_id, created", "")
+		if err := app.Save(images); err != nil {
+			return err
+		}
+		now := time.Now().UTC().Format("2006-01-02 15:04:05.000Z")
+		if _, err := app.DB().NewQuery("UPDATE images SET created = {:now} WHERE created = ''").
+			Bind(dbx.Params{"now": now}).Execute(); err != nil {
+			return err
+		}
+
+		// Per-project retention overrides; 0 uses the server default
+		projects, err := app.FindCollectionByNameOrId("projects")
+		if err != nil {
+			return err
+		}
+		projects.Fields.Add(&core.NumberField{Name: "retention_min_versions", OnlyInt: true})
+		projects.Fields.Add(&core.NumberField{Name: "retention_keep_days", OnlyInt: true})
+		if err := app.Save(projects); err != nil {
+			return err
+		}
+
+		// Deploy events outlive the images they deployed; deleting an image
+		// clears the relation instead of failing
+		return setRelationRequired(app, "deploy_events", "image_id", false)
+	}, func(app core.App) error {
+		if err := setRelationRequired(app, "deploy_events", "image_id", true); err != nil {
+			return err
+		}
+
+		projects, err := app.FindCollectionByNameOrId("projects")
+		if err != nil {
+			return err
+		}
+		projects.Fields.RemoveByName("retention_min_versions")
+		projects.Fields.RemoveByName("retention_keep_days")
+		if err := app.Save(projects); err != nil {
+			return err
+		}
+
+		images, err := app.FindCollectionByNameOrId("images")
+		if err != nil {
+			return err
+		}
+		images.RemoveIndex("idx_images_project_created")
+		images.Fields.RemoveByName("pinned")
+		images.Fields.RemoveByName("created")
+		return app.Save(images)
+	})
+}
+
+// setRelationRequired changes whether a relation field is required
+func setRelationRequired(app core.App, collectionName, fieldName string, required bool) error {
+	collection, err := app.FindCollectionByNameOrId(collectionName)
+	if err != nil {
+		return err
+	}
+	field, ok := collection.Fields.GetByName(fieldName).(*core.RelationField)
+	if !ok {
+		return nil
+	}
+	field.Required = required
+	return app.Save(collection)
+}
@@ -0,0 +1,51 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// GC run history and progress, written and read by the server only
+		runs := core.NewBaseCollection("gc_runs")
+		runs.Fields.Add(&core.TextField{Name: "job_id", Required: true})
+		runs.Fields.Add(&core.SelectField{
+			Name:      "trigger",
+			Required:  true,
+			Values:    []string{"schedule", "admin"},
+			MaxSelect: 1,
+		})
+		runs.Fields.Add(&core.SelectField{
+			Name:      "status",
+			Required:  true,
+			Values:    []string{"running", "succeeded", "failed"},
+			MaxSelect: 1,
+		})
+		runs.Fields.Add(&core.TextField{Name: "phase"})
+		runs.Fields.Add(&core.DateField{Name: "started", Required: true})
+		runs.Fields.Add(&core.DateField{Name: "finished"})
+		runs.Fields.Add(&core.NumberField{Name: "duration_ms"})
+		runs.Fields.Add(&core.NumberField{Name: "expired_plans"})
+		runs.Fields.Add(&core.NumberField{Name: "expired_previews"})
+		runs.Fields.Add(&core.NumberField{Name: "deleted_images"})
+		runs.Fields.Add(&core.NumberField{Name: "referenced_blobs"})
+		runs.Fields.Add(&core.NumberField{Name: "scanned_blobs"})
+		runs.Fields.Add(&core.NumberField{Name: "deleted_blobs"})
+		runs.Fields.Add(&core.NumberField{Name: "leased_blobs"})
+		runs.Fields.Add(&core.NumberField{Name: "bytes_freed"})
+		runs.Fields.Add(&core.JSONField{Name: "phases"})
+		runs.Fields.Add(&core.TextField{Name: "error"})
+
+		runs.AddIndex("idx_gc_runs_job", true, "job_id", "")
+		runs.AddIndex("idx_gc_runs_started", false, "started", "")
+
+		return app.Save(runs)
+	}, func(app core.App) error {
+		runs, err := app.FindCollectionByNameOrId("gc_runs")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(runs)
+	})
+}
@@ -0,0 +1,54 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// Blob reference index: how many images reference each blob and
+		// since when none has. Written by the server only; GC sweeps from
+		// it and rebuilds it on full cycles.
+		refs := core.NewBaseCollection("blob_refs")
+		refs.Fields.Add(&core.TextField{Name: "hash", Required: true})
+		refs.Fields.Add(&core.NumberField{Name: "size"})
+		refs.Fields.Add(&core.NumberField{Name: "refcount"})
+		refs.Fields.Add(&core.DateField{Name: "first_seen"})
+		refs.Fields.Add(&core.DateField{Name: "unreferenced_at"})
+		refs.Fields.Add(&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true})
+
+		refs.AddIndex("idx_blob_refs_hash", true, "hash", "")
+		refs.AddIndex("idx_blob_refs_unreferenced", false, "refcount, unreferenced_at", "")
+
+		if err := app.Save(refs); err != nil {
+			return err
+		}
+
+		// Full cycles rebuild the index; incremental ones sweep from it
+		runs, err := app.FindCollectionByNameOrId("gc_runs")
+		if err != nil {
+			return err
+		}
+		runs.Fields.Add(&core.SelectField{
+			Name:      "mode",
+			Values:    []string{"full", "incremental"},
+			MaxSelect: 1,
+		})
+		runs.Fields.Add(&core.NumberField{Name: "index_drift"})
+		return app.Save(runs)
+	}, func(app core.App) error {
+		if runs, err := app.FindCollectionByNameOrId("gc_runs"); err == nil {
+			runs.Fields.RemoveByName("mode")
+			runs.Fields.RemoveByName("index_drift")
+			if err := app.Save(runs); err != nil {
+				return err
+			}
+		}
+		refs, err := app.FindCollectionByNameOrId("blob_refs")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(refs)
+	})
+}
@@ -0,0 +1,51 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// Blobs each tenant (project owner) has shown it holds, by uploading
+		// them or deploying an image that references them. With the tenant
+		// dedup scope, plans only reuse blobs listed here for the owner.
+		// Written by the server only.
+		owners := core.NewBaseCollection("blob_owners")
+		owners.Fields.Add(&core.TextField{Name: "owner_id", Required: true})
+		owners.Fields.Add(&core.TextField{Name: "hash", Required: true})
+		owners.Fields.Add(&core.AutodateField{Name: "created", OnCreate: true})
+
+		owners.AddIndex("idx_blob_owners_owner_hash", true, "owner_id, hash", "")
+		owners.AddIndex("idx_blob_owners_hash", false, "hash", "")
+
+		if err := app.Save(owners); err != nil {
+			return err
+		}
+
+		// Owners already hold the blobs of their existing images
+		now := time.Now().UTC().Format("2006-01-02 15:04:05.000Z")
+		_, err := app.DB().NewQuery(`
+			INSERT OR IGNORE INTO blob_owners (id, owner_id, hash, created)
+			SELECT 'r' || lower(hex(randomblob(7))), owner_id, hash, {:now}
+			FROM (
+				SELECT DISTINCT p.owner_id AS owner_id, json_extract(f.value, '$.hash') AS hash
+				FROM images i
+				JOIN projects p ON p.id = i.project_id
+				JOIN json_each(i.manifest) f
+				WHERE p.owner_id != '' AND json_valid(i.manifest)
+			)
+			WHERE hash IS NOT NULL AND hash != ''`).
+			Bind(dbx.Params{"now": now}).Execute()
+		return err
+	}, func(app core.App) error {
+		owners, err := app.FindCollectionByNameOrId("blob_owners")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(owners)
+	})
+}
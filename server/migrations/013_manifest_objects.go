@@ -0,0 +1,43 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// Images and plans name their manifest object by hash. The inline
+		// manifest is only kept by records written before manifests were
+		// stored as objects, until the server converts them.
+		for _, name := range []string{"images", "plans"} {
+			collection, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+			collection.Fields.Add(&core.TextField{Name: "manifest_hash"})
+			if field, ok := collection.Fields.GetByName("manifest").(*core.JSONField); ok {
+				field.Required = false
+			}
+			if err := app.Save(collection); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(app core.App) error {
+		for _, name := range []string{"images", "plans"} {
+			collection, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+			collection.Fields.RemoveByName("manifest_hash")
+			if field, ok := collection.Fields.GetByName("manifest").(*core.JSONField); ok {
+				field.Required = true
+			}
+			if err := app.Save(collection); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,28 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// Leases on blobs that pending plans reuse before an image
+		// references them, so GC on any instance keeps them. Written by
+		// the server only.
+		leases := core.NewBaseCollection("blob_leases")
+		leases.Fields.Add(&core.TextField{Name: "hash", Required: true})
+		leases.Fields.Add(&core.DateField{Name: "expires", Required: true})
+
+		leases.AddIndex("idx_blob_leases_hash", true, "hash", "")
+		leases.AddIndex("idx_blob_leases_expires", false, "expires", "")
+
+		return app.Save(leases)
+	}, func(app core.App) error {
+		leases, err := app.FindCollectionByNameOrId("blob_leases")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(leases)
+	})
+}